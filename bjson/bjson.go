@@ -46,13 +46,23 @@ func ReadJSON(dst interface{}, r *http.Request) error {
 	return nil
 }
 
+// ETagger is implemented by payloads that have an entity tag.
+type ETagger interface {
+	ETag() string
+}
+
 // WriteJSON writes the given interface to the response. If the interface
-// cannot be marshaled, a 500 error is written instead.
+// cannot be marshaled, a 500 error is written instead. The ETag header is
+// set to the entity tag of payloads that implement ETagger.
 func WriteJSON(w http.ResponseWriter, payload interface{}, status int) {
 	encoded, err := json.Marshal(payload)
 	if err != nil {
 		handleInternalServerError(w, errors.E(errors.Op("bjson.WriteJSON"), http.StatusInternalServerError, err))
 	} else {
+		if t, ok := payload.(ETagger); ok {
+			w.Header().Set("ETag", t.ETag())
+		}
+
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(status)
 		w.Write(encoded)
@@ -11,17 +11,17 @@ import (
 
 type Client interface {
 	Transacter
-	Count(ctx context.Context, q *datastore.Query) (n int, err error)
+	Count(ctx context.Context, q *Query) (n int, err error)
 	Delete(ctx context.Context, key *datastore.Key) error
 	DeleteMulti(ctx context.Context, keys []*datastore.Key) (err error)
 	Get(ctx context.Context, key *datastore.Key, dst interface{}) (err error)
-	GetAll(ctx context.Context, q *datastore.Query, dst interface{}) (keys []*datastore.Key, err error)
+	GetAll(ctx context.Context, q *Query, dst interface{}) (keys []*datastore.Key, err error)
 	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) (err error)
 	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
 	PutWithTransaction(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.PendingKey, error)
 	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) (ret []*datastore.Key, err error)
 	PutMultiWithTransaction(ctx context.Context, keys []*datastore.Key, src interface{}) (ret []*datastore.PendingKey, err error)
-	Run(ctx context.Context, q *datastore.Query) *datastore.Iterator
+	Run(ctx context.Context, q *Query) Iterator
 	NewTransaction(ctx context.Context) (Transaction, error)
 	AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error)
 	Close() error
@@ -57,8 +57,8 @@ func (c *clientImpl) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]
 	return c.client.AllocateIDs(ctx, keys)
 }
 
-func (c *clientImpl) Count(ctx context.Context, q *datastore.Query) (int, error) {
-	return c.client.Count(ctx, q)
+func (c *clientImpl) Count(ctx context.Context, q *Query) (int, error) {
+	return c.client.Count(ctx, q.datastoreQuery())
 }
 
 func (c *clientImpl) Delete(ctx context.Context, key *datastore.Key) error {
@@ -100,11 +100,29 @@ func (c *clientImpl) Get(ctx context.Context, key *datastore.Key, dst interface{
 		return nil
 	}
 
-	return c.client.Get(ctx, key, dst)
+	return c.client.Get(ctx, key, entity(dst))
 }
 
-func (c *clientImpl) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) (keys []*datastore.Key, err error) {
-	return c.client.GetAll(ctx, q, dst)
+func (c *clientImpl) GetAll(ctx context.Context, q *Query, dst interface{}) (keys []*datastore.Key, err error) {
+	if q.keysOnly || !isRegisteredSlice(dst) {
+		return c.client.GetAll(ctx, q.datastoreQuery(), dst)
+	}
+
+	// Registered entities are loaded from properties, like in the other
+	// clients, since Datastore can only load slices of them directly.
+	var ps []datastore.PropertyList
+
+	keys, err = c.client.GetAll(ctx, q.datastoreQuery(), &ps)
+	if err != nil {
+		return nil, err
+	}
+
+	props := make([][]datastore.Property, len(ps))
+	for i := range ps {
+		props[i] = ps[i]
+	}
+
+	return keys, appendEntities(dst, keys, props)
 }
 
 func (c *clientImpl) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) (err error) {
@@ -118,11 +136,11 @@ func (c *clientImpl) GetMulti(ctx context.Context, keys []*datastore.Key, dst in
 		return nil
 	}
 
-	return c.client.GetMulti(ctx, keys, dst)
+	return c.client.GetMulti(ctx, keys, entities(dst))
 }
 
 func (c *clientImpl) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
-	return c.client.Put(ctx, key, src)
+	return c.client.Put(ctx, key, entity(src))
 }
 
 func (c *clientImpl) PutWithTransaction(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
@@ -140,7 +158,7 @@ func (c *clientImpl) PutWithTransaction(ctx context.Context, key *datastore.Key,
 }
 
 func (c *clientImpl) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) (ret []*datastore.Key, err error) {
-	return c.client.PutMulti(ctx, keys, src)
+	return c.client.PutMulti(ctx, keys, entities(src))
 }
 
 func (c *clientImpl) PutMultiWithTransaction(ctx context.Context, keys []*datastore.Key, src interface{}) (ret []*datastore.PendingKey, err error) {
@@ -157,14 +175,28 @@ func (c *clientImpl) PutMultiWithTransaction(ctx context.Context, keys []*datast
 	return []*datastore.PendingKey{}, fmt.Errorf("clientImpl: No transaction in context")
 }
 
+// RunInTransaction runs f in a transaction. Since f is retried when the
+// transaction fails to commit, only the commit hooks registered by the last
+// attempt are called.
 func (c *clientImpl) RunInTransaction(ctx context.Context, f func(tx Transaction) error) (*datastore.Commit, error) {
-	return c.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		return f(NewTransaction(tx))
+	var t *transactionImpl
+
+	cm, err := c.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		t = &transactionImpl{transaction: tx, IsPending: true}
+		return f(t)
 	})
+	if err != nil {
+		return cm, commitError(err)
+	}
+
+	t.IsPending = false
+	t.runOnCommit()
+
+	return cm, nil
 }
 
-func (c *clientImpl) Run(ctx context.Context, q *datastore.Query) *datastore.Iterator {
-	return c.client.Run(ctx, q)
+func (c *clientImpl) Run(ctx context.Context, q *Query) Iterator {
+	return &iteratorImpl{it: c.client.Run(ctx, q.datastoreQuery())}
 }
 
 func (c *clientImpl) NewTransaction(ctx context.Context) (Transaction, error) {
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"reflect"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// converters holds the functions registered with RegisterEntity, keyed by
+// the pointer types that they convert.
+var converters sync.Map
+
+// RegisterEntity makes every client load and save the values of the type of
+// ptr, which is a pointer to a struct, through the PropertyLoadSaver that
+// convert returns for them. If it implements datastore.KeyLoader too, it is
+// given the keys of the entities that are loaded.
+//
+// This lets types that know nothing about Datastore, such as those of the
+// model, be stored with conversions that are kept next to the stores. It is
+// meant to be called from init functions.
+func RegisterEntity(ptr interface{}, convert func(v interface{}) datastore.PropertyLoadSaver) {
+	t := reflect.TypeOf(ptr)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic("db: RegisterEntity requires a pointer to a struct")
+	}
+
+	converters.Store(t, convert)
+}
+
+// entity returns the PropertyLoadSaver that v is loaded and saved through,
+// or v itself when its type is not registered.
+func entity(v interface{}) interface{} {
+	convert, ok := converters.Load(reflect.TypeOf(v))
+	if !ok || reflect.ValueOf(v).IsNil() {
+		return v
+	}
+
+	return convert.(func(interface{}) datastore.PropertyLoadSaver)(v)
+}
+
+// isRegistered reports whether values of type t, or pointers to them, are
+// loaded and saved through a registered PropertyLoadSaver.
+func isRegistered(t reflect.Type) bool {
+	if t.Kind() != reflect.Ptr {
+		t = reflect.PtrTo(t)
+	}
+
+	_, ok := converters.Load(t)
+
+	return ok
+}
+
+// entities returns the slice v of entities with its elements converted by
+// entity, for GetMulti and PutMulti. Nil pointers are allocated first so
+// that entities can be loaded into them. v is returned as it is when its
+// elements cannot be of a registered type.
+func entities(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return v
+	}
+
+	if elem := rv.Type().Elem(); elem.Kind() != reflect.Interface && !isRegistered(elem) {
+		return v
+	}
+
+	targets, err := multiTargets(v, rv.Len())
+	if err != nil {
+		return v
+	}
+
+	out := make([]interface{}, len(targets))
+	for i := range targets {
+		out[i] = entity(targets[i])
+	}
+
+	return out
+}
+
+// isRegisteredSlice reports whether dst is a pointer to a slice of
+// registered entities, which datastore.Client.GetAll cannot load.
+func isRegisteredSlice(dst interface{}) bool {
+	t := reflect.TypeOf(dst)
+
+	return t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice &&
+		isRegistered(t.Elem().Elem())
+}
+
+// iteratorImpl loads the results of a Datastore query into registered
+// entities through their PropertyLoadSavers.
+type iteratorImpl struct {
+	it *datastore.Iterator
+}
+
+func (it *iteratorImpl) Next(dst interface{}) (*datastore.Key, error) {
+	if dst == nil {
+		return it.it.Next(nil)
+	}
+
+	return it.it.Next(entity(dst))
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// saveEntities converts src, which is a slice of the same length as keys,
+// into properties.
+func saveEntities(keys []*datastore.Key, src interface{}) ([][]datastore.Property, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, datastore.ErrInvalidEntityType
+	}
+
+	out := make([][]datastore.Property, len(keys))
+
+	for i := range keys {
+		if keys[i] == nil {
+			return nil, datastore.ErrInvalidKey
+		}
+
+		elem := v.Index(i)
+		if elem.Kind() == reflect.Interface {
+			elem = elem.Elem()
+		}
+
+		if elem.Kind() != reflect.Ptr {
+			if !elem.CanAddr() {
+				p := reflect.New(elem.Type())
+				p.Elem().Set(elem)
+				elem = p
+			} else {
+				elem = elem.Addr()
+			}
+		}
+
+		props, err := saveEntity(elem.Interface())
+		if err != nil {
+			return nil, err
+		}
+
+		out[i] = props
+	}
+
+	return out, nil
+}
+
+func saveEntity(src interface{}) ([]datastore.Property, error) {
+	var (
+		props []datastore.Property
+		err   error
+	)
+
+	src = entity(src)
+
+	if pls, ok := src.(datastore.PropertyLoadSaver); ok {
+		props, err = pls.Save()
+	} else {
+		props, err = datastore.SaveStruct(src)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range props {
+		props[i].Value = normalizeValue(props[i].Value)
+	}
+
+	return props, nil
+}
+
+// loadEntity loads props into dst and sets its key.
+func loadEntity(dst interface{}, key *datastore.Key, props []datastore.Property) error {
+	ps := make([]datastore.Property, len(props))
+	copy(ps, props)
+
+	dst = entity(dst)
+
+	var err error
+
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		err = pls.Load(ps)
+	} else {
+		err = datastore.LoadStruct(dst, ps)
+	}
+
+	if err != nil && !isFieldMismatch(err) {
+		return err
+	}
+
+	if kl, ok := dst.(datastore.KeyLoader); ok {
+		if kerr := kl.LoadKey(key); kerr != nil {
+			return kerr
+		}
+	} else {
+		setKeyField(dst, key)
+	}
+
+	return err
+}
+
+// setKeyField sets the field of dst that is tagged with __key__, which
+// datastore.LoadStruct leaves alone.
+func setKeyField(dst interface{}, key *datastore.Key) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+
+	v = v.Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("datastore"), ",")[0]
+		if name == "__key__" && t.Field(i).Type == reflect.TypeOf(key) {
+			v.Field(i).Set(reflect.ValueOf(key))
+			return
+		}
+	}
+}
+
+func isFieldMismatch(err error) bool {
+	_, ok := err.(*datastore.ErrFieldMismatch)
+	return ok
+}
+
+// normalizeValue converts v into the type in which Datastore returns it.
+// Times are stored with microsecond precision.
+func normalizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case int:
+		return int64(val)
+	case int8:
+		return int64(val)
+	case int16:
+		return int64(val)
+	case int32:
+		return int64(val)
+	case float32:
+		return float64(val)
+	case time.Time:
+		return val.Truncate(time.Microsecond)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i := range val {
+			out[i] = normalizeValue(val[i])
+		}
+
+		return out
+	case *datastore.Entity:
+		if val == nil {
+			return val
+		}
+
+		e := &datastore.Entity{Key: val.Key, Properties: make([]datastore.Property, len(val.Properties))}
+		for i, p := range val.Properties {
+			p.Value = normalizeValue(p.Value)
+			e.Properties[i] = p
+		}
+
+		return e
+	default:
+		return v
+	}
+}
+
+// appendEntities loads props into new elements of dst, which is a pointer to
+// a slice of structs or of pointers to structs, like datastore.GetAll.
+func appendEntities(dst interface{}, keys []*datastore.Key, props [][]datastore.Property) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return datastore.ErrInvalidEntityType
+	}
+
+	var (
+		slice    = v.Elem()
+		elemType = slice.Type().Elem()
+		isPtr    = elemType.Kind() == reflect.Ptr
+		loadErr  error
+	)
+
+	for i := range keys {
+		var elem reflect.Value
+		if isPtr {
+			elem = reflect.New(elemType.Elem())
+		} else {
+			elem = reflect.New(elemType)
+		}
+
+		if err := loadEntity(elem.Interface(), keys[i], props[i]); err != nil {
+			if !isFieldMismatch(err) {
+				return err
+			}
+
+			loadErr = err
+		}
+
+		if isPtr {
+			slice.Set(reflect.Append(slice, elem))
+		} else {
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+	}
+
+	return loadErr
+}
+
+// multiTargets returns the destinations of the n entities of a GetMulti
+// call. dst must be a slice of length n. Nil pointers are allocated.
+func multiTargets(dst interface{}, n int) ([]interface{}, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != n {
+		return nil, datastore.ErrInvalidEntityType
+	}
+
+	targets := make([]interface{}, n)
+
+	for i := range targets {
+		elem := v.Index(i)
+
+		switch elem.Kind() {
+		case reflect.Ptr:
+			if elem.IsNil() {
+				elem.Set(reflect.New(elem.Type().Elem()))
+			}
+
+			targets[i] = elem.Interface()
+		case reflect.Interface:
+			targets[i] = elem.Interface()
+		default:
+			targets[i] = elem.Addr().Interface()
+		}
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,846 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/log"
+)
+
+var (
+	_ Client      = (*memoryClient)(nil)
+	_ Transaction = (*memoryTransaction)(nil)
+)
+
+// memoryClient keeps entities in memory and mimics the behavior of
+// Datastore that the stores rely on: entities are saved and loaded with the
+// same property conversions, unindexed properties cannot be queried and
+// transactions are serializable. Transactions do not see their own writes
+// and fail with datastore.ErrConcurrentTransaction on commit when an entity
+// that they read has been written since.
+type memoryClient struct {
+	mu       sync.Mutex
+	entities map[string]*memoryEntity
+	// versions holds the version of the last write, including deletes, of
+	// every key that has been written.
+	versions map[string]int64
+	version  int64
+	nextID   int64
+}
+
+type memoryEntity struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+// NewMemoryClient returns a Client that keeps entities in memory. It is meant
+// for tests, which then run without the Datastore emulator. Entities are lost
+// when the process exits.
+func NewMemoryClient() Client {
+	return &memoryClient{
+		entities: make(map[string]*memoryEntity),
+		versions: make(map[string]int64),
+	}
+}
+
+func (c *memoryClient) Close() error {
+	log.Print("Closing DB client")
+	return nil
+}
+
+func (c *memoryClient) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]*datastore.Key, len(keys))
+	for i := range keys {
+		out[i] = c.completeKey(keys[i])
+	}
+
+	return out, nil
+}
+
+func (c *memoryClient) Count(ctx context.Context, q *Query) (int, error) {
+	entities, err := c.query(q)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(entities), nil
+}
+
+func (c *memoryClient) Delete(ctx context.Context, key *datastore.Key) error {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		err := tx.Delete(key)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return nil
+	}
+
+	return c.DeleteMulti(ctx, []*datastore.Key{key})
+}
+
+func (c *memoryClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		err := tx.DeleteMulti(keys)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return nil
+	}
+
+	muts := make([]*memoryMutation, len(keys))
+	for i := range keys {
+		if keys[i] == nil || keys[i].Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+
+		muts[i] = &memoryMutation{key: keys[i], delete: true}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.apply(muts)
+
+	return nil
+}
+
+func (c *memoryClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		err := tx.Get(key, dst)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return nil
+	}
+
+	return c.get(nil, key, dst)
+}
+
+func (c *memoryClient) GetAll(ctx context.Context, q *Query, dst interface{}) ([]*datastore.Key, error) {
+	entities, err := c.query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*datastore.Key, len(entities))
+	for i := range entities {
+		keys[i] = entities[i].key
+	}
+
+	if dst == nil || q.keysOnly {
+		return keys, nil
+	}
+
+	props := make([][]datastore.Property, len(entities))
+	for i := range entities {
+		props[i] = entities[i].props
+	}
+
+	return keys, appendEntities(dst, keys, props)
+}
+
+func (c *memoryClient) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		err := tx.GetMulti(keys, dst)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return nil
+	}
+
+	return c.getMulti(nil, keys, dst)
+}
+
+func (c *memoryClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	keys, err := c.PutMulti(ctx, []*datastore.Key{key}, []interface{}{src})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys[0], nil
+}
+
+func (c *memoryClient) PutWithTransaction(
+	ctx context.Context,
+	key *datastore.Key,
+	src interface{},
+) (*datastore.PendingKey, error) {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		pendingKey, err := tx.Put(key, src)
+		if err != nil {
+			tx.Rollback()
+			return pendingKey, err
+		}
+
+		return pendingKey, nil
+	}
+
+	return &datastore.PendingKey{}, errors.Str("memoryClient: No transaction in context")
+}
+
+func (c *memoryClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	props, err := saveEntities(keys, src)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]*datastore.Key, len(keys))
+	muts := make([]*memoryMutation, len(keys))
+
+	for i := range keys {
+		out[i] = c.completeKey(keys[i])
+		muts[i] = &memoryMutation{key: out[i], props: props[i]}
+	}
+
+	c.apply(muts)
+
+	return out, nil
+}
+
+func (c *memoryClient) PutMultiWithTransaction(
+	ctx context.Context,
+	keys []*datastore.Key,
+	src interface{},
+) ([]*datastore.PendingKey, error) {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		pendingKeys, err := tx.PutMulti(keys, src)
+		if err != nil {
+			tx.Rollback()
+			return pendingKeys, err
+		}
+
+		return pendingKeys, nil
+	}
+
+	return []*datastore.PendingKey{}, errors.Str("memoryClient: No transaction in context")
+}
+
+// RunInTransaction runs f in a transaction and retries it a few times when
+// the transaction conflicts with another one, like the Datastore client.
+func (c *memoryClient) RunInTransaction(ctx context.Context, f func(tx Transaction) error) (*datastore.Commit, error) {
+	const maxAttempts = 3
+
+	for i := 0; i < maxAttempts; i++ {
+		tx := c.newTransaction()
+
+		if err := f(tx); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		cm, err := tx.Commit()
+		if errors.Is(err, datastore.ErrConcurrentTransaction) {
+			continue
+		}
+
+		return cm, err
+	}
+
+	return nil, commitError(datastore.ErrConcurrentTransaction)
+}
+
+func (c *memoryClient) Run(ctx context.Context, q *Query) Iterator {
+	entities, err := c.query(q)
+
+	return &memoryIterator{entities: entities, keysOnly: q.keysOnly, err: err}
+}
+
+func (c *memoryClient) NewTransaction(ctx context.Context) (Transaction, error) {
+	return c.newTransaction(), nil
+}
+
+func (c *memoryClient) newTransaction() *memoryTransaction {
+	return &memoryTransaction{
+		c:         c,
+		reads:     make(map[string]int64),
+		writes:    make(map[string]*memoryMutation),
+		IsPending: true,
+	}
+}
+
+// completeKey returns key with a new ID if it is incomplete. c.mu must be
+// held.
+func (c *memoryClient) completeKey(key *datastore.Key) *datastore.Key {
+	if !key.Incomplete() {
+		return key
+	}
+
+	c.nextID++
+
+	k := *key
+	k.ID = c.nextID
+
+	return &k
+}
+
+// apply writes the mutations as a single new version. c.mu must be held.
+func (c *memoryClient) apply(muts []*memoryMutation) {
+	c.version++
+
+	for _, m := range muts {
+		id := m.key.Encode()
+
+		if m.delete {
+			delete(c.entities, id)
+		} else {
+			c.entities[id] = &memoryEntity{key: m.key, props: m.props}
+		}
+
+		c.versions[id] = c.version
+	}
+}
+
+// get loads the entity with the given key into dst. The version that was
+// read is recorded in reads unless it is nil.
+func (c *memoryClient) get(reads map[string]int64, key *datastore.Key, dst interface{}) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+
+	id := key.Encode()
+
+	c.mu.Lock()
+	e, ok := c.entities[id]
+	if reads != nil {
+		reads[id] = c.versions[id]
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+
+	return loadEntity(dst, e.key, e.props)
+}
+
+func (c *memoryClient) getMulti(reads map[string]int64, keys []*datastore.Key, dst interface{}) error {
+	targets, err := multiTargets(dst, len(keys))
+	if err != nil {
+		return err
+	}
+
+	var (
+		errs   = make(datastore.MultiError, len(keys))
+		hasErr bool
+	)
+
+	for i := range keys {
+		if err := c.get(reads, keys[i], targets[i]); err != nil {
+			errs[i] = err
+			hasErr = true
+		}
+	}
+
+	if hasErr {
+		return errs
+	}
+
+	return nil
+}
+
+// query returns the entities that match q in order.
+func (c *memoryClient) query(q *Query) ([]*memoryEntity, error) {
+	for _, f := range q.filters {
+		if f.value != nil && rank(normalizeValue(f.value)) < 0 {
+			return nil, errors.Errorf("memoryClient: unsupported filter value %T", f.value)
+		}
+	}
+
+	c.mu.Lock()
+
+	var matches []*memoryEntity
+
+	for _, e := range c.entities {
+		if e.key.Kind == q.kind && e.matches(q.filters) && e.hasAll(q.orders) {
+			matches = append(matches, e)
+		}
+	}
+
+	c.mu.Unlock()
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		for _, o := range q.orders {
+			a, b := matches[i].sortValue(o), matches[j].sortValue(o)
+
+			if n := compareValues(a, b); n != 0 {
+				if o.desc {
+					return n > 0
+				}
+
+				return n < 0
+			}
+		}
+
+		return compareKeys(matches[i].key, matches[j].key) < 0
+	})
+
+	if q.offset > 0 {
+		if q.offset >= len(matches) {
+			return nil, nil
+		}
+
+		matches = matches[q.offset:]
+	}
+
+	if q.limit >= 0 && q.limit < len(matches) {
+		matches = matches[:q.limit]
+	}
+
+	return matches, nil
+}
+
+// values returns the indexed values of the property with the given name.
+// Lists are flattened. The second return value is false when the property
+// does not exist or is not indexed.
+func (e *memoryEntity) values(name string) ([]interface{}, bool) {
+	if name == "__key__" {
+		return []interface{}{e.key}, true
+	}
+
+	for _, p := range e.props {
+		if p.Name != name || p.NoIndex {
+			continue
+		}
+
+		if list, ok := p.Value.([]interface{}); ok {
+			return list, len(list) > 0
+		}
+
+		return []interface{}{p.Value}, true
+	}
+
+	return nil, false
+}
+
+func (e *memoryEntity) matches(filters []filter) bool {
+	for _, f := range filters {
+		vals, ok := e.values(f.field)
+		if !ok {
+			return false
+		}
+
+		want := normalizeValue(f.value)
+		matched := false
+
+		for _, v := range vals {
+			if compareFilter(v, f.op, want) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *memoryEntity) hasAll(orders []order) bool {
+	for _, o := range orders {
+		if _, ok := e.values(o.field); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortValue returns the value by which the entity is sorted. Like
+// Datastore, lists are sorted by their smallest value in ascending order
+// and by their largest value in descending order.
+func (e *memoryEntity) sortValue(o order) interface{} {
+	vals, _ := e.values(o.field)
+
+	best := vals[0]
+	for _, v := range vals[1:] {
+		n := compareValues(v, best)
+		if (o.desc && n > 0) || (!o.desc && n < 0) {
+			best = v
+		}
+	}
+
+	return best
+}
+
+type memoryMutation struct {
+	key    *datastore.Key
+	props  []datastore.Property
+	delete bool
+}
+
+type memoryTransaction struct {
+	c *memoryClient
+	// reads holds the versions of the entities that have been read.
+	reads map[string]int64
+	// writes holds the last mutation of each key. They are applied on commit.
+	writes   map[string]*memoryMutation
+	order    []string
+	onCommit []func()
+
+	IsPending bool
+}
+
+func (t *memoryTransaction) Commit() (*datastore.Commit, error) {
+	if !t.IsPending {
+		return nil, errors.Str("memoryTransaction: transaction has already been committed or rolled back")
+	}
+
+	t.c.mu.Lock()
+
+	for id, v := range t.reads {
+		if t.c.versions[id] != v {
+			t.c.mu.Unlock()
+			return nil, commitError(datastore.ErrConcurrentTransaction)
+		}
+	}
+
+	muts := make([]*memoryMutation, len(t.order))
+	for i, id := range t.order {
+		muts[i] = t.writes[id]
+	}
+
+	if len(muts) > 0 {
+		t.c.apply(muts)
+	}
+
+	t.c.mu.Unlock()
+
+	t.IsPending = false
+
+	hooks := t.onCommit
+	t.onCommit = nil
+
+	for i := range hooks {
+		hooks[i]()
+	}
+
+	return &datastore.Commit{}, nil
+}
+
+func (t *memoryTransaction) Delete(key *datastore.Key) error {
+	return t.DeleteMulti([]*datastore.Key{key})
+}
+
+func (t *memoryTransaction) DeleteMulti(keys []*datastore.Key) error {
+	for i := range keys {
+		if keys[i] == nil || keys[i].Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+	}
+
+	for i := range keys {
+		t.write(&memoryMutation{key: keys[i], delete: true})
+	}
+
+	return nil
+}
+
+func (t *memoryTransaction) Get(key *datastore.Key, dst interface{}) error {
+	return t.c.get(t.reads, key, dst)
+}
+
+func (t *memoryTransaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	return t.c.getMulti(t.reads, keys, dst)
+}
+
+// Mutate is not supported since mutations cannot be inspected outside of the
+// datastore package.
+func (t *memoryTransaction) Mutate(muts ...*datastore.Mutation) ([]*datastore.PendingKey, error) {
+	return nil, errors.Str("memoryTransaction: Mutate is not supported")
+}
+
+func (t *memoryTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	pendingKeys, err := t.PutMulti([]*datastore.Key{key}, []interface{}{src})
+	if err != nil {
+		return nil, err
+	}
+
+	return pendingKeys[0], nil
+}
+
+// PutMulti saves the entities on commit. Incomplete keys are completed right
+// away but, since pending keys cannot be resolved outside of the datastore
+// package, the new keys cannot be retrieved.
+func (t *memoryTransaction) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
+	props, err := saveEntities(keys, src)
+	if err != nil {
+		return nil, err
+	}
+
+	complete := make([]*datastore.Key, len(keys))
+
+	t.c.mu.Lock()
+	for i := range keys {
+		complete[i] = t.c.completeKey(keys[i])
+	}
+	t.c.mu.Unlock()
+
+	pendingKeys := make([]*datastore.PendingKey, len(keys))
+	for i := range keys {
+		t.write(&memoryMutation{key: complete[i], props: props[i]})
+		pendingKeys[i] = &datastore.PendingKey{}
+	}
+
+	return pendingKeys, nil
+}
+
+func (t *memoryTransaction) Rollback() error {
+	if !t.IsPending {
+		return errors.Str("memoryTransaction: transaction has already been committed or rolled back")
+	}
+
+	t.IsPending = false
+	t.onCommit = nil
+
+	return nil
+}
+
+func (t *memoryTransaction) Pending() bool {
+	return t.IsPending
+}
+
+func (t *memoryTransaction) OnCommit(f func()) {
+	t.onCommit = append(t.onCommit, f)
+}
+
+func (t *memoryTransaction) write(m *memoryMutation) {
+	id := m.key.Encode()
+
+	if _, ok := t.writes[id]; !ok {
+		t.order = append(t.order, id)
+	}
+
+	t.writes[id] = m
+}
+
+type memoryIterator struct {
+	entities []*memoryEntity
+	keysOnly bool
+	err      error
+	i        int
+}
+
+func (it *memoryIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+
+	if it.i >= len(it.entities) {
+		return nil, iterator.Done
+	}
+
+	e := it.entities[it.i]
+	it.i++
+
+	if dst != nil && !it.keysOnly {
+		if err := loadEntity(dst, e.key, e.props); err != nil {
+			return e.key, err
+		}
+	}
+
+	return e.key, nil
+}
+
+// rank returns the position of the type of v in the order in which
+// Datastore sorts values of different types, or -1 if v cannot be compared.
+func rank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64:
+		return 1
+	case time.Time:
+		return 2
+	case bool:
+		return 3
+	case string, []byte:
+		return 4
+	case float64:
+		return 5
+	case datastore.GeoPoint:
+		return 6
+	case *datastore.Key:
+		return 7
+	default:
+		return -1
+	}
+}
+
+// compareFilter reports whether v satisfies the filter with the given
+// operator and value. Inequalities only match values of the same type.
+func compareFilter(v interface{}, op string, want interface{}) bool {
+	if rank(v) != rank(want) {
+		return false
+	}
+
+	n := compareValues(v, want)
+
+	switch op {
+	case "=":
+		return n == 0
+	case "<":
+		return n < 0
+	case "<=":
+		return n <= 0
+	case ">":
+		return n > 0
+	case ">=":
+		return n >= 0
+	default:
+		return false
+	}
+}
+
+func compareValues(a, b interface{}) int {
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+
+	switch x := a.(type) {
+	case int64:
+		return compareInts(x, b.(int64))
+	case time.Time:
+		y := b.(time.Time)
+
+		switch {
+		case x.Before(y):
+			return -1
+		case x.After(y):
+			return 1
+		default:
+			return 0
+		}
+	case bool:
+		y := b.(bool)
+
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		default:
+			return 1
+		}
+	case string:
+		return strings.Compare(x, toString(b))
+	case []byte:
+		return strings.Compare(string(x), toString(b))
+	case float64:
+		y := b.(float64)
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		default:
+			return 0
+		}
+	case datastore.GeoPoint:
+		y := b.(datastore.GeoPoint)
+		if x.Lat != y.Lat {
+			return compareValues(x.Lat, y.Lat)
+		}
+
+		return compareValues(x.Lng, y.Lng)
+	case *datastore.Key:
+		return compareKeys(x, b.(*datastore.Key))
+	default:
+		return 0
+	}
+}
+
+func toString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+
+	return v.(string)
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareKeys orders keys by their path from the root. Within a kind, keys
+// with IDs come before keys with names.
+func compareKeys(a, b *datastore.Key) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	pa, pb := keyPath(a), keyPath(b)
+
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+
+		if n := strings.Compare(x.Kind, y.Kind); n != 0 {
+			return n
+		}
+
+		if (x.Name == "") != (y.Name == "") {
+			if x.Name == "" {
+				return -1
+			}
+
+			return 1
+		}
+
+		if n := compareInts(x.ID, y.ID); n != 0 {
+			return n
+		}
+
+		if n := strings.Compare(x.Name, y.Name); n != 0 {
+			return n
+		}
+	}
+
+	return compareInts(int64(len(pa)), int64(len(pb)))
+}
+
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+
+	return path
+}
@@ -19,6 +19,13 @@ func TransactionFromContext(ctx context.Context) (Transaction, bool) {
 	return tx, ok
 }
 
+// WithoutTransaction returns a new context from which no transaction can be
+// extracted. It is useful for operations that must not take part in the
+// transaction of the current request.
+func WithoutTransaction(ctx context.Context) context.Context {
+	return context.WithValue(ctx, txKey, nil)
+}
+
 // AddTransactionToContext returns a new context with a transaction added.
 func AddTransactionToContext(ctx context.Context, c Client) (context.Context, Transaction, error) {
 	tx, err := c.NewTransaction(ctx)
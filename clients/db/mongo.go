@@ -0,0 +1,918 @@
+package db
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/api/iterator"
+
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/log"
+)
+
+var (
+	_ Client      = (*mongoClient)(nil)
+	_ Transaction = (*mongoTransaction)(nil)
+)
+
+const (
+	// mongoKeyField marks embedded documents that hold an encoded key.
+	mongoKeyField = "__key__"
+	// mongoGeoField marks embedded documents that hold a geo point.
+	mongoGeoField = "__geo__"
+	// mongoIDCollection holds the counter from which IDs are allocated.
+	mongoIDCollection = "_ids"
+)
+
+var mongoOperators = map[string]string{
+	"<":  "$lt",
+	"<=": "$lte",
+	">":  "$gt",
+	">=": "$gte",
+}
+
+// mongoClient stores entities in MongoDB so that the stores can run without
+// Google Cloud. Every kind has its own collection and entities are documents
+// whose _id is their encoded key. Properties are saved and loaded like they
+// are by Datastore, keys are embedded as {"__key__": <encoded key>} and times
+// are stored with millisecond precision. Transactions are MongoDB
+// transactions, which require a replica set.
+type mongoClient struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+// NewMongoClient returns a Client that stores entities in the given database.
+func NewMongoClient(client *mongo.Client, database string) Client {
+	return &mongoClient{client: client, db: client.Database(database)}
+}
+
+func (c *mongoClient) Close() error {
+	log.Print("Closing DB client")
+	return c.client.Disconnect(context.Background())
+}
+
+func (c *mongoClient) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return c.completeKeys(ctx, keys)
+}
+
+func (c *mongoClient) Count(ctx context.Context, q *Query) (int, error) {
+	if q.limit == 0 {
+		return 0, nil
+	}
+
+	opts := options.Count()
+
+	if q.offset > 0 {
+		opts.SetSkip(int64(q.offset))
+	}
+
+	if q.limit > 0 {
+		opts.SetLimit(int64(q.limit))
+	}
+
+	n, err := c.db.Collection(q.kind).CountDocuments(ctx, mongoFilter(q), opts)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+func (c *mongoClient) Delete(ctx context.Context, key *datastore.Key) error {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		err := tx.Delete(key)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return nil
+	}
+
+	return c.deleteMulti(ctx, []*datastore.Key{key})
+}
+
+func (c *mongoClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		err := tx.DeleteMulti(keys)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return nil
+	}
+
+	return c.deleteMulti(ctx, keys)
+}
+
+func (c *mongoClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		err := tx.Get(key, dst)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return nil
+	}
+
+	return c.get(ctx, key, dst)
+}
+
+func (c *mongoClient) GetAll(ctx context.Context, q *Query, dst interface{}) ([]*datastore.Key, error) {
+	cursor, err := c.find(ctx, q)
+	if err != nil || cursor == nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var (
+		keys  []*datastore.Key
+		props [][]datastore.Property
+	)
+
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+
+		key, ps, err := decodeDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+		props = append(props, ps)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	if dst == nil || q.keysOnly {
+		return keys, nil
+	}
+
+	return keys, appendEntities(dst, keys, props)
+}
+
+func (c *mongoClient) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		err := tx.GetMulti(keys, dst)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return nil
+	}
+
+	return c.getMulti(ctx, keys, dst)
+}
+
+func (c *mongoClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	keys, err := c.PutMulti(ctx, []*datastore.Key{key}, []interface{}{src})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys[0], nil
+}
+
+func (c *mongoClient) PutWithTransaction(
+	ctx context.Context,
+	key *datastore.Key,
+	src interface{},
+) (*datastore.PendingKey, error) {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		pendingKey, err := tx.Put(key, src)
+		if err != nil {
+			tx.Rollback()
+			return pendingKey, err
+		}
+
+		return pendingKey, nil
+	}
+
+	return &datastore.PendingKey{}, errors.Str("mongoClient: No transaction in context")
+}
+
+func (c *mongoClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	props, err := saveEntities(keys, src)
+	if err != nil {
+		return nil, err
+	}
+
+	complete, err := c.completeKeys(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.write(ctx, complete, props); err != nil {
+		return nil, err
+	}
+
+	return complete, nil
+}
+
+func (c *mongoClient) PutMultiWithTransaction(
+	ctx context.Context,
+	keys []*datastore.Key,
+	src interface{},
+) ([]*datastore.PendingKey, error) {
+	if tx, ok := TransactionFromContext(ctx); ok {
+		pendingKeys, err := tx.PutMulti(keys, src)
+		if err != nil {
+			tx.Rollback()
+			return pendingKeys, err
+		}
+
+		return pendingKeys, nil
+	}
+
+	return []*datastore.PendingKey{}, errors.Str("mongoClient: No transaction in context")
+}
+
+// RunInTransaction runs f in a transaction and retries it a few times when
+// the transaction conflicts with another one, like the Datastore client.
+func (c *mongoClient) RunInTransaction(ctx context.Context, f func(tx Transaction) error) (*datastore.Commit, error) {
+	const maxAttempts = 3
+
+	for i := 0; i < maxAttempts; i++ {
+		tx, err := c.newTransaction(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := f(tx); err != nil {
+			if tx.Pending() {
+				tx.Rollback()
+			}
+
+			if errors.Is(err, datastore.ErrConcurrentTransaction) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		cm, err := tx.Commit()
+		if errors.Is(err, datastore.ErrConcurrentTransaction) {
+			continue
+		}
+
+		return cm, err
+	}
+
+	return nil, commitError(datastore.ErrConcurrentTransaction)
+}
+
+func (c *mongoClient) Run(ctx context.Context, q *Query) Iterator {
+	cursor, err := c.find(ctx, q)
+
+	return &mongoIterator{ctx: ctx, cursor: cursor, keysOnly: q.keysOnly, err: err}
+}
+
+func (c *mongoClient) NewTransaction(ctx context.Context) (Transaction, error) {
+	return c.newTransaction(ctx)
+}
+
+func (c *mongoClient) newTransaction(ctx context.Context) (*mongoTransaction, error) {
+	sess, err := c.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sess.StartTransaction(); err != nil {
+		sess.EndSession(ctx)
+		return nil, err
+	}
+
+	return &mongoTransaction{
+		c:         c,
+		ctx:       ctx,
+		sctx:      mongo.NewSessionContext(ctx, sess),
+		sess:      sess,
+		IsPending: true,
+	}, nil
+}
+
+// find runs q. The cursor is nil when q cannot have results.
+func (c *mongoClient) find(ctx context.Context, q *Query) (*mongo.Cursor, error) {
+	// A limit of zero means no limit to MongoDB.
+	if q.limit == 0 {
+		return nil, nil
+	}
+
+	sort := make(bson.D, 0, len(q.orders)+1)
+	for _, o := range q.orders {
+		dir := 1
+		if o.desc {
+			dir = -1
+		}
+
+		sort = append(sort, bson.E{Key: mongoField(o.field), Value: dir})
+	}
+
+	sort = append(sort, bson.E{Key: "_id", Value: 1})
+
+	opts := options.Find().SetSort(sort)
+
+	if q.offset > 0 {
+		opts.SetSkip(int64(q.offset))
+	}
+
+	if q.limit > 0 {
+		opts.SetLimit(int64(q.limit))
+	}
+
+	if q.keysOnly {
+		opts.SetProjection(bson.D{{Key: "_id", Value: 1}})
+	}
+
+	return c.db.Collection(q.kind).Find(ctx, mongoFilter(q), opts)
+}
+
+func (c *mongoClient) get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if key == nil || key.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+
+	var doc bson.D
+
+	err := c.db.Collection(key.Kind).FindOne(ctx, bson.D{{Key: "_id", Value: key.Encode()}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return datastore.ErrNoSuchEntity
+	} else if err != nil {
+		return err
+	}
+
+	_, props, err := decodeDocument(doc)
+	if err != nil {
+		return err
+	}
+
+	return loadEntity(dst, key, props)
+}
+
+func (c *mongoClient) getMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	targets, err := multiTargets(dst, len(keys))
+	if err != nil {
+		return err
+	}
+
+	idsByKind := make(map[string][]string)
+
+	for i := range keys {
+		if keys[i] == nil || keys[i].Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+
+		idsByKind[keys[i].Kind] = append(idsByKind[keys[i].Kind], keys[i].Encode())
+	}
+
+	found := make(map[string][]datastore.Property, len(keys))
+
+	for kind, ids := range idsByKind {
+		cursor, err := c.db.Collection(kind).Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+		if err != nil {
+			return err
+		}
+
+		for cursor.Next(ctx) {
+			var doc bson.D
+			if err := cursor.Decode(&doc); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+
+			key, props, err := decodeDocument(doc)
+			if err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+
+			found[key.Encode()] = props
+		}
+
+		err = cursor.Err()
+		cursor.Close(ctx)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		errs   = make(datastore.MultiError, len(keys))
+		hasErr bool
+	)
+
+	for i := range keys {
+		props, ok := found[keys[i].Encode()]
+		if !ok {
+			errs[i] = datastore.ErrNoSuchEntity
+			hasErr = true
+
+			continue
+		}
+
+		if err := loadEntity(targets[i], keys[i], props); err != nil {
+			errs[i] = err
+			hasErr = true
+		}
+	}
+
+	if hasErr {
+		return errs
+	}
+
+	return nil
+}
+
+// write saves the entities, replacing existing ones.
+func (c *mongoClient) write(ctx context.Context, keys []*datastore.Key, props [][]datastore.Property) error {
+	modelsByKind := make(map[string][]mongo.WriteModel)
+
+	for i := range keys {
+		id := keys[i].Encode()
+		doc := append(bson.D{{Key: "_id", Value: id}}, encodeProperties(props[i])...)
+
+		modelsByKind[keys[i].Kind] = append(modelsByKind[keys[i].Kind], mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: id}}).
+			SetReplacement(doc).
+			SetUpsert(true))
+	}
+
+	for kind, models := range modelsByKind {
+		if _, err := c.db.Collection(kind).BulkWrite(ctx, models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *mongoClient) deleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	idsByKind := make(map[string][]string)
+
+	for i := range keys {
+		if keys[i] == nil || keys[i].Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+
+		idsByKind[keys[i].Kind] = append(idsByKind[keys[i].Kind], keys[i].Encode())
+	}
+
+	for kind, ids := range idsByKind {
+		_, err := c.db.Collection(kind).DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// completeKeys returns keys with new IDs in place of incomplete keys. IDs
+// are allocated from a single counter. ctx must not carry a session since
+// the counter is shared by all transactions.
+func (c *mongoClient) completeKeys(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	out := make([]*datastore.Key, len(keys))
+
+	var n int64
+
+	for i := range keys {
+		if keys[i] == nil {
+			return nil, datastore.ErrInvalidKey
+		}
+
+		if keys[i].Incomplete() {
+			n++
+		}
+
+		out[i] = keys[i]
+	}
+
+	if n == 0 {
+		return out, nil
+	}
+
+	var counter struct {
+		N int64 `bson:"n"`
+	}
+
+	err := c.db.Collection(mongoIDCollection).FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: "ids"}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: n}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return nil, err
+	}
+
+	next := counter.N - n + 1
+
+	for i := range out {
+		if out[i].Incomplete() {
+			k := *out[i]
+			k.ID = next
+			out[i] = &k
+			next++
+		}
+	}
+
+	return out, nil
+}
+
+// mongoTransaction is a MongoDB transaction. Unlike a Datastore transaction,
+// its writes are sent right away and it sees them, but they are only
+// visible to others once it has been committed.
+type mongoTransaction struct {
+	c *mongoClient
+	// ctx is the context that the transaction was started with. It is used
+	// for operations that must not be part of the transaction.
+	ctx      context.Context
+	sctx     mongo.SessionContext
+	sess     mongo.Session
+	onCommit []func()
+
+	IsPending bool
+}
+
+func (t *mongoTransaction) Commit() (*datastore.Commit, error) {
+	if !t.IsPending {
+		return nil, errors.Str("mongoTransaction: transaction has already been committed or rolled back")
+	}
+
+	err := t.sess.CommitTransaction(t.ctx)
+	t.sess.EndSession(t.ctx)
+	t.IsPending = false
+
+	hooks := t.onCommit
+	t.onCommit = nil
+
+	if err != nil {
+		return nil, commitError(mongoTxError(err))
+	}
+
+	for i := range hooks {
+		hooks[i]()
+	}
+
+	return &datastore.Commit{}, nil
+}
+
+func (t *mongoTransaction) Delete(key *datastore.Key) error {
+	return t.DeleteMulti([]*datastore.Key{key})
+}
+
+func (t *mongoTransaction) DeleteMulti(keys []*datastore.Key) error {
+	return mongoTxError(t.c.deleteMulti(t.sctx, keys))
+}
+
+func (t *mongoTransaction) Get(key *datastore.Key, dst interface{}) error {
+	return mongoTxError(t.c.get(t.sctx, key, dst))
+}
+
+func (t *mongoTransaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	return mongoTxError(t.c.getMulti(t.sctx, keys, dst))
+}
+
+// Mutate is not supported since mutations cannot be inspected outside of the
+// datastore package.
+func (t *mongoTransaction) Mutate(muts ...*datastore.Mutation) ([]*datastore.PendingKey, error) {
+	return nil, errors.Str("mongoTransaction: Mutate is not supported")
+}
+
+func (t *mongoTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	pendingKeys, err := t.PutMulti([]*datastore.Key{key}, []interface{}{src})
+	if err != nil {
+		return nil, err
+	}
+
+	return pendingKeys[0], nil
+}
+
+// PutMulti saves the entities in the transaction. Incomplete keys are
+// completed right away but, since pending keys cannot be resolved outside of
+// the datastore package, the new keys cannot be retrieved.
+func (t *mongoTransaction) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
+	props, err := saveEntities(keys, src)
+	if err != nil {
+		return nil, err
+	}
+
+	complete, err := t.c.completeKeys(t.ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.c.write(t.sctx, complete, props); err != nil {
+		return nil, mongoTxError(err)
+	}
+
+	pendingKeys := make([]*datastore.PendingKey, len(keys))
+	for i := range keys {
+		pendingKeys[i] = &datastore.PendingKey{}
+	}
+
+	return pendingKeys, nil
+}
+
+func (t *mongoTransaction) Rollback() error {
+	if !t.IsPending {
+		return errors.Str("mongoTransaction: transaction has already been committed or rolled back")
+	}
+
+	err := t.sess.AbortTransaction(t.ctx)
+	t.sess.EndSession(t.ctx)
+	t.IsPending = false
+	t.onCommit = nil
+
+	return err
+}
+
+func (t *mongoTransaction) Pending() bool {
+	return t.IsPending
+}
+
+func (t *mongoTransaction) OnCommit(f func()) {
+	t.onCommit = append(t.onCommit, f)
+}
+
+// mongoTxError converts the errors that MongoDB returns when transactions
+// conflict into datastore.ErrConcurrentTransaction, which callers retry on.
+func mongoTxError(err error) error {
+	if le, ok := err.(interface{ HasErrorLabel(string) bool }); ok && le.HasErrorLabel("TransientTransactionError") {
+		return datastore.ErrConcurrentTransaction
+	}
+
+	return err
+}
+
+type mongoIterator struct {
+	ctx      context.Context
+	cursor   *mongo.Cursor
+	keysOnly bool
+	err      error
+}
+
+func (it *mongoIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+
+	if it.cursor == nil {
+		return nil, iterator.Done
+	}
+
+	if !it.cursor.Next(it.ctx) {
+		if err := it.cursor.Err(); err != nil {
+			it.err = err
+			return nil, err
+		}
+
+		it.cursor.Close(it.ctx)
+		it.err = iterator.Done
+
+		return nil, iterator.Done
+	}
+
+	var doc bson.D
+	if err := it.cursor.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	key, props, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if dst != nil && !it.keysOnly {
+		if err := loadEntity(dst, key, props); err != nil {
+			return key, err
+		}
+	}
+
+	return key, nil
+}
+
+// mongoFilter returns the MongoDB filter of q. Entities that do not have a
+// property by which q is sorted are excluded, like they are by Datastore.
+func mongoFilter(q *Query) bson.D {
+	conds := make(bson.A, 0, len(q.filters)+len(q.orders))
+
+	for _, f := range q.filters {
+		field, value := mongoField(f.field), encodeValue(normalizeValue(f.value))
+		if k, ok := f.value.(*datastore.Key); ok && field == "_id" && k != nil {
+			value = k.Encode()
+		}
+
+		if op, ok := mongoOperators[f.op]; ok {
+			conds = append(conds, bson.D{{Key: field, Value: bson.D{{Key: op, Value: value}}}})
+		} else {
+			conds = append(conds, bson.D{{Key: field, Value: value}})
+		}
+	}
+
+	for _, o := range q.orders {
+		conds = append(conds, bson.D{{Key: mongoField(o.field), Value: bson.D{{Key: "$exists", Value: true}}}})
+	}
+
+	if len(conds) == 0 {
+		return bson.D{}
+	}
+
+	return bson.D{{Key: "$and", Value: conds}}
+}
+
+func mongoField(name string) string {
+	if name == "__key__" {
+		return "_id"
+	}
+
+	return name
+}
+
+// encodeProperties converts properties into a document. The field that is
+// tagged with __key__ is skipped since the key is stored separately.
+func encodeProperties(props []datastore.Property) bson.D {
+	doc := make(bson.D, 0, len(props))
+	for _, p := range props {
+		if p.Name == mongoKeyField {
+			continue
+		}
+
+		doc = append(doc, bson.E{Key: p.Name, Value: encodeValue(p.Value)})
+	}
+
+	return doc
+}
+
+// encodeValue converts a property value into a BSON value. Times and
+// primitive values are stored as they are.
+func encodeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case *datastore.Key:
+		if val == nil {
+			return nil
+		}
+
+		return bson.D{{Key: mongoKeyField, Value: val.Encode()}}
+	case datastore.GeoPoint:
+		return bson.D{{Key: mongoGeoField, Value: bson.A{val.Lat, val.Lng}}}
+	case *datastore.Entity:
+		if val == nil {
+			return nil
+		}
+
+		doc := encodeProperties(val.Properties)
+		if val.Key != nil {
+			doc = append(doc, bson.E{Key: mongoKeyField, Value: val.Key.Encode()})
+		}
+
+		return doc
+	case []interface{}:
+		out := make(bson.A, len(val))
+		for i := range val {
+			out[i] = encodeValue(val[i])
+		}
+
+		return out
+	default:
+		return v
+	}
+}
+
+// decodeDocument returns the key and the properties of a document.
+func decodeDocument(doc bson.D) (*datastore.Key, []datastore.Property, error) {
+	var (
+		key   *datastore.Key
+		props = make([]datastore.Property, 0, len(doc))
+	)
+
+	for _, e := range doc {
+		if e.Key == "_id" {
+			id, ok := e.Value.(string)
+			if !ok {
+				return nil, nil, errors.Errorf("mongoClient: unsupported _id %T", e.Value)
+			}
+
+			k, err := datastore.DecodeKey(id)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			key = k
+
+			continue
+		}
+
+		v, err := decodeValue(e.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		props = append(props, datastore.Property{Name: e.Key, Value: v})
+	}
+
+	if key == nil {
+		return nil, nil, errors.Str("mongoClient: document without _id")
+	}
+
+	return key, props, nil
+}
+
+// decodeValue converts a BSON value into a property value.
+func decodeValue(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case nil, int64, float64, string, bool:
+		return val, nil
+	case int32:
+		return int64(val), nil
+	case primitive.DateTime:
+		return val.Time(), nil
+	case primitive.Binary:
+		return val.Data, nil
+	case primitive.A:
+		out := make([]interface{}, len(val))
+
+		for i := range val {
+			item, err := decodeValue(val[i])
+			if err != nil {
+				return nil, err
+			}
+
+			out[i] = item
+		}
+
+		return out, nil
+	case primitive.D:
+		return decodeEmbedded(val)
+	case primitive.M:
+		doc := make(primitive.D, 0, len(val))
+		for k, item := range val {
+			doc = append(doc, primitive.E{Key: k, Value: item})
+		}
+
+		return decodeEmbedded(doc)
+	default:
+		return nil, errors.Errorf("mongoClient: unsupported value %T", v)
+	}
+}
+
+// decodeEmbedded converts an embedded document into a key, a geo point or
+// an entity.
+func decodeEmbedded(doc primitive.D) (interface{}, error) {
+	if len(doc) == 1 {
+		switch doc[0].Key {
+		case mongoKeyField:
+			if id, ok := doc[0].Value.(string); ok {
+				return datastore.DecodeKey(id)
+			}
+		case mongoGeoField:
+			if a, ok := doc[0].Value.(primitive.A); ok && len(a) == 2 {
+				lat, latOK := a[0].(float64)
+				lng, lngOK := a[1].(float64)
+
+				if latOK && lngOK {
+					return datastore.GeoPoint{Lat: lat, Lng: lng}, nil
+				}
+			}
+		}
+	}
+
+	e := &datastore.Entity{Properties: make([]datastore.Property, 0, len(doc))}
+
+	for _, item := range doc {
+		if item.Key == mongoKeyField {
+			if id, ok := item.Value.(string); ok {
+				k, err := datastore.DecodeKey(id)
+				if err != nil {
+					return nil, err
+				}
+
+				e.Key = k
+
+				continue
+			}
+		}
+
+		v, err := decodeValue(item.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Properties = append(e.Properties, datastore.Property{Name: item.Key, Value: v})
+	}
+
+	return e, nil
+}
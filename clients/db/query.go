@@ -0,0 +1,150 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Iterator is the result of running a query. Next returns iterator.Done
+// when there are no more results.
+type Iterator interface {
+	Next(dst interface{}) (*datastore.Key, error)
+}
+
+// Query is a query for entities of one kind. It supports the subset of
+// datastore.Query that the stores use so that it can be run by clients
+// other than Datastore. Like datastore.Query, its methods return a modified
+// copy.
+type Query struct {
+	kind     string
+	filters  []filter
+	orders   []order
+	offset   int
+	limit    int
+	keysOnly bool
+}
+
+type filter struct {
+	field string
+	op    string
+	value interface{}
+}
+
+type order struct {
+	field string
+	desc  bool
+}
+
+// NewQuery returns a query for entities of the given kind.
+func NewQuery(kind string) *Query {
+	return &Query{kind: kind, limit: -1}
+}
+
+func (q *Query) clone() *Query {
+	c := *q
+	c.filters = append([]filter(nil), q.filters...)
+	c.orders = append([]order(nil), q.orders...)
+
+	return &c
+}
+
+// Filter returns a query that only matches entities of which the field
+// compares with value. filterStr is a field name followed by one of the
+// operators =, <, <=, > or >=, e.g. "UserKeys =". Fields with multiple
+// values match when any of their values does.
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	c := q.clone()
+
+	filterStr = strings.TrimSpace(filterStr)
+	for _, op := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasSuffix(filterStr, op) {
+			c.filters = append(c.filters, filter{
+				field: strings.TrimSpace(strings.TrimSuffix(filterStr, op)),
+				op:    op,
+				value: value,
+			})
+
+			return c
+		}
+	}
+
+	panic(fmt.Sprintf("db.Query: invalid filter %q", filterStr))
+}
+
+// Order returns a query that is sorted by the given field. A leading "-"
+// sorts in descending order.
+func (q *Query) Order(fieldName string) *Query {
+	c := q.clone()
+
+	fieldName = strings.TrimSpace(fieldName)
+	if strings.HasPrefix(fieldName, "-") {
+		c.orders = append(c.orders, order{field: strings.TrimSpace(fieldName[1:]), desc: true})
+	} else {
+		c.orders = append(c.orders, order{field: fieldName})
+	}
+
+	return c
+}
+
+// Offset returns a query that skips the first n results.
+func (q *Query) Offset(n int) *Query {
+	c := q.clone()
+	c.offset = n
+
+	return c
+}
+
+// Limit returns a query that returns at most n results. A negative limit
+// means no limit.
+func (q *Query) Limit(n int) *Query {
+	c := q.clone()
+	c.limit = n
+
+	return c
+}
+
+// KeysOnly returns a query that only returns keys.
+func (q *Query) KeysOnly() *Query {
+	c := q.clone()
+	c.keysOnly = true
+
+	return c
+}
+
+// Kind returns the kind of the entities that are queried.
+func (q *Query) Kind() string {
+	return q.kind
+}
+
+// datastoreQuery converts the query into a query of the Datastore client.
+func (q *Query) datastoreQuery() *datastore.Query {
+	dq := datastore.NewQuery(q.kind)
+
+	for _, f := range q.filters {
+		dq = dq.Filter(fmt.Sprintf("%s %s", f.field, f.op), f.value)
+	}
+
+	for _, o := range q.orders {
+		if o.desc {
+			dq = dq.Order("-" + o.field)
+		} else {
+			dq = dq.Order(o.field)
+		}
+	}
+
+	if q.offset > 0 {
+		dq = dq.Offset(q.offset)
+	}
+
+	if q.limit >= 0 {
+		dq = dq.Limit(q.limit)
+	}
+
+	if q.keysOnly {
+		dq = dq.KeysOnly()
+	}
+
+	return dq
+}
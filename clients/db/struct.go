@@ -0,0 +1,123 @@
+package db
+
+import (
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// SaveStruct is like datastore.SaveStruct, except that the values of the
+// properties with the given names are saved as keys. Those values must be
+// encoded keys or empty strings, which are saved as null. The names of the
+// properties of nested entities are joined with a dot, as in "Reads.UserKey".
+//
+// This lets entities refer to each other by ID while the references are
+// still stored, and can be queried, as keys.
+func SaveStruct(src interface{}, keyProps ...string) ([]datastore.Property, error) {
+	props, err := datastore.SaveStruct(src)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range keyProps {
+		if err := encodeKeyProps(props, strings.Split(name, ".")); err != nil {
+			return nil, err
+		}
+	}
+
+	return props, nil
+}
+
+// LoadStruct is like datastore.LoadStruct, except that keys are loaded into
+// string fields as encoded keys. It reverses SaveStruct.
+func LoadStruct(dst interface{}, ps []datastore.Property) error {
+	return datastore.LoadStruct(dst, decodeKeyProps(ps))
+}
+
+func encodeKeyProps(props []datastore.Property, path []string) error {
+	for i := range props {
+		if props[i].Name != path[0] {
+			continue
+		}
+
+		v, err := encodeKeyValue(props[i].Value, path[1:])
+		if err != nil {
+			return err
+		}
+
+		props[i].Value = v
+	}
+
+	return nil
+}
+
+func encodeKeyValue(v interface{}, path []string) (interface{}, error) {
+	switch val := v.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i := range val {
+			ev, err := encodeKeyValue(val[i], path)
+			if err != nil {
+				return nil, err
+			}
+
+			out[i] = ev
+		}
+
+		return out, nil
+	case *datastore.Entity:
+		if val == nil || len(path) == 0 {
+			return v, nil
+		}
+
+		return val, encodeKeyProps(val.Properties, path)
+	case string:
+		if len(path) > 0 {
+			return v, nil
+		}
+
+		if val == "" {
+			return nil, nil
+		}
+
+		return datastore.DecodeKey(val)
+	default:
+		return v, nil
+	}
+}
+
+func decodeKeyProps(ps []datastore.Property) []datastore.Property {
+	out := make([]datastore.Property, len(ps))
+	for i := range ps {
+		out[i] = ps[i]
+		out[i].Value = decodeKeyValue(ps[i].Value)
+	}
+
+	return out
+}
+
+func decodeKeyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case *datastore.Key:
+		if val == nil {
+			return nil
+		}
+
+		return val.Encode()
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i := range val {
+			out[i] = decodeKeyValue(val[i])
+		}
+
+		return out
+	case *datastore.Entity:
+		if val == nil {
+			return v
+		}
+
+		return &datastore.Entity{Key: val.Key, Properties: decodeKeyProps(val.Properties)}
+	default:
+		return v
+	}
+}
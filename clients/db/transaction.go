@@ -1,10 +1,17 @@
 package db
 
-import "cloud.google.com/go/datastore"
+import (
+	"net/http"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/errors"
+)
 
 // Transaction is a wrapper around datastore.Transaction. It adds a Pending() method that
 // allows it to be detected whether a transaction has been completed so that they are not
-// accidentally left hanging.
+// accidentally left hanging, and an OnCommit() method that defers side effects until the
+// transaction has been committed.
 type Transaction interface {
 	Commit() (c *datastore.Commit, err error)
 	Delete(key *datastore.Key) error
@@ -16,10 +23,15 @@ type Transaction interface {
 	PutMulti(keys []*datastore.Key, src interface{}) (ret []*datastore.PendingKey, err error)
 	Rollback() (err error)
 	Pending() bool
+	// OnCommit registers f to be called after the transaction has been
+	// committed successfully. It is not called if the transaction is rolled
+	// back or fails to commit.
+	OnCommit(f func())
 }
 
 type transactionImpl struct {
 	transaction *datastore.Transaction
+	onCommit    []func()
 
 	IsPending bool
 }
@@ -31,10 +43,11 @@ func NewTransaction(tx *datastore.Transaction) Transaction {
 func (t *transactionImpl) Commit() (c *datastore.Commit, err error) {
 	cm, err := t.transaction.Commit()
 	if err != nil {
-		return nil, err
+		return nil, commitError(err)
 	}
 
 	t.IsPending = false
+	t.runOnCommit()
 
 	return cm, err
 }
@@ -48,11 +61,11 @@ func (t *transactionImpl) DeleteMulti(keys []*datastore.Key) error {
 }
 
 func (t *transactionImpl) Get(key *datastore.Key, dst interface{}) error {
-	return t.transaction.Get(key, dst)
+	return t.transaction.Get(key, entity(dst))
 }
 
 func (t *transactionImpl) GetMulti(keys []*datastore.Key, dst interface{}) error {
-	return t.transaction.GetMulti(keys, dst)
+	return t.transaction.GetMulti(keys, entities(dst))
 }
 
 func (t *transactionImpl) Mutate(muts ...*datastore.Mutation) ([]*datastore.PendingKey, error) {
@@ -60,11 +73,11 @@ func (t *transactionImpl) Mutate(muts ...*datastore.Mutation) ([]*datastore.Pend
 }
 
 func (t *transactionImpl) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
-	return t.transaction.Put(key, src)
+	return t.transaction.Put(key, entity(src))
 }
 
 func (t *transactionImpl) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
-	return t.transaction.PutMulti(keys, src)
+	return t.transaction.PutMulti(keys, entities(src))
 }
 
 func (t *transactionImpl) Rollback() error {
@@ -81,3 +94,28 @@ func (t *transactionImpl) Rollback() error {
 func (t *transactionImpl) Pending() bool {
 	return t.IsPending
 }
+
+func (t *transactionImpl) OnCommit(f func()) {
+	t.onCommit = append(t.onCommit, f)
+}
+
+func (t *transactionImpl) runOnCommit() {
+	hooks := t.onCommit
+	t.onCommit = nil
+
+	for i := range hooks {
+		hooks[i]()
+	}
+}
+
+// commitError converts datastore.ErrConcurrentTransaction, which means that
+// a transaction conflicted with another one, into an error that is reported
+// to clients as a 409 Conflict. The result still matches
+// datastore.ErrConcurrentTransaction.
+func commitError(err error) error {
+	if errors.Is(err, datastore.ErrConcurrentTransaction) {
+		return errors.E(errors.Op("db.Commit"), http.StatusConflict, err)
+	}
+
+	return err
+}
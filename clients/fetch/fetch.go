@@ -0,0 +1,315 @@
+// Package fetch provides an HTTP client for requesting user supplied URLs.
+// It refuses to connect to private, loopback, link-local and metadata
+// addresses, caps redirects and response sizes, and enforces content-type
+// allow lists.
+package fetch
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hiconvo/api/errors"
+)
+
+const (
+	DefaultMaxRedirects = 5
+	DefaultMaxBodyBytes = 5 << 20
+	DefaultTimeout      = 10 * time.Second
+)
+
+var (
+	ErrBlockedAddress      = errors.Str("fetch: address is not allowed")
+	ErrTooManyRedirects    = errors.Str("fetch: too many redirects")
+	ErrBodyTooLarge        = errors.Str("fetch: response body is too large")
+	ErrContentType         = errors.Str("fetch: content type is not allowed")
+	ErrUnsupportedScheme   = errors.Str("fetch: scheme is not supported")
+	errNoAllowedTypesGiven = errors.Str("fetch: no allowed content types given")
+)
+
+// blockedNetworks are never dialed. They cover "this" network, RFC1918
+// private ranges, carrier-grade NAT, loopback, link-local (which includes
+// cloud metadata servers at 169.254.169.254), and their IPv6 equivalents.
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// Client fetches user supplied URLs safely.
+type Client struct {
+	httpClient   *http.Client
+	maxRedirects int
+	maxBodyBytes int64
+	truncateBody bool
+	isAllowedIP  func(ip net.IP) bool
+}
+
+// Option configures a Client.
+type Option func(c *Client)
+
+// WithMaxRedirects sets the maximum number of redirects that are followed.
+func WithMaxRedirects(n int) Option {
+	return func(c *Client) {
+		c.maxRedirects = n
+	}
+}
+
+// WithMaxBodyBytes sets the maximum number of bytes that can be read from
+// a response body.
+func WithMaxBodyBytes(n int64) Option {
+	return func(c *Client) {
+		c.maxBodyBytes = n
+	}
+}
+
+// WithTruncatedBody cuts response bodies off at the maximum number of bytes
+// instead of failing with ErrBodyTooLarge. It suits documents whose start is
+// all that is needed, such as the head of an HTML page.
+func WithTruncatedBody() Option {
+	return func(c *Client) {
+		c.truncateBody = true
+	}
+}
+
+// WithTimeout sets the overall timeout of a request, including redirects
+// and reading the body.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.httpClient.Timeout = d
+	}
+}
+
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		maxRedirects: DefaultMaxRedirects,
+		maxBodyBytes: DefaultMaxBodyBytes,
+		isAllowedIP:  IsAllowedIP,
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+		// Control is called after DNS resolution with the address that is
+		// actually being dialed, so it also covers DNS rebinding and
+		// redirects to internal hosts.
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !c.isAllowedIP(ip) {
+				return ErrBlockedAddress
+			}
+
+			return nil
+		},
+	}
+
+	c.httpClient = &http.Client{
+		Timeout: DefaultTimeout,
+		Transport: &http.Transport{
+			// Never use a proxy. The proxy would be dialed instead of the
+			// target, which would defeat the address checks above.
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > c.maxRedirects {
+				return ErrTooManyRedirects
+			}
+
+			return checkScheme(req.URL)
+		},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Get requests the given URL. The content type of the response must match
+// one of allowedTypes, which may contain wildcards such as "image/*".
+// Reading more than the configured maximum number of bytes from the body
+// of the response returns ErrBodyTooLarge, unless bodies are truncated. The
+// caller must close the body.
+func (c *Client) Get(
+	ctx context.Context,
+	rawURL string,
+	header http.Header,
+	allowedTypes ...string,
+) (*http.Response, error) {
+	op := errors.Opf("fetch.Get(%s)", rawURL)
+
+	if len(allowedTypes) == 0 {
+		return nil, errors.E(op, errNoAllowedTypesGiven)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	if err := checkScheme(u); err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	for k := range header {
+		req.Header[k] = header[k]
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	if !isAllowedContentType(resp.Header.Get("Content-Type"), allowedTypes) {
+		resp.Body.Close()
+
+		return nil, errors.E(op, errors.Errorf("%w: got %q", ErrContentType, resp.Header.Get("Content-Type")))
+	}
+
+	if c.truncateBody {
+		resp.Body = &truncatedBody{Reader: io.LimitReader(resp.Body, c.maxBodyBytes), Closer: resp.Body}
+
+		return resp, nil
+	}
+
+	if resp.ContentLength > c.maxBodyBytes {
+		resp.Body.Close()
+
+		return nil, errors.E(op, ErrBodyTooLarge)
+	}
+
+	resp.Body = &limitedBody{rc: resp.Body, remaining: c.maxBodyBytes}
+
+	return resp, nil
+}
+
+// IsAllowedIP reports whether ip is a public address that may be dialed.
+func IsAllowedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for i := range blockedNetworks {
+		if blockedNetworks[i].Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrUnsupportedScheme
+	}
+
+	return nil
+}
+
+func isAllowedContentType(contentType string, allowedTypes []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range allowedTypes {
+		if allowed == mediaType {
+			return true
+		}
+
+		if strings.HasSuffix(allowed, "/*") &&
+			strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// limitedBody returns ErrBodyTooLarge instead of silently truncating
+// bodies that are larger than allowed.
+type limitedBody struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+
+	// Read one byte more than allowed to detect bodies that are too large.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.rc.Read(p)
+	b.remaining -= int64(n)
+
+	if b.remaining < 0 {
+		return n + int(b.remaining), ErrBodyTooLarge
+	}
+
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.rc.Close()
+}
+
+// truncatedBody ends at the maximum number of bytes, and closes the whole
+// body.
+type truncatedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+
+	for i := range cidrs {
+		_, n, err := net.ParseCIDR(cidrs[i])
+		if err != nil {
+			panic(err)
+		}
+
+		nets[i] = n
+	}
+
+	return nets
+}
@@ -0,0 +1,233 @@
+package fetch
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestClient returns a client that may dial the loopback address of
+// httptest servers.
+func newTestClient(opts ...Option) *Client {
+	c := NewClient(opts...)
+	c.isAllowedIP = func(ip net.IP) bool {
+		return ip.IsLoopback()
+	}
+
+	return c
+}
+
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><head><title>Hello</title></head></html>"))
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("not really a png"))
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		// Flushing forces a chunked response without a Content-Length.
+		w.Write([]byte(strings.Repeat("a", 512)))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(strings.Repeat("a", 512)))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/html", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/internal", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/computeMetadata/v1/", http.StatusFound)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestIsAllowedIP(t *testing.T) {
+	tests := []struct {
+		IP     string
+		Expect bool
+	}{
+		{IP: "93.184.216.34", Expect: true},
+		{IP: "2606:2800:220:1:248:1893:25c8:1946", Expect: true},
+		{IP: "127.0.0.1", Expect: false},
+		{IP: "10.1.2.3", Expect: false},
+		{IP: "172.16.0.1", Expect: false},
+		{IP: "172.31.255.255", Expect: false},
+		{IP: "192.168.1.1", Expect: false},
+		{IP: "169.254.169.254", Expect: false},
+		{IP: "100.100.100.200", Expect: false},
+		{IP: "0.0.0.0", Expect: false},
+		{IP: "::1", Expect: false},
+		{IP: "::ffff:127.0.0.1", Expect: false},
+		{IP: "::ffff:10.0.0.1", Expect: false},
+		{IP: "fe80::1", Expect: false},
+		{IP: "fd00:ec2::254", Expect: false},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.IP, func(t *testing.T) {
+			if got := IsAllowedIP(net.ParseIP(tcase.IP)); got != tcase.Expect {
+				t.Errorf("IsAllowedIP(%s) = %v, want %v", tcase.IP, got, tcase.Expect)
+			}
+		})
+	}
+}
+
+func TestGetBlocksLoopback(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	_, err := NewClient().Get(context.Background(), srv.URL+"/html", nil, "text/html")
+	if err == nil || !strings.Contains(err.Error(), ErrBlockedAddress.Error()) {
+		t.Fatalf("expected blocked address error, got %v", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	tests := []struct {
+		Name         string
+		Path         string
+		AllowedTypes []string
+		Opts         []Option
+		ExpectErr    error
+		ExpectBody   string
+	}{
+		{
+			Name:         "html",
+			Path:         "/html",
+			AllowedTypes: []string{"text/html"},
+			ExpectBody:   "<html><head><title>Hello</title></head></html>",
+		},
+		{
+			Name:         "image wildcard",
+			Path:         "/image",
+			AllowedTypes: []string{"image/*"},
+			ExpectBody:   "not really a png",
+		},
+		{
+			Name:         "content type not allowed",
+			Path:         "/image",
+			AllowedTypes: []string{"text/html"},
+			ExpectErr:    ErrContentType,
+		},
+		{
+			Name:         "follows redirect",
+			Path:         "/redirect",
+			AllowedTypes: []string{"text/html"},
+			ExpectBody:   "<html><head><title>Hello</title></head></html>",
+		},
+		{
+			Name:         "redirect loop",
+			Path:         "/loop",
+			AllowedTypes: []string{"text/html"},
+			ExpectErr:    ErrTooManyRedirects,
+		},
+		{
+			Name:         "no redirects allowed",
+			Path:         "/redirect",
+			AllowedTypes: []string{"text/html"},
+			Opts:         []Option{WithMaxRedirects(0)},
+			ExpectErr:    ErrTooManyRedirects,
+		},
+		{
+			Name:         "redirect to metadata server",
+			Path:         "/internal",
+			AllowedTypes: []string{"text/html"},
+			ExpectErr:    ErrBlockedAddress,
+		},
+		{
+			Name:         "redirect to file",
+			Path:         "/file",
+			AllowedTypes: []string{"text/html"},
+			ExpectErr:    ErrUnsupportedScheme,
+		},
+		{
+			Name:         "content length too large",
+			Path:         "/html",
+			AllowedTypes: []string{"text/html"},
+			Opts:         []Option{WithMaxBodyBytes(10)},
+			ExpectErr:    ErrBodyTooLarge,
+		},
+		{
+			Name:         "streamed body too large",
+			Path:         "/big",
+			AllowedTypes: []string{"text/html"},
+			Opts:         []Option{WithMaxBodyBytes(1000)},
+			ExpectErr:    ErrBodyTooLarge,
+		},
+		{
+			Name:         "streamed body at limit",
+			Path:         "/big",
+			AllowedTypes: []string{"text/html"},
+			Opts:         []Option{WithMaxBodyBytes(1024)},
+			ExpectBody:   strings.Repeat("a", 1024),
+		},
+		{
+			Name:         "content length truncated",
+			Path:         "/html",
+			AllowedTypes: []string{"text/html"},
+			Opts:         []Option{WithMaxBodyBytes(12), WithTruncatedBody()},
+			ExpectBody:   "<html><head>",
+		},
+		{
+			Name:         "streamed body truncated",
+			Path:         "/big",
+			AllowedTypes: []string{"text/html"},
+			Opts:         []Option{WithMaxBodyBytes(1000), WithTruncatedBody()},
+			ExpectBody:   strings.Repeat("a", 1000),
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			c := newTestClient(tcase.Opts...)
+
+			resp, err := c.Get(context.Background(), srv.URL+tcase.Path, nil, tcase.AllowedTypes...)
+			if err == nil {
+				defer resp.Body.Close()
+
+				var body []byte
+				body, err = ioutil.ReadAll(resp.Body)
+
+				if err == nil && string(body) != tcase.ExpectBody {
+					t.Errorf("got body %q, want %q", body, tcase.ExpectBody)
+				}
+			}
+
+			if tcase.ExpectErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tcase.ExpectErr.Error()) {
+				t.Fatalf("expected error %q, got %v", tcase.ExpectErr, err)
+			}
+		})
+	}
+}
+
+func TestGetUnsupportedScheme(t *testing.T) {
+	_, err := NewClient().Get(context.Background(), "ftp://example.com/file", nil, "text/html")
+	if err == nil || !strings.Contains(err.Error(), ErrUnsupportedScheme.Error()) {
+		t.Fatalf("expected unsupported scheme error, got %v", err)
+	}
+}
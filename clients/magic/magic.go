@@ -11,14 +11,12 @@ import (
 	"strconv"
 	"time"
 
-	"cloud.google.com/go/datastore"
-
 	"github.com/hiconvo/api/errors"
 )
 
 type Client interface {
-	NewLink(k *datastore.Key, salt, action string) string
-	Verify(kenc, b64ts, salt, sig string) error
+	NewLink(id, salt, action string) string
+	Verify(id, b64ts, salt, sig string) error
 }
 
 type clientImpl struct {
@@ -29,21 +27,20 @@ func NewClient(secret string) Client {
 	return &clientImpl{secret}
 }
 
-func (c *clientImpl) NewLink(k *datastore.Key, salt, action string) string {
+// NewLink returns a signed link to the action for the entity with the given
+// ID. The ID must be URL safe.
+func (c *clientImpl) NewLink(id, salt, action string) string {
 	// Get time and convert to epoc string
 	ts := time.Now().Unix()
 	sts := strconv.FormatInt(ts, 10)
 	b64ts := base64.URLEncoding.EncodeToString([]byte(sts))
 
-	// Get url-safe key
-	kenc := k.Encode()
-
 	return fmt.Sprintf("https://app.convo.events/%s/%s/%s/%s",
-		action, kenc, b64ts, c.getSignature(kenc, b64ts, salt))
+		action, id, b64ts, c.getSignature(id, b64ts, salt))
 }
 
-func (c *clientImpl) Verify(kenc, b64ts, salt, sig string) error {
-	if sig == c.getSignature(kenc, b64ts, salt) {
+func (c *clientImpl) Verify(id, b64ts, salt, sig string) error {
+	if sig == c.getSignature(id, b64ts, salt) {
 		return nil
 	}
 
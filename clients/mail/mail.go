@@ -3,6 +3,7 @@ package mail
 import (
 	"encoding/base64"
 	"net/http"
+	"strings"
 
 	"github.com/sendgrid/sendgrid-go"
 	smail "github.com/sendgrid/sendgrid-go/helpers/mail"
@@ -50,7 +51,7 @@ func (s *senderImpl) Send(e EmailMessage) error {
 	if e.ICSAttachment != "" {
 		attachment := smail.NewAttachment()
 		attachment.SetContent(base64.StdEncoding.EncodeToString([]byte(e.ICSAttachment)))
-		attachment.SetType("text/calendar")
+		attachment.SetType(icsContentType(e.ICSAttachment))
 		attachment.SetFilename("event.ics")
 
 		email.AddAttachment(attachment)
@@ -69,6 +70,23 @@ func (s *senderImpl) Send(e EmailMessage) error {
 	return nil
 }
 
+// icsContentType returns the content type of the given iCalendar file.
+// Mail clients only show iTIP messages as invitations when the content type
+// includes their method.
+func icsContentType(ics string) string {
+	for _, line := range strings.Split(ics, "\r\n") {
+		if strings.HasPrefix(line, "BEGIN:VEVENT") {
+			break
+		}
+
+		if strings.HasPrefix(line, "METHOD:") {
+			return "text/calendar; method=" + strings.TrimPrefix(line, "METHOD:")
+		}
+	}
+
+	return "text/calendar"
+}
+
 type loggerImpl struct{}
 
 func NewLogger() Client {
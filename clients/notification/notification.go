@@ -1,10 +1,10 @@
 package notification
 
 import (
+	"context"
 	"fmt"
 	"log"
 
-	"cloud.google.com/go/datastore"
 	"gopkg.in/GetStream/stream-go2.v1"
 
 	"github.com/hiconvo/api/errors"
@@ -19,8 +19,12 @@ const (
 	NewEvent    verb = "NewEvent"
 	UpdateEvent verb = "UpdateEvent"
 	DeleteEvent verb = "DeleteEvent"
+	CancelEvent verb = "CancelEvent"
 	AddRSVP     verb = "AddRSVP"
+	MaybeRSVP   verb = "MaybeRSVP"
+	DeclineRSVP verb = "DeclineRSVP"
 	RemoveRSVP  verb = "RemoveRSVP"
+	PromoteRSVP verb = "PromoteRSVP"
 
 	NewMessage verb = "NewMessage"
 
@@ -30,7 +34,7 @@ const (
 
 // A Notification contains the information needed to dispatch a notification.
 type Notification struct {
-	UserKeys   []*datastore.Key
+	UserIDs    []string
 	Actor      string
 	Verb       verb
 	Target     target
@@ -39,7 +43,7 @@ type Notification struct {
 }
 
 type Client interface {
-	Put(n *Notification) error
+	Put(ctx context.Context, n *Notification) error
 	GenerateToken(userID string) string
 }
 
@@ -83,9 +87,9 @@ func (c *clientImpl) put(n *Notification, userID string) error {
 }
 
 // Put dispatches a notification.
-func (c *clientImpl) Put(n *Notification) error {
-	for _, key := range n.UserKeys {
-		if err := c.put(n, key.Encode()); err != nil {
+func (c *clientImpl) Put(ctx context.Context, n *Notification) error {
+	for _, id := range n.UserIDs {
+		if err := c.put(n, id); err != nil {
 			return err
 		}
 	}
@@ -99,16 +103,16 @@ func (c *clientImpl) GenerateToken(userID string) string {
 	return feed.RealtimeToken(true)
 }
 
-// FilterKey is a convenience function that filters a specific key from a slice.
-func FilterKey(keys []*datastore.Key, toFilter *datastore.Key) []*datastore.Key {
-	var filtered []*datastore.Key
+// FilterID is a convenience function that filters a specific ID from a slice.
+func FilterID(ids []string, toFilter string) []string {
+	var filtered []string
 
-	for i := range keys {
-		if keys[i].Equal(toFilter) {
+	for i := range ids {
+		if ids[i] == toFilter {
 			continue
 		}
 
-		filtered = append(filtered, keys[i])
+		filtered = append(filtered, ids[i])
 	}
 
 	return filtered
@@ -121,7 +125,7 @@ func NewLogger() Client {
 	return &logger{}
 }
 
-func (l *logger) Put(n *Notification) error {
+func (l *logger) Put(ctx context.Context, n *Notification) error {
 	log.Printf("notification.Put(Actor=%s, Verb=%s, Target=%s, TargetID=%s)",
 		n.Actor, n.Verb, string(n.Target), n.TargetID)
 	return nil
@@ -8,11 +8,13 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dyatlov/go-htmlinfo/htmlinfo"
 	xurls "mvdan.cc/xurls/v2"
 
+	"github.com/hiconvo/api/clients/fetch"
 	"github.com/hiconvo/api/errors"
 	"github.com/hiconvo/api/log"
 )
@@ -27,64 +29,221 @@ type LinkData struct {
 	Original    string `json:"-"`
 }
 
+const (
+	_maxPageBytes = 2 << 20
+
+	// MaxLinks is the maximum number of link previews extracted from a
+	// single piece of text.
+	MaxLinks = 5
+	// ExtractTimeout is the deadline shared by all of the fetches made by
+	// ExtractAll.
+	ExtractTimeout = 5 * time.Second
+)
+
 type Client interface {
+	// Extract finds the first URL in the given text and returns its link
+	// preview. It returns nil if there is no URL or no preview could be
+	// generated.
 	Extract(ctx context.Context, text string) *LinkData
+	// Fetch returns the link preview of the given URL.
+	Fetch(ctx context.Context, rawURL string) (*LinkData, error)
 }
 
 func NewClient() Client {
 	return &clientImpl{
-		httpClient: &http.Client{Timeout: time.Duration(5) * time.Second},
+		fetcher: fetch.NewClient(
+			fetch.WithTimeout(time.Duration(5)*time.Second),
+			fetch.WithMaxBodyBytes(_maxPageBytes),
+			// Previews come from the head of the page, so the rest of
+			// pages that are too large is not needed.
+			fetch.WithTruncatedBody()),
 	}
 }
 
 type clientImpl struct {
-	httpClient *http.Client
+	fetcher *fetch.Client
 }
 
-func (c *clientImpl) Extract(ctx context.Context, text string) *LinkData {
-	found := xurls.Strict().FindString(text)
-	if found == "" {
-		return nil
-	}
+// FindURL returns the first URL in the given text or an empty string if
+// there is none.
+func FindURL(text string) string {
+	return xurls.Strict().FindString(text)
+}
 
-	op := errors.Opf("opengraph.Extract(%s)", found)
+// NormalizeURL returns a canonical form of the given URL so that different
+// spellings of the same link share a single preview. The scheme and host
+// are lowercased, mobile subdomains, default ports, trailing slashes,
+// fragments and tracking parameters are removed, and the remaining query
+// parameters are sorted.
+func NormalizeURL(rawURL string) (string, error) {
+	// ParseRequestURI does not expect fragments, so it would keep them as
+	// part of the path or query.
+	if i := strings.Index(rawURL, "#"); i >= 0 {
+		rawURL = rawURL[:i]
+	}
 
-	urlobj, err := url.ParseRequestURI(found)
+	urlobj, err := url.ParseRequestURI(rawURL)
 	if err != nil {
-		log.Print(errors.E(op, err))
+		return "", err
+	}
 
-		return nil
+	if urlobj.Host == "" {
+		return "", errors.Errorf("%q has no host", rawURL)
 	}
 
+	urlobj.Scheme = strings.ToLower(urlobj.Scheme)
+	urlobj.Host = strings.ToLower(urlobj.Host)
 	urlobj.Host = strings.TrimPrefix(urlobj.Host, "m.")
 	urlobj.Host = strings.TrimPrefix(urlobj.Host, "mobile.")
-	cleanURL := urlobj.String()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cleanURL, nil)
-	if err != nil {
-		log.Print(errors.E(op, err))
+	if (urlobj.Scheme == "http" && urlobj.Port() == "80") ||
+		(urlobj.Scheme == "https" && urlobj.Port() == "443") {
+		urlobj.Host = urlobj.Hostname()
+	}
+
+	urlobj.Path = strings.TrimRight(urlobj.Path, "/")
+	urlobj.RawPath = ""
+
+	urlobj.Fragment = ""
+	urlobj.User = nil
+
+	q := urlobj.Query()
+	for k := range q {
+		if strings.HasPrefix(k, "utm_") || k == "fbclid" || k == "gclid" {
+			q.Del(k)
+		}
+	}
+
+	urlobj.RawQuery = q.Encode()
+
+	return urlobj.String(), nil
+}
 
+// FindURLs returns up to max distinct URLs in the order in which they
+// appear in the given text. URLs are told apart by their normalized form,
+// and the first spelling of each is returned.
+func FindURLs(text string, max int) []string {
+	var (
+		found = xurls.Strict().FindAllString(text, -1)
+		urls  = make([]string, 0, len(found))
+		seen  = make(map[string]struct{}, len(found))
+	)
+
+	for i := range found {
+		if len(urls) >= max {
+			break
+		}
+
+		key, err := NormalizeURL(found[i])
+		if err != nil {
+			key = found[i]
+		}
+
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		seen[key] = struct{}{}
+		urls = append(urls, found[i])
+	}
+
+	return urls
+}
+
+// ExtractAll returns the link previews of up to MaxLinks URLs in the given
+// text. The previews are fetched concurrently with a shared deadline.
+// URLs for which no preview could be generated are skipped, and the
+// remaining previews are returned in the order in which they appear in the
+// text.
+func ExtractAll(ctx context.Context, c Client, text string) []*LinkData {
+	urls := FindURLs(text, MaxLinks)
+	if len(urls) == 0 {
 		return nil
 	}
 
-	req.Header.Set("User-Agent", "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)")
-	req.Header.Set("Cache-Control", "no-cache")
+	ctx, cancel := context.WithTimeout(ctx, ExtractTimeout)
+	defer cancel()
+
+	var (
+		results = make([]*LinkData, len(urls))
+		wg      sync.WaitGroup
+	)
+
+	for i := range urls {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			ld, err := c.Fetch(ctx, urls[i])
+			if err != nil {
+				log.Print(err)
+				return
+			}
+
+			ld.Original = urls[i]
+			results[i] = ld
+		}(i)
+	}
+
+	wg.Wait()
+
+	var links []*LinkData
+	for i := range results {
+		if results[i] != nil {
+			links = append(links, results[i])
+		}
+	}
+
+	return links
+}
 
-	resp, err := c.httpClient.Do(req)
+func (c *clientImpl) Extract(ctx context.Context, text string) *LinkData {
+	found := FindURL(text)
+	if found == "" {
+		return nil
+	}
+
+	ld, err := c.Fetch(ctx, found)
 	if err != nil {
-		log.Print(errors.E(op, err))
+		log.Print(err)
 
 		return nil
 	}
+
+	ld.Original = found
+
+	return ld
+}
+
+func (c *clientImpl) Fetch(ctx context.Context, rawURL string) (*LinkData, error) {
+	op := errors.Opf("opengraph.Fetch(%s)", rawURL)
+
+	cleanURL, err := NormalizeURL(rawURL)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	urlobj, err := url.Parse(cleanURL)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	header := http.Header{}
+	header.Set("User-Agent", "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)")
+	header.Set("Cache-Control", "no-cache")
+
+	resp, err := c.fetcher.Get(ctx, cleanURL, header, "text/html", "application/xhtml+xml")
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
 	defer resp.Body.Close()
 
 	info := htmlinfo.NewHTMLInfo()
 
 	err = info.Parse(resp.Body, &cleanURL, nil)
 	if err != nil {
-		log.Print(errors.E(op, err))
-
-		return nil
+		return nil, errors.E(op, err)
 	}
 
 	oembed := info.GenerateOembedFor(cleanURL)
@@ -95,7 +254,7 @@ func (c *clientImpl) Extract(ctx context.Context, text string) *LinkData {
 		Description: info.OGInfo.Description,
 		Favicon:     info.FaviconURL,
 		Image:       oembed.ThumbnailURL,
-		Original:    found,
+		Original:    rawURL,
 	}
 
 	// YouTube and Twitter are not reliable. Sometimes they give us what we're
@@ -103,14 +262,24 @@ func (c *clientImpl) Extract(ctx context.Context, text string) *LinkData {
 	// fall back to their oembed APIs which don't provide much info but which
 	// provide more than nothing.
 	if ld.Image == "" {
+		var fallback *LinkData
+
 		if hn := urlobj.Hostname(); hn == "youtu.be" || strings.HasSuffix(hn, "youtube.com") {
-			return c.handleYouTube(ctx, cleanURL, found)
+			fallback = c.handleYouTube(ctx, cleanURL, rawURL)
 		} else if strings.HasSuffix(hn, "twitter.com") {
-			return c.handleTwitter(ctx, urlobj.String(), found)
+			fallback = c.handleTwitter(ctx, cleanURL, rawURL)
+		} else {
+			return ld, nil
+		}
+
+		if fallback == nil {
+			return nil, errors.E(op, errors.Str("oembed fallback failed"))
 		}
+
+		return fallback, nil
 	}
 
-	return ld
+	return ld, nil
 }
 
 func (c *clientImpl) handleYouTube(ctx context.Context, found, original string) *LinkData {
@@ -118,14 +287,7 @@ func (c *clientImpl) handleYouTube(ctx context.Context, found, original string)
 		html.EscapeString(found))
 	op := errors.Opf("opengraph.handleYouTube(%s)", purl)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, purl, nil)
-	if err != nil {
-		log.Print(errors.E(op, err))
-
-		return nil
-	}
-
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.fetcher.Get(ctx, purl, nil, "application/json", "text/json", "text/javascript")
 	if err != nil {
 		log.Print(errors.E(op, err))
 
@@ -180,14 +342,7 @@ func (c *clientImpl) handleTwitter(ctx context.Context, found, original string)
 		html.EscapeString(found))
 	op := errors.Opf("opengraph.handleTwitter(%s)", purl)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, purl, nil)
-	if err != nil {
-		log.Print(errors.E(op, err))
-
-		return nil
-	}
-
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.fetcher.Get(ctx, purl, nil, "application/json", "text/json", "text/javascript")
 	if err != nil {
 		log.Print(errors.E(op, err))
 
@@ -248,3 +403,7 @@ type nullClient struct{}
 func (c *nullClient) Extract(ctx context.Context, text string) *LinkData {
 	return nil
 }
+
+func (c *nullClient) Fetch(ctx context.Context, rawURL string) (*LinkData, error) {
+	return nil, errors.E(errors.Op("opengraph.nullClient.Fetch"), errors.Str("null client"))
+}
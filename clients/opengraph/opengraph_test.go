@@ -0,0 +1,158 @@
+package opengraph
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hiconvo/api/errors"
+)
+
+func TestFindURLs(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Text   string
+		Max    int
+		Expect []string
+	}{
+		{
+			Name:   "none",
+			Text:   "nothing to see here",
+			Max:    MaxLinks,
+			Expect: []string{},
+		},
+		{
+			Name:   "order",
+			Text:   "see https://b.com/2 and then https://a.com/1",
+			Max:    MaxLinks,
+			Expect: []string{"https://b.com/2", "https://a.com/1"},
+		},
+		{
+			Name:   "max",
+			Text:   "https://a.com https://b.com https://c.com",
+			Max:    2,
+			Expect: []string{"https://a.com", "https://b.com"},
+		},
+		{
+			Name:   "duplicates",
+			Text:   "https://x.com/a https://x.com/a",
+			Max:    MaxLinks,
+			Expect: []string{"https://x.com/a"},
+		},
+		{
+			Name:   "trailing slash",
+			Text:   "https://x.com/a HTTPS://X.com/a/",
+			Max:    MaxLinks,
+			Expect: []string{"https://x.com/a"},
+		},
+		{
+			Name:   "normalized duplicates",
+			Text:   "https://x.com/a?utm_source=mail HTTPS://X.com:443/a#top https://y.com",
+			Max:    2,
+			Expect: []string{"https://x.com/a?utm_source=mail", "https://y.com"},
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			got := FindURLs(tcase.Text, tcase.Max)
+			if !reflect.DeepEqual(got, tcase.Expect) {
+				t.Errorf("FindURLs(%q, %d) = %v, want %v", tcase.Text, tcase.Max, got, tcase.Expect)
+			}
+		})
+	}
+}
+
+// fakeClient serves previews titled after their URLs. URLs that contain
+// "broken" fail and URLs that contain "slow" block until ctx is done.
+type fakeClient struct {
+	mu      sync.Mutex
+	fetched []string
+}
+
+func (c *fakeClient) Extract(ctx context.Context, text string) *LinkData {
+	return nil
+}
+
+func (c *fakeClient) Fetch(ctx context.Context, rawURL string) (*LinkData, error) {
+	c.mu.Lock()
+	c.fetched = append(c.fetched, rawURL)
+	c.mu.Unlock()
+
+	switch {
+	case strings.Contains(rawURL, "broken"):
+		return nil, errors.Str("broken")
+	case strings.Contains(rawURL, "slow"):
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return &LinkData{URL: rawURL, Title: rawURL}, nil
+}
+
+func TestExtractAll(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Text   string
+		Expect []string
+	}{
+		{
+			Name:   "none",
+			Text:   "nothing to see here",
+			Expect: nil,
+		},
+		{
+			Name:   "order",
+			Text:   "https://c.com https://a.com https://b.com",
+			Expect: []string{"https://c.com", "https://a.com", "https://b.com"},
+		},
+		{
+			Name:   "max",
+			Text:   "https://a.com https://b.com https://c.com https://d.com https://e.com https://f.com",
+			Expect: []string{"https://a.com", "https://b.com", "https://c.com", "https://d.com", "https://e.com"},
+		},
+		{
+			Name:   "partial failures",
+			Text:   "https://a.com https://broken.com https://b.com",
+			Expect: []string{"https://a.com", "https://b.com"},
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			var got []string
+			for _, ld := range ExtractAll(context.Background(), &fakeClient{}, tcase.Text) {
+				if ld.Original != ld.URL {
+					t.Errorf("Original = %q, want %q", ld.Original, ld.URL)
+				}
+
+				got = append(got, ld.Original)
+			}
+
+			if !reflect.DeepEqual(got, tcase.Expect) {
+				t.Errorf("ExtractAll(%q) = %v, want %v", tcase.Text, got, tcase.Expect)
+			}
+		})
+	}
+}
+
+func TestExtractAllDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	got := ExtractAll(ctx, &fakeClient{}, "https://a.com https://slow.com https://b.com")
+
+	// The slow link is dropped once the shared deadline passes, and the
+	// others are kept.
+	if elapsed := time.Since(start); elapsed > ExtractTimeout {
+		t.Errorf("ExtractAll took %v, longer than its deadline", elapsed)
+	}
+
+	if len(got) != 2 || got[0].Original != "https://a.com" || got[1].Original != "https://b.com" {
+		t.Errorf("ExtractAll returned %v, want the previews of a.com and b.com", got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"googlemaps.github.io/maps"
 
@@ -17,10 +18,16 @@ type Place struct {
 	Lat       float64
 	Lng       float64
 	UTCOffset int
+	// TimeZone is the IANA name of the time zone of the place.
+	TimeZone string
 }
 
 type Client interface {
-	Resolve(ctx context.Context, placeID string, userUTCOffset int) (Place, error)
+	// Resolve returns the place with the given ID. Places that are not
+	// physical locations, such as video calls, are given the offset and
+	// time zone of the user, which are also used when the time zone of a
+	// place cannot be found.
+	Resolve(ctx context.Context, placeID string, userUTCOffset int, userTimeZone string) (Place, error)
 }
 
 type clientImpl struct {
@@ -98,11 +105,17 @@ func NewClient(apiKey string) Client {
 	}
 }
 
-func (c *clientImpl) Resolve(ctx context.Context, placeID string, userUTCOffset int) (Place, error) {
+func (c *clientImpl) Resolve(
+	ctx context.Context,
+	placeID string,
+	userUTCOffset int,
+	userTimeZone string,
+) (Place, error) {
 	for i := range c.voiceCallLocations {
 		if c.voiceCallLocations[i].PlaceID == placeID {
 			pl := c.voiceCallLocations[i]
 			pl.UTCOffset = userUTCOffset
+			pl.TimeZone = userTimeZone
 			return pl, nil
 		}
 	}
@@ -125,12 +138,26 @@ func (c *clientImpl) Resolve(ctx context.Context, placeID string, userUTCOffset
 		address = strings.Join([]string{result.Name, result.FormattedAddress}, ", ")
 	}
 
+	timeZone := userTimeZone
+
+	tz, err := c.client.Timezone(ctx, &maps.TimezoneRequest{
+		Location:  &result.Geometry.Location,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		// Log the error but don't fail the request
+		log.Alarm(errors.E(errors.Op("places.Resolve"), err))
+	} else {
+		timeZone = tz.TimeZoneID
+	}
+
 	return Place{
 		PlaceID:   result.PlaceID,
 		Address:   address,
 		Lat:       result.Geometry.Location.Lat,
 		Lng:       result.Geometry.Location.Lng,
 		UTCOffset: *result.UTCOffset * 60,
+		TimeZone:  timeZone,
 	}, nil
 }
 
@@ -141,7 +168,12 @@ func NewLogger() Client {
 	return &loggerImpl{}
 }
 
-func (l *loggerImpl) Resolve(ctx context.Context, placeID string, userUTCOffset int) (Place, error) {
+func (l *loggerImpl) Resolve(
+	ctx context.Context,
+	placeID string,
+	userUTCOffset int,
+	userTimeZone string,
+) (Place, error) {
 	log.Printf("places.Resolve(placeID=%s)", placeID)
 
 	return Place{
@@ -150,5 +182,6 @@ func (l *loggerImpl) Resolve(ctx context.Context, placeID string, userUTCOffset
 		Lat:       0.0,
 		Lng:       0.0,
 		UTCOffset: 0,
+		TimeZone:  userTimeZone,
 	}, nil
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
 	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
@@ -25,16 +26,21 @@ const (
 
 	SendInvites        emailAction = "SendInvites"
 	SendUpdatedInvites emailAction = "SendUpdatedInvites"
+	SendReminders      emailAction = "SendReminders"
+	SendCancellation   emailAction = "SendCancellation"
 	SendThread         emailAction = "SendThread"
 	SendWelcome        emailAction = "SendWelcome"
 )
 
 // EmailPayload is a representation of an async email task.
 type EmailPayload struct {
-	// IDs is a slice of strings that are the result of calling *datastore.Key.Encode().
+	// IDs are the IDs of the entities that the emails are about.
 	IDs    []string    `json:"ids"`
 	Type   emailType   `json:"type"`
 	Action emailAction `json:"action"`
+	// Occurrence is the start of the occurrence of the event that reminders
+	// are about.
+	Occurrence time.Time `json:"occurrence"`
 }
 
 type Client interface {
@@ -72,7 +78,9 @@ func (c *clientImpl) PutEmail(ctx context.Context, payload EmailPayload) error {
 			return errors.E(op, errors.Errorf("'%v' is not a valid action for emailType.Thread", payload.Action))
 		}
 	case Event:
-		if !(payload.Action == SendInvites || payload.Action == SendUpdatedInvites) {
+		switch payload.Action {
+		case SendInvites, SendUpdatedInvites, SendReminders, SendCancellation:
+		default:
 			return errors.E(op, errors.Errorf("'%v' is not a valid action for emailType.Event", payload.Action))
 		}
 	case User:
@@ -0,0 +1,370 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/log"
+)
+
+var _ Client = (*elasticClient)(nil)
+
+type elasticClient struct {
+	es *elastic.Client
+}
+
+// NewClient returns a Client backed by the Elasticsearch node at hostname.
+// Connecting is attempted a few times since the node may still be starting.
+func NewClient(hostname string) (Client, error) {
+	var (
+		op     = errors.Opf("search.NewClient(hostname=%s)", hostname)
+		client *elastic.Client
+		err    error
+	)
+
+	const (
+		maxAttempts = 5
+		timeout     = 3
+	)
+
+	for i := 1; i <= maxAttempts; i++ {
+		client, err = elastic.NewClient(
+			elastic.SetSniff(false),
+			elastic.SetURL(fmt.Sprintf("http://%s:9200", hostname)),
+		)
+		if err == nil {
+			log.Printf("%s: Connected to elasticsearch", string(op))
+
+			return &elasticClient{es: client}, nil
+		}
+
+		if i < maxAttempts {
+			log.Printf("%s: Failed to connect to elasticsearch; attempt %d/%d; will retry in %d seconds\n%s\n",
+				string(op), i, maxAttempts, timeout, err)
+			time.Sleep(timeout * time.Second)
+		}
+	}
+
+	return nil, errors.E(op, err)
+}
+
+func (c *elasticClient) EnsureIndex(ctx context.Context, index string, m Mapping) error {
+	op := errors.Opf("search.EnsureIndex(index=%s)", index)
+
+	props := make(map[string]interface{}, len(m))
+	for field, t := range m {
+		props[field] = elasticFieldMapping(t)
+	}
+
+	exists, err := c.es.IndexExists(index).Do(ctx)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if !exists {
+		_, err := c.es.CreateIndex(index).
+			BodyJson(map[string]interface{}{
+				"mappings": map[string]interface{}{"properties": props},
+			}).
+			Do(ctx)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		return nil
+	}
+
+	_, err = c.es.PutMapping().
+		Index(index).
+		BodyJson(map[string]interface{}{"properties": props}).
+		Do(ctx)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	return nil
+}
+
+func (c *elasticClient) Put(ctx context.Context, index, id string, doc interface{}) error {
+	if _, err := c.es.Index().Index(index).Id(id).BodyJson(doc).Do(ctx); err != nil {
+		return errors.E(errors.Opf("search.Put(index=%s)", index), err)
+	}
+
+	return nil
+}
+
+func (c *elasticClient) PutMulti(ctx context.Context, index string, docs []*Document) error {
+	op := errors.Opf("search.PutMulti(index=%s)", index)
+
+	if len(docs) == 0 {
+		return nil
+	}
+
+	bulk := c.es.Bulk()
+	for i := range docs {
+		bulk = bulk.Add(elastic.NewBulkIndexRequest().Index(index).Id(docs[i].ID).Doc(docs[i].Body))
+	}
+
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if failed := res.Failed(); len(failed) > 0 {
+		return errors.E(op, errors.Errorf("failed to index %d of %d documents, first error: %s",
+			len(failed), len(docs), getBulkError(failed[0])))
+	}
+
+	return nil
+}
+
+func (c *elasticClient) Get(ctx context.Context, index, id string, dst interface{}) (bool, error) {
+	op := errors.Opf("search.Get(index=%s)", index)
+
+	res, err := c.es.Get().Index(index).Id(id).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, errors.E(op, err)
+	}
+
+	if err := json.Unmarshal(res.Source, dst); err != nil {
+		return false, errors.E(op, err)
+	}
+
+	return true, nil
+}
+
+func (c *elasticClient) GetMulti(
+	ctx context.Context,
+	index string,
+	ids []string,
+) (map[string]json.RawMessage, error) {
+	out := make(map[string]json.RawMessage, len(ids))
+
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	mget := c.es.MultiGet()
+	for i := range ids {
+		mget = mget.Add(elastic.NewMultiGetItem().Index(index).Id(ids[i]))
+	}
+
+	res, err := mget.Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return out, nil
+		}
+
+		return nil, errors.E(errors.Opf("search.GetMulti(index=%s)", index), err)
+	}
+
+	for _, doc := range res.Docs {
+		if doc.Found {
+			out[doc.Id] = doc.Source
+		}
+	}
+
+	return out, nil
+}
+
+func (c *elasticClient) Delete(ctx context.Context, index, id string) error {
+	_, err := c.es.Delete().Index(index).Id(id).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return errors.E(errors.Opf("search.Delete(index=%s)", index), err)
+	}
+
+	return nil
+}
+
+func (c *elasticClient) UpdateWhere(
+	ctx context.Context,
+	index, field, value string,
+	fields map[string]interface{},
+) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+
+	// The names are sorted so that the same script is compiled only once.
+	sort.Strings(names)
+
+	var src strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&src, "ctx._source['%s'] = params['%s'];", name, name)
+	}
+
+	_, err := c.es.UpdateByQuery(index).
+		Query(elastic.NewTermQuery(keyword(field), value)).
+		Script(elastic.NewScript(src.String()).Params(fields)).
+		ProceedOnVersionConflict().
+		IgnoreUnavailable(true).
+		AllowNoIndices(true).
+		Do(ctx)
+	if err != nil {
+		return errors.E(errors.Opf("search.UpdateWhere(index=%s)", index), err)
+	}
+
+	return nil
+}
+
+func (c *elasticClient) DeleteWhere(ctx context.Context, index, field, value string) error {
+	_, err := c.es.DeleteByQuery(index).
+		Query(elastic.NewTermQuery(keyword(field), value)).
+		ProceedOnVersionConflict().
+		IgnoreUnavailable(true).
+		AllowNoIndices(true).
+		Do(ctx)
+	if err != nil {
+		return errors.E(errors.Opf("search.DeleteWhere(index=%s)", index), err)
+	}
+
+	return nil
+}
+
+func (c *elasticClient) Search(ctx context.Context, q *Query) (*Result, error) {
+	op := errors.Op("search.Search")
+
+	match := elastic.NewMultiMatchQuery(q.Text, q.Fields...)
+	if q.Fuzzy {
+		match = match.Fuzziness("AUTO")
+	}
+
+	// Each index is searched with the filters that apply to it.
+	access := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+	for _, index := range q.Indices {
+		b := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("_index", index))
+
+		for i := range q.Filters {
+			if q.Filters[i].appliesTo(index) {
+				b = b.Filter(elastic.NewTermQuery(keyword(q.Filters[i].Field), q.Filters[i].Value))
+			}
+		}
+
+		access = access.Should(b)
+	}
+
+	svc := c.es.Search(q.Indices...).
+		IgnoreUnavailable(true).
+		AllowNoIndices(true).
+		Query(elastic.NewBoolQuery().Must(match).Filter(access)).
+		Aggregation("indices", elastic.NewTermsAggregation().Field("_index").Size(len(q.Indices))).
+		From(q.From).
+		Size(q.Size)
+
+	if len(q.Highlight) > 0 {
+		h := elastic.NewHighlight().PreTags("<em>").PostTags("</em>")
+		for _, f := range q.Highlight {
+			h = h.Fields(elastic.NewHighlighterField(f))
+		}
+
+		svc = svc.Highlight(h)
+	}
+
+	if q.DateFacet != "" {
+		svc = svc.Aggregation("dates", elastic.NewDateHistogramAggregation().
+			Field(q.DateFacet).
+			CalendarInterval("month").
+			Format("yyyy-MM").
+			MinDocCount(1))
+	}
+
+	if len(q.ResultIndices) > 0 {
+		indices := make([]interface{}, len(q.ResultIndices))
+		for i := range q.ResultIndices {
+			indices[i] = q.ResultIndices[i]
+		}
+
+		svc = svc.PostFilter(elastic.NewTermsQuery("_index", indices...))
+	}
+
+	res, err := svc.Do(ctx)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	out := &Result{
+		Total:       res.TotalHits(),
+		Hits:        make([]*Hit, 0, len(res.Hits.Hits)),
+		IndexCounts: make(map[string]int64, len(q.Indices)),
+		DateCounts:  make([]*DateCount, 0),
+	}
+
+	for _, hit := range res.Hits.Hits {
+		h := &Hit{
+			Index:      hit.Index,
+			ID:         hit.Id,
+			Source:     hit.Source,
+			Highlights: hit.Highlight,
+		}
+
+		if hit.Score != nil {
+			h.Score = *hit.Score
+		}
+
+		out.Hits = append(out.Hits, h)
+	}
+
+	if agg, ok := res.Aggregations.Terms("indices"); ok {
+		for _, b := range agg.Buckets {
+			if index, ok := b.Key.(string); ok {
+				out.IndexCounts[index] = b.DocCount
+			}
+		}
+	}
+
+	if agg, ok := res.Aggregations.DateHistogram("dates"); ok {
+		for _, b := range agg.Buckets {
+			if b.KeyAsString != nil {
+				out.DateCounts = append(out.DateCounts, &DateCount{Month: *b.KeyAsString, Count: b.DocCount})
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// elasticFieldMapping returns the mapping of a field of type t. The mappings
+// are the same as the ones that Elasticsearch creates dynamically, including
+// the keyword subfield of text, so that they can be added to indices that
+// were created without them.
+func elasticFieldMapping(t FieldType) map[string]interface{} {
+	switch t {
+	case DateField:
+		return map[string]interface{}{"type": "date"}
+	case BoolField:
+		return map[string]interface{}{"type": "boolean"}
+	default:
+		return map[string]interface{}{
+			"type": "text",
+			"fields": map[string]interface{}{
+				"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+			},
+		}
+	}
+}
+
+func getBulkError(item *elastic.BulkResponseItem) string {
+	if item.Error == nil {
+		return fmt.Sprintf("status %d", item.Status)
+	}
+
+	return item.Error.Reason
+}
+
+// keyword returns the name of the unanalyzed subfield of field, which the
+// default mapping creates for strings and which is matched exactly.
+func keyword(field string) string {
+	return field + ".keyword"
+}
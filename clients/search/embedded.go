@@ -0,0 +1,549 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hiconvo/api/errors"
+)
+
+var _ Client = (*embeddedClient)(nil)
+
+const _defaultSize = 10
+
+// embeddedClient keeps all documents in memory. Words are matched after
+// splitting text on anything that is not a letter or a number and lower
+// casing it, which is roughly what the standard analyzer of Elasticsearch
+// does. Scores are the number of words of the query that occur in a field
+// weighted by the boost of the field.
+type embeddedClient struct {
+	mu      sync.RWMutex
+	indices map[string]map[string]*embeddedDoc
+}
+
+type embeddedDoc struct {
+	source json.RawMessage
+	fields map[string]interface{}
+}
+
+// NewEmbeddedClient returns a Client that indexes documents in process. It
+// is meant for local development and tests, where running Elasticsearch is
+// a burden. Documents are lost when the process exits.
+func NewEmbeddedClient() Client {
+	return &embeddedClient{indices: make(map[string]map[string]*embeddedDoc)}
+}
+
+// EnsureIndex creates the index. Mappings are ignored since all fields are
+// searchable by words and matched exactly by filters.
+func (c *embeddedClient) EnsureIndex(ctx context.Context, index string, m Mapping) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.indices[index] == nil {
+		c.indices[index] = make(map[string]*embeddedDoc)
+	}
+
+	return nil
+}
+
+func (c *embeddedClient) Put(ctx context.Context, index, id string, doc interface{}) error {
+	d, err := newEmbeddedDoc(doc)
+	if err != nil {
+		return errors.E(errors.Opf("search.Put(index=%s)", index), err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.indices[index] == nil {
+		c.indices[index] = make(map[string]*embeddedDoc)
+	}
+
+	c.indices[index][id] = d
+
+	return nil
+}
+
+func (c *embeddedClient) PutMulti(ctx context.Context, index string, docs []*Document) error {
+	for i := range docs {
+		if err := c.Put(ctx, index, docs[i].ID, docs[i].Body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *embeddedClient) Get(ctx context.Context, index, id string, dst interface{}) (bool, error) {
+	c.mu.RLock()
+	d, ok := c.indices[index][id]
+	c.mu.RUnlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(d.source, dst); err != nil {
+		return false, errors.E(errors.Opf("search.Get(index=%s)", index), err)
+	}
+
+	return true, nil
+}
+
+func (c *embeddedClient) GetMulti(
+	ctx context.Context,
+	index string,
+	ids []string,
+) (map[string]json.RawMessage, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out := make(map[string]json.RawMessage, len(ids))
+	for _, id := range ids {
+		if d, ok := c.indices[index][id]; ok {
+			out[id] = d.source
+		}
+	}
+
+	return out, nil
+}
+
+func (c *embeddedClient) Delete(ctx context.Context, index, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.indices[index], id)
+
+	return nil
+}
+
+func (c *embeddedClient) UpdateWhere(
+	ctx context.Context,
+	index, field, value string,
+	fields map[string]interface{},
+) error {
+	op := errors.Opf("search.UpdateWhere(index=%s)", index)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, d := range c.indices[index] {
+		if !d.matches(field, value) {
+			continue
+		}
+
+		updated := make(map[string]interface{}, len(d.fields)+len(fields))
+		for k, v := range d.fields {
+			updated[k] = v
+		}
+
+		for k, v := range fields {
+			updated[k] = v
+		}
+
+		nd, err := newEmbeddedDoc(updated)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		c.indices[index][id] = nd
+	}
+
+	return nil
+}
+
+func (c *embeddedClient) DeleteWhere(ctx context.Context, index, field, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, d := range c.indices[index] {
+		if d.matches(field, value) {
+			delete(c.indices[index], id)
+		}
+	}
+
+	return nil
+}
+
+func (c *embeddedClient) Search(ctx context.Context, q *Query) (*Result, error) {
+	words := tokenize(q.Text)
+	fields := parseFields(q.Fields)
+
+	out := &Result{
+		Hits:        make([]*Hit, 0),
+		IndexCounts: make(map[string]int64, len(q.Indices)),
+		DateCounts:  make([]*DateCount, 0),
+	}
+
+	if len(words) == 0 {
+		return out, nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var (
+		hits   = make([]*Hit, 0)
+		months = make(map[string]int64)
+		order  = make(map[string]int, len(q.Indices))
+	)
+
+	for i, index := range q.Indices {
+		order[index] = i
+
+		for id, d := range c.indices[index] {
+			if !d.passes(index, q.Filters) {
+				continue
+			}
+
+			score := d.score(fields, words, q.Fuzzy)
+			if score == 0 {
+				continue
+			}
+
+			out.IndexCounts[index]++
+
+			if q.DateFacet != "" {
+				if month, ok := d.month(q.DateFacet); ok {
+					months[month]++
+				}
+			}
+
+			if len(q.ResultIndices) > 0 && !contains(q.ResultIndices, index) {
+				continue
+			}
+
+			hits = append(hits, &Hit{
+				Index:      index,
+				ID:         id,
+				Score:      score,
+				Source:     d.source,
+				Highlights: d.highlight(q.Highlight, words, q.Fuzzy),
+			})
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+
+		if hits[i].Index != hits[j].Index {
+			return order[hits[i].Index] < order[hits[j].Index]
+		}
+
+		return hits[i].ID < hits[j].ID
+	})
+
+	out.Total = int64(len(hits))
+	out.Hits = page(hits, q.From, q.Size)
+
+	for month, count := range months {
+		out.DateCounts = append(out.DateCounts, &DateCount{Month: month, Count: count})
+	}
+
+	sort.Slice(out.DateCounts, func(i, j int) bool {
+		return out.DateCounts[i].Month < out.DateCounts[j].Month
+	})
+
+	return out, nil
+}
+
+func newEmbeddedDoc(doc interface{}) (*embeddedDoc, error) {
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(source, &fields); err != nil {
+		return nil, err
+	}
+
+	return &embeddedDoc{source: source, fields: fields}, nil
+}
+
+// values returns the values of the field as strings. Lists are flattened
+// and nested objects are ignored.
+func (d *embeddedDoc) values(field string) []string {
+	var collect func(v interface{}) []string
+
+	collect = func(v interface{}) []string {
+		switch val := v.(type) {
+		case string:
+			return []string{val}
+		case float64:
+			return []string{strconv.FormatFloat(val, 'f', -1, 64)}
+		case bool:
+			return []string{strconv.FormatBool(val)}
+		case []interface{}:
+			out := make([]string, 0, len(val))
+			for i := range val {
+				out = append(out, collect(val[i])...)
+			}
+
+			return out
+		default:
+			return nil
+		}
+	}
+
+	return collect(d.fields[field])
+}
+
+func (d *embeddedDoc) matches(field, value string) bool {
+	return contains(d.values(field), value)
+}
+
+func (d *embeddedDoc) passes(index string, filters []Filter) bool {
+	for i := range filters {
+		if filters[i].appliesTo(index) && !d.matches(filters[i].Field, filters[i].Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// score returns the score of the best matching field, like the default
+// multi_match query of Elasticsearch, or zero if no field matches.
+func (d *embeddedDoc) score(fields []boostedField, words []token, fuzzy bool) float64 {
+	var best float64
+
+	for _, f := range fields {
+		var (
+			n      int
+			values = d.values(f.name)
+		)
+
+		for _, w := range words {
+			if anyWordMatches(w, values, fuzzy) {
+				n++
+			}
+		}
+
+		if s := float64(n) * f.boost; s > best {
+			best = s
+		}
+	}
+
+	return best
+}
+
+func (d *embeddedDoc) highlight(fields []string, words []token, fuzzy bool) map[string][]string {
+	out := make(map[string][]string)
+
+	for _, f := range fields {
+		for _, v := range d.values(f) {
+			var (
+				b       strings.Builder
+				last    int
+				matched bool
+			)
+
+			for _, t := range tokenize(v) {
+				for _, w := range words {
+					if wordMatches(w, t.text, fuzzy) {
+						b.WriteString(v[last:t.start])
+						b.WriteString("<em>")
+						b.WriteString(v[t.start:t.end])
+						b.WriteString("</em>")
+						last = t.end
+						matched = true
+
+						break
+					}
+				}
+			}
+
+			if matched {
+				b.WriteString(v[last:])
+				out[f] = append(out[f], b.String())
+			}
+		}
+	}
+
+	if len(out) == 0 {
+		return nil
+	}
+
+	return out
+}
+
+func (d *embeddedDoc) month(field string) (string, bool) {
+	vals := d.values(field)
+	if len(vals) == 0 {
+		return "", false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, vals[0])
+	if err != nil || t.IsZero() {
+		return "", false
+	}
+
+	return t.UTC().Format("2006-01"), true
+}
+
+type boostedField struct {
+	name  string
+	boost float64
+}
+
+func parseFields(fields []string) []boostedField {
+	out := make([]boostedField, 0, len(fields))
+
+	for _, f := range fields {
+		bf := boostedField{name: f, boost: 1}
+
+		if i := strings.LastIndex(f, "^"); i >= 0 {
+			if boost, err := strconv.ParseFloat(f[i+1:], 64); err == nil {
+				bf.name, bf.boost = f[:i], boost
+			}
+		}
+
+		out = append(out, bf)
+	}
+
+	return out
+}
+
+type token struct {
+	text       string
+	start, end int
+}
+
+// tokenize splits s into lower cased words along with their byte offsets.
+func tokenize(s string) []token {
+	var (
+		out   []token
+		start = -1
+	)
+
+	for i, r := range s {
+		isWord := unicode.IsLetter(r) || unicode.IsNumber(r)
+
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			out = append(out, token{text: strings.ToLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		out = append(out, token{text: strings.ToLower(s[start:]), start: start, end: len(s)})
+	}
+
+	return out
+}
+
+func anyWordMatches(w token, values []string, fuzzy bool) bool {
+	for _, v := range values {
+		for _, t := range tokenize(v) {
+			if wordMatches(w, t.text, fuzzy) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// wordMatches compares the query word w with the indexed word t. Fuzzy
+// matching allows the same number of edits as the AUTO fuzziness of
+// Elasticsearch.
+func wordMatches(w token, t string, fuzzy bool) bool {
+	if w.text == t {
+		return true
+	}
+
+	if !fuzzy {
+		return false
+	}
+
+	var maxEdits int
+
+	switch n := utf8.RuneCountInString(w.text); {
+	case n > 5:
+		maxEdits = 2
+	case n > 2:
+		maxEdits = 1
+	default:
+		return false
+	}
+
+	return editDistance(w.text, t) <= maxEdits
+}
+
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+
+	if c < a {
+		a = c
+	}
+
+	return a
+}
+
+func page(hits []*Hit, from, size int) []*Hit {
+	if size == 0 {
+		size = _defaultSize
+	}
+
+	if from >= len(hits) {
+		return hits[:0]
+	}
+
+	if size < 0 || from+size > len(hits) {
+		return hits[from:]
+	}
+
+	return hits[from : from+size]
+}
+
+func contains(vals []string, val string) bool {
+	for i := range vals {
+		if vals[i] == val {
+			return true
+		}
+	}
+
+	return false
+}
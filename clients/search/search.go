@@ -1,52 +1,126 @@
 package search
 
 import (
-	"fmt"
-	"time"
+	"context"
+	"encoding/json"
+)
 
-	"github.com/olivere/elastic/v7"
+// Client stores JSON documents in named indices and runs full-text queries
+// against them. Fields are matched exactly by filters and, for lists, when
+// any of their elements matches.
+type Client interface {
+	// EnsureIndex creates the index if it does not exist and adds the
+	// fields of the mapping to it.
+	EnsureIndex(ctx context.Context, index string, m Mapping) error
+	// Put creates or replaces the document with the given ID.
+	Put(ctx context.Context, index, id string, doc interface{}) error
+	// PutMulti creates or replaces the given documents in one request.
+	PutMulti(ctx context.Context, index string, docs []*Document) error
+	// Get unmarshals the document with the given ID into dst and reports
+	// whether it exists.
+	Get(ctx context.Context, index, id string, dst interface{}) (bool, error)
+	// GetMulti returns the sources of the documents with the given IDs.
+	// Documents that do not exist are left out.
+	GetMulti(ctx context.Context, index string, ids []string) (map[string]json.RawMessage, error)
+	// Delete removes the document with the given ID. Removing a document
+	// that does not exist is not an error.
+	Delete(ctx context.Context, index, id string) error
+	// UpdateWhere sets the given fields on all of the documents of which
+	// field matches value.
+	UpdateWhere(ctx context.Context, index, field, value string, fields map[string]interface{}) error
+	// DeleteWhere removes all of the documents of which field matches value.
+	DeleteWhere(ctx context.Context, index, field, value string) error
+	Search(ctx context.Context, q *Query) (*Result, error)
+}
 
-	"github.com/hiconvo/api/errors"
-	"github.com/hiconvo/api/log"
+// FieldType is the way in which a field is indexed.
+type FieldType string
+
+const (
+	// TextField is searched by words and matched exactly by filters.
+	TextField FieldType = "text"
+	DateField FieldType = "date"
+	BoolField FieldType = "boolean"
 )
 
-type Client interface {
-	Update() *elastic.UpdateService
-	Delete() *elastic.DeleteService
-	Search(indicies ...string) *elastic.SearchService
-}
-
-func NewClient(hostname string) Client {
-	var (
-		op     = errors.Opf("search.NewClient(hostname=%s)", hostname)
-		client *elastic.Client
-		err    error
-	)
-
-	const (
-		maxAttempts = 5
-		timeout     = 3
-	)
-
-	for i := 1; i <= maxAttempts; i++ {
-		client, err = elastic.NewClient(
-			elastic.SetSniff(false),
-			elastic.SetURL(fmt.Sprintf("http://%s:9200", hostname)),
-		)
-		if err != nil {
-			if i == maxAttempts {
-				panic(errors.E(op, errors.Str("Failed to connect to elasticsearch")))
-			}
-
-			log.Printf("%s: Failed to connect to elasticsearch; attempt %d/%d; will retry in %d seconds\n%s\n",
-				string(op), i, maxAttempts, timeout, err)
-			time.Sleep(timeout * time.Second)
-		} else {
-			log.Printf("%s: Connected to elasticsearch", string(op))
-
-			break
+// Mapping maps the fields of the documents of an index to their types.
+type Mapping map[string]FieldType
+
+// Document is a document to be indexed along with its ID.
+type Document struct {
+	ID   string
+	Body interface{}
+}
+
+// Filter restricts the documents of Indices, or of all indices when it is
+// empty, to those of which Field matches Value.
+type Filter struct {
+	Indices []string
+	Field   string
+	Value   string
+}
+
+func (f *Filter) appliesTo(index string) bool {
+	if len(f.Indices) == 0 {
+		return true
+	}
+
+	for i := range f.Indices {
+		if f.Indices[i] == index {
+			return true
 		}
 	}
 
-	return client
+	return false
+}
+
+// Query is a full-text query. A document matches when any of the words of
+// Text occurs in any of Fields and it passes all of the filters that apply
+// to its index. Fields can be boosted with a suffix, e.g. "name^2".
+type Query struct {
+	Indices []string
+	Text    string
+	Fields  []string
+	// Fuzzy allows words to match with a few typos.
+	Fuzzy   bool
+	Filters []Filter
+	// ResultIndices limits the hits to the given indices without affecting
+	// the counts of the result.
+	ResultIndices []string
+	// Highlight lists the fields for which snippets are returned.
+	Highlight []string
+	// DateFacet is the name of a date field by which matches are counted
+	// per month.
+	DateFacet string
+	From      int
+	Size      int
+}
+
+type Result struct {
+	// Total is the number of hits regardless of From and Size.
+	Total int64
+	Hits  []*Hit
+	// IndexCounts is the number of matches per index before ResultIndices
+	// is applied.
+	IndexCounts map[string]int64
+	// DateCounts is the number of matches per month of DateFacet before
+	// ResultIndices is applied, ordered by month.
+	DateCounts []*DateCount
+}
+
+// Hit is a matching document. Highlights maps field names to snippets in
+// which the matching words are wrapped in <em> tags.
+type Hit struct {
+	Index      string
+	ID         string
+	Score      float64
+	Source     json.RawMessage
+	Highlights map[string][]string
+}
+
+// DateCount is the number of matches in Month, which is formatted as
+// YYYY-MM.
+type DateCount struct {
+	Month string
+	Count int64
 }
@@ -4,8 +4,6 @@ import (
 	"context"
 	"os"
 
-	"cloud.google.com/go/datastore"
-
 	"github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/errors"
 	"github.com/hiconvo/api/log"
@@ -19,14 +17,14 @@ type clientImpl struct {
 	secrets map[string]string
 }
 
-func NewClient(ctx context.Context, db db.Client) Client {
+func NewClient(ctx context.Context, dbClient db.Client) Client {
 	var s []struct {
 		Name  string
 		Value string
 	}
 
-	q := datastore.NewQuery("Secret")
-	if _, err := db.GetAll(ctx, q, &s); err != nil {
+	q := db.NewQuery("Secret")
+	if _, err := dbClient.GetAll(ctx, q, &s); err != nil {
 		panic(errors.E(errors.Op("secrets.NewClient()"), err))
 	}
 
@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	uuid "github.com/gofrs/uuid"
 	"gocloud.dev/blob"
@@ -19,31 +20,58 @@ import (
 	// This sets up the plumbing to use blob with GCS in production.
 	_ "gocloud.dev/blob/gcsblob"
 
+	"github.com/hiconvo/api/clients/fetch"
 	"github.com/hiconvo/api/errors"
 	"github.com/hiconvo/api/log"
 )
 
-const _nullKey string = "null-key"
+const (
+	_nullKey        string = "null-key"
+	_maxAvatarBytes int64  = 10 << 20
+)
 
 type Client struct {
 	avatarBucketName string
 	photoBucketName  string
+	isLocal          bool
+	fetcher          *fetch.Client
+
+	// photoURLTTL is the lifetime of signed photo URLs. When it is zero,
+	// photos are served from their public bucket URLs.
+	photoURLTTL time.Duration
 }
 
-func NewClient(avatarBucketName, photoBucketName string) *Client {
-	if avatarBucketName == "" || photoBucketName == "" {
-		localBucketName := initLocalStorageDir()
+// Option configures optional behavior of the Client.
+type Option func(c *Client)
 
-		return &Client{
-			avatarBucketName: localBucketName,
-			photoBucketName:  localBucketName,
-		}
+// WithPrivatePhotos makes the client treat the photo bucket as private.
+// Photo URLs returned by GetPhotoURLs are signed and expire after ttl.
+func WithPrivatePhotos(ttl time.Duration) Option {
+	return func(c *Client) {
+		c.photoURLTTL = ttl
 	}
+}
 
-	return &Client{
+func NewClient(avatarBucketName, photoBucketName string, opts ...Option) *Client {
+	c := &Client{
 		avatarBucketName: avatarBucketName,
 		photoBucketName:  photoBucketName,
+		fetcher:          fetch.NewClient(fetch.WithMaxBodyBytes(_maxAvatarBytes)),
+	}
+
+	if avatarBucketName == "" || photoBucketName == "" {
+		localBucketName := initLocalStorageDir()
+
+		c.avatarBucketName = localBucketName
+		c.photoBucketName = localBucketName
+		c.isLocal = true
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
 func initLocalStorageDir() string {
@@ -81,15 +109,58 @@ func (c *Client) GetPhotoURLFromKey(key string) string {
 
 // GetSignedPhotoURL returns a signed URL of the given photo key.
 func (c *Client) GetSignedPhotoURL(ctx context.Context, key string) (string, error) {
-	b, err := blob.OpenBucket(ctx, c.photoBucketName)
+	urls, err := c.GetPhotoURLs(ctx, []string{key})
 	if err != nil {
 		return "", errors.E(errors.Op("storage.GetSignedPhotoURL"), err)
 	}
-	defer b.Close()
 
-	return b.SignedURL(ctx, key, &blob.SignedURLOptions{
-		Expiry: blob.DefaultSignedURLExpiry,
-	})
+	return urls[0], nil
+}
+
+// HasPrivatePhotos reports whether photos are served through signed URLs.
+func (c *Client) HasPrivatePhotos() bool {
+	return c.photoURLTTL > 0
+}
+
+// GetPhotoURLs converts the given stored photo keys into URLs that can be
+// handed to clients. If photos are private, the URLs are signed and expire
+// after the configured TTL. The bucket is opened once for the whole batch.
+// Legacy values that are full public URLs are converted back into keys
+// before signing.
+func (c *Client) GetPhotoURLs(ctx context.Context, keys []string) ([]string, error) {
+	op := errors.Op("storage.GetPhotoURLs")
+	urls := make([]string, len(keys))
+
+	// Local buckets cannot sign URLs, so they are always served publicly.
+	if !c.HasPrivatePhotos() || c.isLocal || len(keys) == 0 {
+		for i := range keys {
+			urls[i] = c.GetPhotoURLFromKey(keys[i])
+		}
+
+		return urls, nil
+	}
+
+	bucket, err := blob.OpenBucket(ctx, c.photoBucketName)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	defer bucket.Close()
+
+	opts := &blob.SignedURLOptions{Expiry: c.photoURLTTL}
+
+	for i := range keys {
+		key := keys[i]
+		if strings.Contains(key, "://") {
+			key = c.GetKeyFromPhotoURL(key)
+		}
+
+		urls[i], err = bucket.SignedURL(ctx, key, opts)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+	}
+
+	return urls, nil
 }
 
 // GetKeyFromAvatarURL accepts a url and returns the last segment of the
@@ -123,10 +194,11 @@ func (c *Client) GetKeyFromPhotoURL(url string) string {
 func (c *Client) PutAvatarFromURL(ctx context.Context, uri string) (string, error) {
 	op := errors.Op("storage.PutAvatarFromURL")
 
-	res, err := http.Get(uri)
+	res, err := c.fetcher.Get(ctx, uri, nil, "image/*")
 	if err != nil {
-		return "", err
+		return "", errors.E(op, err)
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
 		return "", errors.E(op, errors.Str("Could not download avatar image"))
@@ -213,7 +285,8 @@ func (c *Client) PutAvatarFromBlob(ctx context.Context, dat string, size, x, y i
 	return c.GetAvatarURLFromKey(key), nil
 }
 
-// PutPhotoFromBlob resizes the given image blob, saves it, and returns full url of the image.
+// PutPhotoFromBlob resizes the given image blob, saves it, and returns the key
+// of the image. Use GetPhotoURLs to convert the key into a URL.
 func (c *Client) PutPhotoFromBlob(ctx context.Context, parentID, dat string) (string, error) {
 	op := errors.Op("storage.PutPhotoFromBlob")
 
@@ -251,7 +324,7 @@ func (c *Client) PutPhotoFromBlob(ctx context.Context, parentID, dat string) (st
 		return "", errors.E(op, err)
 	}
 
-	return c.GetPhotoURLFromKey(key), nil
+	return key, nil
 }
 
 // DeletePhoto deletes the given photo from the photo bucket.
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	dbc "github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/migrate"
+)
+
+const (
+	exitCodeOK = 0
+)
+
+// This command runs the migrations that have not been applied to the
+// database yet. Progress is recorded after every batch, so a migration that
+// is interrupted resumes where it stopped the next time this command runs.
+func main() {
+	var (
+		isDryRun    bool
+		isStatus    bool
+		markApplied string
+		projectID   string
+		sleepTime   int = 3
+		ctx, cancel     = context.WithCancel(context.Background())
+		signalChan      = make(chan os.Signal, 1)
+	)
+
+	flag.BoolVar(&isDryRun, "dry-run", false, "if passed, nothing is mutated.")
+	flag.BoolVar(&isStatus, "status", false, "if passed, the progress of every migration is printed and nothing is run.")
+	flag.StringVar(&markApplied, "mark-applied", "",
+		"comma separated IDs of migrations to record as applied without running them.")
+	flag.StringVar(&projectID, "project-id", "local-convo-api", "overrides the default project ID.")
+	flag.Parse()
+
+	dbClient := dbc.NewClient(ctx, projectID)
+	defer dbClient.Close()
+
+	m := migrate.New(&migrate.Config{DB: dbClient, IsDryRun: isDryRun})
+
+	if isStatus {
+		if err := printStatus(ctx, m); err != nil {
+			log.Panic(err)
+		}
+
+		return
+	}
+
+	log.Printf("About to migrate with db=%s, dry-run=%v", projectID, isDryRun)
+	log.Printf("You have %d seconds to ctl+c if this is incorrect", sleepTime)
+	time.Sleep(time.Duration(sleepTime) * time.Second)
+
+	signal.Notify(signalChan, os.Interrupt)
+	defer signal.Stop(signalChan)
+
+	go func() {
+		<-signalChan // first signal: stop after the current batch
+		log.Print("Ctl+C detected, stopping after the current batch")
+		cancel()
+		<-signalChan // second signal: exit now
+		dbClient.Close()
+		os.Exit(exitCodeOK)
+	}()
+
+	if markApplied != "" {
+		if err := m.MarkApplied(ctx, strings.Split(markApplied, ",")...); err != nil {
+			log.Panic(err)
+		}
+
+		return
+	}
+
+	if err := m.Run(ctx); err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			log.Print("Stopped, run again to resume")
+
+			return
+		}
+
+		log.Panic(err)
+	}
+}
+
+func printStatus(ctx context.Context, m migrate.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		switch {
+		case s.IsApplied():
+			log.Printf("%s: applied at %v", s.Migration.ID, s.AppliedAt)
+		case !s.StartedAt.IsZero():
+			log.Printf("%s: started at %v, %d entities migrated", s.Migration.ID, s.StartedAt, s.Count)
+		default:
+			log.Printf("%s: pending", s.Migration.ID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"time"
+
+	"google.golang.org/api/iterator"
+
+	dbc "github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/clients/search"
+	"github.com/hiconvo/api/db"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/model"
+)
+
+const (
+	exitCodeOK = 0
+)
+
+// This command makes sure that the search indices exist with explicit
+// mappings and that every user and note in the database has an up to date
+// document in the search index. Documents that are missing or stale are
+// reported and, unless this is a dry run, indexed again in bulk.
+func main() {
+	var (
+		isDryRun    bool
+		isForce     bool
+		projectID   string
+		searchHost  string
+		sleepTime   int = 3
+		ctx, cancel     = context.WithCancel(context.Background())
+		signalChan      = make(chan os.Signal, 1)
+	)
+
+	flag.BoolVar(&isDryRun, "dry-run", false, "if passed, nothing is mutated.")
+	flag.BoolVar(&isForce, "force", false, "if passed, all documents are indexed, not only missing or stale ones.")
+	flag.StringVar(&projectID, "project-id", "local-convo-api", "overrides the default project ID.")
+	flag.StringVar(&searchHost, "search-host", "elasticsearch", "overrides the default elasticsearch host.")
+	flag.Parse()
+
+	log.Printf("About to reindex with db=%s, search-host=%s, dry-run=%v, force=%v",
+		projectID, searchHost, isDryRun, isForce)
+	log.Printf("You have %d seconds to ctl+c if this is incorrect", sleepTime)
+	time.Sleep(time.Duration(sleepTime) * time.Second)
+
+	dbClient := dbc.NewClient(ctx, projectID)
+	defer dbClient.Close()
+
+	searchClient, err := search.NewClient(searchHost)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	signal.Notify(signalChan, os.Interrupt)
+	defer signal.Stop(signalChan)
+
+	go func() {
+		<-signalChan // first signal: clean up and exit gracefully
+		log.Print("Ctl+C detected, cleaning up")
+		cancel()
+		dbClient.Close() // close the db conn when ctl+c
+		os.Exit(exitCodeOK)
+	}()
+
+	r := &reindexer{
+		s:         searchClient,
+		isDryRun:  isDryRun,
+		isForce:   isForce,
+		flushSize: 100,
+	}
+
+	if err := run(ctx, dbClient, r); err != nil {
+		log.Panic(err)
+	}
+}
+
+func run(ctx context.Context, dbClient dbc.Client, r *reindexer) error {
+	var (
+		op         = errors.Op("run")
+		userStore  = &db.UserStore{DB: dbClient}
+		noteStore  = &db.NoteStore{DB: dbClient}
+		userReport *report
+		noteReport *report
+		err        error
+	)
+
+	for _, index := range db.SearchIndices() {
+		log.Printf("Mapping-> index=%s", index.Name)
+
+		if r.isDryRun {
+			log.Print("Mapping-> skipping since this is a dry run")
+			continue
+		}
+
+		if err := r.s.EnsureIndex(ctx, index.Name, index.Mapping); err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	users := userStore.IterAll(ctx)
+
+	userReport, err = r.reindex(ctx, db.UsersSearchIndex.Name, func() (*search.Document, error) {
+		for {
+			u := new(model.User)
+			if _, err := users.Next(u); err != nil {
+				return nil, err
+			}
+
+			// Only registered users can be found.
+			if u.IsRegistered() {
+				return &search.Document{ID: u.ID.String(), Body: db.NewUserSearchDoc(u)}, nil
+			}
+		}
+	})
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	notes := noteStore.IterAll(ctx)
+
+	noteReport, err = r.reindex(ctx, db.NotesSearchIndex.Name, func() (*search.Document, error) {
+		n := new(model.Note)
+		if _, err := notes.Next(n); err != nil {
+			return nil, err
+		}
+
+		return &search.Document{ID: n.ID.String(), Body: db.NewNoteSearchDoc(n)}, nil
+	})
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	log.Printf("Done-> users: %s", userReport)
+	log.Printf("Done-> notes: %s", noteReport)
+
+	return nil
+}
+
+type report struct {
+	Checked  int
+	Missing  int
+	Stale    int
+	Repaired int
+}
+
+func (r *report) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+type reindexer struct {
+	s         search.Client
+	isDryRun  bool
+	isForce   bool
+	flushSize int
+}
+
+// reindex compares the documents returned by next with the ones in the index
+// and puts the ones that differ. next returns iterator.Done when there are
+// no more documents.
+func (r *reindexer) reindex(
+	ctx context.Context,
+	index string,
+	next func() (*search.Document, error),
+) (*report, error) {
+	var (
+		op    = errors.Opf("reindex(index=%s)", index)
+		rep   = new(report)
+		queue []*search.Document
+	)
+
+	flush := func() error {
+		log.Printf("Flushing-> index=%s, len(queue)=%d", index, len(queue))
+
+		ids := make([]string, len(queue))
+		for i := range queue {
+			ids[i] = queue[i].ID
+		}
+
+		existing, err := r.s.GetMulti(ctx, index, ids)
+		if err != nil {
+			return err
+		}
+
+		toPut := make([]*search.Document, 0, len(queue))
+
+		for _, doc := range queue {
+			rep.Checked++
+
+			src, ok := existing[doc.ID]
+			if !ok {
+				log.Printf("Missing-> index=%s, id=%s", index, doc.ID)
+				rep.Missing++
+				toPut = append(toPut, doc)
+
+				continue
+			}
+
+			isSame, err := isSameDoc(src, doc.Body)
+			if err != nil {
+				return err
+			}
+
+			if !isSame {
+				log.Printf("Stale-> index=%s, id=%s", index, doc.ID)
+				rep.Stale++
+				toPut = append(toPut, doc)
+			} else if r.isForce {
+				toPut = append(toPut, doc)
+			}
+		}
+
+		queue = queue[:0]
+
+		if r.isDryRun {
+			log.Printf("Flushing-> skipping %d documents since this is a dry run", len(toPut))
+			return nil
+		}
+
+		if err := r.s.PutMulti(ctx, index, toPut); err != nil {
+			return err
+		}
+
+		rep.Repaired += len(toPut)
+
+		return nil
+	}
+
+	for {
+		doc, err := next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			return rep, errors.E(op, err)
+		}
+
+		queue = append(queue, doc)
+
+		if len(queue) >= r.flushSize {
+			if err := flush(); err != nil {
+				return rep, errors.E(op, err)
+			}
+		}
+	}
+
+	if len(queue) > 0 {
+		if err := flush(); err != nil {
+			return rep, errors.E(op, err)
+		}
+	}
+
+	return rep, nil
+}
+
+// isSameDoc compares the indexed source with the JSON representation of doc.
+func isSameDoc(src json.RawMessage, doc interface{}) (bool, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+
+	var want, got interface{}
+
+	if err := json.Unmarshal(b, &want); err != nil {
+		return false, err
+	}
+
+	if err := json.Unmarshal(src, &got); err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(want, got), nil
+}
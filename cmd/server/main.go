@@ -7,12 +7,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/getsentry/raven-go"
 
 	dbc "github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/clients/magic"
 	sender "github.com/hiconvo/api/clients/mail"
+	"github.com/hiconvo/api/clients/mongo"
 	"github.com/hiconvo/api/clients/notification"
 	"github.com/hiconvo/api/clients/oauth"
 	"github.com/hiconvo/api/clients/opengraph"
@@ -24,9 +26,12 @@ import (
 	"github.com/hiconvo/api/db"
 	"github.com/hiconvo/api/errors"
 	"github.com/hiconvo/api/handler"
+	"github.com/hiconvo/api/linkcache"
 	"github.com/hiconvo/api/log"
 	"github.com/hiconvo/api/mail"
+	"github.com/hiconvo/api/outbox"
 	"github.com/hiconvo/api/template"
+	"github.com/hiconvo/api/usercache"
 	"github.com/hiconvo/api/welcome"
 )
 
@@ -34,7 +39,7 @@ func main() {
 	ctx := context.Background()
 	projectID := getenv("GOOGLE_CLOUD_PROJECT", "local-convo-api")
 
-	dbClient := dbc.NewClient(ctx, projectID)
+	dbClient := getDBClient(ctx, projectID)
 	defer dbClient.Close()
 
 	sc := secrets.NewClient(ctx, dbClient)
@@ -46,20 +51,34 @@ func main() {
 		// clients
 		notifClient   = notification.NewClient(sc.Get("STREAM_API_KEY", "streamKey"), sc.Get("STREAM_API_SECRET", "streamSecret"), "us-east")
 		mailClient    = mail.New(sender.NewClient(sc.Get("SENDGRID_API_KEY", "")), template.NewClient())
-		searchClient  = search.NewClient(sc.Get("ELASTICSEARCH_HOST", "elasticsearch"))
-		storageClient = storage.NewClient(sc.Get("AVATAR_BUCKET_NAME", ""), sc.Get("PHOTO_BUCKET_NAME", ""))
+		searchClient  = getSearchClient(sc)
+		storageClient = storage.NewClient(sc.Get("AVATAR_BUCKET_NAME", ""), sc.Get("PHOTO_BUCKET_NAME", ""), getStorageOptions(sc)...)
 		placesClient  = places.NewClient(sc.Get("GOOGLE_MAPS_API_KEY", ""))
 		magicClient   = magic.NewClient(sc.Get("APP_SECRET", ""))
 		queueClient   = queue.NewClient(ctx, projectID)
 		oauthClient   = oauth.NewClient(sc.Get("GOOGLE_OAUTH_KEY", ""))
-		ogClient      = opengraph.NewClient()
+
+		// outbox
+		outboxClient = outbox.New(&outbox.Config{
+			Store:   &db.OutboxStore{DB: dbClient},
+			Notif:   notifClient,
+			Queue:   queueClient,
+			Indexer: &db.SearchIndexer{DB: dbClient, S: searchClient},
+		})
 
 		// stores
-		userStore    = &db.UserStore{DB: dbClient, Notif: notifClient, S: searchClient, Queue: queueClient}
-		threadStore  = &db.ThreadStore{DB: dbClient}
-		eventStore   = &db.EventStore{DB: dbClient}
-		messageStore = &db.MessageStore{DB: dbClient}
-		noteStore    = &db.NoteStore{DB: dbClient, S: searchClient}
+		userStore = usercache.New(&usercache.Config{
+			Store: &db.UserStore{DB: dbClient, Notif: notifClient, S: searchClient, Queue: outboxClient, Outbox: outboxClient},
+		})
+		threadStore  = &db.ThreadStore{DB: dbClient, S: searchClient, Outbox: outboxClient, Storage: storageClient}
+		eventStore   = &db.EventStore{DB: dbClient, Outbox: outboxClient}
+		messageStore = &db.MessageStore{DB: dbClient, Outbox: outboxClient, Storage: storageClient}
+		noteStore    = &db.NoteStore{DB: dbClient, S: searchClient, Outbox: outboxClient}
+		linkStore    = &db.LinkPreviewStore{DB: dbClient}
+		searchStore  = &db.SearchStore{S: searchClient}
+
+		// link previews
+		linkClient = linkcache.New(&linkcache.Config{Store: linkStore, OG: opengraph.NewClient()})
 
 		// welcomer
 		welcomer = welcome.New(ctx, userStore, sc.Get("SUPPORT_PASSWORD", "support"))
@@ -73,16 +92,19 @@ func main() {
 		EventStore:    eventStore,
 		MessageStore:  messageStore,
 		NoteStore:     noteStore,
+		SearchStore:   searchStore,
 		Welcome:       welcomer,
 		TxnMiddleware: dbc.WithTransaction(dbClient),
 		Mail:          mailClient,
 		Magic:         magicClient,
 		OAuth:         oauthClient,
-		OG:            ogClient,
+		OG:            linkClient,
+		Links:         linkClient,
 		Storage:       storageClient,
-		Notif:         notifClient,
+		Notif:         outboxClient,
 		Places:        placesClient,
-		Queue:         queueClient,
+		Queue:         outboxClient,
+		Outbox:        outboxClient,
 	})
 
 	port := getenv("PORT", "8080")
@@ -119,6 +141,55 @@ func main() {
 	<-idleConnsClosed
 }
 
+// getDBClient returns a MongoDB client when DB_BACKEND is "mongo" and a
+// Datastore client otherwise. Unlike other settings, the backend is read from
+// the environment since secrets are stored in the database.
+func getDBClient(ctx context.Context, projectID string) dbc.Client {
+	if getenv("DB_BACKEND", "datastore") == "mongo" {
+		log.Print("Using MongoDB")
+
+		// The client is disconnected when the DB client is closed.
+		client, _ := mongo.NewClient(ctx, getenv("MONGO_CONNECTION", "mongo"))
+
+		return dbc.NewMongoClient(client, getenv("MONGO_DATABASE", "convo"))
+	}
+
+	return dbc.NewClient(ctx, projectID)
+}
+
+// getStorageOptions makes photos private when PRIVATE_PHOTO_URL_TTL is set to
+// a valid duration such as "1h".
+func getStorageOptions(sc secrets.Client) []storage.Option {
+	ttl, err := time.ParseDuration(sc.Get("PRIVATE_PHOTO_URL_TTL", "0s"))
+	if err != nil {
+		log.Alarm(errors.E(errors.Op("getStorageOptions"), err))
+		return nil
+	}
+
+	if ttl <= 0 {
+		return nil
+	}
+
+	return []storage.Option{storage.WithPrivatePhotos(ttl)}
+}
+
+// getSearchClient returns the embedded search index when SEARCH_BACKEND is
+// "embedded" and Elasticsearch otherwise.
+func getSearchClient(sc secrets.Client) search.Client {
+	if sc.Get("SEARCH_BACKEND", "elasticsearch") == "embedded" {
+		log.Print("Using embedded search index")
+		return search.NewEmbeddedClient()
+	}
+
+	client, err := search.NewClient(sc.Get("ELASTICSEARCH_HOST", "elasticsearch"))
+	if err != nil {
+		log.Alarm(err)
+		log.Panicf("getSearchClient: %v", err)
+	}
+
+	return client
+}
+
 func getenv(name, fallback string) string {
 	if val, ok := os.LookupEnv(name); ok {
 		return val
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/model"
+)
+
+// The types of the model know nothing about how they are stored. The types
+// below convert them to and from properties, and are registered with the
+// db clients so that the model types can be passed to them directly.
+
+func init() {
+	db.RegisterEntity((*model.Event)(nil), func(v interface{}) datastore.PropertyLoadSaver {
+		return (*eventEntity)(v.(*model.Event))
+	})
+	db.RegisterEntity((*model.Message)(nil), func(v interface{}) datastore.PropertyLoadSaver {
+		return (*messageEntity)(v.(*model.Message))
+	})
+	db.RegisterEntity((*model.Note)(nil), func(v interface{}) datastore.PropertyLoadSaver {
+		return (*noteEntity)(v.(*model.Note))
+	})
+	db.RegisterEntity((*model.Thread)(nil), func(v interface{}) datastore.PropertyLoadSaver {
+		return (*threadEntity)(v.(*model.Thread))
+	})
+	db.RegisterEntity((*model.User)(nil), func(v interface{}) datastore.PropertyLoadSaver {
+		return (*userEntity)(v.(*model.User))
+	})
+}
+
+type eventEntity model.Event
+
+func (e *eventEntity) LoadKey(k *datastore.Key) error {
+	e.ID = model.ID(k.Encode())
+	e.Int64ID = k.ID
+
+	return nil
+}
+
+func (e *eventEntity) Save() ([]datastore.Property, error) {
+	// Legacy RSVPs were moved to the responses when the event was loaded,
+	// and the next reminder is kept up to date for the reminder scheduler.
+	saved := model.Event(*e)
+	saved.LegacyRSVPIDs = nil
+	saved.NextReminderAt = saved.NextReminder()
+
+	return db.SaveStruct(&saved, "OwnerKey", "HostKeys", "UserKeys", "Responses.UserKey", "Reads.UserKey", "OccurrenceRSVPs.UserKey")
+}
+
+func (e *eventEntity) Load(ps []datastore.Property) error {
+	if err := db.LoadStruct((*model.Event)(e), ps); err != nil {
+		if mismatch, ok := err.(*datastore.ErrFieldMismatch); ok {
+			if mismatch.FieldName != "GuestsCanInvite" {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	(*model.Event)(e).MoveLegacyRSVPs()
+
+	return nil
+}
+
+type messageEntity model.Message
+
+func (m *messageEntity) LoadKey(k *datastore.Key) error {
+	if k != nil {
+		m.ID = model.ID(k.Encode())
+	}
+
+	return nil
+}
+
+func (m *messageEntity) Save() ([]datastore.Property, error) {
+	return db.SaveStruct((*model.Message)(m), "UserKey", "ParentKey", "Reads.UserKey")
+}
+
+func (m *messageEntity) Load(ps []datastore.Property) error {
+	if err := db.LoadStruct((*model.Message)(m), ps); err != nil {
+		return errors.E(errors.Op("message.Load"), err)
+	}
+
+	return nil
+}
+
+type noteEntity model.Note
+
+func (n *noteEntity) LoadKey(k *datastore.Key) error {
+	n.ID = model.ID(k.Encode())
+
+	return nil
+}
+
+func (n *noteEntity) Save() ([]datastore.Property, error) {
+	return db.SaveStruct((*model.Note)(n), "OwnerKey")
+}
+
+func (n *noteEntity) Load(ps []datastore.Property) error {
+	return db.LoadStruct((*model.Note)(n), ps)
+}
+
+type threadEntity model.Thread
+
+func (t *threadEntity) LoadKey(k *datastore.Key) error {
+	t.ID = model.ID(k.Encode())
+	t.Int64ID = k.ID
+
+	return nil
+}
+
+func (t *threadEntity) Save() ([]datastore.Property, error) {
+	return db.SaveStruct((*model.Thread)(t), "OwnerKey", "UserKeys", "Reads.UserKey")
+}
+
+func (t *threadEntity) Load(ps []datastore.Property) error {
+	return db.LoadStruct((*model.Thread)(t), ps)
+}
+
+type userEntity model.User
+
+func (u *userEntity) LoadKey(k *datastore.Key) error {
+	u.ID = model.ID(k.Encode())
+
+	return nil
+}
+
+func (u *userEntity) Save() ([]datastore.Property, error) {
+	return db.SaveStruct((*model.User)(u), "ContactKeys")
+}
+
+func (u *userEntity) Load(ps []datastore.Property) error {
+	if err := db.LoadStruct((*model.User)(u), ps); err != nil {
+		return err
+	}
+
+	u.SendDigest = true
+	u.SendThreads = true
+	u.SendEvents = true
+
+	for _, p := range ps {
+		if p.Name == "SendDigest" {
+			val := p.Value.(bool)
+			u.SendDigest = val
+		}
+
+		if p.Name == "SendThreads" {
+			val := p.Value.(bool)
+			u.SendThreads = val
+		}
+
+		if p.Name == "SendEvents" {
+			val := p.Value.(bool)
+			u.SendEvents = val
+		}
+	}
+
+	(*model.User)(u).DeriveProperties()
+
+	return nil
+}
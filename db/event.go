@@ -8,25 +8,108 @@ import (
 	"cloud.google.com/go/datastore"
 
 	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/clients/search"
 	"github.com/hiconvo/api/errors"
 	"github.com/hiconvo/api/model"
 )
 
+const _eventsIndex = "events"
+
+// EventsSearchIndex holds events. Users can only find the events of which
+// they are a member.
+var EventsSearchIndex = &SearchIndex{
+	Name: _eventsIndex,
+	Mapping: search.Mapping{
+		"id":          search.TextField,
+		"ownerId":     search.TextField,
+		"userIds":     search.TextField,
+		"name":        search.TextField,
+		"description": search.TextField,
+		"address":     search.TextField,
+		"timestamp":   search.DateField,
+		"createdAt":   search.DateField,
+		"updatedAt":   search.DateField,
+	},
+}
+
 var _ model.EventStore = (*EventStore)(nil)
 
 type EventStore struct {
 	DB db.Client
+	// Outbox updates the search index once events have been saved. Indexing
+	// is skipped when it is nil, which is useful for one-off commands.
+	Outbox model.Outbox
+}
+
+func (s *EventStore) GetEventByID(ctx context.Context, id model.ID) (*model.Event, error) {
+	var e model.Event
+
+	key, err := decodeID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.handleGetEvent(ctx, key, e, false)
 }
 
-func (s *EventStore) GetEventByID(ctx context.Context, id string) (*model.Event, error) {
+// GetDeletedEventByID returns the event with the given ID only if it has
+// been deleted, so that it can be restored.
+func (s *EventStore) GetDeletedEventByID(ctx context.Context, id model.ID) (*model.Event, error) {
 	var e model.Event
 
-	key, err := datastore.DecodeKey(id)
+	key, err := decodeID(id)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.handleGetEvent(ctx, key, e)
+	return s.handleGetEvent(ctx, key, e, true)
+}
+
+// GetEventsDeletedBefore returns the unhydrated events that were deleted
+// before the given time.
+func (s *EventStore) GetEventsDeletedBefore(ctx context.Context, t time.Time) ([]*model.Event, error) {
+	var events []*model.Event
+
+	q := db.NewQuery("Event").
+		Filter("DeletedAt >", time.Time{}).
+		Filter("DeletedAt <", t)
+
+	if _, err := s.DB.GetAll(ctx, q, &events); err != nil {
+		return events, errors.E(errors.Op("EventStore.GetEventsDeletedBefore"), err)
+	}
+
+	return events, nil
+}
+
+// GetEventsDeletedAfter returns the unhydrated events that were deleted
+// after the given time.
+func (s *EventStore) GetEventsDeletedAfter(ctx context.Context, t time.Time) ([]*model.Event, error) {
+	var events []*model.Event
+
+	q := db.NewQuery("Event").
+		Filter("DeletedAt >", t)
+
+	if _, err := s.DB.GetAll(ctx, q, &events); err != nil {
+		return events, errors.E(errors.Op("EventStore.GetEventsDeletedAfter"), err)
+	}
+
+	return events, nil
+}
+
+// GetEventsWithRemindersDue returns the events that have reminders that are
+// due at t. They are not hydrated.
+func (s *EventStore) GetEventsWithRemindersDue(ctx context.Context, t time.Time) ([]*model.Event, error) {
+	var events []*model.Event
+
+	q := db.NewQuery("Event").
+		Filter("NextReminderAt >", time.Time{}).
+		Filter("NextReminderAt <=", t)
+
+	if _, err := s.DB.GetAll(ctx, q, &events); err != nil {
+		return events, errors.E(errors.Op("EventStore.GetEventsWithRemindersDue"), err)
+	}
+
+	return events, nil
 }
 
 func (s *EventStore) GetUnhydratedEventsByUser(
@@ -36,13 +119,19 @@ func (s *EventStore) GetUnhydratedEventsByUser(
 ) ([]*model.Event, error) {
 	var events []*model.Event
 
-	q := datastore.NewQuery("Event").
-		Filter("UserKeys =", u.Key).
+	key, err := decodeID(u.ID)
+	if err != nil {
+		return events, err
+	}
+
+	q := db.NewQuery("Event").
+		Filter("UserKeys =", key).
+		Filter("DeletedAt =", time.Time{}).
 		Order("-CreatedAt").
 		Offset(p.Offset()).
 		Limit(p.Limit())
 
-	_, err := s.DB.GetAll(ctx, q, &events)
+	_, err = s.DB.GetAll(ctx, q, &events)
 	if err != nil {
 		return events, err
 	}
@@ -61,170 +150,319 @@ func (s *EventStore) GetEventsByUser(
 		return events, err
 	}
 
-	// Now that we have the events, we need to get the users. We keep track of
-	// where the users of one event start and another begin by incrementing
-	// an index.
-	var (
-		uKeys []*datastore.Key
-		idxs  []int
-	)
+	if err := s.hydrate(ctx, events); err != nil {
+		return events, err
+	}
 
-	for _, e := range events {
-		uKeys = append(uKeys, e.UserKeys...)
-		idxs = append(idxs, len(e.UserKeys))
+	return events, nil
+}
+
+func (s *EventStore) Commit(ctx context.Context, e *model.Event) error {
+	op := errors.Op("EventStore.Commit")
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
 	}
 
-	// We get all of the users in one go.
-	userPtrs := make([]*model.User, len(uKeys))
-	if err := s.DB.GetMulti(ctx, uKeys, userPtrs); err != nil {
-		return events, err
+	e.UpdatedAt = time.Now()
+
+	key, err := keyOf("Event", e.ID)
+	if err != nil {
+		return errors.E(op, err)
 	}
 
-	// We add the just retrieved user objects to their corresponding events by
-	// iterating through all of the events and assigning their users according
-	// to the index which we created above.
-	//
-	// We also create a new slice of pointers to events which we'll finally
-	// return.
-	start := 0
-	eventPtrs := make([]*model.Event, len(events))
+	key, err = putVersioned(ctx, s.DB, op, key, e, &e.Version)
+	if err != nil {
+		return errors.E(op, err)
+	}
 
-	for i := range events {
-		eventUsers := userPtrs[start : start+idxs[i]]
+	(*eventEntity)(e).LoadKey(key)
 
-		var (
-			eventRSVPs = make([]*model.User, 0)
-			eventHosts = make([]*model.User, 0)
-			owner      *model.User
-		)
+	updateSearchIndex(db.WithoutTransaction(ctx), s.Outbox, e.ID)
 
-		for j := range eventUsers {
-			if events[i].HasRSVP(eventUsers[j]) {
-				eventRSVPs = append(eventRSVPs, eventUsers[j])
-			}
+	return nil
+}
 
-			if events[i].OwnerIs(eventUsers[j]) {
-				owner = eventUsers[j]
-			}
+// CommitMulti saves events without checking their versions, so it must
+// only be used where nothing else changes the events concurrently, as in
+// migrations.
+func (s *EventStore) CommitMulti(ctx context.Context, events []*model.Event) error {
+	op := errors.Op("EventStore.CommitMulti")
 
-			if events[i].HostIs(eventUsers[j]) {
-				eventHosts = append(eventHosts, eventUsers[j])
-			}
-		}
+	keys, err := eventKeys(events)
+	if err != nil {
+		return errors.E(op, err)
+	}
 
-		events[i].Owner = model.MapUserToUserPartial(owner)
-		events[i].UserPartials = model.MapUsersToUserPartials(eventUsers)
-		events[i].Users = eventUsers
-		events[i].RSVPs = model.MapUsersToUserPartials(eventRSVPs)
-		events[i].HostPartials = model.MapUsersToUserPartials(eventHosts)
-		events[i].UserReads = model.MapReadsToUserPartials(events[i], eventUsers)
+	for i := range events {
+		events[i].Version++
+	}
 
-		start += idxs[i]
-		eventPtrs[i] = events[i]
+	if _, err := s.DB.PutMulti(ctx, keys, events); err != nil {
+		return errors.E(op, err)
 	}
 
-	return eventPtrs, nil
+	return nil
 }
 
-func (s *EventStore) Commit(ctx context.Context, e *model.Event) error {
+// CommitMultiWithTransaction saves events that have already been saved
+// before in tx. Their versions are incremented but not checked.
+func (s *EventStore) CommitMultiWithTransaction(tx db.Transaction, events []*model.Event) error {
+	keys, err := eventKeys(events)
+	if err != nil {
+		return err
+	}
+
+	for i := range events {
+		events[i].Version++
+	}
+
+	_, err = tx.PutMulti(keys, events)
+
+	return err
+}
+
+func (s *EventStore) CommitWithTransaction(tx db.Transaction, e *model.Event) error {
 	if e.CreatedAt.IsZero() {
 		e.CreatedAt = time.Now()
 	}
 
 	e.UpdatedAt = time.Now()
 
-	key, err := s.DB.Put(ctx, e.Key, e)
+	key, err := keyOf("Event", e.ID)
 	if err != nil {
 		return err
 	}
 
-	e.ID = key.Encode()
-	e.Key = key
+	if err := putVersionedWithTransaction(tx, errors.Op("EventStore.CommitWithTransaction"), key, e, &e.Version); err != nil {
+		return err
+	}
+
+	// Events whose IDs were allocated ahead of time know their keys already.
+	if !key.Incomplete() {
+		(*eventEntity)(e).LoadKey(key)
+	}
+
+	return updateSearchIndexWithTransaction(tx, s.Outbox, e.ID)
+}
+
+// Delete marks the event as deleted, which hides it along with its messages
+// until it is restored or purged.
+func (s *EventStore) Delete(ctx context.Context, e *model.Event) error {
+	e.DeletedAt = time.Now()
+
+	if err := s.Commit(ctx, e); err != nil {
+		e.DeletedAt = time.Time{}
+		return errors.E(errors.Op("EventStore.Delete"), err)
+	}
 
 	return nil
 }
 
-func (s *EventStore) CommitMulti(ctx context.Context, events []*model.Event) error {
-	keys := make([]*datastore.Key, len(events))
-	for i := range events {
-		keys[i] = events[i].Key
+// Restore undoes the deletion of the event as long as its restore window
+// has not passed.
+func (s *EventStore) Restore(ctx context.Context, e *model.Event) error {
+	op := errors.Op("EventStore.Restore")
+
+	if !model.IsRestorable(e.DeletedAt) {
+		return model.ErrNotRestorable(op)
 	}
 
-	if _, err := s.DB.PutMulti(ctx, keys, events); err != nil {
-		return errors.E(errors.Op("EventStore.CommitMulti"), err)
+	// Restoring the event would not undo what its guests were told.
+	if e.IsCancelledSinceDeleted() {
+		return errors.E(op,
+			errors.Str("cancelled since deleted"),
+			map[string]string{"message": "Guests were already told that this event was cancelled"},
+			http.StatusBadRequest)
+	}
+
+	deletedAt, message := e.DeletedAt, e.CancelMessage
+	e.DeletedAt, e.CancelMessage = time.Time{}, ""
+
+	if err := s.Commit(ctx, e); err != nil {
+		e.DeletedAt, e.CancelMessage = deletedAt, message
+		return errors.E(op, err)
 	}
 
 	return nil
 }
 
-func (s *EventStore) CommitWithTransaction(
-	tx db.Transaction,
-	e *model.Event,
-) (*datastore.PendingKey, error) {
-	if e.CreatedAt.IsZero() {
-		e.CreatedAt = time.Now()
+// Purge permanently deletes the event and all of its messages.
+func (s *EventStore) Purge(ctx context.Context, e *model.Event) error {
+	op := errors.Opf("EventStore.Purge(id=%s)", e.ID)
+
+	key, err := decodeID(e.ID)
+	if err != nil {
+		return errors.E(op, err)
 	}
 
-	e.UpdatedAt = time.Now()
+	if err := purgeMessages(ctx, s.DB, s.Outbox, key); err != nil {
+		return errors.E(op, err)
+	}
 
-	return tx.Put(e.Key, e)
+	if err := s.DB.Delete(ctx, key); err != nil {
+		return errors.E(op, err)
+	}
+
+	updateSearchIndex(ctx, s.Outbox, e.ID)
+
+	return nil
 }
 
-func (s *EventStore) Delete(ctx context.Context, e *model.Event) error {
-	if err := s.DB.Delete(ctx, e.Key); err != nil {
-		return err
+// AllocateID reserves an ID for an event that is yet to be saved.
+func (s *EventStore) AllocateID(ctx context.Context) (model.ID, error) {
+	keys, err := s.DB.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey("Event", nil)})
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	return model.ID(keys[0].Encode()), nil
 }
 
+// handleGetEvent loads and hydrates the event with the given key. Events
+// that have been deleted are only found when isDeleted is true, and the
+// others only when it is false.
 func (s *EventStore) handleGetEvent(
 	ctx context.Context,
 	key *datastore.Key,
 	e model.Event,
+	isDeleted bool,
 ) (*model.Event, error) {
+	op := errors.Op("models.handleGetEvent")
+
 	if err := s.DB.Get(ctx, key, &e); err != nil {
 		if errors.Is(err, datastore.ErrNoSuchEntity) {
-			return nil, errors.E(errors.Op("models.handleGetEvent"), http.StatusNotFound, err)
+			return nil, errors.E(op, http.StatusNotFound, err)
 		}
 
 		return nil, err
 	}
 
-	users := make([]model.User, len(e.UserKeys))
-	if err := s.DB.GetMulti(ctx, e.UserKeys, users); err != nil {
+	if e.DeletedAt.IsZero() == isDeleted {
+		return nil, errors.E(op, http.StatusNotFound, datastore.ErrNoSuchEntity)
+	}
+
+	if err := s.hydrate(ctx, []*model.Event{&e}); err != nil {
 		return nil, err
 	}
 
-	var (
-		userPointers = make([]*model.User, len(users))
-		rsvpPointers = make([]*model.User, 0)
-		hostPointers = make([]*model.User, 0)
-		owner        model.User
-	)
+	return &e, nil
+}
 
-	for i := range users {
-		userPointers[i] = &users[i]
+// hydrate adds the users of all of the given events, which are loaded at
+// once so that listing events takes the same number of round trips no
+// matter how many events there are.
+func (s *EventStore) hydrate(ctx context.Context, events []*model.Event) error {
+	userIDs := make([][]model.ID, len(events))
+	for i := range events {
+		userIDs[i] = events[i].UserIDs
+	}
 
-		if e.OwnerKey.Equal(users[i].Key) {
-			owner = users[i]
-		}
+	users, err := getUsers(ctx, s.DB, userIDs)
+	if err != nil {
+		return err
+	}
+
+	for i, e := range events {
+		var (
+			hosts = make([]*model.User, 0)
+			owner model.User
+		)
 
-		if e.HasRSVP(userPointers[i]) {
-			rsvpPointers = append(rsvpPointers, userPointers[i])
+		for _, u := range users[i] {
+			if e.OwnerIs(u) {
+				owner = *u
+			}
+
+			if e.HostIs(u) {
+				hosts = append(hosts, u)
+			}
 		}
 
-		if e.HostIs(userPointers[i]) {
-			hostPointers = append(hostPointers, userPointers[i])
+		e.UserPartials = model.MapUsersToUserPartials(users[i])
+		e.Users = users[i]
+		e.Owner = model.MapUserToUserPartial(&owner)
+		e.HostPartials = model.MapUsersToUserPartials(hosts)
+		e.SetRSVPUsers(users[i])
+		e.UserReads = model.MapReadsToUserPartials(e, users[i])
+		e.SetUpcomingOccurrences()
+	}
+
+	return nil
+}
+
+// eventDoc is the representation of an event in the search index. UserIDs
+// holds the members, hosts and owner of the event, all of whom can find it.
+type eventDoc struct {
+	ID          string    `json:"id"`
+	OwnerID     string    `json:"ownerId"`
+	UserIDs     []string  `json:"userIds"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Address     string    `json:"address"`
+	Timestamp   time.Time `json:"timestamp"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+func newEventDoc(e *model.Event) *eventDoc {
+	ids := make([]model.ID, 0, len(e.UserIDs)+len(e.HostIDs)+1)
+	ids = append(ids, e.OwnerID)
+	ids = append(ids, e.HostIDs...)
+	ids = append(ids, e.UserIDs...)
+
+	seen := make(map[string]struct{}, len(ids))
+	userIDs := make([]string, 0, len(ids))
+
+	for _, id := range model.IDStrings(ids) {
+		if _, ok := seen[id]; ok {
+			continue
 		}
+
+		seen[id] = struct{}{}
+		userIDs = append(userIDs, id)
 	}
 
-	e.UserPartials = model.MapUsersToUserPartials(userPointers)
-	e.Users = userPointers
-	e.Owner = model.MapUserToUserPartial(&owner)
-	e.HostPartials = model.MapUsersToUserPartials(hostPointers)
-	e.RSVPs = model.MapUsersToUserPartials(rsvpPointers)
-	e.UserReads = model.MapReadsToUserPartials(&e, userPointers)
+	return &eventDoc{
+		ID:          e.ID.String(),
+		OwnerID:     e.OwnerID.String(),
+		UserIDs:     userIDs,
+		Name:        e.Name,
+		Description: e.Description,
+		Address:     e.Address,
+		Timestamp:   e.Timestamp,
+		CreatedAt:   e.CreatedAt,
+		UpdatedAt:   e.UpdatedAt,
+	}
+}
 
-	return &e, nil
+func (i *SearchIndexer) indexEvent(ctx context.Context, key *datastore.Key) error {
+	e := new(model.Event)
+
+	found, err := i.get(ctx, key, e)
+	if err != nil {
+		return err
+	}
+
+	if !found || !e.DeletedAt.IsZero() {
+		return i.S.Delete(ctx, _eventsIndex, key.Encode())
+	}
+
+	doc := newEventDoc(e)
+
+	return i.S.Put(ctx, _eventsIndex, doc.ID, doc)
+}
+
+func eventKeys(events []*model.Event) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(events))
+	for i := range events {
+		key, err := decodeID(events[i].ID)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[i] = key
+	}
+
+	return keys, nil
 }
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/model"
+)
+
+// getUsers loads the users of a batch of entities, whose user IDs are given
+// by ids, with a single call to GetMulti. Users that belong to several of the
+// entities are only loaded once and shared between them. The users of the
+// entity at ids[i] are returned at [i], in the same order as its IDs.
+func getUsers(ctx context.Context, c db.Client, ids [][]model.ID) ([][]*model.User, error) {
+	var (
+		keys []*datastore.Key
+		idxs = make(map[model.ID]int)
+	)
+
+	for i := range ids {
+		for _, id := range ids[i] {
+			if _, ok := idxs[id]; ok {
+				continue
+			}
+
+			key, err := decodeID(id)
+			if err != nil {
+				return nil, err
+			}
+
+			idxs[id] = len(keys)
+			keys = append(keys, key)
+		}
+	}
+
+	users := make([]*model.User, len(keys))
+	if len(keys) > 0 {
+		if err := c.GetMulti(ctx, keys, users); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([][]*model.User, len(ids))
+	for i := range ids {
+		out[i] = make([]*model.User, len(ids[i]))
+
+		for j, id := range ids[i] {
+			out[i][j] = users[idxs[id]]
+		}
+	}
+
+	return out, nil
+}
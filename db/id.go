@@ -0,0 +1,42 @@
+package db
+
+import (
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/model"
+)
+
+// The stores key entities with datastore keys on every backend, and the ID
+// of an entity is its encoded key. The helpers below convert between the
+// two so that the model never has to deal with keys.
+
+// keyOf returns the key of the entity of the given kind with the given ID.
+// Entities that have not been saved yet have no ID and get an incomplete
+// key.
+func keyOf(kind string, id model.ID) (*datastore.Key, error) {
+	if id.IsZero() {
+		return datastore.IncompleteKey(kind, nil), nil
+	}
+
+	return decodeID(id)
+}
+
+// decodeID returns the key that id is the encoding of.
+func decodeID(id model.ID) (*datastore.Key, error) {
+	return datastore.DecodeKey(id.String())
+}
+
+// decodeIDs returns the keys that ids are the encodings of.
+func decodeIDs(ids []model.ID) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i := range ids {
+		key, err := decodeID(ids[i])
+		if err != nil {
+			return nil, err
+		}
+
+		keys[i] = key
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/model"
+)
+
+var _ model.LinkPreviewStore = (*LinkPreviewStore)(nil)
+
+type LinkPreviewStore struct {
+	DB db.Client
+}
+
+func (s *LinkPreviewStore) GetLinkPreviewByURL(
+	ctx context.Context,
+	url string,
+) (*model.LinkPreview, bool, error) {
+	p := new(model.LinkPreview)
+
+	// Previews are shared by everyone, so they are never read as part of the
+	// transaction of a request.
+	if err := s.DB.Get(db.WithoutTransaction(ctx), linkPreviewKey(url), p); err != nil {
+		if errors.Is(err, datastore.ErrNoSuchEntity) {
+			return nil, false, nil
+		}
+
+		return nil, false, errors.E(errors.Opf("LinkPreviewStore.GetLinkPreviewByURL(%s)", url), err)
+	}
+
+	return p, true, nil
+}
+
+func (s *LinkPreviewStore) GetExpiredLinkPreviews(
+	ctx context.Context,
+	before time.Time,
+	limit int,
+) ([]*model.LinkPreview, error) {
+	var previews []*model.LinkPreview
+
+	q := db.NewQuery("LinkPreview").
+		Filter("ExpiresAt <", before).
+		Order("ExpiresAt").
+		Limit(limit)
+
+	if _, err := s.DB.GetAll(ctx, q, &previews); err != nil {
+		return nil, errors.E(errors.Op("LinkPreviewStore.GetExpiredLinkPreviews"), err)
+	}
+
+	return previews, nil
+}
+
+func (s *LinkPreviewStore) Commit(ctx context.Context, p *model.LinkPreview) error {
+	if _, err := s.DB.Put(ctx, linkPreviewKey(p.URL), p); err != nil {
+		return errors.E(errors.Op("LinkPreviewStore.Commit"), err)
+	}
+
+	return nil
+}
+
+func (s *LinkPreviewStore) Delete(ctx context.Context, p *model.LinkPreview) error {
+	if err := s.DB.Delete(ctx, linkPreviewKey(p.URL)); err != nil {
+		return errors.E(errors.Op("LinkPreviewStore.Delete"), err)
+	}
+
+	return nil
+}
+
+// linkPreviewKey hashes the URL since key names are limited in length.
+func linkPreviewKey(url string) *datastore.Key {
+	sum := sha256.Sum256([]byte(url))
+	return datastore.NameKey("LinkPreview", hex.EncodeToString(sum[:]), nil)
+}
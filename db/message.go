@@ -3,10 +3,13 @@ package db
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"cloud.google.com/go/datastore"
 
 	"github.com/hiconvo/api/clients/db"
+	og "github.com/hiconvo/api/clients/opengraph"
+	"github.com/hiconvo/api/clients/storage"
 	"github.com/hiconvo/api/errors"
 	"github.com/hiconvo/api/model"
 )
@@ -22,15 +25,51 @@ var _ model.MessageStore = (*MessageStore)(nil)
 
 type MessageStore struct {
 	DB db.Client
+	// Outbox updates the search index once messages have been saved.
+	// Indexing is skipped when it is nil, which is useful for one-off
+	// commands.
+	Outbox model.Outbox
+	// Storage converts photo keys into URLs. Photos are left unhydrated
+	// when it is nil, which is useful for one-off commands.
+	Storage *storage.Client
 }
 
-func (s *MessageStore) GetMessageByID(ctx context.Context, id string) (*model.Message, error) {
+func (s *MessageStore) GetMessageByID(ctx context.Context, id model.ID) (*model.Message, error) {
+	return s.handleGetMessage(ctx, id, false)
+}
+
+// GetDeletedMessageByID returns the message with the given ID only if it
+// has been deleted, so that it can be restored.
+func (s *MessageStore) GetDeletedMessageByID(ctx context.Context, id model.ID) (*model.Message, error) {
+	return s.handleGetMessage(ctx, id, true)
+}
+
+// GetMessagesDeletedBefore returns the messages that were deleted before
+// the given time.
+func (s *MessageStore) GetMessagesDeletedBefore(ctx context.Context, t time.Time) ([]*model.Message, error) {
+	var messages []*model.Message
+
+	q := db.NewQuery("Message").
+		Filter("DeletedAt >", time.Time{}).
+		Filter("DeletedAt <", t)
+
+	if _, err := s.DB.GetAll(ctx, q, &messages); err != nil {
+		return messages, errors.E(errors.Op("MessageStore.GetMessagesDeletedBefore"), err)
+	}
+
+	return messages, nil
+}
+
+// handleGetMessage loads the message with the given ID. Messages that have
+// been deleted are only found when isDeleted is true, and the others only
+// when it is false.
+func (s *MessageStore) handleGetMessage(ctx context.Context, id model.ID, isDeleted bool) (*model.Message, error) {
 	var (
 		op      = errors.Opf("models.GetMessageByID(id=%q)", id)
 		message = new(model.Message)
 	)
 
-	key, err := datastore.DecodeKey(id)
+	key, err := decodeID(id)
 	if err != nil {
 		return message, errors.E(op, err)
 	}
@@ -44,25 +83,39 @@ func (s *MessageStore) GetMessageByID(ctx context.Context, id string) (*model.Me
 		return message, errors.E(op, err)
 	}
 
+	if message.DeletedAt.IsZero() == isDeleted {
+		return nil, errors.E(op, datastore.ErrNoSuchEntity, http.StatusNotFound)
+	}
+
+	if err := s.hydratePhotos(ctx, []*model.Message{message}); err != nil {
+		return message, errors.E(op, err)
+	}
+
 	return message, nil
 }
 
-func (s *MessageStore) GetMessagesByKey(
+func (s *MessageStore) GetMessagesByParent(
 	ctx context.Context,
-	k *datastore.Key,
+	parentID model.ID,
 	p *model.Pagination,
 	opts ...model.GetMessagesOption,
 ) ([]*model.Message, error) {
-	op := errors.Opf("MessageStore.GetMessagesByKey(key=%d)", k.ID)
+	op := errors.Opf("MessageStore.GetMessagesByParent(parentID=%s)", parentID)
 	messages := make([]*model.Message, 0)
 
+	k, err := decodeID(parentID)
+	if err != nil {
+		return messages, errors.E(op, err)
+	}
+
 	m := map[string]interface{}{}
 	for _, opt := range opts {
 		opt(m)
 	}
 
-	q := datastore.NewQuery("Message").
+	q := db.NewQuery("Message").
 		Filter("ParentKey =", k).
+		Filter("DeletedAt =", time.Time{}).
 		Offset(p.Offset()).
 		Limit(p.Limit())
 
@@ -80,18 +133,24 @@ func (s *MessageStore) GetMessagesByKey(
 		return messages, errors.E(op, err)
 	}
 
-	userKeys := make([]*datastore.Key, len(messages))
+	// Most messages are written by the same few users, who are only loaded
+	// once.
+	userIDs := make([][]model.ID, len(messages))
 	for i := range messages {
-		userKeys[i] = messages[i].UserKey
+		userIDs[i] = []model.ID{messages[i].UserID}
 	}
 
-	users := make([]*model.User, len(userKeys))
-	if err := s.DB.GetMulti(ctx, userKeys, users); err != nil {
+	users, err := getUsers(ctx, s.DB, userIDs)
+	if err != nil {
 		return messages, errors.E(op, err)
 	}
 
 	for i := range messages {
-		messages[i].User = model.MapUserToUserPartial(users[i])
+		messages[i].User = model.MapUserToUserPartial(users[i][0])
+	}
+
+	if err := s.hydratePhotos(ctx, messages); err != nil {
+		return messages, errors.E(op, err)
 	}
 
 	return messages, nil
@@ -103,7 +162,7 @@ func (s *MessageStore) GetMessagesByThread(
 	p *model.Pagination,
 	ops ...model.GetMessagesOption,
 ) ([]*model.Message, error) {
-	return s.GetMessagesByKey(ctx, t.Key, p)
+	return s.GetMessagesByParent(ctx, t.ID, p)
 }
 
 func (s *MessageStore) GetMessagesByEvent(
@@ -112,9 +171,11 @@ func (s *MessageStore) GetMessagesByEvent(
 	p *model.Pagination,
 	ops ...model.GetMessagesOption,
 ) ([]*model.Message, error) {
-	return s.GetMessagesByKey(ctx, e.Key, p)
+	return s.GetMessagesByParent(ctx, e.ID, p)
 }
 
+// GetUnhydratedMessagesByUser returns all of the messages of u, including
+// the deleted ones so that they are kept up to date until they are purged.
 func (s *MessageStore) GetUnhydratedMessagesByUser(
 	ctx context.Context,
 	u *model.User,
@@ -123,7 +184,12 @@ func (s *MessageStore) GetUnhydratedMessagesByUser(
 ) ([]*model.Message, error) {
 	var messages []*model.Message
 
-	q := datastore.NewQuery("Message").Filter("UserKey =", u.Key)
+	key, err := decodeID(u.ID)
+	if err != nil {
+		return messages, err
+	}
+
+	q := db.NewQuery("Message").Filter("UserKey =", key)
 	if _, err := s.DB.GetAll(ctx, q, &messages); err != nil {
 		return messages, err
 	}
@@ -132,39 +198,285 @@ func (s *MessageStore) GetUnhydratedMessagesByUser(
 }
 
 func (s *MessageStore) Commit(ctx context.Context, m *model.Message) error {
-	key, err := s.DB.Put(ctx, m.Key, m)
+	key, err := keyOf("Message", m.ID)
 	if err != nil {
 		return err
 	}
 
-	m.ID = key.Encode()
-	m.Key = key
+	key, err = s.DB.Put(ctx, key, m)
+	if err != nil {
+		return err
+	}
+
+	(*messageEntity)(m).LoadKey(key)
+
+	updateSearchIndex(db.WithoutTransaction(ctx), s.Outbox, m.ID)
 
 	return nil
 }
 
 func (s *MessageStore) CommitMulti(ctx context.Context, messages []*model.Message) error {
-	keys := make([]*datastore.Key, len(messages))
-	for i := range messages {
-		keys[i] = messages[i].Key
+	op := errors.Op("MessageStore.CommitMulti")
+
+	keys, err := messageKeys(messages)
+	if err != nil {
+		return errors.E(op, err)
 	}
 
-	_, err := s.DB.PutMulti(ctx, keys, messages)
+	_, err = s.DB.PutMulti(ctx, keys, messages)
 	if err != nil {
-		return errors.E(errors.Op("MessageStore.CommitMulti"), err)
+		return errors.E(op, err)
 	}
 
 	return nil
 }
 
+// CommitMultiWithTransaction saves messages that have already been saved
+// before in tx.
+func (s *MessageStore) CommitMultiWithTransaction(tx db.Transaction, messages []*model.Message) error {
+	keys, err := messageKeys(messages)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.PutMulti(keys, messages)
+
+	return err
+}
+
+// Delete marks the message as deleted, which hides it until it is restored
+// or purged. The message is saved in the transaction of ctx if it has one.
 func (s *MessageStore) Delete(ctx context.Context, m *model.Message) error {
-	if err := s.DB.Delete(ctx, m.Key); err != nil {
+	m.DeletedAt = time.Now()
+
+	if err := s.save(ctx, m); err != nil {
+		m.DeletedAt = time.Time{}
+		return errors.E(errors.Op("MessageStore.Delete"), err)
+	}
+
+	return nil
+}
+
+// Restore undoes the deletion of the message as long as its restore window
+// has not passed. The message is saved in the transaction of ctx if it has
+// one.
+func (s *MessageStore) Restore(ctx context.Context, m *model.Message) error {
+	op := errors.Op("MessageStore.Restore")
+
+	if !model.IsRestorable(m.DeletedAt) {
+		return model.ErrNotRestorable(op)
+	}
+
+	deletedAt := m.DeletedAt
+	m.DeletedAt = time.Time{}
+
+	if err := s.save(ctx, m); err != nil {
+		m.DeletedAt = deletedAt
+		return errors.E(op, err)
+	}
+
+	return nil
+}
+
+// save saves a message that has already been saved before, in the
+// transaction of ctx if it has one so that the change is committed along
+// with the others that are made in it.
+func (s *MessageStore) save(ctx context.Context, m *model.Message) error {
+	tx, ok := db.TransactionFromContext(ctx)
+	if !ok {
+		return s.Commit(ctx, m)
+	}
+
+	key, err := decodeID(m.ID)
+	if err != nil {
 		return err
 	}
 
+	if _, err := tx.Put(key, m); err != nil {
+		return err
+	}
+
+	return updateSearchIndexWithTransaction(tx, s.Outbox, m.ID)
+}
+
+// Purge permanently deletes the message.
+func (s *MessageStore) Purge(ctx context.Context, m *model.Message) error {
+	op := errors.Opf("MessageStore.Purge(id=%s)", m.ID)
+
+	key, err := decodeID(m.ID)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := s.DB.Delete(ctx, key); err != nil {
+		return errors.E(op, err)
+	}
+
+	updateSearchIndex(ctx, s.Outbox, m.ID)
+
 	return nil
 }
 
+// messageKeysByParent returns the keys of all of the messages of the thread
+// or event with the given key, including the deleted ones.
+func messageKeysByParent(ctx context.Context, c db.Client, parentKey *datastore.Key) ([]*datastore.Key, error) {
+	return c.GetAll(ctx, db.NewQuery("Message").Filter("ParentKey =", parentKey).KeysOnly(), nil)
+}
+
+// updateMessagesSearchIndex schedules the search documents of all of the
+// messages of the thread with the given ID to be updated.
+func updateMessagesSearchIndex(ctx context.Context, c db.Client, o model.Outbox, threadID model.ID) error {
+	if o == nil {
+		return nil
+	}
+
+	key, err := decodeID(threadID)
+	if err != nil {
+		return err
+	}
+
+	keys, err := messageKeysByParent(ctx, c, key)
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		updateSearchIndex(ctx, o, model.ID(keys[i].Encode()))
+	}
+
+	return nil
+}
+
+// purgeMessages permanently deletes all of the messages of the thread or
+// event with the given key.
+func purgeMessages(ctx context.Context, c db.Client, o model.Outbox, parentKey *datastore.Key) error {
+	keys, err := messageKeysByParent(ctx, c, parentKey)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	if err := c.DeleteMulti(ctx, keys); err != nil {
+		return err
+	}
+
+	for i := range keys {
+		updateSearchIndex(ctx, o, model.ID(keys[i].Encode()))
+	}
+
+	return nil
+}
+
+// hydratePhotos converts the stored photo keys of all of the given messages
+// into URLs with a single call to the storage client.
+func (s *MessageStore) hydratePhotos(ctx context.Context, messages []*model.Message) error {
+	var keys []string
+	for i := range messages {
+		keys = append(keys, messages[i].PhotoKeys...)
+	}
+
+	if len(keys) == 0 || s.Storage == nil {
+		return nil
+	}
+
+	urls, err := s.Storage.GetPhotoURLs(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	start := 0
+	for i := range messages {
+		if n := len(messages[i].PhotoKeys); n > 0 {
+			messages[i].Photos = urls[start : start+n]
+			start += n
+		}
+	}
+
+	return nil
+}
+
+// messageDoc is the representation of a message in the search index. The
+// subject and participants of the parent thread are copied onto it so that
+// the same access rules apply to threads and their messages.
+type messageDoc struct {
+	ID        string    `json:"id"`
+	ThreadID  string    `json:"threadId"`
+	UserID    string    `json:"userId"`
+	UserIDs   []string  `json:"userIds"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	Links     []string  `json:"links"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// indexMessage puts the message into the search index. Only messages of
+// threads that have not been deleted are indexed.
+func (i *SearchIndexer) indexMessage(ctx context.Context, key *datastore.Key) error {
+	m := new(model.Message)
+
+	found, err := i.get(ctx, key, m)
+	if err != nil {
+		return err
+	}
+
+	if !found || !m.DeletedAt.IsZero() {
+		return i.S.Delete(ctx, _messagesIndex, key.Encode())
+	}
+
+	parentKey, err := decodeID(m.ParentID)
+	if err != nil || parentKey.Kind != "Thread" {
+		return i.S.Delete(ctx, _messagesIndex, key.Encode())
+	}
+
+	thread := new(model.Thread)
+
+	found, err = i.get(ctx, parentKey, thread)
+	if err != nil {
+		return err
+	}
+
+	if !found || !thread.DeletedAt.IsZero() {
+		return i.S.Delete(ctx, _messagesIndex, key.Encode())
+	}
+
+	doc := &messageDoc{
+		ID:        m.ID.String(),
+		ThreadID:  thread.ID.String(),
+		UserID:    m.UserID.String(),
+		UserIDs:   model.IDStrings(thread.UserIDs),
+		Subject:   thread.Subject,
+		Body:      m.Body,
+		Links:     getLinkTitles(m.GetLinks()),
+		CreatedAt: m.CreatedAt,
+	}
+
+	return i.S.Put(ctx, _messagesIndex, doc.ID, doc)
+}
+
+func messageKeys(messages []*model.Message) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(messages))
+	for i := range messages {
+		key, err := decodeID(messages[i].ID)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[i] = key
+	}
+
+	return keys, nil
+}
+
+func getLinkTitles(links []*og.LinkData) []string {
+	titles := make([]string, 0, len(links))
+	for i := range links {
+		if links[i] != nil && links[i].Title != "" {
+			titles = append(titles, links[i].Title)
+		}
+	}
+
+	return titles
+}
+
 func MessagesOrderBy(by OrderBy) model.GetMessagesOption {
 	return func(m map[string]interface{}) {
 		m["order"] = string(by)
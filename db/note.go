@@ -8,27 +8,78 @@ import (
 	"time"
 
 	"cloud.google.com/go/datastore"
-	"github.com/olivere/elastic/v7"
 
 	"github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/clients/search"
 	"github.com/hiconvo/api/errors"
-	"github.com/hiconvo/api/log"
 	"github.com/hiconvo/api/model"
 )
 
+const _notesIndex = "notes"
+
+// NotesSearchIndex holds the notes of all users. Its documents are created
+// by NewNoteSearchDoc.
+var NotesSearchIndex = &SearchIndex{
+	Name: _notesIndex,
+	Mapping: search.Mapping{
+		"id":        search.TextField,
+		"userId":    search.TextField,
+		"body":      search.TextField,
+		"tags":      search.TextField,
+		"url":       search.TextField,
+		"favicon":   search.TextField,
+		"name":      search.TextField,
+		"pin":       search.BoolField,
+		"variant":   search.TextField,
+		"createdAt": search.DateField,
+		"updatedAt": search.DateField,
+	},
+}
+
 var _ model.NoteStore = (*NoteStore)(nil)
 
 type NoteStore struct {
 	DB db.Client
 	S  search.Client
+	// Outbox updates the search index once notes have been saved. Indexing
+	// is skipped when it is nil, which is useful for one-off commands.
+	Outbox model.Outbox
+}
+
+func (s *NoteStore) GetNoteByID(ctx context.Context, id model.ID) (*model.Note, error) {
+	return s.handleGetNote(ctx, id, false)
+}
+
+// GetDeletedNoteByID returns the note with the given ID only if it has been
+// deleted, so that it can be restored.
+func (s *NoteStore) GetDeletedNoteByID(ctx context.Context, id model.ID) (*model.Note, error) {
+	return s.handleGetNote(ctx, id, true)
+}
+
+// GetNotesDeletedBefore returns the notes that were deleted before the given
+// time.
+func (s *NoteStore) GetNotesDeletedBefore(ctx context.Context, t time.Time) ([]*model.Note, error) {
+	var notes []*model.Note
+
+	q := db.NewQuery("Note").
+		Filter("DeletedAt >", time.Time{}).
+		Filter("DeletedAt <", t)
+
+	if _, err := s.DB.GetAll(ctx, q, &notes); err != nil {
+		return notes, errors.E(errors.Op("NoteStore.GetNotesDeletedBefore"), err)
+	}
+
+	return notes, nil
 }
 
-func (s *NoteStore) GetNoteByID(ctx context.Context, id string) (*model.Note, error) {
+// handleGetNote loads the note with the given ID. Notes that have been
+// deleted are only found when isDeleted is true, and the others only when
+// it is false.
+func (s *NoteStore) handleGetNote(ctx context.Context, id model.ID, isDeleted bool) (*model.Note, error) {
 	op := errors.Opf("NoteStore.GetNoteByID(id=%s)", id)
 	note := new(model.Note)
 
-	key, err := datastore.DecodeKey(id)
+	key, err := decodeID(id)
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
@@ -42,6 +93,10 @@ func (s *NoteStore) GetNoteByID(ctx context.Context, id string) (*model.Note, er
 		return nil, errors.E(op, err)
 	}
 
+	if note.DeletedAt.IsZero() == isDeleted {
+		return nil, errors.E(op, datastore.ErrNoSuchEntity, http.StatusNotFound)
+	}
+
 	return note, nil
 }
 
@@ -55,8 +110,14 @@ func (s *NoteStore) GetNotesByUser(
 
 	notes := make([]*model.Note, 0)
 
-	q := datastore.NewQuery("Note").
-		Filter("OwnerKey =", u.Key).
+	key, err := decodeID(u.ID)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	q := db.NewQuery("Note").
+		Filter("OwnerKey =", key).
+		Filter("DeletedAt =", time.Time{}).
 		Order("-CreatedAt").
 		Offset(p.Offset()).
 		Limit(p.Limit())
@@ -101,7 +162,7 @@ func (s *NoteStore) GetNotesByUser(
 		return nil, errors.E(op, http.StatusBadRequest)
 	}
 
-	_, err := s.DB.GetAll(ctx, q, &notes)
+	_, err = s.DB.GetAll(ctx, q, &notes)
 	if err != nil {
 		return notes, errors.E(op, err)
 	}
@@ -118,49 +179,111 @@ func (s *NoteStore) Commit(ctx context.Context, n *model.Note) error {
 
 	n.UpdatedAt = time.Now()
 
-	key, err := s.DB.Put(ctx, n.Key, n)
+	key, err := keyOf("Note", n.ID)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	key, err = putVersioned(ctx, s.DB, op, key, n, &n.Version)
 	if err != nil {
 		return errors.E(op, err)
 	}
 
-	n.ID = key.Encode()
-	n.Key = key
+	(*noteEntity)(n).LoadKey(key)
 
-	s.updateSearchIndex(ctx, n)
+	updateSearchIndex(db.WithoutTransaction(ctx), s.Outbox, n.ID)
 
 	return nil
 }
 
+// CommitMultiWithTransaction saves notes that have already been saved
+// before in tx. Their versions are incremented but not checked.
+func (s *NoteStore) CommitMultiWithTransaction(tx db.Transaction, notes []*model.Note) error {
+	keys, err := noteKeys(notes)
+	if err != nil {
+		return err
+	}
+
+	for i := range notes {
+		notes[i].Version++
+	}
+
+	_, err = tx.PutMulti(keys, notes)
+
+	return err
+}
+
+// Delete marks the note as deleted, which hides it until it is restored or
+// purged.
 func (s *NoteStore) Delete(ctx context.Context, n *model.Note) error {
-	s.deleteSearchIndex(ctx, n)
+	n.DeletedAt = time.Now()
 
-	if err := s.DB.Delete(ctx, n.Key); err != nil {
-		return err
+	if err := s.Commit(ctx, n); err != nil {
+		n.DeletedAt = time.Time{}
+		return errors.E(errors.Op("NoteStore.Delete"), err)
 	}
 
 	return nil
 }
 
-func (s *NoteStore) handleSearch(ctx context.Context, u *model.User, q string) ([]*model.Note, error) {
-	skip := 0
-	take := 30
+// Restore undoes the deletion of the note as long as its restore window has
+// not passed.
+func (s *NoteStore) Restore(ctx context.Context, n *model.Note) error {
+	op := errors.Op("NoteStore.Restore")
 
-	notes := make([]*model.Note, 0)
+	if !model.IsRestorable(n.DeletedAt) {
+		return model.ErrNotRestorable(op)
+	}
 
-	esQuery := elastic.NewBoolQuery().
-		Must(elastic.NewMultiMatchQuery(q, "body", "name", "url")).
-		Filter(elastic.NewTermQuery("userId.keyword", u.Key.Encode()))
+	deletedAt := n.DeletedAt
+	n.DeletedAt = time.Time{}
 
-	result, err := s.S.Search().
-		Index("notes").
-		Query(esQuery).
-		From(skip).Size(take).
-		Do(ctx)
+	if err := s.Commit(ctx, n); err != nil {
+		n.DeletedAt = deletedAt
+		return errors.E(op, err)
+	}
+
+	return nil
+}
+
+// Purge permanently deletes the note.
+func (s *NoteStore) Purge(ctx context.Context, n *model.Note) error {
+	op := errors.Opf("NoteStore.Purge(id=%s)", n.ID)
+
+	key, err := decodeID(n.ID)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := s.DB.Delete(ctx, key); err != nil {
+		return errors.E(op, err)
+	}
+
+	updateSearchIndex(ctx, s.Outbox, n.ID)
+
+	return nil
+}
+
+func (s *NoteStore) IterAll(ctx context.Context) db.Iterator {
+	query := db.NewQuery("Note")
+	return s.DB.Run(ctx, query)
+}
+
+func (s *NoteStore) handleSearch(ctx context.Context, u *model.User, q string) ([]*model.Note, error) {
+	notes := make([]*model.Note, 0)
+
+	result, err := s.S.Search(ctx, &search.Query{
+		Indices: []string{_notesIndex},
+		Text:    q,
+		Fields:  []string{"body", "name", "url"},
+		Filters: []search.Filter{{Field: "userId", Value: u.ID.String()}},
+		Size:    30,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	for _, hit := range result.Hits.Hits {
+	for _, hit := range result.Hits {
 		note := new(model.Note)
 
 		if err := json.Unmarshal(hit.Source, note); err != nil {
@@ -173,26 +296,46 @@ func (s *NoteStore) handleSearch(ctx context.Context, u *model.User, q string) (
 	return notes, nil
 }
 
-func (s *NoteStore) updateSearchIndex(ctx context.Context, n *model.Note) {
-	_, upsertErr := s.S.Update().
-		Index("notes").
-		Id(n.ID).
-		DocAsUpsert(true).
-		Doc(n).
-		Do(ctx)
-	if upsertErr != nil {
-		log.Printf("Failed to index note in elasticsearch: %v", upsertErr)
+// noteDoc is the representation of a note in the search index. The owner
+// is not part of the JSON representation of a note, so it is added here to
+// restrict searches to the notes of the user.
+type noteDoc struct {
+	*model.Note
+	UserID string `json:"userId"`
+}
+
+// NewNoteSearchDoc returns the representation of n in the search index.
+func NewNoteSearchDoc(n *model.Note) interface{} {
+	return &noteDoc{Note: n, UserID: n.OwnerID.String()}
+}
+
+func (i *SearchIndexer) indexNote(ctx context.Context, key *datastore.Key) error {
+	n := new(model.Note)
+
+	found, err := i.get(ctx, key, n)
+	if err != nil {
+		return err
+	}
+
+	if !found || !n.DeletedAt.IsZero() {
+		return i.S.Delete(ctx, _notesIndex, key.Encode())
 	}
+
+	return i.S.Put(ctx, _notesIndex, n.ID.String(), NewNoteSearchDoc(n))
 }
 
-func (s *NoteStore) deleteSearchIndex(ctx context.Context, n *model.Note) {
-	_, upsertErr := s.S.Delete().
-		Index("notes").
-		Id(n.ID).
-		Do(ctx)
-	if upsertErr != nil {
-		log.Printf("Failed to delete note in elasticsearch: %v", upsertErr)
+func noteKeys(notes []*model.Note) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(notes))
+	for i := range notes {
+		key, err := decodeID(notes[i].ID)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[i] = key
 	}
+
+	return keys, nil
 }
 
 func GetNotesFilter(val string) model.GetNotesOption {
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/log"
+	"github.com/hiconvo/api/model"
+)
+
+var _ model.OutboxStore = (*OutboxStore)(nil)
+
+type OutboxStore struct {
+	DB db.Client
+}
+
+func (s *OutboxStore) GetDueOutboxMessages(
+	ctx context.Context,
+	before time.Time,
+	limit int,
+) ([]*model.OutboxMessage, error) {
+	var messages []*model.OutboxMessage
+
+	q := db.NewQuery("Outbox").
+		Filter("Failed =", false).
+		Filter("NextAttemptAt <=", before).
+		Order("NextAttemptAt").
+		Limit(limit)
+
+	keys, err := s.DB.GetAll(ctx, q, &messages)
+	if err != nil {
+		return nil, errors.E(errors.Op("OutboxStore.GetDueOutboxMessages"), err)
+	}
+
+	for i := range messages {
+		messages[i].ID = keys[i].Name
+	}
+
+	return messages, nil
+}
+
+func (s *OutboxStore) Commit(ctx context.Context, m *model.OutboxMessage) error {
+	if _, err := s.DB.Put(ctx, outboxKey(m), m); err != nil {
+		return errors.E(errors.Opf("OutboxStore.Commit(type=%s)", m.Type), err)
+	}
+
+	return nil
+}
+
+func (s *OutboxStore) CommitWithTransaction(tx db.Transaction, m *model.OutboxMessage) error {
+	_, err := tx.Put(outboxKey(m), m)
+
+	return err
+}
+
+func (s *OutboxStore) Delete(ctx context.Context, m *model.OutboxMessage) error {
+	// Delivery happens after the transaction of the request, if any, has
+	// been committed, so the message is deleted outside of it.
+	if err := s.DB.Delete(db.WithoutTransaction(ctx), outboxKey(m)); err != nil {
+		return errors.E(errors.Opf("OutboxStore.Delete(type=%s)", m.Type), err)
+	}
+
+	return nil
+}
+
+// outboxKey returns the key of the message, which is named by its ID.
+func outboxKey(m *model.OutboxMessage) *datastore.Key {
+	return datastore.NameKey("Outbox", m.ID, nil)
+}
+
+// updateSearchIndex schedules the search document of the entity with the
+// given ID to be updated by o. It is skipped when o is nil, which is useful
+// for one-off commands. Failures are logged since the change that was saved
+// should not be reported as failed.
+func updateSearchIndex(ctx context.Context, o model.Outbox, id model.ID) {
+	if o == nil || id.IsZero() {
+		return
+	}
+
+	m, err := model.NewSearchOutboxMessage(id)
+	if err == nil {
+		err = o.Enqueue(ctx, m)
+	}
+
+	if err != nil {
+		log.Alarm(errors.E(errors.Opf("db.updateSearchIndex(id=%s)", id), err))
+	}
+}
+
+// updateSearchIndexWithTransaction schedules the search document of the
+// entity with the given ID to be updated once tx has been committed. Unlike
+// updateSearchIndex, failures are returned since they fail the transaction.
+func updateSearchIndexWithTransaction(tx db.Transaction, o model.Outbox, id model.ID) error {
+	if o == nil || id.IsZero() {
+		return nil
+	}
+
+	m, err := model.NewSearchOutboxMessage(id)
+	if err != nil {
+		return err
+	}
+
+	return o.EnqueueWithTransaction(tx, m)
+}
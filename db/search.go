@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/clients/search"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/model"
+)
+
+var (
+	_ model.SearchStore   = (*SearchStore)(nil)
+	_ model.SearchIndexer = (*SearchIndexer)(nil)
+)
+
+// _searchIndices maps the search result types to the indices in which
+// they are stored.
+var _searchIndices = map[model.SearchResultType]string{
+	model.SearchResultNote:    _notesIndex,
+	model.SearchResultThread:  _threadsIndex,
+	model.SearchResultMessage: _messagesIndex,
+	model.SearchResultEvent:   _eventsIndex,
+	model.SearchResultPerson:  _usersIndex,
+}
+
+// SearchIndex is a search index that is maintained by one of the stores
+// along with the mapping of its documents.
+type SearchIndex struct {
+	Name    string
+	Mapping search.Mapping
+}
+
+// SearchIndices returns all of the indices that are maintained by the
+// stores.
+func SearchIndices() []*SearchIndex {
+	return []*SearchIndex{
+		UsersSearchIndex,
+		NotesSearchIndex,
+		ThreadsSearchIndex,
+		MessagesSearchIndex,
+		EventsSearchIndex,
+	}
+}
+
+// SearchIndexer writes the documents of the indices that are maintained by
+// the stores. The stores schedule updates through the outbox, which calls
+// the indexer once their changes have been saved.
+type SearchIndexer struct {
+	DB db.Client
+	S  search.Client
+}
+
+// UpdateSearchIndex builds the document of the entity with the given ID
+// from its saved state, so updates that are delivered more than once or out
+// of order leave the index up to date.
+func (i *SearchIndexer) UpdateSearchIndex(ctx context.Context, id model.ID) error {
+	op := errors.Opf("SearchIndexer.UpdateSearchIndex(id=%s)", id)
+
+	key, err := decodeID(id)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	// The entity is read outside of any transaction since only committed
+	// changes are indexed.
+	ctx = db.WithoutTransaction(ctx)
+
+	switch key.Kind {
+	case "User":
+		err = i.indexUser(ctx, key)
+	case "Note":
+		err = i.indexNote(ctx, key)
+	case "Thread":
+		err = i.indexThread(ctx, key)
+	case "Message":
+		err = i.indexMessage(ctx, key)
+	case "Event":
+		err = i.indexEvent(ctx, key)
+	default:
+		err = errors.Errorf("unexpected kind %q", key.Kind)
+	}
+
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	return nil
+}
+
+// get loads the entity with the given key into dst and reports whether it
+// exists.
+func (i *SearchIndexer) get(ctx context.Context, key *datastore.Key, dst interface{}) (bool, error) {
+	if err := i.DB.Get(ctx, key, dst); err != nil {
+		if errors.Is(err, datastore.ErrNoSuchEntity) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SearchStore searches notes, threads, messages, events and people at
+// once. The indices are maintained by the stores of each kind.
+type SearchStore struct {
+	S search.Client
+}
+
+// searchDoc holds the fields of the indexed documents that are needed to
+// build a search result.
+type searchDoc struct {
+	ID        string    `json:"id"`
+	ThreadID  string    `json:"threadId"`
+	Subject   string    `json:"subject"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	FullName  string    `json:"fullName"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Search runs the query against all of the requested types. Access rules
+// differ per type: notes are only visible to their owner, threads, messages
+// and events to their members, and people to everyone. Facets are counted
+// over the matches of all types so that clients can show what a type filter
+// would return.
+func (s *SearchStore) Search(
+	ctx context.Context,
+	u *model.User,
+	input *model.SearchInput,
+) (*model.SearchResults, error) {
+	op := errors.Opf("SearchStore.Search(user=%s)", u.Email)
+	userID := u.ID.String()
+
+	indices := make([]string, 0, len(_searchIndices))
+	for _, t := range model.SearchResultTypes {
+		indices = append(indices, _searchIndices[t])
+	}
+
+	resultIndices := make([]string, len(input.Types))
+	for i := range input.Types {
+		resultIndices[i] = _searchIndices[input.Types[i]]
+	}
+
+	result, err := s.S.Search(ctx, &search.Query{
+		Indices: indices,
+		Text:    input.Query,
+		Fields: []string{
+			"subject^2", "name^2", "fullName^2", "firstName", "lastName",
+			"body", "description", "address", "links", "url", "tags",
+		},
+		Filters: []search.Filter{
+			{Indices: []string{_notesIndex}, Field: "userId", Value: userID},
+			{Indices: []string{_threadsIndex, _messagesIndex, _eventsIndex}, Field: "userIds", Value: userID},
+		},
+		ResultIndices: resultIndices,
+		Highlight: []string{
+			"subject", "name", "fullName", "body", "description", "address", "links", "url",
+		},
+		DateFacet: "createdAt",
+		From:      input.Pagination.Offset(),
+		Size:      input.Pagination.Limit(),
+	})
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	out := &model.SearchResults{
+		Results: make([]*model.SearchResult, 0, len(result.Hits)),
+		Facets: &model.SearchFacets{
+			Types: make(map[model.SearchResultType]int64, len(indices)),
+			Dates: make([]*model.DateFacet, 0, len(result.DateCounts)),
+		},
+		Total: result.Total,
+	}
+
+	for _, hit := range result.Hits {
+		r, err := newSearchResult(hit)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+
+		out.Results = append(out.Results, r)
+	}
+
+	for _, t := range model.SearchResultTypes {
+		out.Facets.Types[t] = result.IndexCounts[_searchIndices[t]]
+	}
+
+	for _, c := range result.DateCounts {
+		out.Facets.Dates = append(out.Facets.Dates, &model.DateFacet{Date: c.Month, Count: c.Count})
+	}
+
+	return out, nil
+}
+
+func newSearchResult(hit *search.Hit) (*model.SearchResult, error) {
+	t, ok := getSearchResultType(hit.Index)
+	if !ok {
+		return nil, errors.Errorf("unexpected index %q", hit.Index)
+	}
+
+	var doc searchDoc
+	if err := json.Unmarshal(hit.Source, &doc); err != nil {
+		return nil, err
+	}
+
+	r := &model.SearchResult{
+		Type:       t,
+		ID:         doc.ID,
+		Highlights: hit.Highlights,
+		Score:      hit.Score,
+	}
+
+	if !doc.CreatedAt.IsZero() {
+		r.CreatedAt = &doc.CreatedAt
+	}
+
+	switch t {
+	case model.SearchResultNote:
+		r.Title = doc.Name
+		if r.Title == "" {
+			r.Title = doc.URL
+		}
+	case model.SearchResultThread:
+		r.Title = doc.Subject
+	case model.SearchResultMessage:
+		r.Title = doc.Subject
+		r.ParentID = doc.ThreadID
+	case model.SearchResultEvent:
+		r.Title = doc.Name
+	case model.SearchResultPerson:
+		r.Title = doc.FullName
+		r.User = new(model.UserPartial)
+
+		if err := json.Unmarshal(hit.Source, r.User); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func getSearchResultType(index string) (model.SearchResultType, bool) {
+	for t, i := range _searchIndices {
+		if i == index {
+			return t, true
+		}
+	}
+
+	return "", false
+}
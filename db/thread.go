@@ -2,31 +2,81 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
+	"reflect"
 	"time"
 
 	"cloud.google.com/go/datastore"
 
 	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/clients/search"
+	"github.com/hiconvo/api/clients/storage"
 	"github.com/hiconvo/api/errors"
 	"github.com/hiconvo/api/model"
 )
 
+const (
+	_threadsIndex  = "threads"
+	_messagesIndex = "messages"
+)
+
+// ThreadsSearchIndex holds threads. Users can only find the threads of
+// which they are a member.
+var ThreadsSearchIndex = &SearchIndex{
+	Name: _threadsIndex,
+	Mapping: search.Mapping{
+		"id":        search.TextField,
+		"ownerId":   search.TextField,
+		"userIds":   search.TextField,
+		"subject":   search.TextField,
+		"body":      search.TextField,
+		"links":     search.TextField,
+		"createdAt": search.DateField,
+		"updatedAt": search.DateField,
+	},
+}
+
+// MessagesSearchIndex holds the messages of threads. The subject and members
+// of the thread are copied onto each message.
+var MessagesSearchIndex = &SearchIndex{
+	Name: _messagesIndex,
+	Mapping: search.Mapping{
+		"id":        search.TextField,
+		"threadId":  search.TextField,
+		"userId":    search.TextField,
+		"userIds":   search.TextField,
+		"subject":   search.TextField,
+		"body":      search.TextField,
+		"links":     search.TextField,
+		"createdAt": search.DateField,
+	},
+}
+
 var _ model.ThreadStore = (*ThreadStore)(nil)
 
 type ThreadStore struct {
 	DB db.Client
+	// S searches threads and messages.
+	S search.Client
+	// Outbox updates the search index once threads have been saved.
+	// Indexing is skipped when it is nil, which is useful for one-off
+	// commands.
+	Outbox model.Outbox
+	// Storage converts photo keys into URLs. Photos are left unhydrated
+	// when it is nil, which is useful for one-off commands.
+	Storage *storage.Client
 }
 
-func (s *ThreadStore) GetThreadByID(ctx context.Context, id string) (*model.Thread, error) {
+func (s *ThreadStore) GetThreadByID(ctx context.Context, id model.ID) (*model.Thread, error) {
 	var t = new(model.Thread)
 
-	key, err := datastore.DecodeKey(id)
+	key, err := decodeID(id)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.handleGetThread(ctx, key, t)
+	return s.handleGetThread(ctx, key, t, false)
 }
 
 func (s *ThreadStore) GetThreadByInt64ID(ctx context.Context, id int64) (*model.Thread, error) {
@@ -34,7 +84,36 @@ func (s *ThreadStore) GetThreadByInt64ID(ctx context.Context, id int64) (*model.
 
 	key := datastore.IDKey("Thread", id, nil)
 
-	return s.handleGetThread(ctx, key, t)
+	return s.handleGetThread(ctx, key, t, false)
+}
+
+// GetDeletedThreadByID returns the thread with the given ID only if it has
+// been deleted, so that it can be restored.
+func (s *ThreadStore) GetDeletedThreadByID(ctx context.Context, id model.ID) (*model.Thread, error) {
+	var t = new(model.Thread)
+
+	key, err := decodeID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.handleGetThread(ctx, key, t, true)
+}
+
+// GetThreadsDeletedBefore returns the unhydrated threads that were deleted
+// before the given time.
+func (s *ThreadStore) GetThreadsDeletedBefore(ctx context.Context, t time.Time) ([]*model.Thread, error) {
+	var threads []*model.Thread
+
+	q := db.NewQuery("Thread").
+		Filter("DeletedAt >", time.Time{}).
+		Filter("DeletedAt <", t)
+
+	if _, err := s.DB.GetAll(ctx, q, &threads); err != nil {
+		return threads, errors.E(errors.Op("ThreadStore.GetThreadsDeletedBefore"), err)
+	}
+
+	return threads, nil
 }
 
 func (s *ThreadStore) GetUnhydratedThreadsByUser(
@@ -44,13 +123,19 @@ func (s *ThreadStore) GetUnhydratedThreadsByUser(
 ) ([]*model.Thread, error) {
 	var threads []*model.Thread
 
-	q := datastore.NewQuery("Thread").
-		Filter("UserKeys =", u.Key).
+	key, err := decodeID(u.ID)
+	if err != nil {
+		return threads, err
+	}
+
+	q := db.NewQuery("Thread").
+		Filter("UserKeys =", key).
+		Filter("DeletedAt =", time.Time{}).
 		Order("-UpdatedAt").
 		Offset(p.Offset()).
 		Limit(p.Limit())
 
-	_, err := s.DB.GetAll(ctx, q, &threads)
+	_, err = s.DB.GetAll(ctx, q, &threads)
 	if err != nil {
 		return threads, err
 	}
@@ -66,53 +151,11 @@ func (s *ThreadStore) GetThreadsByUser(ctx context.Context, u *model.User, p *mo
 		return threads, errors.E(op, err)
 	}
 
-	// Now that we have the threads, we need to get the users. We keep track of
-	// where the users of one thread start and another begin by incrementing
-	// an index.
-	var (
-		userKeys []*datastore.Key
-		idxs     []int
-	)
-	for _, t := range threads {
-		userKeys = append(userKeys, t.UserKeys...)
-		idxs = append(idxs, len(t.UserKeys))
-	}
-
-	// We get all of the users in one go.
-	userPtrs := make([]*model.User, len(userKeys))
-	if err := s.DB.GetMulti(ctx, userKeys, userPtrs); err != nil {
+	if err := s.hydrate(ctx, threads); err != nil {
 		return threads, errors.E(op, err)
 	}
 
-	// We add the just retrieved user objects to their corresponding threads by
-	// iterating through all of the threads and assigning their users according
-	// to the index which we created above.
-	//
-	// We also create a new slice of pointers to threads which we'll finally
-	// return.
-	start := 0
-	threadPtrs := make([]*model.Thread, len(threads))
-	for i := range threads {
-		threadUsers := userPtrs[start : start+idxs[i]]
-
-		var owner *model.User
-		for j := range threadUsers {
-			if threads[i].OwnerKey.Equal(threadUsers[j].Key) {
-				owner = threadUsers[j]
-				break
-			}
-		}
-
-		threads[i].Users = threadUsers
-		threads[i].Owner = model.MapUserToUserPartial(owner)
-		threads[i].UserPartials = model.MapUsersToUserPartials(threadUsers)
-		threads[i].UserReads = model.MapReadsToUserPartials(threads[i], threadUsers)
-
-		start += idxs[i]
-		threadPtrs[i] = threads[i]
-	}
-
-	return threadPtrs, nil
+	return threads, nil
 }
 
 func (s *ThreadStore) Commit(ctx context.Context, t *model.Thread) error {
@@ -122,88 +165,372 @@ func (s *ThreadStore) Commit(ctx context.Context, t *model.Thread) error {
 
 	t.UpdatedAt = time.Now()
 
-	key, err := s.DB.Put(ctx, t.Key, t)
+	op := errors.Op("thread.Commit")
+
+	key, err := keyOf("Thread", t.ID)
 	if err != nil {
-		return errors.E(errors.Op("thread.Commit"), err)
+		return errors.E(op, err)
 	}
 
-	t.ID = key.Encode()
-	t.Key = key
+	key, err = putVersioned(ctx, s.DB, op, key, t, &t.Version)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	(*threadEntity)(t).LoadKey(key)
+
+	updateSearchIndex(db.WithoutTransaction(ctx), s.Outbox, t.ID)
 
 	return nil
 }
 
+// CommitMulti saves threads without checking their versions, so it must
+// only be used where nothing else changes the threads concurrently, as in
+// migrations.
 func (s *ThreadStore) CommitMulti(ctx context.Context, threads []*model.Thread) error {
-	keys := make([]*datastore.Key, len(threads))
+	op := errors.Op("ThreadStore.CommitMulti")
+
+	keys, err := threadKeys(threads)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
 	for i := range threads {
-		keys[i] = threads[i].Key
+		threads[i].Version++
 	}
 
 	if _, err := s.DB.PutMulti(ctx, keys, threads); err != nil {
-		return errors.E(errors.Op("ThreadStore.CommitMulti"), err)
+		return errors.E(op, err)
 	}
 
 	return nil
 }
 
-func (s *ThreadStore) CommitWithTransaction(tx db.Transaction, t *model.Thread) (*datastore.PendingKey, error) {
+// CommitMultiWithTransaction saves threads that have already been saved
+// before in tx. Their versions are incremented but not checked.
+func (s *ThreadStore) CommitMultiWithTransaction(tx db.Transaction, threads []*model.Thread) error {
+	keys, err := threadKeys(threads)
+	if err != nil {
+		return err
+	}
+
+	for i := range threads {
+		threads[i].Version++
+	}
+
+	_, err = tx.PutMulti(keys, threads)
+
+	return err
+}
+
+func (s *ThreadStore) CommitWithTransaction(tx db.Transaction, t *model.Thread) error {
 	if t.CreatedAt.IsZero() {
 		t.CreatedAt = time.Now()
 	}
 
 	t.UpdatedAt = time.Now()
 
-	return tx.Put(t.Key, t)
+	key, err := keyOf("Thread", t.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := putVersionedWithTransaction(tx, errors.Op("ThreadStore.CommitWithTransaction"), key, t, &t.Version); err != nil {
+		return err
+	}
+
+	return updateSearchIndexWithTransaction(tx, s.Outbox, t.ID)
 }
 
+// Delete marks the thread as deleted, which hides it along with its
+// messages until it is restored or purged.
 func (s *ThreadStore) Delete(ctx context.Context, t *model.Thread) error {
-	if err := s.DB.Delete(ctx, t.Key); err != nil {
-		return err
+	t.DeletedAt = time.Now()
+
+	if err := s.Commit(ctx, t); err != nil {
+		t.DeletedAt = time.Time{}
+		return errors.E(errors.Op("ThreadStore.Delete"), err)
+	}
+
+	return nil
+}
+
+// Restore undoes the deletion of the thread as long as its restore window
+// has not passed.
+func (s *ThreadStore) Restore(ctx context.Context, t *model.Thread) error {
+	op := errors.Op("ThreadStore.Restore")
+
+	if !model.IsRestorable(t.DeletedAt) {
+		return model.ErrNotRestorable(op)
+	}
+
+	deletedAt := t.DeletedAt
+	t.DeletedAt = time.Time{}
+
+	if err := s.Commit(ctx, t); err != nil {
+		t.DeletedAt = deletedAt
+		return errors.E(op, err)
+	}
+
+	// The messages were removed from the search index along with the
+	// thread, so they have to be indexed again.
+	if err := updateMessagesSearchIndex(ctx, s.DB, s.Outbox, t.ID); err != nil {
+		return errors.E(op, err)
+	}
+
+	return nil
+}
+
+// Purge permanently deletes the thread and all of its messages.
+func (s *ThreadStore) Purge(ctx context.Context, t *model.Thread) error {
+	op := errors.Opf("ThreadStore.Purge(id=%s)", t.ID)
+
+	key, err := decodeID(t.ID)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := purgeMessages(ctx, s.DB, s.Outbox, key); err != nil {
+		return errors.E(op, err)
 	}
 
+	if err := s.DB.Delete(ctx, key); err != nil {
+		return errors.E(op, err)
+	}
+
+	updateSearchIndex(ctx, s.Outbox, t.ID)
+
 	return nil
 }
 
-func (s *ThreadStore) AllocateKey(ctx context.Context) (*datastore.Key, error) {
+// Search returns the threads and messages that match the given query. Only
+// threads of which u is a member are searched.
+func (s *ThreadStore) Search(
+	ctx context.Context,
+	u *model.User,
+	query string,
+	p *model.Pagination,
+) ([]*model.ThreadSearchResult, error) {
+	op := errors.Opf("ThreadStore.Search(user=%s)", u.Email)
+	results := make([]*model.ThreadSearchResult, 0)
+
+	result, err := s.S.Search(ctx, &search.Query{
+		Indices:   []string{_threadsIndex, _messagesIndex},
+		Text:      query,
+		Fields:    []string{"subject^2", "body", "links"},
+		Filters:   []search.Filter{{Field: "userIds", Value: u.ID.String()}},
+		Highlight: []string{"subject", "body", "links"},
+		From:      p.Offset(),
+		Size:      p.Limit(),
+	})
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	for _, hit := range result.Hits {
+		var doc messageDoc
+
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			return nil, errors.E(op, err)
+		}
+
+		r := &model.ThreadSearchResult{
+			ThreadID:   doc.ID,
+			Subject:    doc.Subject,
+			Highlights: hit.Highlights,
+			CreatedAt:  doc.CreatedAt,
+		}
+
+		if hit.Index == _messagesIndex {
+			r.ThreadID = doc.ThreadID
+			r.MessageID = doc.ID
+		}
+
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+// AllocateID reserves an ID for a thread that is yet to be saved.
+func (s *ThreadStore) AllocateID(ctx context.Context) (model.ID, error) {
 	keys, err := s.DB.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey("Thread", nil)})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return keys[0], nil
+	return model.ID(keys[0].Encode()), nil
 }
 
-func (s *ThreadStore) handleGetThread(ctx context.Context, key *datastore.Key, t *model.Thread) (*model.Thread, error) {
+// handleGetThread loads and hydrates the thread with the given key. Threads
+// that have been deleted are only found when isDeleted is true, and the
+// others only when it is false.
+func (s *ThreadStore) handleGetThread(
+	ctx context.Context,
+	key *datastore.Key,
+	t *model.Thread,
+	isDeleted bool,
+) (*model.Thread, error) {
+	op := errors.Op("ThreadStore.handleGetThread")
+
 	if err := s.DB.Get(ctx, key, t); err != nil {
 		if errors.Is(err, datastore.ErrNoSuchEntity) {
-			return nil, errors.E(errors.Op("ThreadStore.handleGetThread"), err, http.StatusNotFound)
+			return nil, errors.E(op, err, http.StatusNotFound)
 		}
 
 		return t, err
 	}
 
-	users := make([]model.User, len(t.UserKeys))
-	if err := s.DB.GetMulti(ctx, t.UserKeys, users); err != nil {
+	if t.DeletedAt.IsZero() == isDeleted {
+		return nil, errors.E(op, datastore.ErrNoSuchEntity, http.StatusNotFound)
+	}
+
+	if err := s.hydrate(ctx, []*model.Thread{t}); err != nil {
 		return t, err
 	}
 
-	var (
-		userPointers = make([]*model.User, len(users))
-		owner        model.User
-	)
+	return t, nil
+}
+
+// hydrate adds the users and photos of all of the given threads. The users
+// of all of them are loaded at once, so that listing threads takes the same
+// number of round trips no matter how many threads there are.
+func (s *ThreadStore) hydrate(ctx context.Context, threads []*model.Thread) error {
+	userIDs := make([][]model.ID, len(threads))
+	for i := range threads {
+		userIDs[i] = threads[i].UserIDs
+	}
+
+	users, err := getUsers(ctx, s.DB, userIDs)
+	if err != nil {
+		return err
+	}
 
-	for i := range users {
-		userPointers[i] = &users[i]
+	for i, t := range threads {
+		var owner model.User
 
-		if t.OwnerKey.Equal(users[i].Key) {
-			owner = users[i]
+		for j := range users[i] {
+			if t.OwnerIs(users[i][j]) {
+				owner = *users[i][j]
+			}
 		}
+
+		t.Users = users[i]
+		t.UserPartials = model.MapUsersToUserPartials(users[i])
+		t.UserReads = model.MapReadsToUserPartials(t, users[i])
+		t.Owner = model.MapUserToUserPartial(&owner)
 	}
 
-	t.Users = userPointers
-	t.UserPartials = model.MapUsersToUserPartials(userPointers)
-	t.UserReads = model.MapReadsToUserPartials(t, userPointers)
-	t.Owner = model.MapUserToUserPartial(&owner)
+	return s.hydratePhotos(ctx, threads)
+}
 
-	return t, nil
+// hydratePhotos converts the stored photo keys of all of the given threads
+// into URLs with a single call to the storage client.
+func (s *ThreadStore) hydratePhotos(ctx context.Context, threads []*model.Thread) error {
+	var keys []string
+	for i := range threads {
+		keys = append(keys, threads[i].PhotoKeys...)
+	}
+
+	if len(keys) == 0 || s.Storage == nil {
+		return nil
+	}
+
+	urls, err := s.Storage.GetPhotoURLs(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	start := 0
+	for i := range threads {
+		if n := len(threads[i].PhotoKeys); n > 0 {
+			threads[i].Photos = urls[start : start+n]
+			start += n
+		}
+	}
+
+	return nil
+}
+
+// threadDoc is the representation of a thread in the search index.
+type threadDoc struct {
+	ID        string    `json:"id"`
+	OwnerID   string    `json:"ownerId"`
+	UserIDs   []string  `json:"userIds"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	Links     []string  `json:"links"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func newThreadDoc(t *model.Thread) *threadDoc {
+	return &threadDoc{
+		ID:        t.ID.String(),
+		OwnerID:   t.OwnerID.String(),
+		UserIDs:   model.IDStrings(t.UserIDs),
+		Subject:   t.Subject,
+		Body:      t.Body,
+		Links:     getLinkTitles(t.GetLinks()),
+		CreatedAt: t.CreatedAt,
+		UpdatedAt: t.UpdatedAt,
+	}
+}
+
+// indexThread puts the thread into the search index. The subject and
+// participants of the thread are copied onto its messages so that they can
+// be searched with the same access rules. Since this is costly, it is only
+// done when they have changed. When the thread no longer exists or has been
+// deleted, its messages are removed along with it.
+func (i *SearchIndexer) indexThread(ctx context.Context, key *datastore.Key) error {
+	t := new(model.Thread)
+
+	found, err := i.get(ctx, key, t)
+	if err != nil {
+		return err
+	}
+
+	if !found || !t.DeletedAt.IsZero() {
+		id := key.Encode()
+
+		if err := i.S.Delete(ctx, _threadsIndex, id); err != nil {
+			return err
+		}
+
+		return i.S.DeleteWhere(ctx, _messagesIndex, "threadId", id)
+	}
+
+	doc := newThreadDoc(t)
+
+	var prev threadDoc
+	if _, err := i.S.Get(ctx, _threadsIndex, doc.ID, &prev); err != nil {
+		return err
+	}
+
+	if err := i.S.Put(ctx, _threadsIndex, doc.ID, doc); err != nil {
+		return err
+	}
+
+	if prev.Subject == doc.Subject && reflect.DeepEqual(prev.UserIDs, doc.UserIDs) {
+		return nil
+	}
+
+	return i.S.UpdateWhere(ctx, _messagesIndex, "threadId", doc.ID, map[string]interface{}{
+		"userIds": doc.UserIDs,
+		"subject": doc.Subject,
+	})
+}
+
+func threadKeys(threads []*model.Thread) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(threads))
+	for i := range threads {
+		key, err := decodeID(threads[i].ID)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[i] = key
+	}
+
+	return keys, nil
 }
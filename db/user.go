@@ -9,18 +9,31 @@ import (
 	"time"
 
 	"cloud.google.com/go/datastore"
-	"github.com/olivere/elastic/v7"
 
 	"github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/clients/notification"
 	"github.com/hiconvo/api/clients/queue"
 	"github.com/hiconvo/api/clients/search"
 	"github.com/hiconvo/api/errors"
-	"github.com/hiconvo/api/log"
 	"github.com/hiconvo/api/model"
 	"github.com/hiconvo/api/valid"
 )
 
+const _usersIndex = "users"
+
+// UsersSearchIndex holds the registered users. Its documents are created by
+// NewUserSearchDoc.
+var UsersSearchIndex = &SearchIndex{
+	Name: _usersIndex,
+	Mapping: search.Mapping{
+		"id":        search.TextField,
+		"firstName": search.TextField,
+		"lastName":  search.TextField,
+		"fullName":  search.TextField,
+		"avatar":    search.TextField,
+	},
+}
+
 var _ model.UserStore = (*UserStore)(nil)
 
 type UserStore struct {
@@ -28,6 +41,9 @@ type UserStore struct {
 	Notif notification.Client
 	S     search.Client
 	Queue queue.Client
+	// Outbox updates the search index once users have been saved. Indexing
+	// is skipped when it is nil, which is useful for one-off commands.
+	Outbox model.Outbox
 }
 
 func (s *UserStore) Commit(ctx context.Context, u *model.User) error {
@@ -44,35 +60,60 @@ func (s *UserStore) Commit(ctx context.Context, u *model.User) error {
 		u.LastName = strings.Title(strings.TrimSpace(u.LastName))
 	}
 
-	key, err := s.DB.Put(ctx, u.Key, u)
+	key, err := keyOf("User", u.ID)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	key, err = s.DB.Put(ctx, key, u)
 	if err != nil {
 		return errors.E(op, err)
 	}
 
-	u.ID = key.Encode()
-	u.Key = key
+	(*userEntity)(u).LoadKey(key)
 
 	// We have to do this after the user has been saved because we need the
 	// ID, which isn't available until the user is in the database
-	u.RealtimeToken = s.Notif.GenerateToken(u.ID)
+	u.RealtimeToken = s.Notif.GenerateToken(u.ID.String())
 	u.DeriveProperties()
 
-	s.CreateOrUpdateSearchIndex(ctx, u)
+	// The user is saved outside of any transaction of ctx, so its search
+	// document must not depend on it either.
+	updateSearchIndex(db.WithoutTransaction(ctx), s.Outbox, u.ID)
 
 	return nil
 }
 
-func (s *UserStore) CommitWithTransaction(
-	tx db.Transaction,
-	u *model.User,
-) (*datastore.PendingKey, error) {
+func (s *UserStore) CommitWithTransaction(tx db.Transaction, u *model.User) error {
 	if u.CreatedAt.IsZero() {
 		u.CreatedAt = time.Now()
 	}
 
 	u.UpdatedAt = time.Now()
 
-	return tx.Put(u.Key, u)
+	key, err := keyOf("User", u.ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Put(key, u); err != nil {
+		return err
+	}
+
+	return updateSearchIndexWithTransaction(tx, s.Outbox, u.ID)
+}
+
+// CommitMultiWithTransaction saves users that have already been saved
+// before in tx.
+func (s *UserStore) CommitMultiWithTransaction(tx db.Transaction, users []*model.User) error {
+	keys, err := decodeIDs(model.MapUsersToIDs(users))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.PutMulti(keys, users)
+
+	return err
 }
 
 func (s *UserStore) DeleteWithTransaction(
@@ -80,23 +121,22 @@ func (s *UserStore) DeleteWithTransaction(
 	tx db.Transaction,
 	u *model.User,
 ) error {
-	if u.IsRegistered() {
-		_, err := s.S.Delete().
-			Index("users").
-			Id(u.ID).
-			Do(ctx)
-		if err != nil {
-			log.Alarm(errors.Errorf("Failed to remove user from elasticsearch: %v", err))
-		}
+	key, err := decodeID(u.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Delete(key); err != nil {
+		return err
 	}
 
-	return tx.Delete(u.Key)
+	return updateSearchIndexWithTransaction(tx, s.Outbox, u.ID)
 }
 
-func (s *UserStore) GetUserByID(ctx context.Context, id string) (*model.User, error) {
+func (s *UserStore) GetUserByID(ctx context.Context, id model.ID) (*model.User, error) {
 	op := errors.Opf("UserStore.GetUserByID(id=%s)", id)
 
-	key, err := datastore.DecodeKey(id)
+	key, err := decodeID(id)
 	if err != nil {
 		return nil, errors.E(op, err, http.StatusNotFound)
 	}
@@ -157,8 +197,13 @@ func (s *UserStore) GetUserByOAuthID(ctx context.Context, oAuthToken, provider s
 func (s *UserStore) GetUsersByContact(ctx context.Context, u *model.User) ([]*model.User, error) {
 	var users []*model.User
 
-	q := datastore.NewQuery("User").Filter("ContactKeys =", u.Key)
-	_, err := s.DB.GetAll(ctx, q, &users)
+	key, err := decodeID(u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	q := db.NewQuery("User").Filter("ContactKeys =", key)
+	_, err = s.DB.GetAll(ctx, q, &users)
 	if err != nil {
 		return nil, err
 	}
@@ -167,9 +212,13 @@ func (s *UserStore) GetUsersByContact(ctx context.Context, u *model.User) ([]*mo
 }
 
 func (s *UserStore) GetContactsByUser(ctx context.Context, u *model.User) ([]*model.User, error) {
-	contacts := make([]*model.User, len(u.ContactKeys))
+	keys, err := decodeIDs(u.ContactIDs)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := s.DB.GetMulti(ctx, u.ContactKeys, contacts); err != nil {
+	contacts := make([]*model.User, len(keys))
+	if err := s.DB.GetMulti(ctx, keys, contacts); err != nil {
 		return nil, err
 	}
 
@@ -194,7 +243,9 @@ func (s *UserStore) GetOrCreateUserByEmail(ctx context.Context, email string) (*
 		return nil, false, err
 	}
 
-	model.UserWelcomeMulti(ctx, s.Queue, []*model.User{u})
+	// The user is saved outside of any transaction of ctx, so the welcome
+	// email must not depend on it either.
+	model.UserWelcomeMulti(db.WithoutTransaction(ctx), s.Queue, []*model.User{u})
 
 	return u, true, nil
 }
@@ -215,7 +266,7 @@ func (s *UserStore) GetOrCreateUsersByEmail(ctx context.Context, emails []string
 
 		if created {
 			usersToCommit = append(usersToCommit, u)
-			usersToCommitKeys = append(usersToCommitKeys, u.Key)
+			usersToCommitKeys = append(usersToCommitKeys, datastore.IncompleteKey("User", nil))
 		} else {
 			users = append(users, u)
 		}
@@ -227,12 +278,11 @@ func (s *UserStore) GetOrCreateUsersByEmail(ctx context.Context, emails []string
 	}
 
 	for i := range keys {
-		usersToCommit[i].Key = keys[i]
-		usersToCommit[i].ID = keys[i].Encode()
+		(*userEntity)(usersToCommit[i]).LoadKey(keys[i])
 	}
 
 	if len(usersToCommit) > 0 {
-		model.UserWelcomeMulti(ctx, s.Queue, usersToCommit)
+		model.UserWelcomeMulti(db.WithoutTransaction(ctx), s.Queue, usersToCommit)
 	}
 
 	users = append(users, usersToCommit...)
@@ -268,13 +318,13 @@ func (s *UserStore) GetOrCreateUsers(ctx context.Context, users []*model.UserInp
 			continue
 		}
 
-		if _, ok := seen[u.ID]; ok {
+		if _, ok := seen[u.ID.String()]; ok {
 			continue
 		}
 
-		seen[u.ID] = struct{}{}
+		seen[u.ID.String()] = struct{}{}
 
-		key, err := datastore.DecodeKey(u.ID)
+		key, err := decodeID(u.ID)
 		if err != nil {
 			return nil, errors.E(
 				op,
@@ -306,25 +356,20 @@ func (s *UserStore) GetOrCreateUsers(ctx context.Context, users []*model.UserInp
 }
 
 func (s *UserStore) Search(ctx context.Context, query string) ([]*model.UserPartial, error) {
-	skip := 0
-	take := 10
-
 	contacts := make([]*model.UserPartial, 0)
 
-	esQuery := elastic.NewMultiMatchQuery(query, "fullName", "firstName", "lastName").
-		Fuzziness("3").
-		MinimumShouldMatch("0")
-
-	result, err := s.S.Search().
-		Index("users").
-		Query(esQuery).
-		From(skip).Size(take).
-		Do(ctx)
+	result, err := s.S.Search(ctx, &search.Query{
+		Indices: []string{_usersIndex},
+		Text:    query,
+		Fields:  []string{"fullName", "firstName", "lastName"},
+		Fuzzy:   true,
+		Size:    10,
+	})
 	if err != nil {
 		return contacts, err
 	}
 
-	for _, hit := range result.Hits.Hits {
+	for _, hit := range result.Hits {
 		contact := new(model.UserPartial)
 
 		if err := json.Unmarshal(hit.Source, contact); err != nil {
@@ -337,32 +382,18 @@ func (s *UserStore) Search(ctx context.Context, query string) ([]*model.UserPart
 	return contacts, nil
 }
 
-func (s *UserStore) IterAll(ctx context.Context) *datastore.Iterator {
-	query := datastore.NewQuery("User")
+func (s *UserStore) IterAll(ctx context.Context) db.Iterator {
+	query := db.NewQuery("User")
 	return s.DB.Run(ctx, query)
 }
 
-func (s *UserStore) CreateOrUpdateSearchIndex(ctx context.Context, u *model.User) {
-	if u.IsRegistered() {
-		_, upsertErr := s.S.Update().
-			Index("users").
-			Id(u.ID).
-			DocAsUpsert(true).
-			Doc(model.MapUserToUserPartial(u)).
-			Do(ctx)
-		if upsertErr != nil {
-			log.Printf("Failed to index user in elasticsearch: %v", upsertErr)
-		}
-	}
-}
-
 func (s *UserStore) getUserByField(ctx context.Context, field, value string) (*model.User, bool, error) {
 	var (
 		op    = errors.Opf("UserStore.getUserByField(field=%q, value=%q)", field, value)
 		users []model.User
 	)
 
-	q := datastore.NewQuery("User").Filter(fmt.Sprintf("%s =", field), value)
+	q := db.NewQuery("User").Filter(fmt.Sprintf("%s =", field), value)
 
 	keys, err := s.DB.GetAll(ctx, q, &users)
 	if err != nil {
@@ -374,7 +405,7 @@ func (s *UserStore) getUserByField(ctx context.Context, field, value string) (*m
 
 		// Generate the streamer token if not already present
 		if user.RealtimeToken == "" && user.ID != "" {
-			user.RealtimeToken = s.Notif.GenerateToken(user.ID)
+			user.RealtimeToken = s.Notif.GenerateToken(user.ID.String())
 		}
 
 		return &user, true, nil
@@ -402,3 +433,25 @@ func (s *UserStore) getOrCreateUserByEmailNoCommit(ctx context.Context, email st
 
 	return u, true, nil
 }
+
+// NewUserSearchDoc returns the representation of u in the search index.
+func NewUserSearchDoc(u *model.User) interface{} {
+	return model.MapUserToUserPartial(u)
+}
+
+// indexUser puts the user into the search index. Only registered users can
+// be found, so the document of any other user is removed.
+func (i *SearchIndexer) indexUser(ctx context.Context, key *datastore.Key) error {
+	u := new(model.User)
+
+	found, err := i.get(ctx, key, u)
+	if err != nil {
+		return err
+	}
+
+	if !found || !u.IsRegistered() {
+		return i.S.Delete(ctx, _usersIndex, key.Encode())
+	}
+
+	return i.S.Put(ctx, _usersIndex, u.ID.String(), NewUserSearchDoc(u))
+}
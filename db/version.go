@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/model"
+)
+
+// Threads, events and notes are committed with optimistic concurrency
+// control. Each of them has a version that is incremented every time it is
+// committed, and committing it fails with model.ErrConflict when the stored
+// version is no longer the one that was loaded.
+
+// putVersioned saves src, whose version is pointed to by version, under key.
+// Saving an entity that already exists is done in a new transaction so that
+// the version check and the save are atomic.
+func putVersioned(
+	ctx context.Context,
+	c db.Client,
+	op errors.Op,
+	key *datastore.Key,
+	src interface{},
+	version *int64,
+) (*datastore.Key, error) {
+	loaded := *version
+
+	if key.Incomplete() {
+		*version = loaded + 1
+
+		key, err := c.Put(ctx, key, src)
+		if err != nil {
+			*version = loaded
+			return nil, err
+		}
+
+		return key, nil
+	}
+
+	// The transaction is retried when it conflicts with another one, so
+	// the version is set rather than incremented.
+	_, err := c.RunInTransaction(ctx, func(tx db.Transaction) error {
+		*version = loaded
+
+		if err := checkVersion(tx, op, key, loaded); err != nil {
+			return err
+		}
+
+		*version = loaded + 1
+
+		_, err := tx.Put(key, src)
+
+		return err
+	})
+	if err != nil {
+		*version = loaded
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// putVersionedWithTransaction is like putVersioned, except that it saves
+// src in tx.
+func putVersionedWithTransaction(
+	tx db.Transaction,
+	op errors.Op,
+	key *datastore.Key,
+	src interface{},
+	version *int64,
+) error {
+	if err := checkVersion(tx, op, key, *version); err != nil {
+		return err
+	}
+
+	*version++
+
+	if _, err := tx.Put(key, src); err != nil {
+		*version--
+		return err
+	}
+
+	return nil
+}
+
+// checkVersion returns model.ErrConflict if the version of the entity that
+// is stored under key is not version. Entities that have not been stored yet
+// cannot conflict.
+func checkVersion(tx db.Transaction, op errors.Op, key *datastore.Key, version int64) error {
+	if key.Incomplete() {
+		return nil
+	}
+
+	var ps datastore.PropertyList
+	if err := tx.Get(key, &ps); err != nil {
+		if errors.Is(err, datastore.ErrNoSuchEntity) {
+			return nil
+		}
+
+		return err
+	}
+
+	var stored int64
+	for i := range ps {
+		if ps[i].Name == "Version" {
+			stored, _ = ps[i].Value.(int64)
+		}
+	}
+
+	if stored != version {
+		return model.ErrConflict(op)
+	}
+
+	return nil
+}
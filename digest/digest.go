@@ -4,7 +4,6 @@ import (
 	"context"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"google.golang.org/api/iterator"
 
 	dbc "github.com/hiconvo/api/clients/db"
@@ -43,17 +42,15 @@ func New(c *Config) Digester {
 func (d *digesterImpl) Digest(ctx context.Context) error {
 	op := errors.Op("Digest")
 
-	keys, err := d.getUserList(ctx)
+	ids, err := d.getUserList(ctx)
 	if err != nil {
 		return errors.E(op, err)
 	}
 
-	for i, k := range keys {
+	for i, id := range ids {
 		log.Printf("--> digest.sendDigest(count=%d): start", i)
 
-		var user model.User
-
-		err := d.DB.Get(ctx, k, &user)
+		user, err := d.UserStore.GetUserByID(ctx, id)
 		if err != nil {
 			log.Alarm(errors.E(op, errors.Errorf("digest.sendDigest(count=%d): %v", i, err)))
 
@@ -66,7 +63,7 @@ func (d *digesterImpl) Digest(ctx context.Context) error {
 			continue
 		}
 
-		if err := d.sendDigest(ctx, &user); err != nil {
+		if err := d.sendDigest(ctx, user); err != nil {
 			log.Alarm(errors.E(
 				op,
 				errors.Errorf("digest.sendDigest(count=%d): could not send digest for user=%q: %v",
@@ -77,13 +74,13 @@ func (d *digesterImpl) Digest(ctx context.Context) error {
 	return nil
 }
 
-func (d *digesterImpl) getUserList(ctx context.Context) ([]*datastore.Key, error) {
+func (d *digesterImpl) getUserList(ctx context.Context) ([]model.ID, error) {
 	op := errors.Op("getUserList")
 	yesterday := time.Now().Add(time.Duration(24) * time.Hour * -1)
 
-	users := map[string]struct{}{}
+	users := map[model.ID]struct{}{}
 
-	q := datastore.NewQuery("Event").Filter("UpdatedAt >", yesterday)
+	q := dbc.NewQuery("Event").Filter("UpdatedAt >", yesterday)
 	iter := d.DB.Run(ctx, q)
 
 	for {
@@ -98,12 +95,12 @@ func (d *digesterImpl) getUserList(ctx context.Context) ([]*datastore.Key, error
 			return nil, errors.E(op, err)
 		}
 
-		for _, k := range event.UserKeys {
-			users[k.Encode()] = struct{}{}
+		for _, id := range event.UserIDs {
+			users[id] = struct{}{}
 		}
 	}
 
-	q = datastore.NewQuery("Thread").Filter("UpdatedAt >", yesterday)
+	q = dbc.NewQuery("Thread").Filter("UpdatedAt >", yesterday)
 	iter = d.DB.Run(ctx, q)
 
 	for {
@@ -118,25 +115,20 @@ func (d *digesterImpl) getUserList(ctx context.Context) ([]*datastore.Key, error
 			return nil, errors.E(op, err)
 		}
 
-		for _, k := range thread.UserKeys {
-			users[k.Encode()] = struct{}{}
+		for _, id := range thread.UserIDs {
+			users[id] = struct{}{}
 		}
 	}
 
-	var keys []*datastore.Key
-
-	for s := range users {
-		k, err := datastore.DecodeKey(s)
-		if err != nil {
-			return nil, errors.E(op, err)
-		}
+	var ids []model.ID
 
-		keys = append(keys, k)
+	for id := range users {
+		ids = append(ids, id)
 	}
 
-	log.Printf("%v: found %d users who may need digest emails", op, len(keys))
+	log.Printf("%v: found %d users who may need digest emails", op, len(ids))
 
-	return keys, nil
+	return ids, nil
 }
 
 func (d *digesterImpl) sendDigest(ctx context.Context, u *model.User) error {
@@ -162,7 +154,7 @@ func (d *digesterImpl) sendDigest(ctx context.Context, u *model.User) error {
 
 	for i := range events {
 		// Get all of the unread events
-		if !model.IsRead(events[i], u.Key) {
+		if !model.IsRead(events[i], u.ID) {
 			cleanEvents = append(cleanEvents, events[i])
 		}
 
@@ -173,7 +165,7 @@ func (d *digesterImpl) sendDigest(ctx context.Context, u *model.User) error {
 
 	for i := range threads {
 		// Get all of the unread threads
-		if !model.IsRead(threads[i], u.Key) {
+		if !model.IsRead(threads[i], u.ID) {
 			cleanThreads = append(cleanThreads, threads[i])
 		}
 	}
@@ -188,8 +180,6 @@ func (d *digesterImpl) sendDigest(ctx context.Context, u *model.User) error {
 			return errors.E(op, err)
 		}
 
-		// TODO: The following two calls are bad because they're exposed to a race condition
-		// so all this will have to change if there are ever a decent amount of real users
 		if err := markThreadsAsRead(ctx, d.ThreadStore, cleanThreads, u); err != nil {
 			return errors.E(op, err)
 		}
@@ -250,10 +240,10 @@ func generateDigestItemFromEvent(
 	e *model.Event,
 	u *model.User,
 ) (*model.DigestItem, error) {
-	op := errors.Opf("generateDigestItemFromEvent(user=%s, event=%d)", u.Email, e.Key.ID)
+	op := errors.Opf("generateDigestItemFromEvent(user=%s, event=%d)", u.Email, e.Int64ID)
 
-	messages, err := ms.GetMessagesByKey(
-		ctx, e.Key, &model.Pagination{Size: 5},
+	messages, err := ms.GetMessagesByParent(
+		ctx, e.ID, &model.Pagination{Size: 5},
 		db.MessagesOrderBy(db.CreatedAtNewestFirst))
 	if err != nil {
 		return nil, errors.E(op, err)
@@ -263,7 +253,7 @@ func generateDigestItemFromEvent(
 		log.Printf("%v: adding event with name=%s", op, e.Name)
 
 		return &model.DigestItem{
-			ParentID: e.Key,
+			ParentID: e.ID,
 			Name:     e.Name,
 			Messages: reverse(messages),
 		}, nil
@@ -278,11 +268,11 @@ func generateDigestItemFromThread(
 	t *model.Thread,
 	u *model.User,
 ) (*model.DigestItem, error) {
-	op := errors.Opf("generateDigestItemFromThread(user=%s, thread=%d)", u.Email, t.Key.ID)
+	op := errors.Opf("generateDigestItemFromThread(user=%s, thread=%d)", u.Email, t.Int64ID)
 
 	// Get the most recent five messages
-	messages, err := ms.GetMessagesByKey(
-		ctx, t.Key, &model.Pagination{Size: 5},
+	messages, err := ms.GetMessagesByParent(
+		ctx, t.ID, &model.Pagination{Size: 5},
 		db.MessagesOrderBy(db.CreatedAtNewestFirst))
 	if err != nil {
 		return nil, errors.E(op, err)
@@ -295,12 +285,13 @@ func generateDigestItemFromThread(
 	if len(messages) < 5 {
 		firstMessage := &model.Message{
 			Body:      t.Body,
-			PhotoKeys: t.Photos,
+			PhotoKeys: t.PhotoKeys,
+			Photos:    t.Photos,
 			Link:      t.Link,
+			Links:     t.Links,
 			User:      t.Owner,
-			UserKey:   t.OwnerKey,
-			ParentKey: t.Key,
-			ParentID:  t.Key.Encode(),
+			UserID:    t.OwnerID,
+			ParentID:  t.ID,
 			CreatedAt: t.CreatedAt,
 		}
 		cleanMessages = append(cleanMessages, messages...)
@@ -312,7 +303,7 @@ func generateDigestItemFromThread(
 	log.Printf("%v: adding thread with subject=%s", op, t.Subject)
 
 	return &model.DigestItem{
-		ParentID: t.Key,
+		ParentID: t.ID,
 		Name:     t.Subject,
 		Messages: reverse(cleanMessages),
 	}, nil
@@ -331,12 +322,25 @@ func markThreadsAsRead(
 	}
 
 	for i := range threads {
-		model.MarkAsRead(threads[i], user.Key)
-	}
+		thread := threads[i]
+
+		// The thread may have been changed since it was loaded, in which
+		// case it is loaded again so that the changes are kept.
+		err := model.RetryOnConflict(func(attempt int) error {
+			if attempt > 0 {
+				var err error
+				if thread, err = ts.GetThreadByID(ctx, thread.ID); err != nil {
+					return err
+				}
+			}
 
-	err := ts.CommitMulti(ctx, threads)
-	if err != nil {
-		return errors.E(op, err)
+			model.MarkAsRead(thread, user.ID)
+
+			return ts.Commit(ctx, thread)
+		})
+		if err != nil {
+			return errors.E(op, err)
+		}
 	}
 
 	log.Printf("%v: marked %d thread(s) as read", op, len(threads))
@@ -357,12 +361,25 @@ func markEventsAsRead(
 	}
 
 	for i := range events {
-		model.MarkAsRead(events[i], user.Key)
-	}
+		event := events[i]
+
+		// The event may have been changed since it was loaded, in which
+		// case it is loaded again so that the changes are kept.
+		err := model.RetryOnConflict(func(attempt int) error {
+			if attempt > 0 {
+				var err error
+				if event, err = es.GetEventByID(ctx, event.ID); err != nil {
+					return err
+				}
+			}
 
-	err := es.CommitMulti(ctx, events)
-	if err != nil {
-		return errors.E(op, err)
+			model.MarkAsRead(event, user.ID)
+
+			return es.Commit(ctx, event)
+		})
+		if err != nil {
+			return errors.E(op, err)
+		}
 	}
 
 	log.Printf("%v: marked %d event(s) as read", op, len(events))
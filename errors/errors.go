@@ -91,6 +91,12 @@ func (e *Error) Error() string {
 	return b.String()
 }
 
+// Unwrap returns the underlying error, if there is one, so that Is can match
+// the errors that an Error wraps.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
 // ClientReport returns a map of strings suitable to be returned to the end user.
 func (e *Error) ClientReport() map[string]string {
 	if len(e.messages) == 0 {
@@ -103,6 +109,10 @@ func (e *Error) ClientReport() map[string]string {
 			return map[string]string{"message": "You do not have permission to perform this action"}
 		case http.StatusNotFound:
 			return map[string]string{"message": "The requested resource was not found"}
+		case http.StatusConflict:
+			return map[string]string{"message": "The resource was changed by someone else, please try again"}
+		case http.StatusPreconditionFailed:
+			return map[string]string{"message": "The resource has changed since it was loaded"}
 		case http.StatusUnsupportedMediaType:
 			return map[string]string{"message": "Unsupported content-type"}
 		default:
@@ -45,7 +45,7 @@ func (c *Config) AddContact(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	u := middleware.UserFromContext(ctx)
 	vars := mux.Vars(r)
-	userID := vars["userID"]
+	userID := model.ID(vars["userID"])
 
 	if !u.IsRegistered() {
 		bjson.HandleError(w, errors.E(
@@ -79,7 +79,7 @@ func (c *Config) RemoveContact(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	u := middleware.UserFromContext(ctx)
 	vars := mux.Vars(r)
-	userID := vars["userID"]
+	userID := model.ID(vars["userID"])
 
 	userToBeRemoved, err := c.UserStore.GetUserByID(ctx, userID)
 	if err != nil {
@@ -1,14 +1,15 @@
 package event
 
 import (
+	"context"
 	"html"
 	"net/http"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"github.com/gorilla/mux"
 
 	"github.com/hiconvo/api/bjson"
+	dbc "github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/clients/magic"
 	notif "github.com/hiconvo/api/clients/notification"
 	"github.com/hiconvo/api/clients/opengraph"
@@ -24,6 +25,7 @@ import (
 )
 
 type Config struct {
+	DB            dbc.Client
 	UserStore     model.UserStore
 	EventStore    model.EventStore
 	MessageStore  model.MessageStore
@@ -44,6 +46,7 @@ func NewHandler(c *Config) *mux.Router {
 	s.Use(middleware.WithUser(c.UserStore))
 	s.HandleFunc("/events", c.CreateEvent).Methods("POST")
 	s.HandleFunc("/events", c.GetEvents).Methods("GET")
+	s.HandleFunc("/events/{eventID}/restore", c.RestoreEvent).Methods("POST")
 
 	t := r.NewRoute().Subrouter()
 	t.Use(middleware.WithUser(c.UserStore), middleware.WithEvent(c.EventStore))
@@ -51,13 +54,16 @@ func NewHandler(c *Config) *mux.Router {
 	t.HandleFunc("/events/{eventID}", c.DeleteEvent).Methods("DELETE")
 	t.HandleFunc("/events/{eventID}/messages", c.GetMessagesByEvent).Methods("GET")
 	t.HandleFunc("/events/{eventID}/messages/{messageID}", c.DeleteEventMessage).Methods("DELETE")
+	t.HandleFunc("/events/{eventID}/messages/{messageID}/restore", c.RestoreEventMessage).Methods("POST")
 	t.HandleFunc("/events/{eventID}/magic", c.GetMagicLink).Methods("GET")
+	t.HandleFunc("/events/{eventID}/occurrences", c.GetOccurrences).Methods("GET")
 
 	u := r.NewRoute().Subrouter()
 	u.Use(c.TxnMiddleware, middleware.WithUser(c.UserStore), middleware.WithEvent(c.EventStore))
 	u.HandleFunc("/events/{eventID}/messages", c.AddMessageToEvent).Methods("POST")
 	u.HandleFunc("/events/{eventID}/reads", c.MarkEventAsRead).Methods("POST")
 	u.HandleFunc("/events/{eventID}", c.UpdateEvent).Methods("PATCH")
+	u.HandleFunc("/events/{eventID}/cancel", c.CancelEvent).Methods("POST")
 	u.HandleFunc("/events/{eventID}/users/{userID}", c.AddUserToEvent).Methods("POST")
 	u.HandleFunc("/events/{eventID}/users/{userID}", c.RemoveUserFromEvent).Methods("DELETE")
 	u.HandleFunc("/events/{eventID}/rsvps", c.AddRSVPToEvent).Methods("POST")
@@ -76,11 +82,19 @@ type createEventPayload struct {
 	Name            string `validate:"max=255,nonzero"`
 	PlaceID         string `validate:"max=255,nonzero"`
 	Timestamp       string `validate:"max=255,nonzero"`
+	EndTimestamp    string `validate:"max=255"`
+	AllDay          bool
 	Description     string `validate:"max=4097,nonzero"`
 	Hosts           []*model.UserInput
 	Users           []*model.UserInput
 	GuestsCanInvite bool
-	UTCOffset       int `json:"utcOffset"`
+	UTCOffset       int    `json:"utcOffset"`
+	TimeZone        string `validate:"max=255"`
+	Recurrence      *model.Recurrence
+	Capacity        int `validate:"min=0"`
+	// Reminders are how many minutes before each occurrence of the event its
+	// guests are reminded of it.
+	Reminders []int
 }
 
 // CreateEvent creates a event.
@@ -125,7 +139,19 @@ func (c *Config) CreateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	place, err := c.Places.Resolve(ctx, payload.PlaceID, payload.UTCOffset)
+	var end time.Time
+	if payload.EndTimestamp != "" {
+		end, err = time.Parse(time.RFC3339, payload.EndTimestamp)
+		if err != nil {
+			bjson.HandleError(w, errors.E(op, map[string]string{
+				"endTimestamp": "Invalid time",
+			}, http.StatusBadRequest))
+
+			return
+		}
+	}
+
+	place, err := c.Places.Resolve(ctx, payload.PlaceID, payload.UTCOffset, payload.TimeZone)
 	if err != nil {
 		bjson.HandleError(w, err)
 		return
@@ -161,6 +187,35 @@ func (c *Config) CreateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := event.SetTimeZone(place.TimeZone); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	if err := event.SetEnd(end, payload.AllDay); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	if payload.Recurrence != nil {
+		if err := event.SetRecurrence(payload.Recurrence); err != nil {
+			bjson.HandleError(w, err)
+			return
+		}
+	}
+
+	if err := event.SetCapacity(payload.Capacity); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	if payload.Reminders != nil {
+		if err := event.SetReminders(payload.Reminders); err != nil {
+			bjson.HandleError(w, err)
+			return
+		}
+	}
+
 	if err := c.EventStore.Commit(ctx, event); err != nil {
 		bjson.HandleError(w, err)
 		return
@@ -171,6 +226,8 @@ func (c *Config) CreateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	event.SetUpcomingOccurrences()
+
 	bjson.WriteJSON(w, event, http.StatusCreated)
 }
 
@@ -203,11 +260,51 @@ func (c *Config) GetEvent(w http.ResponseWriter, r *http.Request) {
 	bjson.HandleError(w, errors.E(errors.Op("handlers.GetEvent"), http.StatusNotFound))
 }
 
+// GetOccurrences lists the occurrences of the event that start between the
+// times given by the from and to query parameters along with their RSVPs.
+// They default to now and to no upper bound.
+func (c *Config) GetOccurrences(w http.ResponseWriter, r *http.Request) {
+	op := errors.Op("handlers.GetOccurrences")
+	ctx := r.Context()
+	u := middleware.UserFromContext(ctx)
+	event := middleware.EventFromContext(ctx)
+
+	if !(event.OwnerIs(u) || event.HasUser(u)) {
+		bjson.HandleError(w, errors.E(op, errors.Str("no permission"), http.StatusNotFound))
+		return
+	}
+
+	from, err := parseTimeParam(op, r, "from")
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	if from.IsZero() {
+		from = time.Now()
+	}
+
+	to, err := parseTimeParam(op, r, "to")
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	bjson.WriteJSON(w,
+		map[string][]*model.Occurrence{
+			"occurrences": event.ExpandOccurrences(from, to, model.MaxExpandedOccurrences),
+		},
+		http.StatusOK)
+}
+
 type deleteEventPayload struct {
 	Message string `validate:"max=255"`
 }
 
-// DeleteEvent allows the owner to delete the event.
+// DeleteEvent allows the owner to delete the event. The event can be restored
+// until its restore window has passed. The guests of events that have not
+// happened yet are told that they were cancelled once model.CancelDelay has
+// passed, after which they can no longer be restored.
 func (c *Config) DeleteEvent(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	u := middleware.UserFromContext(ctx)
@@ -234,28 +331,100 @@ func (c *Config) DeleteEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	event.CancelMessage = html.UnescapeString(payload.Message)
+
 	if err := c.EventStore.Delete(ctx, event); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
 
-	if event.IsInFuture() {
-		if err := c.Mail.SendCancellation(c.Magic, event, html.UnescapeString(payload.Message)); err != nil {
-			bjson.HandleError(w, err)
-			return
-		}
+	bjson.WriteJSON(w, event, http.StatusOK)
+}
 
-		if err := c.Notif.Put(&notif.Notification{
-			UserKeys:   notif.FilterKey(event.UserKeys, u.Key),
-			Actor:      u.FullName,
-			Verb:       notif.DeleteEvent,
-			Target:     notif.Event,
-			TargetID:   event.ID,
-			TargetName: event.Name,
-		}); err != nil {
-			// Log the error but don't fail the request
-			log.Alarm(err)
-		}
+type cancelEventPayload struct {
+	Message string `validate:"max=255"`
+}
+
+// CancelEvent allows the owner to cancel the event. Unlike deleted events,
+// cancelled events are kept so that guests can still see them, and the
+// guests are told right away.
+func (c *Config) CancelEvent(w http.ResponseWriter, r *http.Request) {
+	op := errors.Op("handlers.CancelEvent")
+	ctx := r.Context()
+	u := middleware.UserFromContext(ctx)
+	event := middleware.EventFromContext(ctx)
+	tx, _ := middleware.TransactionFromContext(ctx)
+
+	var payload cancelEventPayload
+	if err := bjson.ReadJSON(&payload, r); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	if err := valid.Raw(&payload); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	if !event.OwnerIs(u) {
+		bjson.HandleError(w, errors.E(op, errors.Str("no permission"), http.StatusNotFound))
+		return
+	}
+
+	if err := event.Cancel(html.UnescapeString(payload.Message)); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	if err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	if err := event.SendCancellationAsync(ctx, c.Queue); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	// Guests are not told about a cancellation that fails to commit.
+	c.notifyOnCommit(tx, &notif.Notification{
+		UserIDs:    notif.FilterID(model.IDStrings(event.UserIDs), u.ID.String()),
+		Actor:      u.FullName,
+		Verb:       notif.CancelEvent,
+		Target:     notif.Event,
+		TargetID:   event.ID.String(),
+		TargetName: event.Name,
+	})
+
+	if _, err := tx.Commit(); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
+	bjson.WriteJSON(w, event, http.StatusOK)
+}
+
+// RestoreEvent allows the owner to undo the deletion of the event.
+func (c *Config) RestoreEvent(w http.ResponseWriter, r *http.Request) {
+	op := errors.Op("handlers.RestoreEvent")
+	ctx := r.Context()
+	u := middleware.UserFromContext(ctx)
+	id := model.ID(mux.Vars(r)["eventID"])
+
+	event, err := c.EventStore.GetDeletedEventByID(ctx, id)
+	if err != nil {
+		bjson.HandleError(w, errors.E(op, err, http.StatusNotFound))
+		return
+	}
+
+	if !event.OwnerIs(u) {
+		bjson.HandleError(w, errors.E(op, errors.Str("no permission"), http.StatusNotFound))
+		return
+	}
+
+	if err := c.EventStore.Restore(ctx, event); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
 	}
 
 	bjson.WriteJSON(w, event, http.StatusOK)
@@ -324,7 +493,7 @@ func (c *Config) AddMessageToEvent(w http.ResponseWriter, r *http.Request) {
 		c.OG,
 		&model.NewMessageInput{
 			User:   u,
-			Parent: event.Key,
+			Parent: event.ID,
 			Body:   html.UnescapeString(payload.Body),
 			Blob:   payload.Blob,
 		})
@@ -334,35 +503,35 @@ func (c *Config) AddMessageToEvent(w http.ResponseWriter, r *http.Request) {
 	}
 
 	model.ClearReads(event)
-	model.MarkAsRead(event, u.Key)
+	model.MarkAsRead(event, u.ID)
 
 	if err := c.MessageStore.Commit(ctx, message); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
 
-	if _, err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+	if err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
 
-	if _, err := tx.Commit(); err != nil {
-		bjson.HandleError(w, errors.E(op, err))
-		return
-	}
-
-	if err := c.Notif.Put(&notif.Notification{
-		UserKeys:   notif.FilterKey(event.UserKeys, u.Key),
+	if err := c.Notif.Put(ctx, &notif.Notification{
+		UserIDs:    notif.FilterID(model.IDStrings(event.UserIDs), u.ID.String()),
 		Actor:      u.FullName,
 		Verb:       notif.NewMessage,
 		Target:     notif.Event,
-		TargetID:   event.ID,
+		TargetID:   event.ID.String(),
 		TargetName: event.Name,
 	}); err != nil {
 		// Log the error but don't fail the request
 		log.Alarm(err)
 	}
 
+	if _, err := tx.Commit(); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
 	bjson.WriteJSON(w, message, http.StatusCreated)
 }
 
@@ -372,7 +541,7 @@ func (c *Config) DeleteEventMessage(w http.ResponseWriter, r *http.Request) {
 	u := middleware.UserFromContext(ctx)
 	event := middleware.EventFromContext(ctx)
 	vars := mux.Vars(r)
-	id := vars["messageID"]
+	id := model.ID(vars["messageID"])
 
 	m, err := c.MessageStore.GetMessageByID(ctx, id)
 	if err != nil {
@@ -380,7 +549,7 @@ func (c *Config) DeleteEventMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !event.Key.Equal(m.ParentKey) {
+	if event.ID != m.ParentID {
 		bjson.HandleError(w, errors.E(op,
 			errors.Str("message not in event"),
 			http.StatusNotFound))
@@ -403,9 +572,37 @@ func (c *Config) DeleteEventMessage(w http.ResponseWriter, r *http.Request) {
 	bjson.WriteJSON(w, m, http.StatusOK)
 }
 
+// RestoreEventMessage allows the owner of a message to undo its deletion.
+func (c *Config) RestoreEventMessage(w http.ResponseWriter, r *http.Request) {
+	op := errors.Op("handlers.RestoreEventMessage")
+	ctx := r.Context()
+	u := middleware.UserFromContext(ctx)
+	event := middleware.EventFromContext(ctx)
+	id := model.ID(mux.Vars(r)["messageID"])
+
+	m, err := c.MessageStore.GetDeletedMessageByID(ctx, id)
+	if err != nil {
+		bjson.HandleError(w, errors.E(op, err, http.StatusNotFound))
+		return
+	}
+
+	if event.ID != m.ParentID || !m.OwnerIs(u) {
+		bjson.HandleError(w, errors.E(op, errors.Str("no permission"), http.StatusNotFound))
+		return
+	}
+
+	if err := c.MessageStore.Restore(ctx, m); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
+	m.User = model.MapUserToUserPartial(u)
+
+	bjson.WriteJSON(w, m, http.StatusOK)
+}
+
 func (c *Config) MarkEventAsRead(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	tx, _ := middleware.TransactionFromContext(ctx)
 	user := middleware.UserFromContext(ctx)
 	event := middleware.EventFromContext(ctx)
 
@@ -418,25 +615,31 @@ func (c *Config) MarkEventAsRead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if model.IsRead(event, user.Key) {
+	if model.IsRead(event, user.ID) {
 		bjson.WriteJSON(w, event, http.StatusOK)
 		return
 	}
 
-	if err := model.MarkMessagesAsRead(ctx, c.MessageStore, user, event.Key); err != nil {
-		bjson.HandleError(w, err)
-		return
-	}
+	err := middleware.RetryOnConflict(ctx, c.DB, func(ctx context.Context, tx dbc.Transaction, attempt int) error {
+		if attempt > 0 {
+			var err error
+			if event, err = c.EventStore.GetEventByID(ctx, event.ID); err != nil {
+				return err
+			}
+		}
 
-	model.MarkAsRead(event, user.Key)
-	event.UserReads = model.MapReadsToUserPartials(event, event.Users)
+		if err := model.MarkMessagesAsRead(ctx, c.MessageStore, user, event.ID); err != nil {
+			return err
+		}
 
-	if _, err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
-		bjson.HandleError(w, err)
-		return
-	}
+		model.MarkAsRead(event, user.ID)
+		event.UserReads = model.MapReadsToUserPartials(event, event.Users)
 
-	if _, err := tx.Commit(); err != nil {
+		err := c.EventStore.CommitWithTransaction(tx, event)
+
+		return err
+	})
+	if err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
@@ -469,11 +672,23 @@ type updateEventPayload struct {
 	Name            string `validate:"max=255"`
 	PlaceID         string `validate:"max=255"`
 	Timestamp       string `validate:"max=255"`
+	EndTimestamp    string `validate:"max=255"`
+	AllDay          *bool
 	Description     string `validate:"max=4097"`
 	Hosts           []*model.UserInput
 	GuestsCanInvite bool
 	Resend          bool
-	UTCOffset       int `json:"utcOffset"`
+	UTCOffset       int    `json:"utcOffset"`
+	TimeZone        string `validate:"max=255"`
+	Recurrence      *model.Recurrence
+	Capacity        *int
+	// Reminders replace the reminders of the event when they are given. An
+	// empty list removes them.
+	Reminders []int
+	// Occurrence is the start of an occurrence of a recurring event. When it
+	// is given, the changes only apply to that occurrence and the ones after
+	// it, which become an event of their own.
+	Occurrence string `validate:"max=255"`
 }
 
 // UpdateEvent allows the owner to change the event name and location.
@@ -490,6 +705,14 @@ func (c *Config) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if event.IsCancelled() {
+		bjson.HandleError(w, errors.E(op,
+			map[string]string{"message": "You cannot update cancelled events"},
+			http.StatusBadRequest))
+
+		return
+	}
+
 	// Only allow updating future events
 	if !event.IsInFuture() {
 		bjson.HandleError(w, errors.E(op,
@@ -516,6 +739,58 @@ func (c *Config) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if payload.Occurrence != "" {
+		start, err := time.Parse(time.RFC3339, payload.Occurrence)
+		if err != nil {
+			bjson.HandleError(w, errors.E(op,
+				map[string]string{"occurrence": "Invalid time"},
+				http.StatusBadRequest))
+
+			return
+		}
+
+		if start.Before(time.Now()) {
+			bjson.HandleError(w, errors.E(op,
+				map[string]string{"message": "You cannot update past occurrences"},
+				http.StatusBadRequest))
+
+			return
+		}
+
+		following, err := event.SplitAt(start)
+		if err != nil {
+			bjson.HandleError(w, err)
+			return
+		}
+
+		if following != event {
+			following.ID, err = c.EventStore.AllocateID(ctx)
+			if err != nil {
+				bjson.HandleError(w, err)
+				return
+			}
+
+			// The preceding occurrences now end sooner.
+			event.Revise()
+
+			if err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+				bjson.HandleError(w, err)
+				return
+			}
+
+			// Calendars only drop the occurrences that moved once they are
+			// sent the preceding event with its new end.
+			if payload.Resend {
+				if err := event.SendUpdatedInvitesAsync(ctx, c.Queue); err != nil {
+					bjson.HandleError(w, err)
+					return
+				}
+			}
+
+			event = following
+		}
+	}
+
 	err = event.SetHosts(hosts)
 	if err != nil {
 		bjson.HandleError(w, err)
@@ -534,6 +809,33 @@ func (c *Config) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		event.Description = html.UnescapeString(payload.Description)
 	}
 
+	// The place is resolved again when the time zone changes, since only
+	// places that are not physical locations take the time zone of the user.
+	if (payload.PlaceID != "" && payload.PlaceID != event.PlaceID) ||
+		(payload.TimeZone != "" && payload.TimeZone != event.TimeZone) {
+		placeID := payload.PlaceID
+		if placeID == "" {
+			placeID = event.PlaceID
+		}
+
+		place, err := c.Places.Resolve(ctx, placeID, payload.UTCOffset, payload.TimeZone)
+		if err != nil {
+			bjson.HandleError(w, err)
+			return
+		}
+
+		event.PlaceID = place.PlaceID
+		event.Address = place.Address
+		event.Lat = place.Lat
+		event.Lng = place.Lng
+		event.UTCOffset = place.UTCOffset
+
+		if err := event.SetTimeZone(place.TimeZone); err != nil {
+			bjson.HandleError(w, err)
+			return
+		}
+	}
+
 	if payload.Timestamp != "" {
 		timestamp, err := time.Parse(time.RFC3339, payload.Timestamp)
 		if err != nil {
@@ -545,30 +847,73 @@ func (c *Config) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if !timestamp.Equal(event.Timestamp) {
-			event.Timestamp = timestamp
+			event.Reschedule(timestamp)
+		}
+	}
+
+	// The end is set again even if it did not change, since all-day events
+	// have to start at the beginning of a day.
+	end, allDay := event.EndTimestamp, event.AllDay
+	if payload.AllDay != nil && *payload.AllDay != allDay {
+		// All-day events that become timed ones last DefaultEventDuration
+		// unless they are given an end.
+		if allDay {
+			end = time.Time{}
 		}
+
+		allDay = *payload.AllDay
 	}
 
-	if payload.PlaceID != "" && payload.PlaceID != event.PlaceID {
-		place, err := c.Places.Resolve(ctx, payload.PlaceID, payload.UTCOffset)
+	if payload.EndTimestamp != "" {
+		end, err = time.Parse(time.RFC3339, payload.EndTimestamp)
 		if err != nil {
-			bjson.HandleError(w, err)
+			bjson.HandleError(w, errors.E(op,
+				map[string]string{"endTimestamp": "Invalid time"},
+				http.StatusBadRequest))
+
 			return
 		}
-
-		event.PlaceID = place.PlaceID
-		event.Address = place.Address
-		event.Lat = place.Lat
-		event.Lng = place.Lng
-		event.UTCOffset = place.UTCOffset
 	}
 
-	if _, err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+	if err := event.SetEnd(end, allDay); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
 
-	if _, err := tx.Commit(); err != nil {
+	// The recurrence is checked again even if it did not change, since the
+	// event might have moved past its end.
+	recurrence := event.Recurrence
+	if payload.Recurrence != nil {
+		recurrence = payload.Recurrence
+	}
+
+	if recurrence != nil {
+		if err := event.SetRecurrence(recurrence); err != nil {
+			bjson.HandleError(w, err)
+			return
+		}
+	}
+
+	var promoted []*model.User
+	if payload.Capacity != nil && *payload.Capacity != event.Capacity {
+		if err := event.SetCapacity(*payload.Capacity); err != nil {
+			bjson.HandleError(w, err)
+			return
+		}
+
+		promoted = c.promoteWaitlist(tx, event)
+	}
+
+	if payload.Reminders != nil {
+		if err := event.SetReminders(payload.Reminders); err != nil {
+			bjson.HandleError(w, err)
+			return
+		}
+	}
+
+	event.Revise()
+
+	if err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
@@ -580,18 +925,27 @@ func (c *Config) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := c.Notif.Put(&notif.Notification{
-		UserKeys:   notif.FilterKey(event.UserKeys, u.Key),
+	if err := c.Notif.Put(ctx, &notif.Notification{
+		UserIDs:    notif.FilterID(model.IDStrings(event.UserIDs), u.ID.String()),
 		Actor:      u.FullName,
 		Verb:       notif.UpdateEvent,
 		Target:     notif.Event,
-		TargetID:   event.ID,
+		TargetID:   event.ID.String(),
 		TargetName: event.Name,
 	}); err != nil {
 		// Log the error but don't fail the request
 		log.Alarm(err)
 	}
 
+	if _, err := tx.Commit(); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	c.sendPromotions(event, promoted)
+
+	event.SetUpcomingOccurrences()
+
 	bjson.WriteJSON(w, event, http.StatusOK)
 }
 
@@ -622,7 +976,7 @@ func (c *Config) AddUserToEvent(w http.ResponseWriter, r *http.Request) {
 	)
 
 	if _, ee := valid.Email(maybeUserID); ee != nil {
-		userToBeAdded, err = c.UserStore.GetUserByID(ctx, maybeUserID)
+		userToBeAdded, err = c.UserStore.GetUserByID(ctx, model.ID(maybeUserID))
 	} else {
 		userToBeAdded, _, err = c.UserStore.GetOrCreateUserByEmail(ctx, maybeUserID)
 	}
@@ -637,7 +991,7 @@ func (c *Config) AddUserToEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+	if err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
@@ -663,7 +1017,7 @@ func (c *Config) RemoveUserFromEvent(w http.ResponseWriter, r *http.Request) {
 	u := middleware.UserFromContext(ctx)
 	event := middleware.EventFromContext(ctx)
 	vars := mux.Vars(r)
-	userID := vars["userID"]
+	userID := model.ID(vars["userID"])
 
 	userToBeRemoved, err := c.UserStore.GetUserByID(ctx, userID)
 	if err != nil {
@@ -673,7 +1027,7 @@ func (c *Config) RemoveUserFromEvent(w http.ResponseWriter, r *http.Request) {
 
 	// If the requestor is the owner or the requestor is the user to be
 	// removed, then remove the user.
-	if event.OwnerIs(u) || userToBeRemoved.Key.Equal(u.Key) {
+	if event.OwnerIs(u) || userToBeRemoved.ID == u.ID {
 		if err := event.RemoveRSVP(userToBeRemoved); err != nil {
 			bjson.HandleError(w, err)
 			return
@@ -689,8 +1043,10 @@ func (c *Config) RemoveUserFromEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	promoted := c.promoteWaitlist(tx, event)
+
 	// Save the event.
-	if _, err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+	if err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
@@ -700,89 +1056,162 @@ func (c *Config) RemoveUserFromEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	c.sendPromotions(event, promoted)
+
 	bjson.WriteJSON(w, event, http.StatusOK)
 }
 
-// AddRSVPToEvent RSVPs a user to the event.
+type rsvpPayload struct {
+	Status string
+	Guests int    `validate:"min=0,max=10"`
+	Note   string `validate:"max=1023"`
+}
+
+// AddRSVPToEvent sets the response of a user to the event, which is going
+// unless another status is given, along with the guests that she is
+// bringing and a note. When the occurrence query parameter is given, the
+// user is only going to the occurrence of a recurring event that starts at
+// that time.
 func (c *Config) AddRSVPToEvent(w http.ResponseWriter, r *http.Request) {
+	op := errors.Op("handlers.AddRSVPToEvent")
 	ctx := r.Context()
-	tx, _ := middleware.TransactionFromContext(ctx)
 	u := middleware.UserFromContext(ctx)
 	event := middleware.EventFromContext(ctx)
 
-	if !event.HasUser(u) {
-		bjson.HandleError(w, errors.E(
-			errors.Op("handlers.AddRSVPToEvent"),
-			errors.Str("no permission"),
-			http.StatusNotFound))
-
+	var payload rsvpPayload
+	if err := bjson.ReadJSON(&payload, r); err != nil {
+		bjson.HandleError(w, err)
 		return
 	}
 
-	if err := event.AddRSVP(u); err != nil {
+	if err := valid.Raw(&payload); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
 
-	if _, err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+	if payload.Status == "" {
+		payload.Status = model.RSVPGoing
+	}
+
+	occurrence, err := parseTimeParam(op, r, "occurrence")
+	if err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
 
-	if _, err := tx.Commit(); err != nil {
-		bjson.HandleError(w, err)
+	if !occurrence.IsZero() && payload.Status != model.RSVPGoing {
+		bjson.HandleError(w, errors.E(op,
+			errors.Str("occurrence status"),
+			map[string]string{"status": "You can only say that you are going to an occurrence"},
+			http.StatusBadRequest))
 		return
 	}
 
-	if err := c.Notif.Put(&notif.Notification{
-		UserKeys:   []*datastore.Key{event.OwnerKey},
-		Actor:      u.FullName,
-		Verb:       notif.AddRSVP,
-		Target:     notif.Event,
-		TargetID:   event.ID,
-		TargetName: event.Name,
-	}); err != nil {
-		// Log the error but don't fail the request
-		log.Alarm(err)
+	var promoted []*model.User
+
+	err = middleware.RetryOnConflict(ctx, c.DB, func(ctx context.Context, tx dbc.Transaction, attempt int) error {
+		if attempt > 0 {
+			var err error
+			if event, err = c.EventStore.GetEventByID(ctx, event.ID); err != nil {
+				return err
+			}
+		}
+
+		if !event.HasUser(u) {
+			return errors.E(op, errors.Str("no permission"), http.StatusNotFound)
+		}
+
+		if occurrence.IsZero() {
+			if err := event.SetRSVP(u, payload.Status, payload.Guests, payload.Note); err != nil {
+				return err
+			}
+		} else if err := event.AddOccurrenceRSVP(u, occurrence); err != nil {
+			return err
+		}
+
+		// Users who stop going or bring fewer guests make room for others.
+		promoted = c.promoteWaitlist(tx, event)
+
+		if err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+			return err
+		}
+
+		c.notifyOnCommit(tx, newRSVPNotification(event, u, payload.Status))
+
+		return nil
+	})
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
 	}
 
+	c.sendPromotions(event, promoted)
+
+	event.SetUpcomingOccurrences()
+
 	bjson.WriteJSON(w, event, http.StatusOK)
 }
 
 // RemoveRSVPFromEvent removed a user from the event. The owner can remove
-// anyone. Participants can remove themselves.
+// anyone. Participants can remove themselves. When the occurrence query
+// parameter is given, only the RSVP to the occurrence of a recurring event
+// that starts at that time is removed.
 func (c *Config) RemoveRSVPFromEvent(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	tx, _ := middleware.TransactionFromContext(ctx)
 	u := middleware.UserFromContext(ctx)
 	event := middleware.EventFromContext(ctx)
 
-	if err := event.RemoveRSVP(u); err != nil {
+	occurrence, err := parseTimeParam(errors.Op("handlers.RemoveRSVPFromEvent"), r, "occurrence")
+	if err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
 
-	if _, err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
-		bjson.HandleError(w, err)
-		return
-	}
+	var promoted []*model.User
 
-	if _, err := tx.Commit(); err != nil {
+	// The waitlist is promoted in the same transaction as the RSVP is
+	// removed, so that the spot that opens up is not given out twice.
+	err = middleware.RetryOnConflict(ctx, c.DB, func(ctx context.Context, tx dbc.Transaction, attempt int) error {
+		if attempt > 0 {
+			var err error
+			if event, err = c.EventStore.GetEventByID(ctx, event.ID); err != nil {
+				return err
+			}
+		}
+
+		if occurrence.IsZero() {
+			if err := event.RemoveRSVP(u); err != nil {
+				return err
+			}
+		} else if err := event.RemoveOccurrenceRSVP(u, occurrence); err != nil {
+			return err
+		}
+
+		promoted = c.promoteWaitlist(tx, event)
+
+		if err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+			return err
+		}
+
+		c.notifyOnCommit(tx, &notif.Notification{
+			UserIDs:    []string{event.OwnerID.String()},
+			Actor:      u.FullName,
+			Verb:       notif.RemoveRSVP,
+			Target:     notif.Event,
+			TargetID:   event.ID.String(),
+			TargetName: event.Name,
+		})
+
+		return nil
+	})
+	if err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
 
-	if err := c.Notif.Put(&notif.Notification{
-		UserKeys:   []*datastore.Key{event.OwnerKey},
-		Actor:      u.FullName,
-		Verb:       notif.RemoveRSVP,
-		Target:     notif.Event,
-		TargetID:   event.ID,
-		TargetName: event.Name,
-	}); err != nil {
-		// Log the error but don't fail the request
-		log.Alarm(err)
-	}
+	c.sendPromotions(event, promoted)
+
+	event.SetUpcomingOccurrences()
 
 	bjson.WriteJSON(w, event, http.StatusOK)
 }
@@ -831,28 +1260,28 @@ func (c *Config) MagicInvite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := c.EventStore.CommitWithTransaction(tx, e); err != nil {
+	if err := c.EventStore.CommitWithTransaction(tx, e); err != nil {
 		bjson.HandleError(w, errors.E(op, err))
 		return
 	}
 
-	if _, err := tx.Commit(); err != nil {
-		bjson.HandleError(w, errors.E(op, err))
-		return
-	}
-
-	if err := c.Notif.Put(&notif.Notification{
-		UserKeys:   []*datastore.Key{e.OwnerKey},
+	if err := c.Notif.Put(ctx, &notif.Notification{
+		UserIDs:    []string{e.OwnerID.String()},
 		Actor:      u.FullName,
 		Verb:       notif.AddRSVP,
 		Target:     notif.Event,
-		TargetID:   e.ID,
+		TargetID:   e.ID.String(),
 		TargetName: e.Name,
 	}); err != nil {
 		// Log the error but don't fail the request
 		log.Alarm(err)
 	}
 
+	if _, err := tx.Commit(); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
 	bjson.WriteJSON(w, e, http.StatusOK)
 }
 
@@ -871,7 +1300,7 @@ func (c *Config) RollMagicLink(w http.ResponseWriter, r *http.Request) {
 
 	event.RollToken()
 
-	if _, err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
+	if err := c.EventStore.CommitWithTransaction(tx, event); err != nil {
 		bjson.HandleError(w, errors.E(op, err))
 		return
 	}
@@ -889,14 +1318,14 @@ type magicRSVPPayload struct {
 	Timestamp string `validate:"nonzero"`
 	UserID    string `validate:"nonzero"`
 	EventID   string `validate:"nonzero"`
+	Status    string
 }
 
 // MagicRSVP rsvps a user without a registered account to an event that
-// she has been invited to.
+// she has been invited to. She is going unless another status is given.
 func (c *Config) MagicRSVP(w http.ResponseWriter, r *http.Request) {
 	op := errors.Op("handlers.MagicRSVP")
 	ctx := r.Context()
-	tx, _ := middleware.TransactionFromContext(ctx)
 
 	var payload magicRSVPPayload
 	if err := bjson.ReadJSON(&payload, r); err != nil {
@@ -909,13 +1338,17 @@ func (c *Config) MagicRSVP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := c.UserStore.GetUserByID(ctx, payload.UserID)
+	if payload.Status == "" {
+		payload.Status = model.RSVPGoing
+	}
+
+	u, err := c.UserStore.GetUserByID(ctx, model.ID(payload.UserID))
 	if err != nil {
 		bjson.HandleError(w, errors.E(op, err))
 		return
 	}
 
-	e, err := c.EventStore.GetEventByID(ctx, payload.EventID)
+	e, err := c.EventStore.GetEventByID(ctx, model.ID(payload.EventID))
 	if err != nil {
 		bjson.HandleError(w, errors.E(op, err))
 		return
@@ -931,42 +1364,144 @@ func (c *Config) MagicRSVP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := e.AddRSVP(u); err != nil {
-		log.Print(errors.E(op, err))
-		// Just return the user and be done with it
-		bjson.WriteJSON(w, u, http.StatusOK)
+	var promoted []*model.User
 
-		return
-	}
+	err = middleware.RetryOnConflict(ctx, c.DB, func(ctx context.Context, tx dbc.Transaction, attempt int) error {
+		promoted = nil
 
-	u.Verified = true
+		if attempt > 0 {
+			var err error
+			if u, err = c.UserStore.GetUserByID(ctx, u.ID); err != nil {
+				return err
+			}
 
-	if _, err := c.EventStore.CommitWithTransaction(tx, e); err != nil {
-		bjson.HandleError(w, errors.E(op, err))
-		return
-	}
+			if e, err = c.EventStore.GetEventByID(ctx, e.ID); err != nil {
+				return err
+			}
+		}
 
-	if _, err := c.UserStore.CommitWithTransaction(tx, u); err != nil {
-		bjson.HandleError(w, errors.E(op, err))
-		return
-	}
+		if err := e.SetRSVPStatus(u, payload.Status); err != nil {
+			log.Print(errors.E(op, err))
+			// Just return the user and be done with it
+			return nil
+		}
 
-	if _, err := tx.Commit(); err != nil {
+		u.Verified = true
+		promoted = c.promoteWaitlist(tx, e)
+
+		if err := c.EventStore.CommitWithTransaction(tx, e); err != nil {
+			return err
+		}
+
+		if err := c.UserStore.CommitWithTransaction(tx, u); err != nil {
+			return err
+		}
+
+		c.notifyOnCommit(tx, newRSVPNotification(e, u, payload.Status))
+
+		return nil
+	})
+	if err != nil {
 		bjson.HandleError(w, errors.E(op, err))
 		return
 	}
 
-	if err := c.Notif.Put(&notif.Notification{
-		UserKeys:   []*datastore.Key{e.OwnerKey},
+	c.sendPromotions(e, promoted)
+
+	bjson.WriteJSON(w, u, http.StatusOK)
+}
+
+// newRSVPNotification returns the notification to the owner of the event
+// of the response of the user with the given status.
+func newRSVPNotification(e *model.Event, u *model.User, status string) *notif.Notification {
+	n := &notif.Notification{
+		UserIDs:    []string{e.OwnerID.String()},
 		Actor:      u.FullName,
 		Verb:       notif.AddRSVP,
 		Target:     notif.Event,
-		TargetID:   e.ID,
+		TargetID:   e.ID.String(),
 		TargetName: e.Name,
-	}); err != nil {
-		// Log the error but don't fail the request
-		log.Alarm(err)
 	}
 
-	bjson.WriteJSON(w, u, http.StatusOK)
+	switch status {
+	case model.RSVPMaybe:
+		n.Verb = notif.MaybeRSVP
+	case model.RSVPDeclined:
+		n.Verb = notif.DeclineRSVP
+	}
+
+	return n
+}
+
+// notifyOnCommit puts the notification once tx has been committed. Only the
+// attempt that is committed notifies, so no one is told about a change that
+// a conflict undoes or told about it more than once.
+func (c *Config) notifyOnCommit(tx dbc.Transaction, n *notif.Notification) {
+	tx.OnCommit(func() {
+		// The request may be over by the time the transaction is committed.
+		if err := c.Notif.Put(context.Background(), n); err != nil {
+			log.Alarm(err)
+		}
+	})
+}
+
+// promoteWaitlist lets the users at the front of the waitlist of the event go
+// if it has room for them, and notifies them once tx has been committed. It
+// returns the users who were let in so that they can be emailed by
+// sendPromotions once the event is saved.
+func (c *Config) promoteWaitlist(tx dbc.Transaction, e *model.Event) []*model.User {
+	ids := e.PromoteWaitlist()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	users := make([]*model.User, 0, len(ids))
+	for _, id := range ids {
+		for i := range e.Users {
+			if e.Users[i].ID == id {
+				users = append(users, e.Users[i])
+				break
+			}
+		}
+	}
+
+	c.notifyOnCommit(tx, &notif.Notification{
+		UserIDs:    model.IDStrings(ids),
+		Actor:      e.Owner.FullName,
+		Verb:       notif.PromoteRSVP,
+		Target:     notif.Event,
+		TargetID:   e.ID.String(),
+		TargetName: e.Name,
+	})
+
+	return users
+}
+
+// sendPromotions emails the users who were let off the waitlist of the
+// event.
+func (c *Config) sendPromotions(e *model.Event, users []*model.User) {
+	for i := range users {
+		if err := c.Mail.SendWaitlistPromotion(c.Magic, e, users[i]); err != nil {
+			// Log the error but don't fail the request
+			log.Alarm(err)
+		}
+	}
+}
+
+// parseTimeParam parses the RFC 3339 time given by the query parameter with
+// the given name. The time is zero when the parameter is missing.
+func parseTimeParam(op errors.Op, r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.E(op,
+			map[string]string{name: "Invalid time"},
+			http.StatusBadRequest)
+	}
+
+	return t, nil
 }
@@ -18,13 +18,17 @@ import (
 	"github.com/hiconvo/api/handler/contact"
 	"github.com/hiconvo/api/handler/event"
 	"github.com/hiconvo/api/handler/inbound"
+	"github.com/hiconvo/api/handler/link"
 	"github.com/hiconvo/api/handler/middleware"
 	"github.com/hiconvo/api/handler/note"
+	"github.com/hiconvo/api/handler/search"
 	"github.com/hiconvo/api/handler/task"
 	"github.com/hiconvo/api/handler/thread"
 	"github.com/hiconvo/api/handler/user"
+	"github.com/hiconvo/api/linkcache"
 	"github.com/hiconvo/api/mail"
 	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/outbox"
 )
 
 type Config struct {
@@ -35,6 +39,7 @@ type Config struct {
 	EventStore    model.EventStore
 	MessageStore  model.MessageStore
 	NoteStore     model.NoteStore
+	SearchStore   model.SearchStore
 	Welcome       model.Welcomer
 	TxnMiddleware mux.MiddlewareFunc
 	Mail          *mail.Client
@@ -43,8 +48,10 @@ type Config struct {
 	Storage       *storage.Client
 	Notif         notif.Client
 	OG            opengraph.Client
+	Links         linkcache.Client
 	Places        places.Client
 	Queue         queue.Client
+	Outbox        outbox.Client
 }
 
 func New(c *Config) http.Handler {
@@ -59,6 +66,8 @@ func New(c *Config) http.Handler {
 		UserStore:    c.UserStore,
 		ThreadStore:  c.ThreadStore,
 		MessageStore: c.MessageStore,
+		EventStore:   c.EventStore,
+		Notif:        c.Notif,
 		Mail:         c.Mail,
 		Magic:        c.Magic,
 		OG:           c.OG,
@@ -70,10 +79,14 @@ func New(c *Config) http.Handler {
 		ThreadStore:  c.ThreadStore,
 		EventStore:   c.EventStore,
 		MessageStore: c.MessageStore,
+		NoteStore:    c.NoteStore,
 		Welcome:      c.Welcome,
 		Mail:         c.Mail,
 		Magic:        c.Magic,
+		Notif:        c.Notif,
 		Storage:      c.Storage,
+		Links:        c.Links,
+		Outbox:       c.Outbox,
 	}))
 
 	t := router.NewRoute().Subrouter()
@@ -96,6 +109,7 @@ func New(c *Config) http.Handler {
 		UserStore: c.UserStore,
 	}))
 	t.PathPrefix("/threads").Handler(thread.NewHandler(&thread.Config{
+		DB:            c.DB,
 		UserStore:     c.UserStore,
 		ThreadStore:   c.ThreadStore,
 		MessageStore:  c.MessageStore,
@@ -108,6 +122,7 @@ func New(c *Config) http.Handler {
 		Queue:         c.Queue,
 	}))
 	t.PathPrefix("/events").Handler(event.NewHandler(&event.Config{
+		DB:            c.DB,
 		UserStore:     c.UserStore,
 		EventStore:    c.EventStore,
 		MessageStore:  c.MessageStore,
@@ -120,11 +135,19 @@ func New(c *Config) http.Handler {
 		Places:        c.Places,
 		Queue:         c.Queue,
 	}))
+	t.PathPrefix("/links").Handler(link.NewHandler(&link.Config{
+		UserStore: c.UserStore,
+		OG:        c.OG,
+	}))
 	t.PathPrefix("/notes").Handler(note.NewHandler(&note.Config{
 		UserStore: c.UserStore,
 		NoteStore: c.NoteStore,
 		OG:        c.OG,
 	}))
+	t.PathPrefix("/search").Handler(search.NewHandler(&search.Config{
+		UserStore:   c.UserStore,
+		SearchStore: c.SearchStore,
+	}))
 
 	h := middleware.WithCORS(router)
 	h = middleware.WithLogging(h)
@@ -3,11 +3,16 @@ package inbound
 import (
 	"fmt"
 	"html"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"path"
+	"strings"
 
 	"github.com/gorilla/mux"
 
 	"github.com/hiconvo/api/clients/magic"
+	notif "github.com/hiconvo/api/clients/notification"
 	"github.com/hiconvo/api/clients/opengraph"
 	"github.com/hiconvo/api/clients/pluck"
 	"github.com/hiconvo/api/clients/storage"
@@ -23,6 +28,8 @@ type Config struct {
 	UserStore    model.UserStore
 	ThreadStore  model.ThreadStore
 	MessageStore model.MessageStore
+	EventStore   model.EventStore
+	Notif        notif.Client
 	Magic        magic.Client
 	Mail         *mail.Client
 	OG           opengraph.Client
@@ -58,6 +65,12 @@ func (c *Config) Inbound(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Calendars reply to invitations at the organizer address of the event
+	if eventID, ok := model.EventInt64IDFromOrganizerEmail(to); ok {
+		c.handleInvitationReply(w, r, eventID, from)
+		return
+	}
+
 	// Get thread id from address
 	threadID, err := c.Pluck.ThreadInt64IDFromAddress(to)
 	if err != nil {
@@ -127,7 +140,7 @@ func (c *Config) Inbound(w http.ResponseWriter, r *http.Request) {
 		c.OG,
 		&model.NewMessageInput{
 			User:   user,
-			Parent: thread.Key,
+			Parent: thread.ID,
 			Body:   html.UnescapeString(payload.Body),
 		})
 	if err != nil {
@@ -136,7 +149,7 @@ func (c *Config) Inbound(w http.ResponseWriter, r *http.Request) {
 	}
 
 	model.ClearReads(thread)
-	model.MarkAsRead(thread, user.Key)
+	model.MarkAsRead(thread, user.ID)
 
 	if err := c.MessageStore.Commit(ctx, message); err != nil {
 		handleServerErrorResponse(w, err)
@@ -163,6 +176,143 @@ func (c *Config) Inbound(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(fmt.Sprintf("PASS: message %s created", message.ID)))
 }
 
+// handleInvitationReply records the RSVP in an iTIP REPLY that a calendar
+// sent about an invitation from the event with the given Int64ID. Replies
+// are sent without the user writing them, so no one is emailed about
+// replies that cannot be recorded.
+func (c *Config) handleInvitationReply(w http.ResponseWriter, r *http.Request, int64ID int64, from string) {
+	op := errors.Op("handler.handleInvitationReply")
+	ctx := r.Context()
+
+	raw, err := calendarAttachment(r)
+	if err != nil {
+		handleClientErrorResponse(w, errors.E(op, err))
+		return
+	}
+
+	id, status, err := model.ParseInvitationReply(raw, from)
+	if err != nil {
+		handleClientErrorResponse(w, errors.E(op, err))
+		return
+	}
+
+	u, found, err := c.UserStore.GetUserByEmail(ctx, from)
+	if err != nil {
+		handleServerErrorResponse(w, errors.E(op, err))
+		return
+	} else if !found {
+		handleClientErrorResponse(w, errors.E(op, errors.Str("Email not recognized")))
+		return
+	}
+
+	var (
+		event    *model.Event
+		promoted []model.ID
+	)
+
+	err = model.RetryOnConflict(func(attempt int) error {
+		var err error
+		if event, err = c.EventStore.GetEventByID(ctx, id); err != nil {
+			return err
+		}
+
+		if event.Int64ID != int64ID || !event.HasUser(u) {
+			return errors.E(op, errors.Str("permission denied"), http.StatusNotFound)
+		}
+
+		if err := event.SetRSVPStatus(u, status); err != nil {
+			return err
+		}
+
+		// Users who stop going make room for others.
+		promoted = event.PromoteWaitlist()
+
+		return c.EventStore.Commit(ctx, event)
+	})
+	if err != nil {
+		handleClientErrorResponse(w, errors.E(op, err))
+		return
+	}
+
+	n := &notif.Notification{
+		UserIDs:    []string{event.OwnerID.String()},
+		Actor:      u.FullName,
+		Verb:       notif.AddRSVP,
+		Target:     notif.Event,
+		TargetID:   event.ID.String(),
+		TargetName: event.Name,
+	}
+
+	switch status {
+	case model.RSVPMaybe:
+		n.Verb = notif.MaybeRSVP
+	case model.RSVPDeclined:
+		n.Verb = notif.DeclineRSVP
+	}
+
+	if err := c.Notif.Put(ctx, n); err != nil {
+		log.Alarm(errors.E(op, err))
+	}
+
+	if len(promoted) > 0 {
+		if err := c.Notif.Put(ctx, &notif.Notification{
+			UserIDs:    model.IDStrings(promoted),
+			Actor:      event.Owner.FullName,
+			Verb:       notif.PromoteRSVP,
+			Target:     notif.Event,
+			TargetID:   event.ID.String(),
+			TargetName: event.Name,
+		}); err != nil {
+			log.Alarm(errors.E(op, err))
+		}
+
+		for i := range event.Users {
+			for _, pid := range promoted {
+				if event.Users[i].ID != pid {
+					continue
+				}
+
+				if err := c.Mail.SendWaitlistPromotion(c.Magic, event, event.Users[i]); err != nil {
+					log.Alarm(errors.E(op, err))
+				}
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("PASS: rsvp to event %s recorded", event.ID)))
+}
+
+// calendarAttachment returns the contents of the first iCalendar file
+// attached to the email.
+func calendarAttachment(r *http.Request) (string, error) {
+	op := errors.Op("handler.calendarAttachment")
+
+	for _, headers := range r.MultipartForm.File {
+		for _, h := range headers {
+			mediaType, _, _ := mime.ParseMediaType(h.Header.Get("Content-Type"))
+			if mediaType != "text/calendar" && !strings.EqualFold(path.Ext(h.Filename), ".ics") {
+				continue
+			}
+
+			f, err := h.Open()
+			if err != nil {
+				return "", errors.E(op, err)
+			}
+			defer f.Close()
+
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				return "", errors.E(op, err)
+			}
+
+			return string(b), nil
+		}
+	}
+
+	return "", errors.E(op, errors.Str("no calendar attached"))
+}
+
 func handleClientErrorResponse(w http.ResponseWriter, err error) {
 	log.Alarm(errors.E(errors.Op("inboundClientError"), err))
 	w.WriteHeader(http.StatusOK)
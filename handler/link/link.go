@@ -0,0 +1,46 @@
+package link
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hiconvo/api/bjson"
+	"github.com/hiconvo/api/clients/opengraph"
+	"github.com/hiconvo/api/handler/middleware"
+	"github.com/hiconvo/api/model"
+)
+
+type Config struct {
+	UserStore model.UserStore
+	OG        opengraph.Client
+}
+
+func NewHandler(c *Config) *mux.Router {
+	r := mux.NewRouter()
+
+	r.Use(middleware.WithUser(c.UserStore))
+	r.HandleFunc("/links/preview", c.GetLinkPreview).Methods("GET")
+
+	return r
+}
+
+// GetLinkPreview returns the preview of the given URL so that it can be
+// shown before a message is posted.
+func (c *Config) GetLinkPreview(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		bjson.WriteJSON(w, map[string]string{"message": "url cannot be empty"}, http.StatusBadRequest)
+		return
+	}
+
+	link, err := c.OG.Fetch(ctx, url)
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	bjson.WriteJSON(w, link, http.StatusOK)
+}
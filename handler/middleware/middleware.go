@@ -39,7 +39,8 @@ func WithErrorReporting(next http.Handler) http.Handler {
 var corsHandler = handlers.CORS(
 	handlers.AllowedOrigins([]string{"*"}),
 	handlers.AllowedMethods([]string{"GET", "PATCH", "POST", "DELETE"}),
-	handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+	handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "If-Match"}),
+	handlers.ExposedHeaders([]string{"ETag"}),
 )
 
 // WithCORS adds OPTIONS endpoints and validates CORS permissions and validation.
@@ -108,13 +109,14 @@ func ThreadFromContext(ctx context.Context) *model.Thread {
 }
 
 // WithThread adds the thread indicated in the url to the context. If the thread
-// cannot be found, then a 404 response is returned.
+// cannot be found, then a 404 response is returned. Write requests with an
+// If-Match header that does not match the thread get a 412 response.
 func WithThread(s model.ThreadStore) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			vars := mux.Vars(r)
-			id := vars["threadID"]
+			id := model.ID(vars["threadID"])
 
 			thread, err := s.GetThreadByID(ctx, id)
 			if err != nil {
@@ -122,6 +124,11 @@ func WithThread(s model.ThreadStore) func(http.Handler) http.Handler {
 				return
 			}
 
+			if err := checkIfMatch(r, thread); err != nil {
+				bjson.HandleError(w, errors.E(errors.Op("middleware.WithThread"), err))
+				return
+			}
+
 			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, threadKey, thread)))
 		})
 	}
@@ -133,14 +140,15 @@ func EventFromContext(ctx context.Context) *model.Event {
 	return ctx.Value(eventKey).(*model.Event)
 }
 
-// WithEvent adds the thread indicated in the url to the context. If the thread
-// cannot be found, then a 404 response is returned.
+// WithEvent adds the event indicated in the url to the context. If the event
+// cannot be found, then a 404 response is returned. Write requests with an
+// If-Match header that does not match the event get a 412 response.
 func WithEvent(s model.EventStore) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			vars := mux.Vars(r)
-			id := vars["eventID"]
+			id := model.ID(vars["eventID"])
 
 			event, err := s.GetEventByID(ctx, id)
 			if err != nil {
@@ -148,6 +156,11 @@ func WithEvent(s model.EventStore) func(http.Handler) http.Handler {
 				return
 			}
 
+			if err := checkIfMatch(r, event); err != nil {
+				bjson.HandleError(w, errors.E(errors.Op("middleware.WithEvent"), err))
+				return
+			}
+
 			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, eventKey, event)))
 		})
 	}
@@ -159,8 +172,9 @@ func NoteFromContext(ctx context.Context) *model.Note {
 	return ctx.Value(noteKey).(*model.Note)
 }
 
-// WithEvent adds the thread indicated in the url to the context. If the thread
-// cannot be found, then a 404 response is returned.
+// WithNote adds the note indicated in the url to the context. If the note
+// cannot be found, then a 404 response is returned. Write requests with an
+// If-Match header that does not match the note get a 412 response.
 func WithNote(s model.NoteStore) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -168,7 +182,7 @@ func WithNote(s model.NoteStore) func(http.Handler) http.Handler {
 			ctx := r.Context()
 			u := UserFromContext(ctx)
 			vars := mux.Vars(r)
-			id := vars["noteID"]
+			id := model.ID(vars["noteID"])
 
 			n, err := s.GetNoteByID(ctx, id)
 			if err != nil {
@@ -176,17 +190,87 @@ func WithNote(s model.NoteStore) func(http.Handler) http.Handler {
 				return
 			}
 
-			if !n.OwnerKey.Equal(u.Key) {
+			if n.OwnerID != u.ID {
 				bjson.HandleError(w, errors.E(
 					op, errors.Str("no permission"), http.StatusNotFound))
 				return
 			}
 
+			if err := checkIfMatch(r, n); err != nil {
+				bjson.HandleError(w, errors.E(op, err))
+				return
+			}
+
 			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, noteKey, n)))
 		})
 	}
 }
 
+// checkIfMatch returns a 412 error if r is a write request with an If-Match
+// header that does not match the entity tag of x, which means that the
+// client loaded a version of x that has been changed since.
+func checkIfMatch(r *http.Request, x bjson.ETagger) error {
+	val := r.Header.Get("If-Match")
+	if val == "" || !isWriteRequest(r.Method) {
+		return nil
+	}
+
+	etag := x.ETag()
+	for _, tag := range strings.Split(val, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return nil
+		}
+	}
+
+	return errors.E(
+		errors.Op("middleware.checkIfMatch"),
+		errors.Errorf("If-Match %s does not match %s", val, etag),
+		http.StatusPreconditionFailed)
+}
+
+// RetryOnConflict calls f with the transaction of the request and commits
+// the transaction. When that fails because of a concurrent change, f is
+// called again with a new transaction in ctx, up to a few times. Whatever f
+// loaded before is stale by then, so f must load what it changes again when
+// attempt is not zero. This is only suitable for changes that can be applied
+// on top of any other change, such as RSVPs and marking something as read.
+func RetryOnConflict(
+	ctx context.Context,
+	c db.Client,
+	f func(ctx context.Context, tx db.Transaction, attempt int) error,
+) error {
+	tx, _ := TransactionFromContext(ctx)
+
+	err := model.RetryOnConflict(func(attempt int) error {
+		if attempt > 0 {
+			if tx.Pending() {
+				tx.Rollback()
+			}
+
+			nctx, ntx, err := AddTransactionToContext(ctx, c)
+			if err != nil {
+				return err
+			}
+
+			ctx, tx = nctx, ntx
+		}
+
+		if err := f(ctx, tx, attempt); err != nil {
+			return err
+		}
+
+		_, err := tx.Commit()
+
+		return err
+	})
+
+	if tx.Pending() {
+		tx.Rollback()
+	}
+
+	return err
+}
+
 // TransactionFromContext extracts a transaction from the given
 // context is one is present.
 func TransactionFromContext(ctx context.Context) (db.Transaction, bool) {
@@ -28,6 +28,7 @@ func NewHandler(c *Config) *mux.Router {
 	r.Use(middleware.WithUser(c.UserStore))
 	r.HandleFunc("/notes", c.CreateNote).Methods("POST")
 	r.HandleFunc("/notes", c.GetNotes).Methods("GET")
+	r.HandleFunc("/notes/{noteID}/restore", c.RestoreNote).Methods("POST")
 
 	s := r.NewRoute().Subrouter()
 	s.Use(middleware.WithNote(c.NoteStore))
@@ -204,7 +205,7 @@ func (c *Config) UpdateNote(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := c.NoteStore.Commit(ctx, n); err != nil {
-		log.Alarm(errors.Errorf("Inconsistent data detected for u=%s note=%v", u.Email, n.Key.ID))
+		log.Alarm(errors.Errorf("Inconsistent data detected for u=%s note=%s", u.Email, n.ID))
 		bjson.HandleError(w, errors.E(op, err))
 		return
 	}
@@ -218,7 +219,9 @@ func (c *Config) DeleteNote(w http.ResponseWriter, r *http.Request) {
 	n := middleware.NoteFromContext(ctx)
 	u := middleware.UserFromContext(ctx)
 
-	userChanged, err := model.TabulateNoteTags(u, n, []string{})
+	// The tags are tabulated on a copy so that the note keeps them in case
+	// it is restored.
+	userChanged, err := model.TabulateNoteTags(u, &model.Note{Tags: n.Tags}, []string{})
 	if err != nil {
 		bjson.HandleError(w, errors.E(op, err))
 		return
@@ -238,3 +241,42 @@ func (c *Config) DeleteNote(w http.ResponseWriter, r *http.Request) {
 
 	bjson.WriteJSON(w, n, http.StatusOK)
 }
+
+// RestoreNote allows the owner to undo the deletion of the note.
+func (c *Config) RestoreNote(w http.ResponseWriter, r *http.Request) {
+	op := errors.Op("handlers.RestoreNote")
+	ctx := r.Context()
+	u := middleware.UserFromContext(ctx)
+	id := model.ID(mux.Vars(r)["noteID"])
+
+	n, err := c.NoteStore.GetDeletedNoteByID(ctx, id)
+	if err != nil {
+		bjson.HandleError(w, errors.E(op, err, http.StatusNotFound))
+		return
+	}
+
+	if n.OwnerID != u.ID {
+		bjson.HandleError(w, errors.E(op, errors.Str("no permission"), http.StatusNotFound))
+		return
+	}
+
+	userChanged, err := model.TabulateNoteTags(u, &model.Note{}, n.Tags)
+	if err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
+	if err := c.NoteStore.Restore(ctx, n); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
+	if userChanged {
+		if err := c.UserStore.Commit(ctx, u); err != nil {
+			bjson.HandleError(w, errors.E(op, err))
+			return
+		}
+	}
+
+	bjson.WriteJSON(w, n, http.StatusOK)
+}
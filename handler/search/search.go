@@ -0,0 +1,70 @@
+package search
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hiconvo/api/bjson"
+	"github.com/hiconvo/api/handler/middleware"
+	"github.com/hiconvo/api/model"
+)
+
+type Config struct {
+	UserStore   model.UserStore
+	SearchStore model.SearchStore
+}
+
+func NewHandler(c *Config) *mux.Router {
+	r := mux.NewRouter()
+
+	r.Use(middleware.WithUser(c.UserStore))
+	r.HandleFunc("/search", c.Search).Methods("GET")
+
+	return r
+}
+
+// Search searches the notes, threads, messages and events of the user and
+// all people at once. Results can be limited to some types by passing a
+// comma separated list of types as the type query parameter.
+func (c *Config) Search(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := middleware.UserFromContext(ctx)
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		bjson.WriteJSON(w, map[string]string{"message": "q cannot be empty"}, http.StatusBadRequest)
+		return
+	}
+
+	types := make([]model.SearchResultType, 0)
+
+	for _, val := range r.URL.Query()["type"] {
+		for _, s := range strings.Split(val, ",") {
+			t := model.SearchResultType(strings.ToLower(strings.TrimSpace(s)))
+			if t == "" {
+				continue
+			}
+
+			if !t.IsValid() {
+				bjson.WriteJSON(w, map[string]string{"message": "invalid type"}, http.StatusBadRequest)
+				return
+			}
+
+			types = append(types, t)
+		}
+	}
+
+	results, err := c.SearchStore.Search(ctx, u, &model.SearchInput{
+		Query:      query,
+		Types:      types,
+		Pagination: model.GetPagination(r),
+	})
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	bjson.WriteJSON(w, results, http.StatusOK)
+}
@@ -1,6 +1,7 @@
 package task
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -8,13 +9,19 @@ import (
 	"github.com/hiconvo/api/bjson"
 	"github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/clients/magic"
+	notif "github.com/hiconvo/api/clients/notification"
 	"github.com/hiconvo/api/clients/queue"
 	"github.com/hiconvo/api/clients/storage"
 	"github.com/hiconvo/api/digest"
 	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/linkcache"
 	"github.com/hiconvo/api/log"
 	"github.com/hiconvo/api/mail"
 	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/outbox"
+	"github.com/hiconvo/api/purge"
+	"github.com/hiconvo/api/reminder"
+	"github.com/hiconvo/api/usercache"
 )
 
 type Config struct {
@@ -23,17 +30,27 @@ type Config struct {
 	ThreadStore  model.ThreadStore
 	EventStore   model.EventStore
 	MessageStore model.MessageStore
+	NoteStore    model.NoteStore
 	Welcome      model.Welcomer
 	Mail         *mail.Client
 	Magic        magic.Client
+	Notif        notif.Client
 	Storage      *storage.Client
+	Links        linkcache.Client
+	Outbox       outbox.Client
 }
 
 func NewHandler(c *Config) *mux.Router {
 	r := mux.NewRouter()
 
+	r.HandleFunc("/tasks/cancellations", c.CancelDeleted)
 	r.HandleFunc("/tasks/digest", c.CreateDigest)
 	r.HandleFunc("/tasks/emails", c.SendEmailsAsync)
+	r.HandleFunc("/tasks/links", c.RefreshLinks)
+	r.HandleFunc("/tasks/outbox", c.DispatchOutbox)
+	r.HandleFunc("/tasks/purge", c.PurgeDeleted)
+	r.HandleFunc("/tasks/reminders", c.ScheduleReminders)
+	r.HandleFunc("/tasks/usercache", c.UserCacheStats)
 
 	return r
 }
@@ -65,6 +82,148 @@ func (c *Config) CreateDigest(w http.ResponseWriter, r *http.Request) {
 	bjson.WriteJSON(w, map[string]string{"message": "pass"}, http.StatusOK)
 }
 
+func (c *Config) RefreshLinks(w http.ResponseWriter, r *http.Request) {
+	if val := r.Header.Get("X-Appengine-Cron"); val != "true" {
+		bjson.WriteJSON(w, map[string]string{
+			"message": "Not found",
+		}, http.StatusNotFound)
+
+		return
+	}
+
+	count, err := c.Links.Refresh(r.Context())
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	log.Printf("handlers.RefreshLinks: refreshed %d link previews", count)
+
+	bjson.WriteJSON(w, map[string]string{"message": "pass"}, http.StatusOK)
+}
+
+// DispatchOutbox retries the side effects that could not be delivered when
+// they were recorded.
+func (c *Config) DispatchOutbox(w http.ResponseWriter, r *http.Request) {
+	if val := r.Header.Get("X-Appengine-Cron"); val != "true" {
+		bjson.WriteJSON(w, map[string]string{
+			"message": "Not found",
+		}, http.StatusNotFound)
+
+		return
+	}
+
+	count, err := c.Outbox.Dispatch(r.Context())
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	log.Printf("handlers.DispatchOutbox: delivered %d outbox messages", count)
+
+	bjson.WriteJSON(w, map[string]string{"message": "pass"}, http.StatusOK)
+}
+
+// PurgeDeleted permanently deletes the threads, events, messages and notes
+// that were deleted longer ago than they can be restored.
+func (c *Config) PurgeDeleted(w http.ResponseWriter, r *http.Request) {
+	if val := r.Header.Get("X-Appengine-Cron"); val != "true" {
+		bjson.WriteJSON(w, map[string]string{
+			"message": "Not found",
+		}, http.StatusNotFound)
+
+		return
+	}
+
+	count, err := c.purger().Purge(r.Context())
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	log.Printf("handlers.PurgeDeleted: purged %d deleted entities", count)
+
+	bjson.WriteJSON(w, map[string]string{"message": "pass"}, http.StatusOK)
+}
+
+// CancelDeleted tells the guests of deleted events that have not happened
+// yet that they were cancelled, once model.CancelDelay has passed.
+func (c *Config) CancelDeleted(w http.ResponseWriter, r *http.Request) {
+	if val := r.Header.Get("X-Appengine-Cron"); val != "true" {
+		bjson.WriteJSON(w, map[string]string{
+			"message": "Not found",
+		}, http.StatusNotFound)
+
+		return
+	}
+
+	count, err := c.purger().CancelDeleted(r.Context())
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	log.Printf("handlers.CancelDeleted: cancelled %d deleted events", count)
+
+	bjson.WriteJSON(w, map[string]string{"message": "pass"}, http.StatusOK)
+}
+
+// getEventToCancel returns the event whose guests are told that it was
+// cancelled, which may have been deleted.
+func (c *Config) getEventToCancel(ctx context.Context, id model.ID) (*model.Event, error) {
+	e, err := c.EventStore.GetEventByID(ctx, id)
+	if err == nil {
+		return e, nil
+	}
+
+	if deleted, derr := c.EventStore.GetDeletedEventByID(ctx, id); derr == nil {
+		return deleted, nil
+	}
+
+	return nil, err
+}
+
+func (c *Config) purger() purge.Purger {
+	return purge.New(&purge.Config{
+		DB:           c.DB,
+		Queue:        c.Outbox,
+		ThreadStore:  c.ThreadStore,
+		EventStore:   c.EventStore,
+		MessageStore: c.MessageStore,
+		NoteStore:    c.NoteStore,
+		Mail:         c.Mail,
+		Magic:        c.Magic,
+		Notif:        c.Notif,
+	})
+}
+
+// ScheduleReminders queues the reminder emails of events that are due.
+func (c *Config) ScheduleReminders(w http.ResponseWriter, r *http.Request) {
+	if val := r.Header.Get("X-Appengine-Cron"); val != "true" {
+		bjson.WriteJSON(w, map[string]string{
+			"message": "Not found",
+		}, http.StatusNotFound)
+
+		return
+	}
+
+	s := reminder.New(&reminder.Config{
+		DB:         c.DB,
+		EventStore: c.EventStore,
+		Queue:      c.Outbox,
+	})
+
+	count, err := s.Schedule(r.Context())
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	log.Printf("handlers.ScheduleReminders: reminded guests of %d events", count)
+
+	bjson.WriteJSON(w, map[string]string{"message": "pass"}, http.StatusOK)
+}
+
 func (c *Config) SendEmailsAsync(w http.ResponseWriter, r *http.Request) {
 	var (
 		op      errors.Op = "handlers.SendEmailsAsync"
@@ -88,7 +247,7 @@ func (c *Config) SendEmailsAsync(w http.ResponseWriter, r *http.Request) {
 	for i := range payload.IDs {
 		switch payload.Type {
 		case queue.User:
-			u, err := c.UserStore.GetUserByID(ctx, payload.IDs[i])
+			u, err := c.UserStore.GetUserByID(ctx, model.ID(payload.IDs[i]))
 			if err != nil {
 				log.Alarm(errors.E(op, err))
 				break
@@ -102,7 +261,15 @@ func (c *Config) SendEmailsAsync(w http.ResponseWriter, r *http.Request) {
 				log.Alarm(errors.E(op, err))
 			}
 		case queue.Event:
-			e, err := c.EventStore.GetEventByID(ctx, payload.IDs[i])
+			var (
+				e   *model.Event
+				err error
+			)
+			if payload.Action == queue.SendCancellation {
+				e, err = c.getEventToCancel(ctx, model.ID(payload.IDs[i]))
+			} else {
+				e, err = c.EventStore.GetEventByID(ctx, model.ID(payload.IDs[i]))
+			}
 			if err != nil {
 				log.Alarm(errors.E(op, err))
 				break
@@ -112,6 +279,10 @@ func (c *Config) SendEmailsAsync(w http.ResponseWriter, r *http.Request) {
 				err = c.Mail.SendEventInvites(c.Magic, e, false)
 			} else if payload.Action == queue.SendUpdatedInvites {
 				err = c.Mail.SendEventInvites(c.Magic, e, true)
+			} else if payload.Action == queue.SendReminders {
+				err = c.Mail.SendEventReminders(c.Magic, e, payload.Occurrence)
+			} else if payload.Action == queue.SendCancellation {
+				err = c.Mail.SendCancellation(c.Magic, e, e.CancelMessage)
 			}
 
 			if err != nil {
@@ -119,7 +290,7 @@ func (c *Config) SendEmailsAsync(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 		case queue.Thread:
-			thread, err := c.ThreadStore.GetThreadByID(ctx, payload.IDs[i])
+			thread, err := c.ThreadStore.GetThreadByID(ctx, model.ID(payload.IDs[i]))
 			if err != nil {
 				log.Alarm(errors.E(op, err))
 				break
@@ -141,7 +312,7 @@ func (c *Config) SendEmailsAsync(w http.ResponseWriter, r *http.Request) {
 				// such users with a digest, we mark the thread as read for these users.
 				for i := range thread.Users {
 					if !thread.Users[i].IsRegistered() {
-						model.MarkAsRead(thread, thread.Users[i].Key)
+						model.MarkAsRead(thread, thread.Users[i].ID)
 					}
 				}
 
@@ -155,3 +326,30 @@ func (c *Config) SendEmailsAsync(w http.ResponseWriter, r *http.Request) {
 
 	bjson.WriteJSON(w, map[string]string{"message": "pass"}, http.StatusOK)
 }
+
+// UserCacheStats logs and returns the hits and misses of the user cache of
+// the instance that handles the request.
+func (c *Config) UserCacheStats(w http.ResponseWriter, r *http.Request) {
+	if val := r.Header.Get("X-Appengine-Cron"); val != "true" {
+		bjson.WriteJSON(w, map[string]string{
+			"message": "Not found",
+		}, http.StatusNotFound)
+
+		return
+	}
+
+	store, ok := c.UserStore.(usercache.Store)
+	if !ok {
+		bjson.WriteJSON(w, map[string]string{
+			"message": "Not found",
+		}, http.StatusNotFound)
+
+		return
+	}
+
+	stats := store.Stats()
+
+	log.Printf("handlers.UserCacheStats: %d hits, %d misses, %d entries", stats.Hits, stats.Misses, stats.Size)
+
+	bjson.WriteJSON(w, stats, http.StatusOK)
+}
@@ -1,13 +1,14 @@
 package thread
 
 import (
+	"context"
 	"html"
 	"net/http"
 
-	"cloud.google.com/go/datastore"
 	"github.com/gorilla/mux"
 
 	"github.com/hiconvo/api/bjson"
+	dbc "github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/clients/magic"
 	notif "github.com/hiconvo/api/clients/notification"
 	"github.com/hiconvo/api/clients/opengraph"
@@ -22,6 +23,7 @@ import (
 )
 
 type Config struct {
+	DB            dbc.Client
 	UserStore     model.UserStore
 	ThreadStore   model.ThreadStore
 	MessageStore  model.MessageStore
@@ -40,6 +42,8 @@ func NewHandler(c *Config) *mux.Router {
 	r.Use(middleware.WithUser(c.UserStore))
 	r.HandleFunc("/threads", c.CreateThread).Methods("POST")
 	r.HandleFunc("/threads", c.GetThreads).Methods("GET")
+	r.HandleFunc("/threads/search", c.SearchThreads).Methods("GET")
+	r.HandleFunc("/threads/{threadID}/restore", c.RestoreThread).Methods("POST")
 
 	s := r.NewRoute().Subrouter()
 	s.Use(middleware.WithThread(c.ThreadStore))
@@ -55,6 +59,7 @@ func NewHandler(c *Config) *mux.Router {
 	t.HandleFunc("/threads/{threadID}/users/{userID}", c.RemoveUserFromThread).Methods("DELETE")
 	t.HandleFunc("/threads/{threadID}/messages", c.AddMessageToThread).Methods("POST")
 	t.HandleFunc("/threads/{threadID}/messages/{messageID}", c.DeleteThreadMessage).Methods("DELETE")
+	t.HandleFunc("/threads/{threadID}/messages/{messageID}/restore", c.RestoreThreadMessage).Methods("POST")
 
 	return r
 }
@@ -120,7 +125,7 @@ func (c *Config) CreateThread(w http.ResponseWriter, r *http.Request) {
 
 	if thread.IsSendable() {
 		if err := c.Queue.PutEmail(ctx, queue.EmailPayload{
-			IDs:    []string{thread.ID},
+			IDs:    []string{thread.ID.String()},
 			Type:   queue.Thread,
 			Action: queue.SendThread,
 		}); err != nil {
@@ -146,6 +151,28 @@ func (c *Config) GetThreads(w http.ResponseWriter, r *http.Request) {
 	bjson.WriteJSON(w, map[string][]*model.Thread{"threads": threads}, http.StatusOK)
 }
 
+// SearchThreads searches the threads, and their messages, of which the
+// user is a member.
+func (c *Config) SearchThreads(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := middleware.UserFromContext(ctx)
+	p := model.GetPagination(r)
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		bjson.WriteJSON(w, map[string]string{"message": "q cannot be empty"}, http.StatusBadRequest)
+		return
+	}
+
+	results, err := c.ThreadStore.Search(ctx, u, query, p)
+	if err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
+	bjson.WriteJSON(w, map[string]interface{}{"results": results}, http.StatusOK)
+}
+
 // GetThread gets a thread.
 func (c *Config) GetThread(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -180,8 +207,7 @@ func (c *Config) DeleteThread(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Delete messages too
-
+	// The messages are hidden along with the thread and purged with it.
 	if err := c.ThreadStore.Delete(ctx, thread); err != nil {
 		bjson.HandleError(w, err)
 		return
@@ -190,6 +216,32 @@ func (c *Config) DeleteThread(w http.ResponseWriter, r *http.Request) {
 	bjson.WriteJSON(w, thread, http.StatusOK)
 }
 
+// RestoreThread allows the owner to undo the deletion of the thread.
+func (c *Config) RestoreThread(w http.ResponseWriter, r *http.Request) {
+	op := errors.Op("handlers.RestoreThread")
+	ctx := r.Context()
+	u := middleware.UserFromContext(ctx)
+	id := model.ID(mux.Vars(r)["threadID"])
+
+	thread, err := c.ThreadStore.GetDeletedThreadByID(ctx, id)
+	if err != nil {
+		bjson.HandleError(w, errors.E(op, err, http.StatusNotFound))
+		return
+	}
+
+	if !thread.OwnerIs(u) {
+		bjson.HandleError(w, errors.E(op, errors.Str("no permission"), http.StatusNotFound))
+		return
+	}
+
+	if err := c.ThreadStore.Restore(ctx, thread); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
+	bjson.WriteJSON(w, thread, http.StatusOK)
+}
+
 // GetMessagesByThread gets the messages from the given thread.
 func (c *Config) GetMessagesByThread(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -217,7 +269,6 @@ func (c *Config) GetMessagesByThread(w http.ResponseWriter, r *http.Request) {
 
 func (c *Config) MarkThreadAsRead(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	tx, _ := middleware.TransactionFromContext(ctx)
 	user := middleware.UserFromContext(ctx)
 	thread := middleware.ThreadFromContext(ctx)
 
@@ -230,25 +281,31 @@ func (c *Config) MarkThreadAsRead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if model.IsRead(thread, user.Key) {
+	if model.IsRead(thread, user.ID) {
 		bjson.WriteJSON(w, thread, http.StatusOK)
 		return
 	}
 
-	if err := model.MarkMessagesAsRead(ctx, c.MessageStore, user, thread.Key); err != nil {
-		bjson.HandleError(w, err)
-		return
-	}
+	err := middleware.RetryOnConflict(ctx, c.DB, func(ctx context.Context, tx dbc.Transaction, attempt int) error {
+		if attempt > 0 {
+			var err error
+			if thread, err = c.ThreadStore.GetThreadByID(ctx, thread.ID); err != nil {
+				return err
+			}
+		}
 
-	model.MarkAsRead(thread, user.Key)
-	thread.UserReads = model.MapReadsToUserPartials(thread, thread.Users)
+		if err := model.MarkMessagesAsRead(ctx, c.MessageStore, user, thread.ID); err != nil {
+			return err
+		}
 
-	if _, err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
-		bjson.HandleError(w, err)
-		return
-	}
+		model.MarkAsRead(thread, user.ID)
+		thread.UserReads = model.MapReadsToUserPartials(thread, thread.Users)
 
-	if _, err := tx.Commit(); err != nil {
+		err := c.ThreadStore.CommitWithTransaction(tx, thread)
+
+		return err
+	})
+	if err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
@@ -290,7 +347,7 @@ func (c *Config) UpdateThread(w http.ResponseWriter, r *http.Request) {
 
 	thread.Subject = html.UnescapeString(payload.Subject)
 
-	if _, err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
+	if err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
@@ -331,7 +388,7 @@ func (c *Config) AddUserToThread(w http.ResponseWriter, r *http.Request) {
 	)
 
 	if _, ee := valid.Email(maybeUserID); ee != nil {
-		userToBeAdded, err = c.UserStore.GetUserByID(ctx, maybeUserID)
+		userToBeAdded, err = c.UserStore.GetUserByID(ctx, model.ID(maybeUserID))
 	} else {
 		userToBeAdded, created, err = c.UserStore.GetOrCreateUserByEmail(ctx, maybeUserID)
 	}
@@ -346,19 +403,14 @@ func (c *Config) AddUserToThread(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
-		bjson.HandleError(w, err)
-		return
-	}
-
-	if _, err := tx.Commit(); err != nil {
+	if err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
 
 	if created {
 		err := c.Queue.PutEmail(ctx, queue.EmailPayload{
-			IDs:    []string{thread.ID},
+			IDs:    []string{thread.ID.String()},
 			Type:   queue.Thread,
 			Action: queue.SendThread,
 		})
@@ -367,18 +419,23 @@ func (c *Config) AddUserToThread(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := c.Notif.Put(&notif.Notification{
-		UserKeys:   []*datastore.Key{userToBeAdded.Key},
+	if err := c.Notif.Put(ctx, &notif.Notification{
+		UserIDs:    []string{userToBeAdded.ID.String()},
 		Actor:      u.FullName,
 		Verb:       notif.NewMessage,
 		Target:     notif.Thread,
-		TargetID:   thread.ID,
+		TargetID:   thread.ID.String(),
 		TargetName: thread.Subject,
 	}); err != nil {
 		// Log the error but don't fail the request
 		log.Alarm(err)
 	}
 
+	if _, err := tx.Commit(); err != nil {
+		bjson.HandleError(w, err)
+		return
+	}
+
 	bjson.WriteJSON(w, thread, http.StatusOK)
 }
 
@@ -392,7 +449,7 @@ func (c *Config) RemoveUserFromThread(w http.ResponseWriter, r *http.Request) {
 	thread := middleware.ThreadFromContext(ctx)
 
 	vars := mux.Vars(r)
-	userID := vars["userID"]
+	userID := model.ID(vars["userID"])
 
 	userToBeRemoved, err := c.UserStore.GetUserByID(ctx, userID)
 	if err != nil {
@@ -402,9 +459,9 @@ func (c *Config) RemoveUserFromThread(w http.ResponseWriter, r *http.Request) {
 
 	// If the requestor is the owner or the requestor is the user to be
 	// removed, then remove the user.
-	if thread.HasUser(userToBeRemoved) && (thread.OwnerIs(u) || userToBeRemoved.Key.Equal(u.Key)) {
+	if thread.HasUser(userToBeRemoved) && (thread.OwnerIs(u) || userToBeRemoved.ID == u.ID) {
 		// The owner cannot remove herself
-		if userToBeRemoved.Key.Equal(thread.OwnerKey) {
+		if thread.OwnerIs(userToBeRemoved) {
 			bjson.HandleError(w, errors.E(op,
 				map[string]string{"message": "The Convo owner cannot be removed from the convo"},
 				http.StatusBadRequest,
@@ -422,7 +479,7 @@ func (c *Config) RemoveUserFromThread(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Save the thread.
-	if _, err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
+	if err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
 		bjson.HandleError(w, err)
 		return
 	}
@@ -471,7 +528,7 @@ func (c *Config) AddMessageToThread(w http.ResponseWriter, r *http.Request) {
 		c.OG,
 		&model.NewMessageInput{
 			User:   u,
-			Parent: thread.Key,
+			Parent: thread.ID,
 			Body:   html.UnescapeString(payload.Body),
 			Blob:   payload.Blob,
 		},
@@ -487,35 +544,35 @@ func (c *Config) AddMessageToThread(w http.ResponseWriter, r *http.Request) {
 	}
 
 	model.ClearReads(thread)
-	model.MarkAsRead(thread, u.Key)
+	model.MarkAsRead(thread, u.ID)
 
 	if err := c.MessageStore.Commit(ctx, message); err != nil {
 		bjson.HandleError(w, errors.E(op, err))
 		return
 	}
 
-	if _, err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
+	if err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
 		bjson.HandleError(w, errors.E(op, err))
 		return
 	}
 
-	if _, err := tx.Commit(); err != nil {
-		bjson.HandleError(w, errors.E(op, err))
-		return
-	}
-
-	if err := c.Notif.Put(&notif.Notification{
-		UserKeys:   notif.FilterKey(thread.UserKeys, u.Key),
+	if err := c.Notif.Put(ctx, &notif.Notification{
+		UserIDs:    notif.FilterID(model.IDStrings(thread.UserIDs), u.ID.String()),
 		Actor:      u.FullName,
 		Verb:       notif.NewMessage,
 		Target:     notif.Thread,
-		TargetID:   thread.ID,
+		TargetID:   thread.ID.String(),
 		TargetName: thread.Subject,
 	}); err != nil {
 		// Log the error but don't fail the request
 		log.Alarm(err)
 	}
 
+	if _, err := tx.Commit(); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
 	bjson.WriteJSON(w, message, http.StatusCreated)
 }
 
@@ -527,7 +584,7 @@ func (c *Config) DeleteThreadMessage(w http.ResponseWriter, r *http.Request) {
 	u := middleware.UserFromContext(ctx)
 	thread := middleware.ThreadFromContext(ctx)
 	vars := mux.Vars(r)
-	id := vars["messageID"]
+	id := model.ID(vars["messageID"])
 
 	message, err := c.MessageStore.GetMessageByID(ctx, id)
 	if err != nil {
@@ -544,7 +601,7 @@ func (c *Config) DeleteThreadMessage(w http.ResponseWriter, r *http.Request) {
 	// we assign u to the User field of the message.
 	message.User = model.MapUserToUserPartial(u)
 
-	if !message.ParentKey.Equal(thread.Key) {
+	if message.ParentID != thread.ID {
 		bjson.HandleError(w, errors.E(
 			op, errors.Str("message not a child of thread"), http.StatusNotFound))
 		return
@@ -557,7 +614,49 @@ func (c *Config) DeleteThreadMessage(w http.ResponseWriter, r *http.Request) {
 
 	thread.ResponseCount--
 
-	if _, err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
+	if err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
+	if _, err := tx.Commit(); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
+	bjson.WriteJSON(w, message, http.StatusOK)
+}
+
+// RestoreThreadMessage allows the owner of a message to undo its deletion.
+func (c *Config) RestoreThreadMessage(w http.ResponseWriter, r *http.Request) {
+	op := errors.Op("handlers.RestoreThreadMessage")
+	ctx := r.Context()
+	tx, _ := middleware.TransactionFromContext(ctx)
+	u := middleware.UserFromContext(ctx)
+	thread := middleware.ThreadFromContext(ctx)
+	id := model.ID(mux.Vars(r)["messageID"])
+
+	message, err := c.MessageStore.GetDeletedMessageByID(ctx, id)
+	if err != nil {
+		bjson.HandleError(w, errors.E(op, err, http.StatusNotFound))
+		return
+	}
+
+	if message.ParentID != thread.ID || !message.OwnerIs(u) {
+		bjson.HandleError(w, errors.E(op, errors.Str("no permission"), http.StatusNotFound))
+		return
+	}
+
+	message.User = model.MapUserToUserPartial(u)
+
+	if err := c.MessageStore.Restore(ctx, message); err != nil {
+		bjson.HandleError(w, errors.E(op, err))
+		return
+	}
+
+	thread.ResponseCount++
+
+	if err := c.ThreadStore.CommitWithTransaction(tx, thread); err != nil {
 		bjson.HandleError(w, errors.E(op, err))
 		return
 	}
@@ -255,7 +255,7 @@ func (c *Config) OAuth(w http.ResponseWriter, r *http.Request) {
 		_tokenUser, ok, err := c.UserStore.GetUserByToken(ctx, token)
 
 		if ok && err == nil {
-			canMergeTokenUser = !_tokenUser.Key.Incomplete() && !_tokenUser.IsRegistered()
+			canMergeTokenUser = !_tokenUser.ID.IsZero() && !_tokenUser.IsRegistered()
 			tokenUser = _tokenUser
 		}
 	}
@@ -405,7 +405,7 @@ func (c *Config) UpdatePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := c.UserStore.GetUserByID(ctx, payload.UserID)
+	u, err := c.UserStore.GetUserByID(ctx, model.ID(payload.UserID))
 	if err != nil {
 		bjson.HandleError(w, errors.E(
 			errors.Op("handlers.UpdatePassword"),
@@ -453,7 +453,7 @@ func (c *Config) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 func (c *Config) GetUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
-	userID := vars["userID"]
+	userID := model.ID(vars["userID"])
 
 	u, err := c.UserStore.GetUserByID(ctx, userID)
 	if err != nil {
@@ -487,7 +487,7 @@ func (c *Config) VerifyEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := c.UserStore.GetUserByID(ctx, payload.UserID)
+	u, err := c.UserStore.GetUserByID(ctx, model.ID(payload.UserID))
 	if err != nil {
 		bjson.HandleError(w, errors.E(
 			errors.Op("handlers.VerifyEmail"),
@@ -515,7 +515,7 @@ func (c *Config) VerifyEmail(w http.ResponseWriter, r *http.Request) {
 
 	// If there is already an account associated with this email, merge the two accounts.
 	dupUser, found, err := c.UserStore.GetUserByEmail(ctx, payload.Email)
-	if found && !dupUser.Key.Equal(u.Key) {
+	if found && dupUser.ID != u.ID {
 		if err := u.MergeWith(
 			ctx,
 			c.Transacter,
@@ -608,7 +608,7 @@ func (c *Config) MagicLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := c.UserStore.GetUserByID(ctx, payload.UserID)
+	u, err := c.UserStore.GetUserByID(ctx, model.ID(payload.UserID))
 	if err != nil {
 		bjson.HandleError(w, errors.E(op, err, http.StatusUnauthorized))
 		return
@@ -905,7 +905,7 @@ func (c *Config) MagicUnsubscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := c.UserStore.GetUserByID(ctx, payload.UserID)
+	u, err := c.UserStore.GetUserByID(ctx, model.ID(payload.UserID))
 	if err != nil {
 		bjson.HandleError(w, errors.E(op, err, http.StatusUnauthorized))
 		return
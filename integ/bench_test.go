@@ -0,0 +1,134 @@
+package handler_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/testutil"
+)
+
+// countingDBClient counts the round trips to the db that load entities, and
+// how many entities they load.
+type countingDBClient struct {
+	db.Client
+	calls    int
+	entities int
+}
+
+func (c *countingDBClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	c.calls++
+	c.entities++
+
+	return c.Client.Get(ctx, key, dst)
+}
+
+func (c *countingDBClient) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	c.calls++
+	c.entities += len(keys)
+
+	return c.Client.GetMulti(ctx, keys, dst)
+}
+
+func (c *countingDBClient) GetAll(ctx context.Context, q *db.Query, dst interface{}) ([]*datastore.Key, error) {
+	keys, err := c.Client.GetAll(ctx, q, dst)
+
+	c.calls++
+	c.entities += reflect.ValueOf(dst).Elem().Len()
+
+	return keys, err
+}
+
+func (c *countingDBClient) report(b *testing.B) {
+	b.ReportMetric(float64(c.calls)/float64(b.N), "calls/op")
+	b.ReportMetric(float64(c.entities)/float64(b.N), "entities/op")
+}
+
+// newBenchmarkMembers returns an owner and the members that they share a
+// page of threads or events with.
+func newBenchmarkMembers(b *testing.B) (*model.User, []*model.User) {
+	owner, _ := _mock.NewUser(_ctx, b)
+
+	members := make([]*model.User, 5)
+	for i := range members {
+		members[i], _ = _mock.NewUser(_ctx, b)
+	}
+
+	return owner, members
+}
+
+func BenchmarkGetThreadsByUser(b *testing.B) {
+	owner, members := newBenchmarkMembers(b)
+	for i := 0; i < 10; i++ {
+		_mock.NewThread(_ctx, b, owner, members)
+	}
+
+	c := &countingDBClient{Client: _dbClient}
+	s := testutil.NewThreadStore(_ctx, b, c)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		threads, err := s.GetThreadsByUser(_ctx, owner, &model.Pagination{Size: 10})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if len(threads) != 10 {
+			b.Fatalf("got %d threads, want 10", len(threads))
+		}
+	}
+
+	c.report(b)
+}
+
+func BenchmarkGetEventsByUser(b *testing.B) {
+	owner, members := newBenchmarkMembers(b)
+	for i := 0; i < 10; i++ {
+		_mock.NewEvent(_ctx, b, owner, members[:1], members[1:])
+	}
+
+	c := &countingDBClient{Client: _dbClient}
+	s := testutil.NewEventStore(_ctx, b, c)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		events, err := s.GetEventsByUser(_ctx, owner, &model.Pagination{Size: 10})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if len(events) != 10 {
+			b.Fatalf("got %d events, want 10", len(events))
+		}
+	}
+
+	c.report(b)
+}
+
+func BenchmarkGetMessagesByThread(b *testing.B) {
+	owner, members := newBenchmarkMembers(b)
+	thread := _mock.NewThread(_ctx, b, owner, members)
+
+	for i := 0; i < 10; i++ {
+		_mock.NewThreadMessage(_ctx, b, members[i%len(members)], thread)
+	}
+
+	c := &countingDBClient{Client: _dbClient}
+	s := testutil.NewMessageStore(_ctx, b, c)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := s.GetMessagesByThread(_ctx, thread, &model.Pagination{Size: 20}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	c.report(b)
+}
@@ -22,7 +22,7 @@ func TestGetContacts(t *testing.T) {
 	if err := user.AddContact(contact2); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := _dbClient.Put(_ctx, user.Key, user); err != nil {
+	if err := _mock.UserStore.Commit(_ctx, user); err != nil {
 		t.Fatal(err)
 	}
 
@@ -39,7 +39,7 @@ func TestGetContacts(t *testing.T) {
 		{
 			AuthHeader:         testutil.GetAuthHeader(user.Token),
 			ExpectStatus:       http.StatusOK,
-			ExpectContactIDs:   []string{contact1.ID, contact2.ID},
+			ExpectContactIDs:   []string{contact1.ID.String(), contact2.ID.String()},
 			ExpectContactNames: []string{contact1.FullName, contact2.FullName},
 		},
 		{
@@ -123,7 +123,7 @@ func TestCreateContact(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < 400 {
-				tt.Assert(jsonpath.Equal("$.id", contact1.ID))
+				tt.Assert(jsonpath.Equal("$.id", contact1.ID.String()))
 				tt.Assert(jsonpath.Equal("$.fullName", contact1.FullName))
 				tt.Assert(jsonpath.NotPresent("$.email"))
 				tt.Assert(jsonpath.NotPresent("$.token"))
@@ -144,7 +144,7 @@ func TestDeleteContact(t *testing.T) {
 
 	user.AddContact(contact1)
 
-	if _, err := _dbClient.Put(_ctx, user.Key, user); err != nil {
+	if err := _mock.UserStore.Commit(_ctx, user); err != nil {
 		t.Fatal(err)
 	}
 
@@ -192,7 +192,7 @@ func TestDeleteContact(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < 400 {
-				tt.Assert(jsonpath.Equal("$.id", contact1.ID))
+				tt.Assert(jsonpath.Equal("$.id", contact1.ID.String()))
 				tt.Assert(jsonpath.Equal("$.fullName", contact1.FullName))
 				tt.Assert(jsonpath.NotPresent("$.email"))
 				tt.Assert(jsonpath.NotPresent("$.token"))
@@ -1,19 +1,25 @@
 package handler_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
-	"cloud.google.com/go/datastore"
+	ics "github.com/arran4/golang-ical"
 	"github.com/icrowley/fake"
 	"github.com/steinfletcher/apitest"
 	jsonpath "github.com/steinfletcher/apitest-jsonpath"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/clients/magic"
+	notif "github.com/hiconvo/api/clients/notification"
+	eventhandler "github.com/hiconvo/api/handler/event"
 	"github.com/hiconvo/api/model"
 	"github.com/hiconvo/api/testutil"
 )
@@ -42,13 +48,13 @@ func TestCreateEvent(t *testing.T) {
 				"description": fake.Paragraph(),
 				"users": []map[string]string{
 					{
-						"id": u2.ID,
+						"id": u2.ID.String(),
 					},
 				},
 			},
 			ExpectStatus:   http.StatusCreated,
-			ExpectOwnerID:  u1.ID,
-			ExpectMemberID: u2.ID,
+			ExpectOwnerID:  u1.ID.String(),
+			ExpectMemberID: u2.ID.String(),
 		},
 		{
 			Name:       "good payload with new email",
@@ -60,7 +66,7 @@ func TestCreateEvent(t *testing.T) {
 				"description": fake.Paragraph(),
 				"users": []map[string]string{
 					{
-						"id": u2.ID,
+						"id": u2.ID.String(),
 					},
 					{
 						"email": "test@test.com",
@@ -71,8 +77,8 @@ func TestCreateEvent(t *testing.T) {
 				},
 			},
 			ExpectStatus:   http.StatusCreated,
-			ExpectOwnerID:  u1.ID,
-			ExpectMemberID: u2.ID,
+			ExpectOwnerID:  u1.ID.String(),
+			ExpectMemberID: u2.ID.String(),
 		},
 		{
 			Name:       "good payload with host",
@@ -84,7 +90,7 @@ func TestCreateEvent(t *testing.T) {
 				"description": fake.Paragraph(),
 				"users": []map[string]string{
 					{
-						"id": u2.ID,
+						"id": u2.ID.String(),
 					},
 					{
 						"email": "test@test.com",
@@ -92,14 +98,14 @@ func TestCreateEvent(t *testing.T) {
 				},
 				"hosts": []map[string]string{
 					{
-						"id": u3.ID,
+						"id": u3.ID.String(),
 					},
 				},
 			},
 			ExpectStatus:   http.StatusCreated,
-			ExpectOwnerID:  u1.ID,
-			ExpectMemberID: u2.ID,
-			ExpectHostID:   u3.ID,
+			ExpectOwnerID:  u1.ID.String(),
+			ExpectMemberID: u2.ID.String(),
+			ExpectHostID:   u3.ID.String(),
 		},
 		{
 			Name:       "good payload with dupe host owner",
@@ -111,7 +117,7 @@ func TestCreateEvent(t *testing.T) {
 				"description": fake.Paragraph(),
 				"users": []map[string]string{
 					{
-						"id": u2.ID,
+						"id": u2.ID.String(),
 					},
 					{
 						"email": "test@test.com",
@@ -119,13 +125,13 @@ func TestCreateEvent(t *testing.T) {
 				},
 				"hosts": []map[string]string{
 					{
-						"id": u1.ID,
+						"id": u1.ID.String(),
 					},
 				},
 			},
 			ExpectStatus:   http.StatusCreated,
-			ExpectOwnerID:  u1.ID,
-			ExpectMemberID: u2.ID,
+			ExpectOwnerID:  u1.ID.String(),
+			ExpectMemberID: u2.ID.String(),
 		},
 		{
 			Name:       "bad payload",
@@ -153,7 +159,7 @@ func TestCreateEvent(t *testing.T) {
 				"description": fake.Paragraph(),
 				"users": []map[string]string{
 					{
-						"id": u2.ID,
+						"id": u2.ID.String(),
 					},
 				},
 			},
@@ -169,7 +175,7 @@ func TestCreateEvent(t *testing.T) {
 				"description": fake.Paragraph(),
 				"users": []map[string]string{
 					{
-						"id": u2.ID,
+						"id": u2.ID.String(),
 					},
 				},
 			},
@@ -202,6 +208,317 @@ func TestCreateEvent(t *testing.T) {
 	}
 }
 
+func TestCreateEventWithEnd(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+
+	tests := []struct {
+		Name               string
+		GivenEndTimestamp  string
+		GivenAllDay        bool
+		ExpectStatus       int
+		ExpectTimestamp    string
+		ExpectEndTimestamp string
+	}{
+		{
+			Name:               "timed",
+			GivenEndTimestamp:  "2119-09-08T23:30:00Z",
+			ExpectStatus:       http.StatusCreated,
+			ExpectTimestamp:    "2119-09-08T18:00:00Z",
+			ExpectEndTimestamp: "2119-09-08T23:30:00Z",
+		},
+		{
+			Name:               "all day",
+			GivenAllDay:        true,
+			ExpectStatus:       http.StatusCreated,
+			ExpectTimestamp:    "2119-09-08T00:00:00Z",
+			ExpectEndTimestamp: "2119-09-08T00:00:00Z",
+		},
+		{
+			Name:               "several days",
+			GivenEndTimestamp:  "2119-09-10T12:00:00Z",
+			GivenAllDay:        true,
+			ExpectStatus:       http.StatusCreated,
+			ExpectTimestamp:    "2119-09-08T00:00:00Z",
+			ExpectEndTimestamp: "2119-09-10T00:00:00Z",
+		},
+		{
+			Name:              "end before start",
+			GivenEndTimestamp: "2119-09-08T17:00:00Z",
+			ExpectStatus:      http.StatusBadRequest,
+		},
+		{
+			Name:              "end at start",
+			GivenEndTimestamp: "2119-09-08T18:00:00Z",
+			ExpectStatus:      http.StatusBadRequest,
+		},
+		{
+			Name:              "last day before first day",
+			GivenEndTimestamp: "2119-09-07T23:00:00Z",
+			GivenAllDay:       true,
+			ExpectStatus:      http.StatusBadRequest,
+		},
+		{
+			Name:              "invalid end",
+			GivenEndTimestamp: "tomorrow",
+			ExpectStatus:      http.StatusBadRequest,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Post("/events").
+				Headers(testutil.GetAuthHeader(owner.Token)).
+				JSON(map[string]interface{}{
+					"name":         fake.Title(),
+					"placeId":      fake.CharactersN(32),
+					"timestamp":    "2119-09-08T18:00:00Z",
+					"endTimestamp": tcase.GivenEndTimestamp,
+					"allDay":       tcase.GivenAllDay,
+					"description":  fake.Paragraph(),
+				}).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+
+			if tcase.ExpectStatus < http.StatusBadRequest {
+				tt.Assert(jsonpath.Equal("$.allDay", tcase.GivenAllDay))
+				tt.Assert(jsonpath.Equal("$.timestamp", tcase.ExpectTimestamp))
+				tt.Assert(jsonpath.Equal("$.endTimestamp", tcase.ExpectEndTimestamp))
+			} else {
+				tt.Assert(jsonpath.Present("$.endTimestamp"))
+			}
+
+			tt.End()
+		})
+	}
+}
+
+func TestEventEndTimes(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, nil, nil)
+	event.Reschedule(time.Date(2030, 6, 5, 18, 0, 0, 0, time.UTC))
+
+	// Events without an end keep lasting an hour.
+	assert.Equal(t, "Wednesday, June 5 @ 6:00 PM", event.GetFormatedTime())
+	assert.Contains(t, event.GetICS(), "DTEND:20300605T190000Z")
+
+	assert.NoError(t, event.SetEnd(time.Date(2030, 6, 5, 23, 30, 0, 0, time.UTC), false))
+	assert.Equal(t, "Wednesday, June 5 @ 6:00 PM - 11:30 PM", event.GetFormatedTime())
+	assert.Contains(t, event.GetICS(), "DTSTART:20300605T180000Z")
+	assert.Contains(t, event.GetICS(), "DTEND:20300605T233000Z")
+
+	assert.NoError(t, event.SetEnd(time.Date(2030, 6, 6, 2, 0, 0, 0, time.UTC), false))
+	assert.Equal(t, "Wednesday, June 5 @ 6:00 PM - Thursday, June 6 @ 2:00 AM", event.GetFormatedTime())
+
+	// Moving the event keeps how long it lasts.
+	event.Reschedule(time.Date(2030, 6, 7, 18, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2030, 6, 8, 2, 0, 0, 0, time.UTC), event.EndTimestamp)
+
+	assert.NoError(t, event.SetEnd(time.Date(2030, 6, 9, 12, 0, 0, 0, time.UTC), true))
+	assert.Equal(t, "Friday, June 7 - Sunday, June 9", event.GetFormatedTime())
+	assert.Contains(t, event.GetICS(), "DTSTART;VALUE=DATE:20300607")
+	assert.Contains(t, event.GetICS(), "DTEND;VALUE=DATE:20300610")
+
+	assert.NoError(t, event.SetEnd(time.Time{}, true))
+	assert.Equal(t, "Friday, June 7", event.GetFormatedTime())
+	assert.Contains(t, event.GetICS(), "DTEND;VALUE=DATE:20300608")
+
+	// The end is saved.
+	assert.NoError(t, event.SetEnd(time.Date(2030, 6, 8, 0, 0, 0, 0, time.UTC), true))
+	assert.NoError(t, _mock.EventStore.Commit(_ctx, event))
+
+	got, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+	assert.True(t, got.AllDay)
+	assert.Equal(t, 2*24*time.Hour, got.Duration())
+	assert.Equal(t, event.GetFormatedTime(), got.GetFormatedTime())
+}
+
+func TestEventTimeZones(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+
+	var event model.Event
+
+	// Daylight saving time applies in July, though not when the event is
+	// created.
+	apitest.New().
+		Handler(_handler).
+		Post("/events").
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(map[string]interface{}{
+			"name":         fake.Title(),
+			"placeId":      fake.CharactersN(32),
+			"timestamp":    "2030-07-04T22:00:00Z",
+			"endTimestamp": "2030-07-05T01:00:00Z",
+			"description":  fake.Paragraph(),
+			"utcOffset":    -5 * 3600,
+			"timeZone":     "America/New_York",
+		}).
+		Expect(t).
+		Status(http.StatusCreated).
+		Assert(jsonpath.Equal("$.timeZone", "America/New_York")).
+		End().
+		JSON(&event)
+
+	got, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Thursday, July 4 @ 6:00 PM - 9:00 PM", got.GetFormatedTime())
+
+	ics := got.GetICS()
+	assert.Contains(t, ics, "DTSTART;TZID=America/New_York:20300704T180000")
+	assert.Contains(t, ics, "DTEND;TZID=America/New_York:20300704T210000")
+	assert.Contains(t, ics, "BEGIN:VTIMEZONE\r\nTZID:America/New_York\r\n")
+	assert.Contains(t, ics, "TZOFFSETTO:-0400")
+	assert.NotContains(t, ics, "BEGIN:STANDARD\r\nDTSTART:20301103")
+
+	// Weekly occurrences keep their local time across the end of daylight
+	// saving time, and so do their exceptions when the event moves.
+	assert.NoError(t, got.SetRecurrence(&model.Recurrence{
+		Frequency:  model.FrequencyWeekly,
+		Count:      20,
+		Exceptions: []time.Time{time.Date(2030, 11, 7, 23, 0, 0, 0, time.UTC)},
+	}))
+
+	occurrences := got.GetOccurrences(time.Date(2030, 10, 30, 0, 0, 0, 0, time.UTC), time.Time{}, 2)
+	if assert.Len(t, occurrences, 2) {
+		assert.Equal(t, time.Date(2030, 10, 31, 22, 0, 0, 0, time.UTC), occurrences[0].UTC())
+		assert.Equal(t, time.Date(2030, 11, 14, 23, 0, 0, 0, time.UTC), occurrences[1].UTC())
+	}
+
+	got.Reschedule(time.Date(2030, 7, 4, 23, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2030, 11, 8, 0, 0, 0, 0, time.UTC), got.Recurrence.Exceptions[0].UTC())
+
+	ics = got.GetICS()
+	assert.Contains(t, ics, "EXDATE;TZID=America/New_York:20301107T190000")
+	assert.Contains(t, ics, "BEGIN:STANDARD\r\nDTSTART:20301103T020000\r\nTZOFFSETFROM:-0400\r\nTZOFFSETTO:-0500\r\n")
+
+	// Places that are not physical locations take the time zone of the user,
+	// which must exist.
+	apitest.New().
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", event.ID)).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(map[string]interface{}{"timeZone": "Europe/Atlantis"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		Assert(jsonpath.Present("$.timeZone")).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", event.ID)).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(map[string]interface{}{"timeZone": "Europe/Paris"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.timeZone", "Europe/Paris")).
+		Assert(jsonpath.Equal("$.timestamp", "2030-07-04T22:00:00Z")).
+		End()
+}
+
+func TestEventTimeZoneFromOffset(t *testing.T) {
+	assert.Equal(t, "Etc/UTC", model.TimeZoneFromOffset(0))
+	assert.Equal(t, "Etc/GMT-2", model.TimeZoneFromOffset(2*3600))
+	assert.Equal(t, "Etc/GMT+5", model.TimeZoneFromOffset(-5*3600))
+	assert.Equal(t, "Asia/Kolkata", model.TimeZoneFromOffset(5*3600+1800))
+	assert.Equal(t, "", model.TimeZoneFromOffset(17))
+
+	owner, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, nil, nil)
+	event.UTCOffset = 2 * 3600
+	event.Reschedule(time.Date(2030, 6, 5, 18, 0, 0, 0, time.UTC))
+
+	assert.NoError(t, event.SetTimeZone(""))
+	assert.Equal(t, "Etc/GMT-2", event.TimeZone)
+	assert.Equal(t, "Wednesday, June 5 @ 8:00 PM", event.GetFormatedTime())
+	assert.Contains(t, event.GetICS(), "BEGIN:STANDARD\r\nDTSTART:20300604T200000\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0200\r\n")
+}
+
+func TestUpdateEventEnd(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, nil, nil)
+	url := fmt.Sprintf("/events/%s", event.ID)
+
+	tests := []struct {
+		Name               string
+		GivenBody          map[string]interface{}
+		ExpectStatus       int
+		ExpectAllDay       bool
+		ExpectTimestamp    string
+		ExpectEndTimestamp string
+	}{
+		{
+			Name: "timed",
+			GivenBody: map[string]interface{}{
+				"timestamp":    "2030-06-05T18:00:00Z",
+				"endTimestamp": "2030-06-05T20:00:00Z",
+			},
+			ExpectStatus:       http.StatusOK,
+			ExpectTimestamp:    "2030-06-05T18:00:00Z",
+			ExpectEndTimestamp: "2030-06-05T20:00:00Z",
+		},
+		{
+			Name:               "move",
+			GivenBody:          map[string]interface{}{"timestamp": "2030-06-06T18:00:00Z"},
+			ExpectStatus:       http.StatusOK,
+			ExpectTimestamp:    "2030-06-06T18:00:00Z",
+			ExpectEndTimestamp: "2030-06-06T20:00:00Z",
+		},
+		{
+			Name:               "all day",
+			GivenBody:          map[string]interface{}{"allDay": true},
+			ExpectStatus:       http.StatusOK,
+			ExpectAllDay:       true,
+			ExpectTimestamp:    "2030-06-06T00:00:00Z",
+			ExpectEndTimestamp: "2030-06-06T00:00:00Z",
+		},
+		{
+			Name:               "move all day",
+			GivenBody:          map[string]interface{}{"timestamp": "2030-06-07T15:00:00Z"},
+			ExpectStatus:       http.StatusOK,
+			ExpectAllDay:       true,
+			ExpectTimestamp:    "2030-06-07T00:00:00Z",
+			ExpectEndTimestamp: "2030-06-07T00:00:00Z",
+		},
+		{
+			Name:         "end before start",
+			GivenBody:    map[string]interface{}{"endTimestamp": "2030-06-06T15:00:00Z"},
+			ExpectStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "timed again",
+			GivenBody: map[string]interface{}{
+				"timestamp": "2030-06-07T15:00:00Z",
+				"allDay":    false,
+			},
+			ExpectStatus:       http.StatusOK,
+			ExpectTimestamp:    "2030-06-07T15:00:00Z",
+			ExpectEndTimestamp: "0001-01-01T00:00:00Z",
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Patch(url).
+				JSON(tcase.GivenBody).
+				Headers(testutil.GetAuthHeader(owner.Token)).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+
+			if tcase.ExpectStatus < http.StatusBadRequest {
+				tt.Assert(jsonpath.Equal("$.allDay", tcase.ExpectAllDay))
+				tt.Assert(jsonpath.Equal("$.timestamp", tcase.ExpectTimestamp))
+				tt.Assert(jsonpath.Equal("$.endTimestamp", tcase.ExpectEndTimestamp))
+			}
+
+			tt.End()
+		})
+	}
+}
+
 func TestGetEvents(t *testing.T) {
 	owner, _ := _mock.NewUser(_ctx, t)
 	member1, _ := _mock.NewUser(_ctx, t)
@@ -254,10 +571,10 @@ func TestGetEvents(t *testing.T) {
 
 			if tcase.IsEventInRes {
 				tt.Assert(jsonpath.Equal("$.events[0].name", event.Name))
-				tt.Assert(jsonpath.Equal("$.events[0].owner.id", event.Owner.ID))
-				tt.Assert(jsonpath.Contains("$.events[0].users[*].id", member1.ID))
-				tt.Assert(jsonpath.Contains("$.events[0].users[*].id", member2.ID))
-				tt.Assert(jsonpath.Contains("$.events[0].hosts[*].id", host1.ID))
+				tt.Assert(jsonpath.Equal("$.events[0].owner.id", event.Owner.ID.String()))
+				tt.Assert(jsonpath.Contains("$.events[0].users[*].id", member1.ID.String()))
+				tt.Assert(jsonpath.Contains("$.events[0].users[*].id", member2.ID.String()))
+				tt.Assert(jsonpath.Contains("$.events[0].hosts[*].id", host1.ID.String()))
 			}
 
 			tt.End()
@@ -307,9 +624,9 @@ func TestGetEvent(t *testing.T) {
 
 			if tcase.ExpectStatus < http.StatusBadRequest {
 				tt.Assert(jsonpath.Equal("$.name", event.Name))
-				tt.Assert(jsonpath.Equal("$.owner.id", event.Owner.ID))
-				tt.Assert(jsonpath.Contains("$.users[*].id", member.ID))
-				tt.Assert(jsonpath.Contains("$.hosts[*].id", host.ID))
+				tt.Assert(jsonpath.Equal("$.owner.id", event.Owner.ID.String()))
+				tt.Assert(jsonpath.Contains("$.users[*].id", member.ID.String()))
+				tt.Assert(jsonpath.Contains("$.hosts[*].id", host.ID.String()))
 			}
 
 			tt.End()
@@ -374,11 +691,89 @@ func TestDeleteEvent(t *testing.T) {
 
 			if tcase.ShouldPass {
 				var gotEvent model.Event
-				err := _dbClient.Get(_ctx, event.Key, &gotEvent)
-				assert.Equal(t, datastore.ErrNoSuchEntity, err)
+				err := _dbClient.Get(_ctx, mustDecodeID(t, event.ID), &gotEvent)
+				assert.NoError(t, err)
+				assert.False(t, gotEvent.DeletedAt.IsZero())
+				assert.Equal(t, "had to cancel", gotEvent.CancelMessage)
+			}
+		})
+	}
+}
+
+func TestRestoreEvent(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	host, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{host}, []*model.User{member})
+	url := fmt.Sprintf("/events/%s/restore", event.ID)
+
+	apitest.New("delete").
+		Handler(_handler).
+		Delete(fmt.Sprintf("/events/%s", event.ID)).
+		JSON(map[string]interface{}{"message": "had to cancel"}).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	tests := []struct {
+		Name         string
+		AuthHeader   map[string]string
+		ExpectStatus int
+	}{
+		{
+			Name:         "host attempt",
+			AuthHeader:   testutil.GetAuthHeader(host.Token),
+			ExpectStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "member attempt",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			ExpectStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "success",
+			AuthHeader:   testutil.GetAuthHeader(owner.Token),
+			ExpectStatus: http.StatusOK,
+		},
+		{
+			Name:         "after success",
+			AuthHeader:   testutil.GetAuthHeader(owner.Token),
+			ExpectStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Post(url).
+				JSON(`{}`).
+				Headers(tcase.AuthHeader).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+			if tcase.ExpectStatus == http.StatusOK {
+				tt.Assert(jsonpath.Equal("$.id", event.ID.String()))
+				tt.Assert(jsonpath.Contains("$.users[*].id", member.ID.String()))
 			}
+
+			tt.End()
 		})
 	}
+
+	var gotEvent model.Event
+	err := _dbClient.Get(_ctx, mustDecodeID(t, event.ID), &gotEvent)
+	assert.NoError(t, err)
+	assert.True(t, gotEvent.DeletedAt.IsZero())
+	assert.Empty(t, gotEvent.CancelMessage)
+
+	apitest.New("member can get restored event").
+		Handler(_handler).
+		Get(fmt.Sprintf("/events/%s", event.ID)).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
 }
 
 func TestGetEventMessages(t *testing.T) {
@@ -428,9 +823,9 @@ func TestGetEventMessages(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.messages[0].id", message1.ID))
+				tt.Assert(jsonpath.Equal("$.messages[0].id", message1.ID.String()))
 				tt.Assert(jsonpath.Equal("$.messages[0].body", message1.Body))
-				tt.Assert(jsonpath.Equal("$.messages[1].id", message2.ID))
+				tt.Assert(jsonpath.Equal("$.messages[1].id", message2.ID.String()))
 				tt.Assert(jsonpath.Equal("$.messages[1].body", message2.Body))
 			}
 
@@ -510,10 +905,10 @@ func TestAddMessageToEvent(t *testing.T) {
 
 		if tcase.ExpectCode < 300 {
 			tt.
-				Assert(jsonpath.Equal("$.parentId", event.ID)).
+				Assert(jsonpath.Equal("$.parentId", event.ID.String())).
 				Assert(jsonpath.Equal("$.body", tcase.ExpectBody)).
 				Assert(jsonpath.Equal("$.user.fullName", tcase.GivenAuthor.FullName)).
-				Assert(jsonpath.Equal("$.user.id", tcase.GivenAuthor.ID))
+				Assert(jsonpath.Equal("$.user.id", tcase.GivenAuthor.ID.String()))
 			if tcase.ExpectPhoto {
 				tt.Assert(jsonpath.Present("$.photos[0]"))
 			} else {
@@ -525,6 +920,219 @@ func TestAddMessageToEvent(t *testing.T) {
 	}
 }
 
+func TestCancelEvent(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	host, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{host}, []*model.User{member})
+	url := fmt.Sprintf("/events/%s/cancel", event.ID)
+
+	tests := []struct {
+		Name         string
+		AuthHeader   map[string]string
+		ExpectStatus int
+	}{
+		{
+			Name:         "host attempt",
+			AuthHeader:   testutil.GetAuthHeader(host.Token),
+			ExpectStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "member attempt",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			ExpectStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "success",
+			AuthHeader:   testutil.GetAuthHeader(owner.Token),
+			ExpectStatus: http.StatusOK,
+		},
+		{
+			Name:         "after success",
+			AuthHeader:   testutil.GetAuthHeader(owner.Token),
+			ExpectStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Post(url).
+				JSON(map[string]interface{}{"message": "It's raining"}).
+				Headers(tcase.AuthHeader).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+			if tcase.ExpectStatus == http.StatusOK {
+				tt.Assert(jsonpath.Equal("$.id", event.ID.String()))
+				tt.Assert(jsonpath.Equal("$.cancelMessage", "It's raining"))
+			}
+
+			tt.End()
+		})
+	}
+
+	// Cancelled events are still there for guests to see.
+	apitest.New("get").
+		Handler(_handler).
+		Get(fmt.Sprintf("/events/%s", event.ID)).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.cancelMessage", "It's raining")).
+		End()
+
+	apitest.New("rsvp").
+		Handler(_handler).
+		Post(fmt.Sprintf("/events/%s/rsvps", event.ID)).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	apitest.New("update").
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", event.ID)).
+		JSON(`{"name": "Another name"}`).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	gotEvent, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, gotEvent.IsCancelled())
+
+	ics := gotEvent.GetInvitationICS(member)
+	assert.Contains(t, ics, "METHOD:CANCEL\r\n")
+	assert.Contains(t, ics, fmt.Sprintf("UID:%s\r\n", event.ID))
+	assert.Contains(t, ics, "SEQUENCE:1\r\n")
+	assert.Contains(t, ics, "STATUS:CANCELLED\r\n")
+}
+
+func TestEventInvitationICS(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	other, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member, other})
+
+	apitest.New("rsvp").
+		Handler(_handler).
+		Post(fmt.Sprintf("/events/%s/rsvps", event.ID)).
+		JSON(`{"status": "maybe"}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	for _, name := range []string{"First update", "Second update"} {
+		apitest.New(name).
+			Handler(_handler).
+			Patch(fmt.Sprintf("/events/%s", event.ID)).
+			JSON(map[string]interface{}{"name": name}).
+			Headers(testutil.GetAuthHeader(owner.Token)).
+			Expect(t).
+			Status(http.StatusOK).
+			End()
+	}
+
+	gotEvent, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Imported events are not iTIP messages.
+	assert.NotContains(t, gotEvent.GetICS(), "METHOD:")
+	assert.NotContains(t, gotEvent.GetICS(), "ATTENDEE")
+
+	tests := []struct {
+		User       *model.User
+		ExpectStat ics.ParticipationStatus
+	}{
+		{User: member, ExpectStat: ics.ParticipationStatusTentative},
+		{User: other, ExpectStat: ics.ParticipationStatusNeedsAction},
+	}
+
+	for _, tcase := range tests {
+		raw := gotEvent.GetInvitationICS(tcase.User)
+		assert.Contains(t, raw, "METHOD:REQUEST\r\n")
+		assert.Contains(t, raw, "SEQUENCE:2\r\n")
+
+		cal, err := ics.ParseCalendar(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !assert.Len(t, cal.Events(), 1) {
+			continue
+		}
+
+		ev := cal.Events()[0]
+		assert.Equal(t, event.ID.String(), ev.Id())
+		assert.Equal(t, "mailto:"+gotEvent.GetOrganizerEmail(), ev.GetProperty(ics.ComponentPropertyOrganizer).Value)
+
+		if assert.Len(t, ev.Attendees(), 1) {
+			assert.Equal(t, tcase.User.Email, ev.Attendees()[0].Email())
+			assert.Equal(t, tcase.ExpectStat, ev.Attendees()[0].ParticipationStatus())
+		}
+	}
+}
+
+func TestEventICSRename(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+
+	parse := func(e *model.Event) *ics.VEvent {
+		cal, err := ics.ParseCalendar(strings.NewReader(e.GetInvitationICS(member)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(cal.Events()) != 1 {
+			t.Fatalf("got %d events, want 1", len(cal.Events()))
+		}
+
+		return cal.Events()[0]
+	}
+
+	before := parse(event)
+
+	apitest.New().
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", event.ID)).
+		JSON(map[string]interface{}{"name": "A completely different name"}).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	gotEvent, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := parse(gotEvent)
+
+	// Calendars match the update to the entry they have by its UID and
+	// ORGANIZER, so neither changes along with the name.
+	assert.Equal(t, before.Id(), after.Id())
+	assert.Equal(t,
+		before.GetProperty(ics.ComponentPropertyOrganizer).Value,
+		after.GetProperty(ics.ComponentPropertyOrganizer).Value)
+	assert.NotEqual(t, event.GetEmail(), gotEvent.GetEmail())
+
+	seqBefore, err := strconv.Atoi(before.GetProperty(ics.ComponentProperty(ics.PropertySequence)).Value)
+	assert.NoError(t, err)
+	seqAfter, err := strconv.Atoi(after.GetProperty(ics.ComponentProperty(ics.PropertySequence)).Value)
+	assert.NoError(t, err)
+	assert.Greater(t, seqAfter, seqBefore)
+}
+
 func TestDeleteEventMessage(t *testing.T) {
 	owner, _ := _mock.NewUser(_ctx, t)
 	member1, _ := _mock.NewUser(_ctx, t)
@@ -555,21 +1163,21 @@ func TestDeleteEventMessage(t *testing.T) {
 		{
 			Name:            "member attempt to delete message he does not own",
 			GivenAuthHeader: testutil.GetAuthHeader(member1.Token),
-			GivenMessageID:  message1.ID,
+			GivenMessageID:  message1.ID.String(),
 			ExpectCode:      http.StatusNotFound,
 			ExpectBody:      `{"message":"The requested resource was not found"}`,
 		},
 		{
 			Name:            "nonmember attempt to delete message",
 			GivenAuthHeader: testutil.GetAuthHeader(nonmember.Token),
-			GivenMessageID:  message1.ID,
+			GivenMessageID:  message1.ID.String(),
 			ExpectCode:      http.StatusNotFound,
 			ExpectBody:      `{"message":"The requested resource was not found"}`,
 		},
 		{
 			Name:            "success",
 			GivenAuthHeader: testutil.GetAuthHeader(member1.Token),
-			GivenMessageID:  message2.ID,
+			GivenMessageID:  message2.ID.String(),
 			ExpectCode:      http.StatusOK,
 			ExpectBody:      string(message2encoded),
 		},
@@ -588,8 +1196,9 @@ func TestDeleteEventMessage(t *testing.T) {
 
 		if tcase.ExpectCode == http.StatusOK {
 			var gotMessage model.Message
-			err := _dbClient.Get(_ctx, message2.Key, &gotMessage)
-			assert.Equal(t, datastore.ErrNoSuchEntity, err)
+			err := _dbClient.Get(_ctx, mustDecodeID(t, message2.ID), &gotMessage)
+			assert.NoError(t, err)
+			assert.False(t, gotMessage.DeletedAt.IsZero())
 		}
 	}
 }
@@ -638,8 +1247,8 @@ func TestMarkEventAsRead(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.id", event.ID))
-				tt.Assert(jsonpath.Equal("$.reads[0].id", owner.ID))
+				tt.Assert(jsonpath.Equal("$.id", event.ID.String()))
+				tt.Assert(jsonpath.Equal("$.reads[0].id", owner.ID.String()))
 			}
 
 			tt.End()
@@ -726,10 +1335,10 @@ func TestUpdateEvent(t *testing.T) {
 			GivenBody: map[string]interface{}{
 				"name": "Ruth Marcus",
 				"hosts": []map[string]string{
-					{"id": owner.ID}, // make sure owner doesn't get added as host
-					{"id": member2.ID},
+					{"id": owner.ID.String()}, // make sure owner doesn't get added as host
+					{"id": member2.ID.String()},
 				}},
-			ExpectHostID: member2.ID,
+			ExpectHostID: member2.ID.String(),
 		},
 		{
 			Name:         "host change name",
@@ -785,6 +1394,86 @@ func TestUpdateEvent(t *testing.T) {
 	}
 }
 
+func TestUpdateEventIfMatch(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, nil, nil)
+	url := fmt.Sprintf("/events/%s", event.ID)
+
+	apitest.New("get").
+		Handler(_handler).
+		Get(url).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Header("ETag", event.ETag()).
+		End()
+
+	tests := []struct {
+		Name         string
+		GivenIfMatch string
+		ExpectStatus int
+		ExpectETag   string
+	}{
+		{
+			Name:         "stale",
+			GivenIfMatch: `"0"`,
+			ExpectStatus: http.StatusPreconditionFailed,
+		},
+		{
+			Name:         "current",
+			GivenIfMatch: event.ETag(),
+			ExpectStatus: http.StatusOK,
+			ExpectETag:   `"2"`,
+		},
+		{
+			Name:         "previous",
+			GivenIfMatch: event.ETag(),
+			ExpectStatus: http.StatusPreconditionFailed,
+		},
+		{
+			Name:         "any",
+			GivenIfMatch: "*",
+			ExpectStatus: http.StatusOK,
+			ExpectETag:   `"3"`,
+		},
+		{
+			Name:         "list",
+			GivenIfMatch: `"1", "3"`,
+			ExpectStatus: http.StatusOK,
+			ExpectETag:   `"4"`,
+		},
+		{
+			Name:         "none",
+			ExpectStatus: http.StatusOK,
+			ExpectETag:   `"5"`,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			headers := testutil.GetAuthHeader(owner.Token)
+			if tcase.GivenIfMatch != "" {
+				headers["If-Match"] = tcase.GivenIfMatch
+			}
+
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Patch(url).
+				JSON(map[string]interface{}{"name": tcase.Name}).
+				Headers(headers).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+
+			if tcase.ExpectStatus == http.StatusOK {
+				tt.Header("ETag", tcase.ExpectETag)
+				tt.Assert(jsonpath.Equal("$.name", tcase.Name))
+			}
+
+			tt.End()
+		})
+	}
+}
+
 func TestAddUserToEvent(t *testing.T) {
 	owner, _ := _mock.NewUser(_ctx, t)
 	host, _ := _mock.NewUser(_ctx, t)
@@ -797,7 +1486,7 @@ func TestAddUserToEvent(t *testing.T) {
 
 	eventAllowGuests := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
 	eventAllowGuests.GuestsCanInvite = true
-	if _, err := _dbClient.Put(_ctx, eventAllowGuests.Key, eventAllowGuests); err != nil {
+	if err := _mock.EventStore.Commit(_ctx, eventAllowGuests); err != nil {
 		t.Fatal(err)
 	}
 
@@ -813,61 +1502,61 @@ func TestAddUserToEvent(t *testing.T) {
 		{
 			AuthHeader:   testutil.GetAuthHeader(nonmember.Token),
 			ExpectStatus: http.StatusNotFound,
-			GivenUserID:  memberToAdd.ID,
-			GivenEventID: event.ID,
+			GivenUserID:  memberToAdd.ID.String(),
+			GivenEventID: event.ID.String(),
 		},
 		{
 			AuthHeader:   testutil.GetAuthHeader(member.Token),
 			ExpectStatus: http.StatusNotFound,
-			GivenUserID:  memberToAdd.ID,
-			GivenEventID: event.ID,
+			GivenUserID:  memberToAdd.ID.String(),
+			GivenEventID: event.ID.String(),
 		},
 		{
 			AuthHeader:   map[string]string{"boop": "beep"},
 			ExpectStatus: http.StatusUnauthorized,
-			GivenUserID:  memberToAdd.ID,
-			GivenEventID: event.ID,
+			GivenUserID:  memberToAdd.ID.String(),
+			GivenEventID: event.ID.String(),
 		},
 		{
 			AuthHeader:   testutil.GetAuthHeader(owner.Token),
 			ExpectStatus: http.StatusOK,
-			GivenUserID:  memberToAdd.ID,
+			GivenUserID:  memberToAdd.ID.String(),
 			ExpectNames:  []string{owner.FullName, host.FullName, member.FullName, memberToAdd.FullName},
-			GivenEventID: event.ID,
+			GivenEventID: event.ID.String(),
 		},
 		{
 			AuthHeader:   testutil.GetAuthHeader(owner.Token),
 			ExpectStatus: http.StatusOK,
 			GivenUserID:  "addedOnTheFly@againanothertime.com",
 			ExpectNames:  []string{owner.FullName, host.FullName, member.FullName, memberToAdd.FullName, "addedonthefly"},
-			GivenEventID: event.ID,
+			GivenEventID: event.ID.String(),
 		},
 		{
 			AuthHeader:   testutil.GetAuthHeader(owner.Token),
 			ExpectStatus: http.StatusOK,
 			GivenUserID:  secondMemberToAdd.Email,
 			ExpectNames:  []string{owner.FullName, host.FullName, member.FullName, memberToAdd.FullName, "addedonthefly", secondMemberToAdd.FullName},
-			GivenEventID: event.ID,
+			GivenEventID: event.ID.String(),
 		},
 		{
 			AuthHeader:   testutil.GetAuthHeader(host.Token),
 			ExpectStatus: http.StatusOK,
-			GivenUserID:  thridMemberToAdd.ID,
+			GivenUserID:  thridMemberToAdd.ID.String(),
 			ExpectNames:  []string{owner.FullName, host.FullName, member.FullName, memberToAdd.FullName, "addedonthefly", secondMemberToAdd.FullName, thridMemberToAdd.FullName},
-			GivenEventID: event.ID,
+			GivenEventID: event.ID.String(),
 		},
 		{
 			AuthHeader:   testutil.GetAuthHeader(nonmember.Token),
 			ExpectStatus: http.StatusNotFound,
-			GivenUserID:  memberToAdd.ID,
-			GivenEventID: eventAllowGuests.ID,
+			GivenUserID:  memberToAdd.ID.String(),
+			GivenEventID: eventAllowGuests.ID.String(),
 		},
 		{
 			AuthHeader:   testutil.GetAuthHeader(member.Token),
 			ExpectStatus: http.StatusOK,
-			GivenUserID:  memberToAdd.ID,
+			GivenUserID:  memberToAdd.ID.String(),
 			ExpectNames:  []string{owner.FullName, member.FullName, memberToAdd.FullName},
-			GivenEventID: eventAllowGuests.ID,
+			GivenEventID: eventAllowGuests.ID.String(),
 		},
 	}
 
@@ -883,7 +1572,7 @@ func TestAddUserToEvent(t *testing.T) {
 
 			if tcase.ExpectStatus <= http.StatusBadRequest {
 				tt.Assert(jsonpath.Equal("$.id", tcase.GivenEventID))
-				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID))
+				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID.String()))
 				tt.Assert(jsonpath.Equal("$.owner.fullName", owner.FullName))
 
 				for _, name := range tcase.ExpectNames {
@@ -914,31 +1603,31 @@ func TestRemoveUserFromEvent(t *testing.T) {
 	}{
 		{
 			AuthHeader:   testutil.GetAuthHeader(nonmember.Token),
-			GivenUserID:  member.ID,
+			GivenUserID:  member.ID.String(),
 			ExpectStatus: http.StatusNotFound,
 		},
 		{
 			AuthHeader:   testutil.GetAuthHeader(member.Token),
-			GivenUserID:  memberToRemove.ID,
+			GivenUserID:  memberToRemove.ID.String(),
 			ExpectStatus: http.StatusNotFound,
 		},
 		{
 			AuthHeader:   map[string]string{"boop": "beep"},
-			GivenUserID:  member.ID,
+			GivenUserID:  member.ID.String(),
 			ExpectStatus: http.StatusUnauthorized,
 		},
 		{
 			AuthHeader:        testutil.GetAuthHeader(owner.Token),
-			GivenUserID:       memberToRemove.ID,
+			GivenUserID:       memberToRemove.ID.String(),
 			ExpectStatus:      http.StatusOK,
-			ExpectMemberIDs:   []string{owner.ID, member.ID, memberToLeave.ID},
+			ExpectMemberIDs:   []string{owner.ID.String(), member.ID.String(), memberToLeave.ID.String()},
 			ExpectMemberNames: []string{owner.FullName, member.FullName, memberToLeave.FullName},
 		},
 		{
 			AuthHeader:        testutil.GetAuthHeader(memberToLeave.Token),
-			GivenUserID:       memberToLeave.ID,
+			GivenUserID:       memberToLeave.ID.String(),
 			ExpectStatus:      http.StatusOK,
-			ExpectMemberIDs:   []string{owner.ID, member.ID},
+			ExpectMemberIDs:   []string{owner.ID.String(), member.ID.String()},
 			ExpectMemberNames: []string{owner.FullName, member.FullName},
 		},
 	}
@@ -954,8 +1643,8 @@ func TestRemoveUserFromEvent(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.id", event.ID))
-				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID))
+				tt.Assert(jsonpath.Equal("$.id", event.ID.String()))
+				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID.String()))
 				tt.Assert(jsonpath.Equal("$.owner.fullName", owner.FullName))
 
 				for _, name := range tcase.ExpectMemberNames {
@@ -1015,10 +1704,10 @@ func TestAddRSVPToEvent(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.id", event.ID))
-				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID))
+				tt.Assert(jsonpath.Equal("$.id", event.ID.String()))
+				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID.String()))
 				tt.Assert(jsonpath.Equal("$.owner.fullName", owner.FullName))
-				tt.Assert(jsonpath.Contains("$.rsvps[*].id", member.ID))
+				tt.Assert(jsonpath.Contains("$.rsvps[*].id", member.ID.String()))
 				tt.Assert(jsonpath.Contains("$.rsvps[*].fullName", member.FullName))
 			}
 
@@ -1042,7 +1731,7 @@ func TestRemoveRSVPFromEvent(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := _dbClient.Put(_ctx, event.Key, event); err != nil {
+	if err := _mock.EventStore.Commit(_ctx, event); err != nil {
 		t.Fatal(err)
 	}
 
@@ -1068,7 +1757,7 @@ func TestRemoveRSVPFromEvent(t *testing.T) {
 		{
 			AuthHeader:        testutil.GetAuthHeader(memberToRemove.Token),
 			ExpectStatus:      http.StatusOK,
-			ExpectMemberIDs:   []string{member.ID},
+			ExpectMemberIDs:   []string{member.ID.String()},
 			ExpectMemberNames: []string{member.FullName},
 		},
 	}
@@ -1084,8 +1773,8 @@ func TestRemoveRSVPFromEvent(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.id", event.ID))
-				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID))
+				tt.Assert(jsonpath.Equal("$.id", event.ID.String()))
+				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID.String()))
 				tt.Assert(jsonpath.Equal("$.owner.fullName", owner.FullName))
 
 				for _, name := range tcase.ExpectMemberNames {
@@ -1104,6 +1793,430 @@ func TestRemoveRSVPFromEvent(t *testing.T) {
 	}
 }
 
+func TestRSVPStatuses(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	other, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member, other})
+	url := fmt.Sprintf("/events/%s/rsvps", event.ID)
+
+	apitest.New().
+		Handler(_handler).
+		Post(url).
+		JSON(`{"status": "maybe", "guests": 1, "note": "Might be late"}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.rsvps", 0)).
+		Assert(jsonpath.Equal("$.maybes[0].id", member.ID.String())).
+		Assert(jsonpath.Equal("$.responses[0].userId", member.ID.String())).
+		Assert(jsonpath.Equal("$.responses[0].status", "maybe")).
+		Assert(jsonpath.Equal("$.responses[0].guests", float64(1))).
+		Assert(jsonpath.Equal("$.responses[0].note", "Might be late")).
+		Assert(jsonpath.Equal("$.rsvpCounts.maybe", float64(1))).
+		Assert(jsonpath.Equal("$.rsvpCounts.headcount", float64(0))).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Post(url).
+		JSON(`{"status": "going", "guests": 2}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.rsvps[0].id", member.ID.String())).
+		Assert(jsonpath.Len("$.maybes", 0)).
+		Assert(jsonpath.Len("$.responses", 1)).
+		Assert(jsonpath.Equal("$.rsvpCounts.going", float64(1))).
+		Assert(jsonpath.Equal("$.rsvpCounts.maybe", float64(0))).
+		Assert(jsonpath.Equal("$.rsvpCounts.headcount", float64(3))).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Post(url).
+		JSON(`{"status": "declined", "guests": 2}`).
+		Headers(testutil.GetAuthHeader(other.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.declines[0].id", other.ID.String())).
+		Assert(jsonpath.Equal("$.responses[1].guests", float64(0))).
+		Assert(jsonpath.Equal("$.rsvpCounts.declined", float64(1))).
+		Assert(jsonpath.Equal("$.rsvpCounts.headcount", float64(3))).
+		End()
+
+	tests := []struct {
+		Name       string
+		GivenBody  string
+		ExpectBody string
+	}{
+		{
+			Name:       "Same",
+			GivenBody:  `{"status": "declined"}`,
+			ExpectBody: `{"message":"You have already RSVP'd"}`,
+		},
+		{
+			Name:       "Status",
+			GivenBody:  `{"status": "perhaps"}`,
+			ExpectBody: `{"status":"Must be going, maybe or declined"}`,
+		},
+		{
+			Name:      "Guests",
+			GivenBody: `{"status": "going", "guests": 11}`,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Post(url).
+				JSON(tcase.GivenBody).
+				Headers(testutil.GetAuthHeader(other.Token)).
+				Expect(t).
+				Status(http.StatusBadRequest)
+
+			if tcase.ExpectBody != "" {
+				tt.Body(tcase.ExpectBody)
+			}
+
+			tt.End()
+		})
+	}
+
+	apitest.New().
+		Handler(_handler).
+		Delete(url).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(other.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.declines", 0)).
+		Assert(jsonpath.Len("$.responses", 1)).
+		Assert(jsonpath.Equal("$.rsvpCounts.declined", float64(0))).
+		End()
+
+	got, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+	assert.True(t, got.HasRSVP(member))
+	assert.Nil(t, got.GetRSVP(other))
+	assert.Equal(t, model.RSVPCounts{Going: 1, Headcount: 3}, got.RSVPCounts)
+}
+
+func TestEventCapacity(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	first, _ := _mock.NewUser(_ctx, t)
+	second, _ := _mock.NewUser(_ctx, t)
+	third, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{first, second, third})
+	url := fmt.Sprintf("/events/%s/rsvps", event.ID)
+
+	apitest.New().
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", event.ID)).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(map[string]interface{}{"capacity": 3}).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.capacity", float64(3))).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Post(url).
+		JSON(`{"guests": 1}`).
+		Headers(testutil.GetAuthHeader(first.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.rsvps[0].id", first.ID.String())).
+		Assert(jsonpath.Equal("$.rsvpCounts.headcount", float64(2))).
+		End()
+
+	// The second user does not fit with her guest, and the third would
+	// but cannot skip ahead of her.
+	apitest.New().
+		Handler(_handler).
+		Post(url).
+		JSON(`{"guests": 1}`).
+		Headers(testutil.GetAuthHeader(second.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.rsvps", 1)).
+		Assert(jsonpath.Equal("$.waitlist[0].id", second.ID.String())).
+		Assert(jsonpath.Equal("$.responses[1].status", "waitlisted")).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Post(url).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(third.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.rsvps", 1)).
+		Assert(jsonpath.Equal("$.waitlist[1].id", third.ID.String())).
+		Assert(jsonpath.Equal("$.rsvpCounts.waitlisted", float64(2))).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Post(url).
+		JSON(`{"guests": 3}`).
+		Headers(testutil.GetAuthHeader(first.Token)).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		Body(`{"guests":"There is not enough room for more guests"}`).
+		End()
+
+	// Both waitlisted users fit once the first user stops going, and they
+	// are let in in the order that they joined the waitlist.
+	apitest.New().
+		Handler(_handler).
+		Delete(url).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(first.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.rsvps[0].id", second.ID.String())).
+		Assert(jsonpath.Equal("$.rsvps[1].id", third.ID.String())).
+		Assert(jsonpath.Len("$.waitlist", 0)).
+		Assert(jsonpath.Equal("$.rsvpCounts.headcount", float64(3))).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Post(url).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(first.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.waitlist[0].id", first.ID.String())).
+		End()
+
+	// Raising the capacity lets the waitlisted user in.
+	apitest.New().
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", event.ID)).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(map[string]interface{}{"capacity": 4}).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.rsvps", 3)).
+		Assert(jsonpath.Len("$.waitlist", 0)).
+		End()
+
+	got, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+	assert.True(t, got.HasRSVP(first))
+	assert.Equal(t, model.RSVPCounts{Going: 3, Headcount: 4}, got.RSVPCounts)
+
+	apitest.New().
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", event.ID)).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(map[string]interface{}{"capacity": -1}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		Body(`{"capacity":"Capacity cannot be negative"}`).
+		End()
+}
+
+// notifRecorder records the notifications that are put.
+type notifRecorder struct {
+	notif.Client
+	notifications []*notif.Notification
+}
+
+func (r *notifRecorder) Put(ctx context.Context, n *notif.Notification) error {
+	r.notifications = append(r.notifications, n)
+	return nil
+}
+
+func (r *notifRecorder) count(verb string) int {
+	count := 0
+	for i := range r.notifications {
+		if string(r.notifications[i].Verb) == verb {
+			count++
+		}
+	}
+
+	return count
+}
+
+// conflictingEventStore saves the stored event again before the first
+// CommitWithTransaction, as a concurrent request would, so that it
+// conflicts. When late is set, the event is saved again after it has been
+// saved in the transaction, so that committing the transaction conflicts
+// instead.
+type conflictingEventStore struct {
+	model.EventStore
+	late       bool
+	conflicted bool
+}
+
+func (s *conflictingEventStore) CommitWithTransaction(tx db.Transaction, e *model.Event) error {
+	if s.late {
+		if err := s.EventStore.CommitWithTransaction(tx, e); err != nil {
+			return err
+		}
+
+		return s.conflict(e.ID)
+	}
+
+	if err := s.conflict(e.ID); err != nil {
+		return err
+	}
+
+	return s.EventStore.CommitWithTransaction(tx, e)
+}
+
+func (s *conflictingEventStore) conflict(id model.ID) error {
+	if s.conflicted {
+		return nil
+	}
+
+	s.conflicted = true
+
+	stored, err := s.EventStore.GetEventByID(context.Background(), id)
+	if err != nil {
+		return err
+	}
+
+	return s.EventStore.Commit(context.Background(), stored)
+}
+
+// newConflictingEventHandler returns an event handler that saves events with
+// store and records notifications with recorder.
+func newConflictingEventHandler(store *conflictingEventStore, recorder *notifRecorder) http.Handler {
+	return eventhandler.NewHandler(&eventhandler.Config{
+		DB:            _dbClient,
+		UserStore:     _mock.UserStore,
+		EventStore:    store,
+		MessageStore:  _mock.MessageStore,
+		TxnMiddleware: db.WithTransaction(_dbClient),
+		Mail:          _mock.Mail,
+		Magic:         _mock.Magic,
+		Notif:         recorder,
+		Queue:         _mock.Queue,
+	})
+}
+
+func TestEventCapacityConflict(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	first, _ := _mock.NewUser(_ctx, t)
+	second, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{first, second})
+
+	assert.NoError(t, event.SetCapacity(1))
+	assert.NoError(t, event.SetRSVP(first, model.RSVPGoing, 0, ""))
+	assert.NoError(t, event.SetRSVP(second, model.RSVPGoing, 0, ""))
+	assert.NoError(t, _mock.EventStore.Commit(_ctx, event))
+
+	recorder := &notifRecorder{Client: notif.NewLogger()}
+	store := &conflictingEventStore{EventStore: _mock.EventStore}
+	h := newConflictingEventHandler(store, recorder)
+
+	// The second user takes the spot of the first one once the removal is
+	// retried after the conflict.
+	apitest.New().
+		Handler(h).
+		Delete(fmt.Sprintf("/events/%s/rsvps", event.ID)).
+		Headers(testutil.GetAuthHeader(first.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.rsvps", 1)).
+		Assert(jsonpath.Equal("$.rsvps[0].id", second.ID.String())).
+		End()
+
+	// Only the attempt that was committed notifies.
+	assert.True(t, store.conflicted)
+	assert.Len(t, recorder.notifications, 2)
+	assert.Equal(t, 1, recorder.count(string(notif.RemoveRSVP)))
+	assert.Equal(t, 1, recorder.count(string(notif.PromoteRSVP)))
+}
+
+func TestCancelEventConflict(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+
+	recorder := &notifRecorder{Client: notif.NewLogger()}
+	store := &conflictingEventStore{EventStore: _mock.EventStore, late: true}
+
+	apitest.New().
+		Handler(newConflictingEventHandler(store, recorder)).
+		Post(fmt.Sprintf("/events/%s/cancel", event.ID)).
+		JSON(`{"message": "had to cancel"}`).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusConflict).
+		End()
+
+	// Guests are not told about a cancellation that was not committed.
+	assert.True(t, store.conflicted)
+	assert.Empty(t, recorder.notifications)
+
+	got, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+	assert.False(t, got.IsCancelled())
+}
+
+func TestEventReminders(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+	url := fmt.Sprintf("/events/%s", event.ID)
+
+	apitest.New("duplicates are removed").
+		Handler(_handler).
+		Patch(url).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(`{"reminders": [60, 1440, 60]}`).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.reminders", []interface{}{float64(1440), float64(60)})).
+		End()
+
+	apitest.New("too early").
+		Handler(_handler).
+		Patch(url).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(fmt.Sprintf(`{"reminders": [%d]}`, model.MaxReminderMinutes+1)).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		Assert(jsonpath.Present("$.reminders")).
+		End()
+
+	apitest.New("too many").
+		Handler(_handler).
+		Patch(url).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(`{"reminders": [1, 2, 3, 4, 5, 6]}`).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		Assert(jsonpath.Present("$.reminders")).
+		End()
+
+	apitest.New("not the owner").
+		Handler(_handler).
+		Patch(url).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		JSON(`{"reminders": [30]}`).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New("cleared").
+		Handler(_handler).
+		Patch(url).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		JSON(`{"reminders": []}`).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.reminders", 0)).
+		End()
+}
+
 func TestMagicInvite(t *testing.T) {
 	owner, _ := _mock.NewUser(_ctx, t)
 	host, _ := _mock.NewUser(_ctx, t)
@@ -1124,25 +2237,25 @@ func TestMagicInvite(t *testing.T) {
 	}{
 		{
 			Name:         "Owner",
-			EventID:      event.ID,
+			EventID:      event.ID.String(),
 			AuthToken:    owner.Token,
 			ExpectStatus: http.StatusBadRequest,
 		},
 		{
 			Name:         "Host",
-			EventID:      event.ID,
+			EventID:      event.ID.String(),
 			AuthToken:    host.Token,
 			ExpectStatus: http.StatusBadRequest,
 		},
 		{
 			Name:         "Random",
-			EventID:      event.ID,
+			EventID:      event.ID.String(),
 			AuthToken:    nonmember.Token,
 			ExpectStatus: http.StatusOK,
 		},
 		{
 			Name:         "Unrelated Event",
-			EventID:      event2.ID,
+			EventID:      event2.ID.String(),
 			AuthToken:    nonmember.Token,
 			ExpectStatus: http.StatusUnauthorized,
 		},
@@ -1158,9 +2271,9 @@ func TestMagicInvite(t *testing.T) {
 				Expect(t).
 				Status(testCase.ExpectStatus)
 			if testCase.ExpectStatus == http.StatusOK {
-				tt.Assert(jsonpath.Equal("$.id", event.ID))
-				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID))
-				tt.Assert(jsonpath.Contains("$.users[*].id", nonmember.ID))
+				tt.Assert(jsonpath.Equal("$.id", event.ID.String()))
+				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID.String()))
+				tt.Assert(jsonpath.Contains("$.users[*].id", nonmember.ID.String()))
 			}
 			tt.End()
 		})
@@ -1245,7 +2358,7 @@ func TestMagicRSVP(t *testing.T) {
 			},
 			ExpectStatus: http.StatusOK,
 			ExpectData: map[string]interface{}{
-				"id":        member1.ID,
+				"id":        member1.ID.String(),
 				"firstName": member1.FirstName,
 				"lastName":  member1.LastName,
 				"token":     member1.Token,
@@ -1262,7 +2375,7 @@ func TestMagicRSVP(t *testing.T) {
 			},
 			ExpectStatus: http.StatusOK,
 			ExpectData: map[string]interface{}{
-				"id":        member1.ID,
+				"id":        member1.ID.String(),
 				"firstName": member1.FirstName,
 				"lastName":  member1.LastName,
 				"token":     member1.Token,
@@ -1304,7 +2417,7 @@ func TestMagicRSVP(t *testing.T) {
 			if tcase.ExpectStatus >= http.StatusBadRequest {
 				tt.Body(tcase.ExpectError)
 			} else {
-				tt.Assert(jsonpath.Equal("$.id", member1.ID))
+				tt.Assert(jsonpath.Equal("$.id", member1.ID.String()))
 				tt.Assert(jsonpath.Equal("$.firstName", member1.FirstName))
 				tt.Assert(jsonpath.Equal("$.lastName", member1.LastName))
 				tt.Assert(jsonpath.Equal("$.fullName", member1.FullName))
@@ -1317,3 +2430,33 @@ func TestMagicRSVP(t *testing.T) {
 		})
 	}
 }
+
+func TestMagicRSVPStatus(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+
+	kenc, b64ts, sig := testutil.GetMagicLinkParts(event.GetRSVPMagicLink(magic.NewClient(""), member))
+
+	for _, status := range []string{model.RSVPMaybe, model.RSVPDeclined} {
+		apitest.New(status).
+			Handler(_handler).
+			Post("/events/rsvps").
+			JSON(map[string]interface{}{
+				"signature": sig,
+				"timestamp": b64ts,
+				"userID":    kenc,
+				"eventID":   event.ID,
+				"status":    status,
+			}).
+			Expect(t).
+			Status(http.StatusOK).
+			Assert(jsonpath.Equal("$.id", member.ID.String())).
+			End()
+
+		got, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+		if assert.NoError(t, err) && assert.NotNil(t, got.GetRSVP(member)) {
+			assert.Equal(t, status, got.GetRSVP(member).Status)
+		}
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"testing"
 
+	ics "github.com/arran4/golang-ical"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/hiconvo/api/model"
@@ -61,3 +63,72 @@ func TestInbound(t *testing.T) {
 	assert.Equal(t, rr.Code, http.StatusOK)
 	assert.Equal(t, finalMessageCount > initalMessageCount, true)
 }
+
+func TestInboundInvitationReply(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+
+	tests := []struct {
+		PartStat     string
+		ExpectStatus string
+	}{
+		{PartStat: "ACCEPTED", ExpectStatus: model.RSVPGoing},
+		{PartStat: "TENTATIVE", ExpectStatus: model.RSVPMaybe},
+		{PartStat: "DECLINED", ExpectStatus: model.RSVPDeclined},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.PartStat, func(t *testing.T) {
+			cal := ics.NewCalendar()
+			cal.SetMethod(ics.MethodReply)
+			ev := cal.AddEvent(event.ID.String())
+			ev.SetOrganizer("mailto:" + event.GetOrganizerEmail())
+			ev.AddAttendee(member.Email, ics.ParticipationStatus(tcase.PartStat))
+			reply := cal.Serialize()
+
+			var b bytes.Buffer
+			form := multipart.NewWriter(&b)
+
+			form.WriteField("to", event.GetOrganizerEmail())
+			form.WriteField("from", fmt.Sprintf("%s <%s>", member.FullName, member.Email))
+			form.WriteField("text", "Accepted: "+event.Name)
+			form.WriteField("envelope", fmt.Sprintf(`{"to":["%s"],"from":"%s"}`, event.GetOrganizerEmail(), member.Email))
+			form.WriteField("attachments", "1")
+			form.WriteField("subject", "Accepted: "+event.Name)
+
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", `form-data; name="attachment1"; filename="invite.ics"`)
+			header.Set("Content-Type", "text/calendar; method=REPLY")
+			part, err := form.CreatePart(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write([]byte(reply))
+
+			form.Close()
+
+			req, err := http.NewRequest("POST", "/inbound", &b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Add("Content-Type", form.FormDataContentType())
+
+			rr := httptest.NewRecorder()
+			_handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Contains(t, rr.Body.String(), "PASS")
+
+			gotEvent, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rsvp := gotEvent.GetRSVP(member)
+			if assert.NotNil(t, rsvp) {
+				assert.Equal(t, tcase.ExpectStatus, rsvp.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package handler_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+	"github.com/stretchr/testify/assert"
+
+	og "github.com/hiconvo/api/clients/opengraph"
+	"github.com/hiconvo/api/linkcache"
+	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/testutil"
+)
+
+func TestGetLinkPreview(t *testing.T) {
+	u, _ := _mock.NewUser(_ctx, t)
+
+	if err := _mock.LinkStore.Commit(_ctx, &model.LinkPreview{
+		URL: "https://convo.events/cached",
+		Link: &og.LinkData{
+			URL:   "https://convo.events/cached",
+			Title: "Cached preview",
+			Site:  "Convo",
+		},
+		FetchedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := _mock.LinkStore.Commit(_ctx, &model.LinkPreview{
+		URL:       "https://convo.events/broken",
+		Failed:    true,
+		FetchedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name         string
+		AuthHeader   map[string]string
+		URL          string
+		ExpectStatus int
+		ExpectTitle  string
+	}{
+		{
+			Name:         "cached",
+			AuthHeader:   testutil.GetAuthHeader(u.Token),
+			URL:          "https://convo.events/cached",
+			ExpectStatus: http.StatusOK,
+			ExpectTitle:  "Cached preview",
+		},
+		{
+			Name:         "normalized",
+			AuthHeader:   testutil.GetAuthHeader(u.Token),
+			URL:          "HTTPS://Convo.Events:443/cached?utm_source=test#top",
+			ExpectStatus: http.StatusOK,
+			ExpectTitle:  "Cached preview",
+		},
+		{
+			Name:         "negative cache",
+			AuthHeader:   testutil.GetAuthHeader(u.Token),
+			URL:          "https://convo.events/broken",
+			ExpectStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "invalid url",
+			AuthHeader:   testutil.GetAuthHeader(u.Token),
+			URL:          "not a url",
+			ExpectStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "empty url",
+			AuthHeader:   testutil.GetAuthHeader(u.Token),
+			URL:          "",
+			ExpectStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "unauthenticated",
+			AuthHeader:   nil,
+			URL:          "https://convo.events/cached",
+			ExpectStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Get("/links/preview").
+				Query("url", tcase.URL).
+				Headers(tcase.AuthHeader).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+
+			if tcase.ExpectStatus < 400 {
+				tt.Assert(jsonpath.Equal("$.title", tcase.ExpectTitle))
+			}
+
+			tt.End()
+		})
+	}
+}
+
+// fakeOGClient serves previews titled after the URL and records which URLs
+// it was asked for. It fails like a real fetch would once ctx is done.
+type fakeOGClient struct {
+	mu      sync.Mutex
+	fetched []string
+}
+
+func (c *fakeOGClient) Extract(ctx context.Context, text string) *og.LinkData {
+	return nil
+}
+
+func (c *fakeOGClient) Fetch(ctx context.Context, rawURL string) (*og.LinkData, error) {
+	c.mu.Lock()
+	c.fetched = append(c.fetched, rawURL)
+	c.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return &og.LinkData{URL: rawURL, Title: "Refreshed " + rawURL}, nil
+}
+
+func TestRefreshLinkPreviews(t *testing.T) {
+	active := &model.LinkPreview{
+		URL:         "https://convo.events/refresh/active",
+		Link:        &og.LinkData{URL: "https://convo.events/refresh/active", Title: "Stale"},
+		FetchedAt:   time.Now().Add(-48 * time.Hour),
+		ExpiresAt:   time.Now().Add(-24 * time.Hour),
+		RequestedAt: time.Now().Add(-time.Hour),
+	}
+	idle := &model.LinkPreview{
+		URL:       "https://convo.events/refresh/idle",
+		Link:      &og.LinkData{URL: "https://convo.events/refresh/idle", Title: "Stale"},
+		FetchedAt: time.Now().Add(-60 * 24 * time.Hour),
+		ExpiresAt: time.Now().Add(-59 * 24 * time.Hour),
+	}
+
+	for _, p := range []*model.LinkPreview{active, idle} {
+		if err := _mock.LinkStore.Commit(_ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake := &fakeOGClient{}
+	client := linkcache.New(&linkcache.Config{Store: _mock.LinkStore, OG: fake})
+
+	count, err := client.Refresh(_ctx)
+	if assert.NoError(t, err) {
+		assert.GreaterOrEqual(t, count, 1)
+	}
+
+	assert.Contains(t, fake.fetched, active.URL)
+	assert.NotContains(t, fake.fetched, idle.URL)
+
+	got, found, err := _mock.LinkStore.GetLinkPreviewByURL(_ctx, active.URL)
+	if assert.NoError(t, err) && assert.True(t, found) {
+		assert.Equal(t, "Refreshed "+active.URL, got.Link.Title)
+		assert.False(t, got.IsExpired())
+	}
+
+	_, found, err = _mock.LinkStore.GetLinkPreviewByURL(_ctx, idle.URL)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestLinkPreviewCancelled(t *testing.T) {
+	url := "https://convo.events/cancelled"
+	client := linkcache.New(&linkcache.Config{Store: _mock.LinkStore, OG: &fakeOGClient{}})
+
+	ctx, cancel := context.WithCancel(_ctx)
+	cancel()
+
+	_, err := client.Fetch(ctx, url)
+	assert.Error(t, err)
+
+	// A fetch that the caller gave up on is not remembered as a failure.
+	_, found, err := _mock.LinkStore.GetLinkPreviewByURL(_ctx, url)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	ld, err := client.Fetch(_ctx, url)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Refreshed "+url, ld.Title)
+	}
+}
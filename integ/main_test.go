@@ -7,10 +7,12 @@ import (
 	"os"
 	"testing"
 
+	"cloud.google.com/go/datastore"
 	"github.com/steinfletcher/apitest"
 
 	"github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/clients/search"
+	"github.com/hiconvo/api/model"
 	"github.com/hiconvo/api/random"
 	"github.com/hiconvo/api/testutil"
 )
@@ -40,6 +42,19 @@ func TestMain(m *testing.M) {
 	os.Exit(result)
 }
 
+// mustDecodeID returns the key that the stores use for the entity with the
+// given ID, so that tests can check what was written to the db directly.
+func mustDecodeID(t *testing.T, id model.ID) *datastore.Key {
+	t.Helper()
+
+	key, err := datastore.DecodeKey(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
 func Test404(t *testing.T) {
 	apitest.New().
 		Handler(_handler).
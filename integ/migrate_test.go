@@ -0,0 +1,315 @@
+package handler_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/migrate"
+	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/random"
+)
+
+type migrateTestEntity struct {
+	N        int
+	Migrated int
+}
+
+// putMigrateTestEntities puts count entities of a new kind, keyed so that
+// the order of their keys is the order of N, and returns the kind.
+func putMigrateTestEntities(t *testing.T, count int) string {
+	kind := "MigrateTest" + random.String(8)
+
+	for i := 0; i < count; i++ {
+		key := datastore.NameKey(kind, fmt.Sprintf("%03d", i), nil)
+		if _, err := _dbClient.Put(_ctx, key, &migrateTestEntity{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return kind
+}
+
+// newMigrateTestMigration returns a migration of the entities of a new kind
+// that counts how many times each of them is migrated. It fails once when it
+// reaches the entity at failAt, unless failAt is negative.
+func newMigrateTestMigration(t *testing.T, count, failAt int) (*migrate.Migration, func() []int) {
+	kind := putMigrateTestEntities(t, count)
+
+	m := &migrate.Migration{
+		ID:        "0001-" + kind,
+		Query:     db.NewQuery(kind),
+		BatchSize: 2,
+		Step: func(ctx context.Context, s *migrate.Step) (int, error) {
+			var entities []*migrateTestEntity
+			keys, err := s.DB.GetAll(ctx, s.Query, &entities)
+			if err != nil {
+				return 0, err
+			}
+
+			for i := range entities {
+				if entities[i].N == failAt {
+					failAt = -1
+					return 0, errors.Str("failed")
+				}
+
+				entities[i].Migrated++
+			}
+
+			if !s.IsDryRun {
+				if _, err := s.DB.PutMulti(ctx, keys, entities); err != nil {
+					return 0, err
+				}
+			}
+
+			return len(entities), nil
+		},
+	}
+
+	migrated := func() []int {
+		var entities []*migrateTestEntity
+		if _, err := _dbClient.GetAll(_ctx, db.NewQuery(kind).Order("N"), &entities); err != nil {
+			t.Fatal(err)
+		}
+
+		out := make([]int, len(entities))
+		for i := range entities {
+			out[i] = entities[i].Migrated
+		}
+
+		return out
+	}
+
+	return m, migrated
+}
+
+func TestMigrateRun(t *testing.T) {
+	m, migrated := newMigrateTestMigration(t, 5, -1)
+	mig := migrate.New(&migrate.Config{DB: _dbClient, Migrations: []*migrate.Migration{m}})
+
+	assert.NoError(t, mig.Run(_ctx))
+	assert.Equal(t, []int{1, 1, 1, 1, 1}, migrated())
+
+	statuses, err := mig.Status(_ctx)
+	assert.NoError(t, err)
+	assert.True(t, statuses[0].IsApplied())
+	assert.Equal(t, 5, statuses[0].Count)
+
+	// Applied migrations do not run again.
+	assert.NoError(t, mig.Run(_ctx))
+	assert.Equal(t, []int{1, 1, 1, 1, 1}, migrated())
+}
+
+func TestMigrateResume(t *testing.T) {
+	m, migrated := newMigrateTestMigration(t, 5, 3)
+	mig := migrate.New(&migrate.Config{DB: _dbClient, Migrations: []*migrate.Migration{m}})
+
+	assert.Error(t, mig.Run(_ctx))
+	assert.Equal(t, []int{1, 1, 0, 0, 0}, migrated())
+
+	statuses, err := mig.Status(_ctx)
+	assert.NoError(t, err)
+	assert.False(t, statuses[0].IsApplied())
+	assert.Equal(t, 2, statuses[0].Count)
+
+	// The migration resumes after the last batch that succeeded.
+	assert.NoError(t, mig.Run(_ctx))
+	assert.Equal(t, []int{1, 1, 1, 1, 1}, migrated())
+}
+
+func TestMigrateDeletes(t *testing.T) {
+	kind := putMigrateTestEntities(t, 5)
+	m := &migrate.Migration{
+		ID:        "0001-" + kind,
+		Query:     db.NewQuery(kind),
+		BatchSize: 2,
+		Step: func(ctx context.Context, s *migrate.Step) (int, error) {
+			keys, err := s.DB.GetAll(ctx, s.Query.KeysOnly(), nil)
+			if err != nil {
+				return 0, err
+			}
+
+			if err := s.DB.DeleteMulti(ctx, keys); err != nil {
+				return 0, err
+			}
+
+			return len(keys), nil
+		},
+	}
+	mig := migrate.New(&migrate.Config{DB: _dbClient, Migrations: []*migrate.Migration{m}})
+
+	// Deleting the entities of a batch does not make the next batch skip
+	// any entities.
+	assert.NoError(t, mig.Run(_ctx))
+
+	keys, err := _dbClient.GetAll(_ctx, db.NewQuery(kind).KeysOnly(), nil)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 0)
+
+	statuses, err := mig.Status(_ctx)
+	assert.NoError(t, err)
+	assert.True(t, statuses[0].IsApplied())
+	assert.Equal(t, 5, statuses[0].Count)
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	m, migrated := newMigrateTestMigration(t, 3, -1)
+	mig := migrate.New(&migrate.Config{DB: _dbClient, Migrations: []*migrate.Migration{m}, IsDryRun: true})
+
+	assert.NoError(t, mig.Run(_ctx))
+	assert.Equal(t, []int{0, 0, 0}, migrated())
+
+	statuses, err := mig.Status(_ctx)
+	assert.NoError(t, err)
+	assert.False(t, statuses[0].IsApplied())
+	assert.Equal(t, 0, statuses[0].Count)
+}
+
+func TestMigrateMarkApplied(t *testing.T) {
+	m, migrated := newMigrateTestMigration(t, 3, -1)
+	mig := migrate.New(&migrate.Config{DB: _dbClient, Migrations: []*migrate.Migration{m}})
+
+	assert.Error(t, mig.MarkApplied(_ctx, "0002-unknown"))
+	assert.NoError(t, mig.MarkApplied(_ctx, m.ID))
+	assert.NoError(t, mig.Run(_ctx))
+	assert.Equal(t, []int{0, 0, 0}, migrated())
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	m, migrated := newMigrateTestMigration(t, 3, -1)
+	m.Baseline = true
+	mig := migrate.New(&migrate.Config{DB: _dbClient, Migrations: []*migrate.Migration{m}})
+
+	assert.NoError(t, mig.Run(_ctx))
+	assert.Equal(t, []int{0, 0, 0}, migrated())
+
+	statuses, err := mig.Status(_ctx)
+	assert.NoError(t, err)
+	assert.True(t, statuses[0].IsApplied())
+	assert.Equal(t, 0, statuses[0].Count)
+
+	// The one-off commands that the first migrations replaced already ran.
+	for _, m := range migrate.All[:3] {
+		assert.True(t, m.Baseline, m.ID)
+	}
+}
+
+func TestMigratePopulateDeletedAt(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	ownerKey := mustDecodeID(t, owner.ID)
+
+	// The thread is saved the way threads were before they could be
+	// deleted, without DeletedAt.
+	key, err := _dbClient.Put(_ctx, datastore.IncompleteKey("Thread", nil), &datastore.PropertyList{
+		{Name: "OwnerKey", Value: ownerKey},
+		{Name: "UserKeys", Value: []interface{}{ownerKey}},
+		{Name: "Subject", Value: "legacy", NoIndex: true},
+		{Name: "CreatedAt", Value: time.Now()},
+		{Name: "UpdatedAt", Value: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	threads, err := _mock.ThreadStore.GetThreadsByUser(_ctx, owner, &model.Pagination{})
+	assert.NoError(t, err)
+	assert.Len(t, threads, 0)
+
+	var migrations []*migrate.Migration
+	for _, m := range migrate.All {
+		if m.ID == "0004-thread-deleted-at" {
+			migrations = append(migrations, m)
+		}
+	}
+
+	mig := migrate.New(&migrate.Config{DB: _dbClient, Migrations: migrations})
+	assert.NoError(t, mig.Run(_ctx))
+
+	threads, err = _mock.ThreadStore.GetThreadsByUser(_ctx, owner, &model.Pagination{})
+	assert.NoError(t, err)
+
+	if assert.Len(t, threads, 1) {
+		assert.Equal(t, key.Encode(), threads[0].ID.String())
+	}
+}
+
+func TestMigrateEventTimeZones(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, nil, nil)
+
+	// The event is saved the way events were before they had time zones.
+	event.UTCOffset = 3600
+	event.TimeZone = ""
+	assert.NoError(t, _mock.EventStore.Commit(_ctx, event))
+
+	var migrations []*migrate.Migration
+	for _, m := range migrate.All {
+		if m.ID == "0008-event-time-zones" {
+			migrations = append(migrations, m)
+		}
+	}
+
+	mig := migrate.New(&migrate.Config{DB: _dbClient, Migrations: migrations})
+	assert.NoError(t, mig.Run(_ctx))
+
+	got, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Etc/GMT-1", got.TimeZone)
+	assert.Equal(t, event.Timestamp.Unix(), got.Timestamp.Unix())
+}
+
+func TestMigrateEventRSVPStatuses(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	event := _mock.NewEvent(_ctx, t, owner, nil, []*model.User{member})
+	key := mustDecodeID(t, event.ID)
+
+	// The event is saved the way events were before RSVPs had statuses.
+	var props datastore.PropertyList
+	if err := _dbClient.Get(_ctx, key, &props); err != nil {
+		t.Fatal(err)
+	}
+
+	props = append(props, datastore.Property{Name: "RSVPKeys", Value: []interface{}{mustDecodeID(t, member.ID)}})
+
+	if _, err := _dbClient.Put(_ctx, key, &props); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+	assert.True(t, got.HasRSVP(member))
+
+	var migrations []*migrate.Migration
+	for _, m := range migrate.All {
+		if m.ID == "0009-event-rsvp-statuses" {
+			migrations = append(migrations, m)
+		}
+	}
+
+	mig := migrate.New(&migrate.Config{DB: _dbClient, Migrations: migrations})
+	assert.NoError(t, mig.Run(_ctx))
+
+	var saved datastore.PropertyList
+	assert.NoError(t, _dbClient.Get(_ctx, key, &saved))
+
+	for i := range saved {
+		assert.NotEqual(t, "RSVPKeys", saved[i].Name)
+	}
+
+	got, err = _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+
+	if assert.Len(t, got.Responses, 1) {
+		assert.Equal(t, member.ID, got.Responses[0].UserID)
+		assert.Equal(t, model.RSVPGoing, got.Responses[0].Status)
+	}
+
+	assert.Equal(t, 1, got.RSVPCounts.Headcount)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/icrowley/fake"
 	"github.com/steinfletcher/apitest"
 	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+	"github.com/stretchr/testify/assert"
 
 	"github.com/hiconvo/api/model"
 	"github.com/hiconvo/api/testutil"
@@ -135,7 +136,7 @@ func TestGetNote(t *testing.T) {
 				tt.Assert(jsonpath.Equal("$.name", n1.Name))
 				tt.Assert(jsonpath.Equal("$.url", n1.URL))
 				tt.Assert(jsonpath.Equal("$.favicon", n1.Favicon))
-				tt.Assert(jsonpath.Equal("$.id", n1.ID))
+				tt.Assert(jsonpath.Equal("$.id", n1.ID.String()))
 			}
 			tt.End()
 		})
@@ -153,6 +154,7 @@ func TestGetNotes(t *testing.T) {
 	tests := []struct {
 		Name            string
 		URL             string
+		GivenQuery      map[string]string
 		GivenAuthHeader map[string]string
 		ExpectStatus    int
 		Check           func(tt *apitest.Response)
@@ -168,22 +170,23 @@ func TestGetNotes(t *testing.T) {
 					tt.Assert(jsonpath.Equal(fmt.Sprintf("$.notes[%d].name", i), n.Name))
 					tt.Assert(jsonpath.Equal(fmt.Sprintf("$.notes[%d].url", i), n.URL))
 					tt.Assert(jsonpath.Equal(fmt.Sprintf("$.notes[%d].favicon", i), n.Favicon))
-					tt.Assert(jsonpath.Equal(fmt.Sprintf("$.notes[%d].id", i), n.ID))
+					tt.Assert(jsonpath.Equal(fmt.Sprintf("$.notes[%d].id", i), n.ID.String()))
 				}
 			},
 		},
-		// {
-		// 	Name:            "search",
-		// 	URL:             fmt.Sprintf("/notes?search=%s", url.QueryEscape(n1.Body)),
-		// 	GivenAuthHeader: testutil.GetAuthHeader(u1.Token),
-		// 	ExpectStatus:    http.StatusOK,
-		// 	Check: func(tt *apitest.Response) {
-		// 		tt.Assert(jsonpath.Equal("$.notes[0].name", n1.Name))
-		// 		tt.Assert(jsonpath.Equal("$.notes[0].url", n1.URL))
-		// 		tt.Assert(jsonpath.Equal("$.notes[0].favicon", n1.Favicon))
-		// 		tt.Assert(jsonpath.Equal("$.notes[0].id", n1.ID))
-		// 	},
-		// },
+		{
+			Name:            "search",
+			URL:             "/notes",
+			GivenQuery:      map[string]string{"search": n1.Body},
+			GivenAuthHeader: testutil.GetAuthHeader(u1.Token),
+			ExpectStatus:    http.StatusOK,
+			Check: func(tt *apitest.Response) {
+				tt.Assert(jsonpath.Equal("$.notes[0].name", n1.Name))
+				tt.Assert(jsonpath.Equal("$.notes[0].url", n1.URL))
+				tt.Assert(jsonpath.Equal("$.notes[0].favicon", n1.Favicon))
+				tt.Assert(jsonpath.Equal("$.notes[0].id", n1.ID.String()))
+			},
+		},
 		{
 			Name:            "bad headers",
 			URL:             "/notes",
@@ -197,6 +200,7 @@ func TestGetNotes(t *testing.T) {
 			tt := apitest.New(tcase.Name).
 				Handler(_handler).
 				Get(tcase.URL).
+				QueryParams(tcase.GivenQuery).
 				Headers(tcase.GivenAuthHeader).
 				Expect(t).
 				Status(tcase.ExpectStatus)
@@ -271,13 +275,41 @@ func TestUpdateNote(t *testing.T) {
 				tt.Assert(jsonpath.Equal("$.name", tcase.GivenBody["name"]))
 				tt.Assert(jsonpath.Equal("$.url", tcase.GivenBody["url"]))
 				tt.Assert(jsonpath.Equal("$.favicon", tcase.GivenBody["favicon"]))
-				tt.Assert(jsonpath.Equal("$.id", n1.ID))
+				tt.Assert(jsonpath.Equal("$.id", n1.ID.String()))
 			}
 			tt.End()
 		})
 	}
 }
 
+func TestUpdateNoteIfMatch(t *testing.T) {
+	u1, _ := _mock.NewUser(_ctx, t)
+	n1 := _mock.NewNote(_ctx, t, u1)
+	url := fmt.Sprintf("/notes/%s", n1.ID)
+
+	apitest.New("stale").
+		Handler(_handler).
+		Patch(url).
+		JSON(map[string]string{"name": "stale"}).
+		Headers(testutil.GetAuthHeader(u1.Token)).
+		Header("If-Match", `"0"`).
+		Expect(t).
+		Status(http.StatusPreconditionFailed).
+		End()
+
+	apitest.New("current").
+		Handler(_handler).
+		Patch(url).
+		JSON(map[string]string{"name": "current"}).
+		Headers(testutil.GetAuthHeader(u1.Token)).
+		Header("If-Match", n1.ETag()).
+		Expect(t).
+		Status(http.StatusOK).
+		Header("ETag", `"2"`).
+		Assert(jsonpath.Equal("$.name", "current")).
+		End()
+}
+
 func TestDeleteNote(t *testing.T) {
 	u1, _ := _mock.NewUser(_ctx, t)
 	u2, _ := _mock.NewUser(_ctx, t)
@@ -328,10 +360,82 @@ func TestDeleteNote(t *testing.T) {
 				tt.Assert(jsonpath.Equal("$.name", n1.Name))
 				tt.Assert(jsonpath.Equal("$.url", n1.URL))
 				tt.Assert(jsonpath.Equal("$.favicon", n1.Favicon))
-				tt.Assert(jsonpath.Equal("$.id", n1.ID))
+				tt.Assert(jsonpath.Equal("$.id", n1.ID.String()))
 			}
 
 			tt.End()
 		})
 	}
 }
+
+func TestRestoreNote(t *testing.T) {
+	u1, _ := _mock.NewUser(_ctx, t)
+	u2, _ := _mock.NewUser(_ctx, t)
+	n1 := _mock.NewNote(_ctx, t, u1)
+	url := fmt.Sprintf("/notes/%s", n1.ID)
+
+	apitest.New("tag").
+		Handler(_handler).
+		Patch(url).
+		JSON(map[string]interface{}{"tags": []string{"restored"}}).
+		Headers(testutil.GetAuthHeader(u1.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New("delete").
+		Handler(_handler).
+		Delete(url).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(u1.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	hasTag := func() bool {
+		u, err := _mock.UserStore.GetUserByID(_ctx, u1.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range u.Tags {
+			if u.Tags[i].Name == "restored" {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	assert.False(t, hasTag())
+
+	apitest.New("wrong person").
+		Handler(_handler).
+		Post(url + "/restore").
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(u2.Token)).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New("success").
+		Handler(_handler).
+		Post(url + "/restore").
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(u1.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.id", n1.ID.String())).
+		Assert(jsonpath.Contains("$.tags", "restored")).
+		End()
+
+	assert.True(t, hasTag())
+
+	apitest.New("get restored note").
+		Handler(_handler).
+		Get(url).
+		Headers(testutil.GetAuthHeader(u1.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+}
@@ -0,0 +1,483 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icrowley/fake"
+	"github.com/steinfletcher/apitest"
+	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hiconvo/api/clients/queue"
+	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/testutil"
+)
+
+// newRecurringEvent returns an event whose first occurrence starts at start
+// and that repeats by r.
+func newRecurringEvent(
+	t *testing.T,
+	owner *model.User,
+	users []*model.User,
+	start time.Time,
+	r *model.Recurrence,
+) *model.Event {
+	t.Helper()
+
+	event := _mock.NewEvent(_ctx, t, owner, nil, users)
+	event.Reschedule(start)
+
+	if err := event.SetRecurrence(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := _mock.EventStore.Commit(_ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	return event
+}
+
+func TestCreateRecurringEvent(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+
+	tests := []struct {
+		Name              string
+		GivenRecurrence   map[string]interface{}
+		ExpectStatus      int
+		ExpectOccurrences []string
+	}{
+		{
+			Name: "weekly with exception",
+			GivenRecurrence: map[string]interface{}{
+				"frequency":  "weekly",
+				"count":      3,
+				"exceptions": []string{"2119-09-15T18:00:00Z"},
+			},
+			ExpectStatus:      http.StatusCreated,
+			ExpectOccurrences: []string{"2119-09-08T18:00:00Z", "2119-09-22T18:00:00Z"},
+		},
+		{
+			Name: "every other day until",
+			GivenRecurrence: map[string]interface{}{
+				"frequency": "daily",
+				"interval":  2,
+				"until":     "2119-09-12T18:00:00Z",
+			},
+			ExpectStatus: http.StatusCreated,
+			ExpectOccurrences: []string{
+				"2119-09-08T18:00:00Z", "2119-09-10T18:00:00Z", "2119-09-12T18:00:00Z",
+			},
+		},
+		{
+			Name:            "unknown frequency",
+			GivenRecurrence: map[string]interface{}{"frequency": "yearly"},
+			ExpectStatus:    http.StatusBadRequest,
+		},
+		{
+			Name: "count and until",
+			GivenRecurrence: map[string]interface{}{
+				"frequency": "daily",
+				"count":     3,
+				"until":     "2119-09-12T18:00:00Z",
+			},
+			ExpectStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "until before start",
+			GivenRecurrence: map[string]interface{}{
+				"frequency": "daily",
+				"until":     "2119-09-01T18:00:00Z",
+			},
+			ExpectStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Post("/events").
+				JSON(map[string]interface{}{
+					"name":        fake.Title(),
+					"placeId":     fake.CharactersN(32),
+					"timestamp":   "2119-09-08T18:00:00Z",
+					"description": fake.Paragraph(),
+					"recurrence":  tcase.GivenRecurrence,
+				}).
+				Headers(testutil.GetAuthHeader(owner.Token)).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+
+			if tcase.ExpectStatus < http.StatusBadRequest {
+				tt.Assert(jsonpath.Equal("$.recurrence.frequency", tcase.GivenRecurrence["frequency"]))
+				tt.Assert(jsonpath.Len("$.occurrences", len(tcase.ExpectOccurrences)))
+
+				for i := range tcase.ExpectOccurrences {
+					tt.Assert(jsonpath.Equal(fmt.Sprintf("$.occurrences[%d].start", i), tcase.ExpectOccurrences[i]))
+				}
+			} else {
+				tt.Assert(jsonpath.Present("$.recurrence"))
+			}
+
+			tt.End()
+		})
+	}
+}
+
+func TestRecurringEventICS(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	start := time.Date(2030, 6, 5, 18, 0, 0, 0, time.UTC)
+	event := newRecurringEvent(t, owner, nil, start, &model.Recurrence{
+		Frequency:  model.FrequencyWeekly,
+		Count:      3,
+		Exceptions: []time.Time{start.AddDate(0, 0, 7)},
+	})
+
+	ics := event.GetICS()
+	assert.Contains(t, ics, "RRULE:FREQ=WEEKLY;INTERVAL=1;COUNT=3")
+	assert.Contains(t, ics, "EXDATE:20300612T180000Z")
+
+	event.Recurrence = &model.Recurrence{
+		Frequency: model.FrequencyMonthly,
+		Interval:  2,
+		Until:     start.AddDate(1, 0, 0),
+	}
+
+	ics = event.GetICS()
+	assert.Contains(t, ics, "RRULE:FREQ=MONTHLY;INTERVAL=2;UNTIL=20310605T180000Z")
+	assert.NotContains(t, ics, "EXDATE")
+}
+
+func TestRecurringEventReminder(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	start := time.Date(2030, 6, 5, 18, 0, 0, 0, time.UTC)
+	event := newRecurringEvent(t, owner, nil, start, &model.Recurrence{
+		Frequency: model.FrequencyWeekly,
+		Count:     3,
+	})
+	assert.NoError(t, event.SetTimeZone("Europe/Paris"))
+	assert.NoError(t, event.SetReminders([]int{60}))
+	event.RemindedAt = start.AddDate(0, 0, 7).Add(-2 * time.Hour)
+
+	// The reminder is about the second occurrence, not the next one.
+	due, ok := event.DueReminder(start.AddDate(0, 0, 7).Add(-30 * time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, start.AddDate(0, 0, 7), due.UTC())
+
+	// The occurrence is formatted in the time zone of the event after it
+	// has been queued.
+	b, err := json.Marshal(queue.EmailPayload{Occurrence: due})
+	assert.NoError(t, err)
+
+	var payload queue.EmailPayload
+	assert.NoError(t, json.Unmarshal(b, &payload))
+	assert.Equal(t, "Wednesday, June 12 @ 8:00 PM", event.GetFormatedOccurrence(payload.Occurrence))
+	assert.Equal(t, "Wednesday, June 5 @ 8:00 PM", event.GetFormatedTime())
+}
+
+func TestGetOccurrences(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	nonmember, _ := _mock.NewUser(_ctx, t)
+
+	// Months without a 31st are skipped.
+	event := newRecurringEvent(t, owner, []*model.User{member},
+		time.Date(2030, 1, 31, 18, 0, 0, 0, time.UTC),
+		&model.Recurrence{Frequency: model.FrequencyMonthly, Count: 5})
+	eventURL := fmt.Sprintf("/events/%s/occurrences", event.ID)
+
+	tests := []struct {
+		Name              string
+		AuthHeader        map[string]string
+		GivenQuery        map[string]string
+		ExpectStatus      int
+		ExpectOccurrences []string
+	}{
+		{
+			Name:         "all",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			ExpectStatus: http.StatusOK,
+			ExpectOccurrences: []string{
+				"2030-01-31T18:00:00Z",
+				"2030-03-31T18:00:00Z",
+				"2030-05-31T18:00:00Z",
+				"2030-07-31T18:00:00Z",
+				"2030-08-31T18:00:00Z",
+			},
+		},
+		{
+			Name:              "window",
+			AuthHeader:        testutil.GetAuthHeader(owner.Token),
+			GivenQuery:        map[string]string{"from": "2030-02-01T00:00:00Z", "to": "2030-07-31T18:00:00Z"},
+			ExpectStatus:      http.StatusOK,
+			ExpectOccurrences: []string{"2030-03-31T18:00:00Z", "2030-05-31T18:00:00Z"},
+		},
+		{
+			Name:         "invalid time",
+			AuthHeader:   testutil.GetAuthHeader(owner.Token),
+			GivenQuery:   map[string]string{"from": "tomorrow"},
+			ExpectStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "nonmember",
+			AuthHeader:   testutil.GetAuthHeader(nonmember.Token),
+			ExpectStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Get(eventURL).
+				QueryParams(tcase.GivenQuery).
+				Headers(tcase.AuthHeader).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+
+			if tcase.ExpectStatus < http.StatusBadRequest {
+				tt.Assert(jsonpath.Len("$.occurrences", len(tcase.ExpectOccurrences)))
+
+				for i := range tcase.ExpectOccurrences {
+					tt.Assert(jsonpath.Equal(fmt.Sprintf("$.occurrences[%d].start", i), tcase.ExpectOccurrences[i]))
+				}
+			}
+
+			tt.End()
+		})
+	}
+}
+
+func TestOccurrenceRSVP(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	start := time.Date(2030, 6, 5, 18, 0, 0, 0, time.UTC)
+	event := newRecurringEvent(t, owner, []*model.User{member}, start,
+		&model.Recurrence{Frequency: model.FrequencyDaily, Count: 3})
+	rsvpURL := fmt.Sprintf("/events/%s/rsvps", event.ID)
+	second := "2030-06-06T18:00:00Z"
+
+	apitest.New().
+		Handler(_handler).
+		Post(rsvpURL).
+		Query("occurrence", second).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.rsvps", 0)).
+		Assert(jsonpath.Len("$.occurrences[0].rsvps", 0)).
+		Assert(jsonpath.Equal("$.occurrences[1].rsvps[0].id", member.ID.String())).
+		Assert(jsonpath.Len("$.occurrences[2].rsvps", 0)).
+		End()
+
+	// Duplicates and times that are not occurrences are rejected.
+	for _, occurrence := range []string{second, "2030-06-06T19:00:00Z"} {
+		apitest.New().
+			Handler(_handler).
+			Post(rsvpURL).
+			Query("occurrence", occurrence).
+			JSON(`{}`).
+			Headers(testutil.GetAuthHeader(member.Token)).
+			Expect(t).
+			Status(http.StatusBadRequest).
+			End()
+	}
+
+	apitest.New().
+		Handler(_handler).
+		Get(fmt.Sprintf("/events/%s", event.ID)).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.occurrences[1].rsvps[0].id", member.ID.String())).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Delete(rsvpURL).
+		Query("occurrence", second).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.occurrences[1].rsvps", 0)).
+		End()
+
+	// RSVPs to the event count for every occurrence.
+	apitest.New().
+		Handler(_handler).
+		Post(rsvpURL).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.occurrences[0].rsvps[0].id", member.ID.String())).
+		Assert(jsonpath.Equal("$.occurrences[2].rsvps[0].id", member.ID.String())).
+		End()
+}
+
+func TestOccurrenceRSVPCapacity(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	regular, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	other, _ := _mock.NewUser(_ctx, t)
+	start := time.Date(2030, 6, 5, 18, 0, 0, 0, time.UTC)
+	event := newRecurringEvent(t, owner, []*model.User{regular, member, other}, start,
+		&model.Recurrence{Frequency: model.FrequencyDaily, Count: 3})
+
+	// One seat is taken by the user who is going to every occurrence.
+	assert.NoError(t, event.SetCapacity(2))
+	assert.NoError(t, event.SetRSVP(regular, model.RSVPGoing, 0, ""))
+	assert.NoError(t, _mock.EventStore.Commit(_ctx, event))
+
+	rsvpURL := fmt.Sprintf("/events/%s/rsvps", event.ID)
+	second := "2030-06-06T18:00:00Z"
+
+	apitest.New().
+		Handler(_handler).
+		Post(rsvpURL).
+		Query("occurrence", second).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.occurrences[1].rsvps", 2)).
+		End()
+
+	// The second occurrence is full, but the others still have room.
+	apitest.New().
+		Handler(_handler).
+		Post(rsvpURL).
+		Query("occurrence", second).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(other.Token)).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		Assert(jsonpath.Equal("$.message", "This occurrence is full")).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Post(rsvpURL).
+		Query("occurrence", "2030-06-07T18:00:00Z").
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(other.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Len("$.occurrences[1].rsvps", 2)).
+		Assert(jsonpath.Len("$.occurrences[2].rsvps", 2)).
+		End()
+}
+
+func TestUpdateFollowingOccurrences(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	start := time.Date(2030, 6, 5, 18, 0, 0, 0, time.UTC)
+	event := newRecurringEvent(t, owner, []*model.User{member}, start, &model.Recurrence{
+		Frequency:  model.FrequencyWeekly,
+		Count:      5,
+		Exceptions: []time.Time{start.AddDate(0, 0, 7), start.AddDate(0, 0, 21)},
+	})
+
+	assert.NoError(t, event.AddOccurrenceRSVP(member, start.AddDate(0, 0, 28)))
+	assert.NoError(t, _mock.EventStore.Commit(_ctx, event))
+
+	// Moving the third occurrence an hour later moves the ones after it.
+	var following model.Event
+
+	apitest.New().
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", event.ID)).
+		JSON(map[string]interface{}{
+			"name":       "Cercle de lecture",
+			"occurrence": "2030-06-19T18:00:00Z",
+			"timestamp":  "2030-06-19T19:00:00Z",
+			"resend":     true,
+		}).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.name", "Cercle de lecture")).
+		Assert(jsonpath.Equal("$.recurrence.count", float64(3))).
+		Assert(jsonpath.Len("$.occurrences", 2)).
+		Assert(jsonpath.Equal("$.occurrences[0].start", "2030-06-19T19:00:00Z")).
+		Assert(jsonpath.Equal("$.occurrences[1].start", "2030-07-03T19:00:00Z")).
+		Assert(jsonpath.Equal("$.occurrences[1].rsvps[0].id", member.ID.String())).
+		End().
+		JSON(&following)
+
+	assert.NotEqual(t, event.ID, following.ID)
+
+	// The earlier occurrences are left as they were.
+	original, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, event.Name, original.Name)
+	assert.Len(t, original.GetOccurrences(time.Time{}, time.Time{}, 10), 1)
+	assert.Empty(t, original.OccurrenceRSVPs)
+	assert.Greater(t, original.Sequence, event.Sequence)
+
+	split, err := _mock.EventStore.GetEventByID(_ctx, following.ID)
+	assert.NoError(t, err)
+	assert.True(t, split.HasUser(member))
+	assert.Equal(t, owner.ID, split.OwnerID)
+	assert.NotEqual(t, original.Token, split.Token)
+
+	// Updating from the first occurrence changes the whole event.
+	apitest.New().
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", following.ID)).
+		JSON(map[string]interface{}{
+			"occurrence": "2030-06-19T19:00:00Z",
+			"recurrence": map[string]interface{}{"frequency": ""},
+		}).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.id", following.ID.String())).
+		Assert(jsonpath.NotPresent("$.occurrences")).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Patch(fmt.Sprintf("/events/%s", event.ID)).
+		JSON(map[string]interface{}{"occurrence": "2030-06-12T18:00:00Z"}).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestMergeOccurrenceRSVPs(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	u, _ := _mock.NewUser(_ctx, t)
+	oldUser := _mock.NewIncompleteUser(_ctx, t)
+	start := time.Date(2030, 6, 5, 18, 0, 0, 0, time.UTC)
+	event := newRecurringEvent(t, owner, []*model.User{oldUser}, start,
+		&model.Recurrence{Frequency: model.FrequencyDaily, Count: 2})
+
+	assert.NoError(t, event.AddOccurrenceRSVP(oldUser, start.AddDate(0, 0, 1)))
+	assert.NoError(t, _mock.EventStore.Commit(_ctx, event))
+
+	assert.NoError(t, u.MergeWith(
+		_ctx,
+		_dbClient,
+		_mock.UserStore,
+		_mock.MessageStore,
+		_mock.ThreadStore,
+		_mock.EventStore,
+		_mock.NoteStore,
+		oldUser))
+
+	event, err := _mock.EventStore.GetEventByID(_ctx, event.ID)
+	assert.NoError(t, err)
+	assert.True(t, event.HasOccurrenceRSVP(u, start.AddDate(0, 0, 1)))
+	assert.False(t, event.HasOccurrenceRSVP(u, start))
+	assert.True(t, strings.HasPrefix(event.GetFormatedTime(), "Wednesday, June 5"))
+}
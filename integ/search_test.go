@@ -0,0 +1,105 @@
+package handler_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+
+	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/testutil"
+)
+
+func TestSearch(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	nonmember, _ := _mock.NewUser(_ctx, t)
+	thread := _mock.NewThread(_ctx, t, owner, []*model.User{member})
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+
+	tests := []struct {
+		Name         string
+		AuthHeader   map[string]string
+		Query        string
+		Type         string
+		ExpectStatus int
+		ExpectEmpty  bool
+		ExpectID     string
+	}{
+		{
+			Name:         "member",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			Query:        thread.Subject,
+			ExpectStatus: http.StatusOK,
+			ExpectID:     thread.ID.String(),
+		},
+		{
+			Name:         "member with type filter",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			Query:        event.Name,
+			Type:         "event",
+			ExpectStatus: http.StatusOK,
+			ExpectID:     event.ID.String(),
+		},
+		{
+			Name:         "owner",
+			AuthHeader:   testutil.GetAuthHeader(owner.Token),
+			Query:        event.Name,
+			Type:         "thread,event",
+			ExpectStatus: http.StatusOK,
+			ExpectID:     event.ID.String(),
+		},
+		{
+			Name:         "nonmember",
+			AuthHeader:   testutil.GetAuthHeader(nonmember.Token),
+			Query:        thread.Subject,
+			Type:         "thread,message,event,note",
+			ExpectStatus: http.StatusOK,
+			ExpectEmpty:  true,
+		},
+		{
+			Name:         "invalid type",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			Query:        thread.Subject,
+			Type:         "thread,boop",
+			ExpectStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "empty query",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			Query:        "",
+			ExpectStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "unauthenticated",
+			AuthHeader:   map[string]string{"boop": "beep"},
+			Query:        thread.Subject,
+			ExpectStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Get("/search").
+				Query("q", tcase.Query).
+				Query("type", tcase.Type).
+				Headers(tcase.AuthHeader).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+
+			if tcase.ExpectEmpty {
+				tt.Assert(jsonpath.Len("$.results", 0))
+			}
+
+			if tcase.ExpectID != "" {
+				tt.Assert(jsonpath.Contains("$.results[*].id", tcase.ExpectID))
+				tt.Assert(jsonpath.Present("$.facets.types"))
+			}
+
+			tt.End()
+		})
+	}
+}
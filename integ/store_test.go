@@ -0,0 +1,29 @@
+package handler_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/testutil"
+)
+
+func TestStoreContract(t *testing.T) {
+	testutil.RunStoreContract(_ctx, t, _dbClient)
+}
+
+func TestStoreContractMongo(t *testing.T) {
+	if os.Getenv("MONGO_CONNECTION") == "" {
+		t.Skip("MONGO_CONNECTION is not set")
+	}
+
+	client, closer := testutil.NewMongoClient(_ctx)
+	defer closer()
+
+	dbClient := db.NewMongoClient(client, "convo-test")
+
+	testutil.ClearDB(_ctx, dbClient)
+	defer testutil.ClearDB(_ctx, dbClient)
+
+	testutil.RunStoreContract(_ctx, t, dbClient)
+}
@@ -4,10 +4,18 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/datastore"
 	"github.com/steinfletcher/apitest"
+	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+	"github.com/stretchr/testify/assert"
 
+	"github.com/hiconvo/api/clients/notification"
 	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/purge"
+	"github.com/hiconvo/api/reminder"
+	"github.com/hiconvo/api/testutil"
 )
 
 func TestSendEmailsAsync(t *testing.T) {
@@ -40,6 +48,31 @@ func TestSendEmailsAsync(t *testing.T) {
 			},
 			ExpectStatus: 200,
 		},
+		{
+			GivenBody: fmt.Sprintf(`{ "ids": ["%v"], "type": "Event", "action": "SendReminders" }`, event.ID),
+			GivenHeaders: map[string]string{
+				"Content-Type":          "application/json",
+				"X-Appengine-Queuename": "convo-emails",
+			},
+			ExpectStatus: 200,
+		},
+		{
+			GivenBody: fmt.Sprintf(`{ "ids": ["%v"], "type": "Event", "action": "SendReminders", "occurrence": "%s" }`,
+				event.ID, event.Timestamp.Format(time.RFC3339)),
+			GivenHeaders: map[string]string{
+				"Content-Type":          "application/json",
+				"X-Appengine-Queuename": "convo-emails",
+			},
+			ExpectStatus: 200,
+		},
+		{
+			GivenBody: fmt.Sprintf(`{ "ids": ["%v"], "type": "Event", "action": "SendCancellation" }`, event.ID),
+			GivenHeaders: map[string]string{
+				"Content-Type":          "application/json",
+				"X-Appengine-Queuename": "convo-emails",
+			},
+			ExpectStatus: 200,
+		},
 		{
 			GivenBody: fmt.Sprintf(`{ "ids": ["%v"], "type": "Thread", "action": "SendThread" }`, thread.ID),
 			GivenHeaders: map[string]string{
@@ -92,3 +125,304 @@ func TestDigest(t *testing.T) {
 		Status(http.StatusOK).
 		End()
 }
+
+func TestDispatchOutbox(t *testing.T) {
+	tests := []struct {
+		Name         string
+		Headers      map[string]string
+		ExpectStatus int
+	}{
+		{
+			Name:         "cron",
+			Headers:      map[string]string{"X-Appengine-Cron": "true"},
+			ExpectStatus: http.StatusOK,
+		},
+		{
+			Name:         "not cron",
+			Headers:      map[string]string{},
+			ExpectStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tcase := range tests {
+		apitest.New(tcase.Name).
+			Handler(_handler).
+			Get("/tasks/outbox").
+			Headers(tcase.Headers).
+			Expect(t).
+			Status(tcase.ExpectStatus).
+			End()
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	thread := _mock.NewThread(_ctx, t, owner, []*model.User{member})
+	threadMessage := _mock.NewThreadMessage(_ctx, t, member, thread)
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+	eventMessage := _mock.NewEventMessage(_ctx, t, member, event)
+	note := _mock.NewNote(_ctx, t, owner)
+	recentNote := _mock.NewNote(_ctx, t, owner)
+
+	// Everything but recentNote was deleted before the restore window.
+	deletedAt := time.Now().Add(-model.RestoreWindow - time.Hour)
+
+	thread.DeletedAt = deletedAt
+	if err := _mock.ThreadStore.Commit(_ctx, thread); err != nil {
+		t.Fatal(err)
+	}
+
+	event.DeletedAt = deletedAt
+	event.CancelMessage = "had to cancel"
+	if err := _mock.EventStore.Commit(_ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	note.DeletedAt = deletedAt
+	if err := _mock.NoteStore.Commit(_ctx, note); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := _mock.NoteStore.Delete(_ctx, recentNote); err != nil {
+		t.Fatal(err)
+	}
+
+	apitest.New("not cron").
+		Handler(_handler).
+		Get("/tasks/purge").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New("cron").
+		Handler(_handler).
+		Get("/tasks/purge").
+		Headers(map[string]string{"X-Appengine-Cron": "true"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	for _, id := range []model.ID{thread.ID, threadMessage.ID, event.ID, eventMessage.ID, note.ID} {
+		var ps datastore.PropertyList
+		err := _dbClient.Get(_ctx, mustDecodeID(t, id), &ps)
+		assert.Equal(t, datastore.ErrNoSuchEntity, err)
+	}
+
+	var gotNote model.Note
+	err := _dbClient.Get(_ctx, mustDecodeID(t, recentNote.ID), &gotNote)
+	assert.NoError(t, err)
+	assert.False(t, gotNote.DeletedAt.IsZero())
+}
+
+func TestCancelDeleted(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	now := time.Now()
+
+	// The event was deleted a day before it starts, which is well within
+	// the restore window.
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+	event.Reschedule(now.Add(24 * time.Hour))
+	event.CancelMessage = "had to cancel"
+	if err := _mock.EventStore.Delete(_ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &notifRecorder{Client: notification.NewLogger()}
+	p := purge.New(&purge.Config{
+		DB:         _dbClient,
+		Queue:      _mock.Queue,
+		EventStore: _mock.EventStore,
+		Mail:       _mock.Mail,
+		Magic:      _mock.Magic,
+		Notif:      recorder,
+	})
+
+	// Guests are not told until the owner can no longer undo the deletion
+	// quietly.
+	count, err := p.CancelDeleted(_ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, count)
+	}
+
+	var saved model.Event
+	if err := _dbClient.Get(_ctx, mustDecodeID(t, event.ID), &saved); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, saved.CancelledAt.IsZero())
+
+	saved.DeletedAt = now.Add(-model.CancelDelay - time.Minute)
+	if _, err := _dbClient.Put(_ctx, mustDecodeID(t, event.ID), &saved); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err = p.CancelDeleted(_ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, count)
+	}
+
+	// Guests are only told once.
+	count, err = p.CancelDeleted(_ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, count)
+	}
+
+	assert.Equal(t, 1, recorder.count(string(notification.DeleteEvent)))
+
+	saved = model.Event{}
+	if err := _dbClient.Get(_ctx, mustDecodeID(t, event.ID), &saved); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, saved.CancelledAt.IsZero())
+	assert.False(t, saved.DeletedAt.IsZero())
+	assert.Equal(t, "had to cancel", saved.CancelMessage)
+
+	// Once guests have been told, the deletion can no longer be undone.
+	apitest.New("restore").
+		Handler(_handler).
+		Post(fmt.Sprintf("/events/%s/restore", event.ID)).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		Assert(jsonpath.Equal("$.message", "Guests were already told that this event was cancelled")).
+		End()
+
+	// Cancellations are sent for deleted events.
+	apitest.New("SendCancellation").
+		Handler(_handler).
+		Post("/tasks/emails").
+		Body(fmt.Sprintf(`{ "ids": ["%v"], "type": "Event", "action": "SendCancellation" }`, event.ID)).
+		Headers(map[string]string{
+			"Content-Type":          "application/json",
+			"X-Appengine-Queuename": "convo-emails",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	// Guests of events that are deleted shortly before they start are told
+	// halfway to the start.
+	soon := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+	soon.Reschedule(now.Add(20 * time.Minute))
+	soon.DeletedAt = now
+	assert.Equal(t, now.Add(10*time.Minute), soon.CancelDueAt())
+
+	apitest.New("not cron").
+		Handler(_handler).
+		Get("/tasks/cancellations").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New("cron").
+		Handler(_handler).
+		Get("/tasks/cancellations").
+		Headers(map[string]string{"X-Appengine-Cron": "true"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestScheduleReminders(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	now := time.Now()
+
+	// The reminder of this event became due half an hour ago.
+	event := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+	event.Reschedule(now.Add(30 * time.Minute))
+	if err := event.SetReminders([]int{60}); err != nil {
+		t.Fatal(err)
+	}
+	event.RemindedAt = now.Add(-2 * time.Hour)
+	if err := _mock.EventStore.Commit(_ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reminder of this event is too late to be sent.
+	stale := _mock.NewEvent(_ctx, t, owner, []*model.User{}, []*model.User{member})
+	stale.Reschedule(now.Add(30 * time.Minute))
+	if err := stale.SetReminders([]int{24 * 60}); err != nil {
+		t.Fatal(err)
+	}
+	stale.RemindedAt = now.Add(-2 * 24 * time.Hour)
+	if err := _mock.EventStore.Commit(_ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	s := reminder.New(&reminder.Config{
+		DB:         _dbClient,
+		EventStore: _mock.EventStore,
+		Queue:      _mock.Queue,
+	})
+
+	count, err := s.Schedule(_ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, count)
+	}
+
+	// Guests are only reminded once.
+	count, err = s.Schedule(_ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, count)
+	}
+
+	for _, e := range []*model.Event{event, stale} {
+		var saved model.Event
+		if err := _dbClient.Get(_ctx, mustDecodeID(t, e.ID), &saved); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.True(t, saved.NextReminderAt.IsZero())
+		assert.False(t, saved.RemindedAt.Before(now))
+	}
+
+	apitest.New("not cron").
+		Handler(_handler).
+		Get("/tasks/reminders").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New("cron").
+		Handler(_handler).
+		Get("/tasks/reminders").
+		Headers(map[string]string{"X-Appengine-Cron": "true"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestUserCacheStats(t *testing.T) {
+	u, _ := _mock.NewUser(_ctx, t)
+
+	for i := 0; i < 2; i++ {
+		apitest.New().
+			Handler(_handler).
+			Get("/users").
+			Headers(testutil.GetAuthHeader(u.Token)).
+			Expect(t).
+			Status(http.StatusOK).
+			End()
+	}
+
+	apitest.New("not cron").
+		Handler(_handler).
+		Get("/tasks/usercache").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New("cron").
+		Handler(_handler).
+		Get("/tasks/usercache").
+		Headers(map[string]string{"X-Appengine-Cron": "true"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Present("$.hits")).
+		Assert(jsonpath.Present("$.misses")).
+		Assert(jsonpath.Present("$.size")).
+		End()
+}
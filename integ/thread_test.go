@@ -7,7 +7,6 @@ import (
 	"testing"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"github.com/icrowley/fake"
 	"github.com/steinfletcher/apitest"
 	jsonpath "github.com/steinfletcher/apitest-jsonpath"
@@ -37,14 +36,14 @@ func TestCreateThread(t *testing.T) {
 				"subject": fake.Title(),
 				"users": []map[string]string{
 					{
-						"id": u2.ID,
+						"id": u2.ID.String(),
 					},
 				},
 				"body": fake.Paragraph(),
 			},
 			ExpectStatus:     http.StatusCreated,
-			ExpectOwnerID:    u1.ID,
-			ExpectMemberID:   u2.ID,
+			ExpectOwnerID:    u1.ID.String(),
+			ExpectMemberID:   u2.ID.String(),
 			ExpectMembersLen: 2,
 		},
 		{
@@ -54,7 +53,7 @@ func TestCreateThread(t *testing.T) {
 				"subject": fake.Title(),
 				"users": []map[string]string{
 					{
-						"id": u2.ID,
+						"id": u2.ID.String(),
 					},
 					{
 						"email": "test@testing.com",
@@ -69,8 +68,8 @@ func TestCreateThread(t *testing.T) {
 				"body": fake.Paragraph(),
 			},
 			ExpectStatus:     http.StatusCreated,
-			ExpectOwnerID:    u1.ID,
-			ExpectMemberID:   u2.ID,
+			ExpectOwnerID:    u1.ID.String(),
+			ExpectMemberID:   u2.ID.String(),
 			ExpectMembersLen: 4,
 		},
 		{
@@ -93,7 +92,7 @@ func TestCreateThread(t *testing.T) {
 				"subject": fake.Title(),
 				"users": []map[string]string{
 					{
-						"id": u2.ID,
+						"id": u2.ID.String(),
 					},
 				},
 				"body": fake.Paragraph(),
@@ -173,11 +172,11 @@ func TestGetThreads(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.IsThreadInRes {
-				tt.Assert(jsonpath.Equal("$.threads[0].id", thread.ID))
+				tt.Assert(jsonpath.Equal("$.threads[0].id", thread.ID.String()))
 				tt.Assert(jsonpath.Equal("$.threads[0].subject", thread.Subject))
-				tt.Assert(jsonpath.Equal("$.threads[0].owner.id", owner.ID))
-				tt.Assert(jsonpath.Equal("$.threads[0].users[0].id", member1.ID))
-				tt.Assert(jsonpath.Equal("$.threads[0].users[1].id", member2.ID))
+				tt.Assert(jsonpath.Equal("$.threads[0].owner.id", owner.ID.String()))
+				tt.Assert(jsonpath.Equal("$.threads[0].users[0].id", member1.ID.String()))
+				tt.Assert(jsonpath.Equal("$.threads[0].users[1].id", member2.ID.String()))
 				tt.Assert(jsonpath.NotPresent("$.threads[0].users[0].email"))
 				tt.Assert(jsonpath.NotPresent("$.threads[0].users[1].email"))
 			}
@@ -187,6 +186,72 @@ func TestGetThreads(t *testing.T) {
 	}
 }
 
+func TestSearchThreads(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	nonmember, _ := _mock.NewUser(_ctx, t)
+	thread := _mock.NewThread(_ctx, t, owner, []*model.User{member})
+	_mock.NewThreadMessage(_ctx, t, member, thread)
+
+	tests := []struct {
+		Name         string
+		AuthHeader   map[string]string
+		Query        string
+		ExpectStatus int
+		ExpectEmpty  bool
+		ExpectFound  bool
+	}{
+		{
+			Name:         "member",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			Query:        thread.Subject,
+			ExpectStatus: http.StatusOK,
+			ExpectFound:  true,
+		},
+		{
+			Name:         "nonmember",
+			AuthHeader:   testutil.GetAuthHeader(nonmember.Token),
+			Query:        thread.Subject,
+			ExpectStatus: http.StatusOK,
+			ExpectEmpty:  true,
+		},
+		{
+			Name:         "empty query",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			Query:        "",
+			ExpectStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "unauthenticated",
+			AuthHeader:   map[string]string{"boop": "beep"},
+			Query:        thread.Subject,
+			ExpectStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Get("/threads/search").
+				Query("q", tcase.Query).
+				Headers(tcase.AuthHeader).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+
+			if tcase.ExpectEmpty {
+				tt.Assert(jsonpath.Len("$.results", 0))
+			}
+
+			if tcase.ExpectFound {
+				tt.Assert(jsonpath.Contains("$.results[*].threadId", thread.ID.String()))
+			}
+
+			tt.End()
+		})
+	}
+}
+
 func TestGetThread(t *testing.T) {
 	owner, _ := _mock.NewUser(_ctx, t)
 	member, _ := _mock.NewUser(_ctx, t)
@@ -227,10 +292,10 @@ func TestGetThread(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.id", thread.ID))
+				tt.Assert(jsonpath.Equal("$.id", thread.ID.String()))
 				tt.Assert(jsonpath.Equal("$.subject", thread.Subject))
-				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID))
-				tt.Assert(jsonpath.Equal("$.users[0].id", member.ID))
+				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID.String()))
+				tt.Assert(jsonpath.Equal("$.users[0].id", member.ID.String()))
 				tt.Assert(jsonpath.NotPresent("$.users[0].email"))
 			}
 
@@ -297,14 +362,88 @@ func TestDeleteThread(t *testing.T) {
 
 			if tcase.ShouldPass {
 				var gotThread model.Thread
-				err := _dbClient.Get(_ctx, thread.Key, &gotThread)
-				assert.Equal(t, datastore.ErrNoSuchEntity, err)
+				err := _dbClient.Get(_ctx, mustDecodeID(t, thread.ID), &gotThread)
+				assert.NoError(t, err)
+				assert.False(t, gotThread.DeletedAt.IsZero())
 			}
 		})
 	}
 
 }
 
+func TestRestoreThread(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	thread := _mock.NewThread(_ctx, t, owner, []*model.User{member})
+	expired := _mock.NewThread(_ctx, t, owner, []*model.User{member})
+
+	if err := _mock.ThreadStore.Delete(_ctx, thread); err != nil {
+		t.Fatal(err)
+	}
+
+	expired.DeletedAt = time.Now().Add(-model.RestoreWindow - time.Hour)
+	if err := _mock.ThreadStore.Commit(_ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name         string
+		AuthHeader   map[string]string
+		GivenThread  *model.Thread
+		ExpectStatus int
+	}{
+		{
+			Name:         "member attempt",
+			AuthHeader:   testutil.GetAuthHeader(member.Token),
+			GivenThread:  thread,
+			ExpectStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "restore window passed",
+			AuthHeader:   testutil.GetAuthHeader(owner.Token),
+			GivenThread:  expired,
+			ExpectStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "success",
+			AuthHeader:   testutil.GetAuthHeader(owner.Token),
+			GivenThread:  thread,
+			ExpectStatus: http.StatusOK,
+		},
+		{
+			Name:         "after success",
+			AuthHeader:   testutil.GetAuthHeader(owner.Token),
+			GivenThread:  thread,
+			ExpectStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tcase := range tests {
+		t.Run(tcase.Name, func(t *testing.T) {
+			tt := apitest.New(tcase.Name).
+				Handler(_handler).
+				Post(fmt.Sprintf("/threads/%s/restore", tcase.GivenThread.ID)).
+				JSON(`{}`).
+				Headers(tcase.AuthHeader).
+				Expect(t).
+				Status(tcase.ExpectStatus)
+			if tcase.ExpectStatus == http.StatusOK {
+				tt.Assert(jsonpath.Equal("$.id", thread.ID.String()))
+			}
+
+			tt.End()
+		})
+	}
+
+	apitest.New("member can get restored thread").
+		Handler(_handler).
+		Get(fmt.Sprintf("/threads/%s", thread.ID)).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+}
+
 func TestGetMessagesByThread(t *testing.T) {
 	owner, _ := _mock.NewUser(_ctx, t)
 	member1, _ := _mock.NewUser(_ctx, t)
@@ -352,9 +491,9 @@ func TestGetMessagesByThread(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.messages[0].id", message1.ID))
+				tt.Assert(jsonpath.Equal("$.messages[0].id", message1.ID.String()))
 				tt.Assert(jsonpath.Equal("$.messages[0].body", message1.Body))
-				tt.Assert(jsonpath.Equal("$.messages[1].id", message2.ID))
+				tt.Assert(jsonpath.Equal("$.messages[1].id", message2.ID.String()))
 				tt.Assert(jsonpath.Equal("$.messages[1].body", message2.Body))
 			}
 
@@ -404,8 +543,8 @@ func TestMarkThreadAsRead(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus < http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.id", thread.ID))
-				tt.Assert(jsonpath.Equal("$.reads[0].id", owner.ID))
+				tt.Assert(jsonpath.Equal("$.id", thread.ID.String()))
+				tt.Assert(jsonpath.Equal("$.reads[0].id", owner.ID.String()))
 			}
 
 			tt.End()
@@ -494,25 +633,25 @@ func TestAddUserToThread(t *testing.T) {
 			Name:         "nonmember attempt to add",
 			AuthHeader:   testutil.GetAuthHeader(nonmember.Token),
 			ExpectStatus: http.StatusNotFound,
-			GivenUserID:  memberToAdd.ID,
+			GivenUserID:  memberToAdd.ID.String(),
 		},
 		{
 			Name:         "member without permission attempt to add",
 			AuthHeader:   testutil.GetAuthHeader(member.Token),
 			ExpectStatus: http.StatusNotFound,
-			GivenUserID:  memberToAdd.ID,
+			GivenUserID:  memberToAdd.ID.String(),
 		},
 		{
 			Name:         "bad auth header",
 			AuthHeader:   map[string]string{"boop": "beep"},
 			ExpectStatus: http.StatusUnauthorized,
-			GivenUserID:  memberToAdd.ID,
+			GivenUserID:  memberToAdd.ID.String(),
 		},
 		{
 			Name:         "success with existing user",
 			AuthHeader:   testutil.GetAuthHeader(owner.Token),
 			ExpectStatus: http.StatusOK,
-			GivenUserID:  memberToAdd.ID,
+			GivenUserID:  memberToAdd.ID.String(),
 			ExpectNames: []string{
 				member.FullName,
 				owner.FullName,
@@ -557,8 +696,8 @@ func TestAddUserToThread(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus <= http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.id", thread.ID))
-				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID))
+				tt.Assert(jsonpath.Equal("$.id", thread.ID.String()))
+				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID.String()))
 				tt.Assert(jsonpath.Equal("$.owner.fullName", owner.FullName))
 				for i := range tcase.ExpectNames {
 					tt.Assert(jsonpath.Equal(
@@ -591,35 +730,35 @@ func TestRemoveFromThread(t *testing.T) {
 		{
 			Name:         "nonmember attempt",
 			AuthHeader:   testutil.GetAuthHeader(nonmember.Token),
-			GivenUserID:  member.ID,
+			GivenUserID:  member.ID.String(),
 			ExpectStatus: http.StatusNotFound,
 		},
 		{
 			Name:         "member attempt to remove other member",
 			AuthHeader:   testutil.GetAuthHeader(member.Token),
-			GivenUserID:  memberToRemove.ID,
+			GivenUserID:  memberToRemove.ID.String(),
 			ExpectStatus: http.StatusNotFound,
 		},
 		{
 			Name:         "bad auth header",
 			AuthHeader:   map[string]string{"boop": "beep"},
-			GivenUserID:  member.ID,
+			GivenUserID:  member.ID.String(),
 			ExpectStatus: http.StatusUnauthorized,
 		},
 		{
 			Name:              "owner remove member success",
 			AuthHeader:        testutil.GetAuthHeader(owner.Token),
-			GivenUserID:       memberToRemove.ID,
+			GivenUserID:       memberToRemove.ID.String(),
 			ExpectStatus:      http.StatusOK,
-			ExpectMemberIDs:   []string{owner.ID, member.ID, memberToLeave.ID},
+			ExpectMemberIDs:   []string{owner.ID.String(), member.ID.String(), memberToLeave.ID.String()},
 			ExpectMemberNames: []string{member.FullName, owner.FullName, memberToLeave.FullName},
 		},
 		{
 			Name:              "member remove self success",
 			AuthHeader:        testutil.GetAuthHeader(memberToLeave.Token),
-			GivenUserID:       memberToLeave.ID,
+			GivenUserID:       memberToLeave.ID.String(),
 			ExpectStatus:      http.StatusOK,
-			ExpectMemberIDs:   []string{owner.ID, member.ID},
+			ExpectMemberIDs:   []string{owner.ID.String(), member.ID.String()},
 			ExpectMemberNames: []string{member.FullName, owner.FullName},
 		},
 	}
@@ -635,8 +774,8 @@ func TestRemoveFromThread(t *testing.T) {
 				Status(tcase.ExpectStatus)
 
 			if tcase.ExpectStatus <= http.StatusBadRequest {
-				tt.Assert(jsonpath.Equal("$.id", thread.ID))
-				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID))
+				tt.Assert(jsonpath.Equal("$.id", thread.ID.String()))
+				tt.Assert(jsonpath.Equal("$.owner.id", owner.ID.String()))
 				tt.Assert(jsonpath.Equal("$.owner.fullName", owner.FullName))
 				for i := range tcase.ExpectMemberNames {
 					tt.Assert(jsonpath.Equal(
@@ -720,10 +859,10 @@ func TestAddMessageToThread(t *testing.T) {
 
 		if testCase.ExpectCode < 300 {
 			tt.
-				Assert(jsonpath.Equal("$.parentId", thread.ID)).
+				Assert(jsonpath.Equal("$.parentId", thread.ID.String())).
 				Assert(jsonpath.Equal("$.body", testCase.ExpectBody)).
 				Assert(jsonpath.Equal("$.user.fullName", testCase.GivenAuthor.FullName)).
-				Assert(jsonpath.Equal("$.user.id", testCase.GivenAuthor.ID))
+				Assert(jsonpath.Equal("$.user.id", testCase.GivenAuthor.ID.String()))
 			if testCase.ExpectPhoto {
 				tt.Assert(jsonpath.Present("$.photos[0]"))
 			} else {
@@ -765,21 +904,21 @@ func TestDeleteThreadMessage(t *testing.T) {
 		{
 			Name:            "member attempt to delete message he does not own",
 			GivenAuthHeader: testutil.GetAuthHeader(member1.Token),
-			GivenMessageID:  message1.ID,
+			GivenMessageID:  message1.ID.String(),
 			ExpectCode:      http.StatusNotFound,
 			ExpectBody:      `{"message":"The requested resource was not found"}`,
 		},
 		{
 			Name:            "nonmember attempt to delete message",
 			GivenAuthHeader: testutil.GetAuthHeader(nonmember.Token),
-			GivenMessageID:  message1.ID,
+			GivenMessageID:  message1.ID.String(),
 			ExpectCode:      http.StatusNotFound,
 			ExpectBody:      `{"message":"The requested resource was not found"}`,
 		},
 		{
 			Name:            "empty payload",
 			GivenAuthHeader: testutil.GetAuthHeader(member1.Token),
-			GivenMessageID:  message2.ID,
+			GivenMessageID:  message2.ID.String(),
 			ExpectCode:      http.StatusOK,
 			ExpectBody:      string(message2encoded),
 		},
@@ -799,3 +938,72 @@ func TestDeleteThreadMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestRestoreThreadMessage(t *testing.T) {
+	owner, _ := _mock.NewUser(_ctx, t)
+	member, _ := _mock.NewUser(_ctx, t)
+	thread := _mock.NewThread(_ctx, t, owner, []*model.User{member})
+	message := _mock.NewThreadMessage(_ctx, t, member, thread)
+	url := fmt.Sprintf("/threads/%s/messages/%s", thread.ID, message.ID)
+
+	getResponseCount := func() int {
+		var gotThread model.Thread
+		if err := _dbClient.Get(_ctx, mustDecodeID(t, thread.ID), &gotThread); err != nil {
+			t.Fatal(err)
+		}
+
+		return gotThread.ResponseCount
+	}
+
+	responseCount := getResponseCount()
+
+	apitest.New("delete").
+		Handler(_handler).
+		Delete(url).
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	assert.Equal(t, responseCount-1, getResponseCount())
+
+	apitest.New("deleted message is hidden").
+		Handler(_handler).
+		Get(fmt.Sprintf("/threads/%s/messages", thread.ID)).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.NotPresent("$.messages[0]")).
+		End()
+
+	apitest.New("restore by non-owner").
+		Handler(_handler).
+		Post(url + "/restore").
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New("restore").
+		Handler(_handler).
+		Post(url + "/restore").
+		JSON(`{}`).
+		Headers(testutil.GetAuthHeader(member.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.id", message.ID.String())).
+		End()
+
+	assert.Equal(t, responseCount, getResponseCount())
+
+	apitest.New("restored message is shown").
+		Handler(_handler).
+		Get(fmt.Sprintf("/threads/%s/messages", thread.ID)).
+		Headers(testutil.GetAuthHeader(owner.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.messages[0].id", message.ID.String())).
+		End()
+}
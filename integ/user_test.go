@@ -171,7 +171,7 @@ func TestAuthenticateUser(t *testing.T) {
 			if tcase.ExpectStatus >= http.StatusBadRequest {
 				tt.Body(tcase.ExpectBody)
 			} else {
-				tt.Assert(jsonpath.Equal("$.id", existingUser.ID))
+				tt.Assert(jsonpath.Equal("$.id", existingUser.ID.String()))
 				tt.Assert(jsonpath.Equal("$.firstName", existingUser.FirstName))
 				tt.Assert(jsonpath.Equal("$.lastName", existingUser.LastName))
 				tt.Assert(jsonpath.Equal("$.fullName", existingUser.FullName))
@@ -231,7 +231,7 @@ func TestGetCurrentUser(t *testing.T) {
 			if tcase.ExpectStatus >= http.StatusBadRequest {
 				tt.Body(tcase.ExpectBody)
 			} else {
-				tt.Assert(jsonpath.Equal("$.id", existingUser.ID))
+				tt.Assert(jsonpath.Equal("$.id", existingUser.ID.String()))
 				tt.Assert(jsonpath.Equal("$.firstName", existingUser.FirstName))
 				tt.Assert(jsonpath.Equal("$.lastName", existingUser.LastName))
 				tt.Assert(jsonpath.Equal("$.token", existingUser.Token))
@@ -289,7 +289,7 @@ func TestGetUser(t *testing.T) {
 			if tcase.ExpectStatus >= http.StatusBadRequest {
 				tt.Body(tcase.ExpectBody)
 			} else {
-				tt.Assert(jsonpath.Equal("$.id", user1.ID))
+				tt.Assert(jsonpath.Equal("$.id", user1.ID.String()))
 				tt.Assert(jsonpath.Equal("$.firstName", user1.FirstName))
 				tt.Assert(jsonpath.Equal("$.lastName", user1.LastName))
 				tt.Assert(jsonpath.Equal("$.fullName", user1.FullName))
@@ -308,7 +308,7 @@ func TestOAuth(t *testing.T) {
 	existingUser2, _ := _mock.NewUser(_ctx, t)
 	existingUser2.PasswordDigest = ""
 	existingUser2.Verified = false
-	if _, err := _dbClient.Put(_ctx, existingUser2.Key, existingUser2); err != nil {
+	if err := _mock.UserStore.Commit(_ctx, existingUser2); err != nil {
 		t.Fatal(err)
 	}
 
@@ -437,7 +437,7 @@ func TestUpdatePassword(t *testing.T) {
 			},
 			ExpectStatus: http.StatusOK,
 			OutData: map[string]interface{}{
-				"id":        existingUser1.ID,
+				"id":        existingUser1.ID.String(),
 				"firstName": existingUser1.FirstName,
 				"lastName":  existingUser1.LastName,
 				"token":     existingUser1.Token,
@@ -503,7 +503,7 @@ func TestVerifyEmail(t *testing.T) {
 	existingUser1, _ := _mock.NewUser(_ctx, t)
 	existingUser1.Emails = []string{}
 	existingUser1.Verified = false
-	_dbClient.Put(_ctx, existingUser1.Key, existingUser1)
+	_mock.UserStore.Commit(_ctx, existingUser1)
 	kenc1, b64ts1, sig1 := testutil.GetMagicLinkParts(existingUser1.GetVerifyEmailMagicLink(magicClient, existingUser1.Email))
 
 	// Bad signature case
@@ -551,7 +551,7 @@ func TestVerifyEmail(t *testing.T) {
 			},
 			ExpectStatus: http.StatusOK,
 			OutData: map[string]interface{}{
-				"id":        existingUser1.ID,
+				"id":        existingUser1.ID.String(),
 				"firstName": existingUser1.FirstName,
 				"lastName":  existingUser1.LastName,
 				"token":     existingUser1.Token,
@@ -600,7 +600,7 @@ func TestVerifyEmail(t *testing.T) {
 			},
 			ExpectStatus: http.StatusOK,
 			OutData: map[string]interface{}{
-				"id":        existingUser3.ID,
+				"id":        existingUser3.ID.String(),
 				"firstName": existingUser3.FirstName,
 				"lastName":  existingUser3.LastName,
 				"token":     existingUser3.Token,
@@ -622,7 +622,7 @@ func TestVerifyEmail(t *testing.T) {
 			},
 			ExpectStatus: http.StatusOK,
 			OutData: map[string]interface{}{
-				"id":        existingUser4.ID,
+				"id":        existingUser4.ID.String(),
 				"firstName": existingUser4.FirstName,
 				"lastName":  existingUser4.LastName,
 				"token":     existingUser4.Token,
@@ -680,10 +680,10 @@ func TestVerifyEmail(t *testing.T) {
 				foundEventMessage := false
 				fountThreadMessage := false
 				for i := range messages {
-					if messages[i].Key.Equal(eventMessage.Key) {
+					if messages[i].ID == eventMessage.ID {
 						foundEventMessage = true
 					}
-					if messages[i].Key.Equal(threadMessage.Key) {
+					if messages[i].ID == threadMessage.ID {
 						fountThreadMessage = true
 					}
 				}
@@ -719,10 +719,10 @@ func TestVerifyEmail(t *testing.T) {
 				foundNote1 := false
 				foundNote2 := false
 				for i := range notes {
-					if notes[i].Key.Equal(note1.Key) {
+					if notes[i].ID == note1.ID {
 						foundNote1 = true
 					}
-					if notes[i].Key.Equal(note2.Key) {
+					if notes[i].ID == note2.ID {
 						foundNote2 = true
 					}
 				}
@@ -872,7 +872,7 @@ func TestUpdateUser(t *testing.T) {
 			},
 			ExpectStatus: http.StatusOK,
 			OutData: map[string]interface{}{
-				"id":         existingUser.ID,
+				"id":         existingUser.ID.String(),
 				"firstName":  "Sir",
 				"lastName":   "Malebranche",
 				"token":      existingUser.Token,
@@ -888,7 +888,7 @@ func TestUpdateUser(t *testing.T) {
 			},
 			ExpectStatus: http.StatusOK,
 			OutData: map[string]interface{}{
-				"id":         existingUser.ID,
+				"id":         existingUser.ID.String(),
 				"firstName":  "Sir",
 				"lastName":   "Malebranche",
 				"token":      existingUser.Token,
@@ -978,7 +978,7 @@ func TestRemoveEmail(t *testing.T) {
 	existingUser1, _ := _mock.NewUser(_ctx, t)
 	existingUser2, _ := _mock.NewUser(_ctx, t)
 	existingUser2.AddEmail(emailToRemove)
-	_dbClient.Put(_ctx, existingUser2.Key, existingUser2)
+	_mock.UserStore.Commit(_ctx, existingUser2)
 
 	tests := []struct {
 		Name            string
@@ -1024,7 +1024,7 @@ func TestMakeEmailPrimary(t *testing.T) {
 	existingUser1, _ := _mock.NewUser(_ctx, t)
 	existingUser2, _ := _mock.NewUser(_ctx, t)
 	existingUser2.AddEmail(emailToMakePrimary)
-	_dbClient.Put(_ctx, existingUser2.Key, existingUser2)
+	_mock.UserStore.Commit(_ctx, existingUser2)
 
 	tests := []struct {
 		Name            string
@@ -0,0 +1,194 @@
+package handler_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	jsonpath "github.com/steinfletcher/apitest-jsonpath"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hiconvo/api/testutil"
+	"github.com/hiconvo/api/usercache"
+)
+
+// newUserCache returns a cached user store of its own, so that its stats
+// are not affected by other tests.
+func newUserCache(t *testing.T, cache usercache.Cache) usercache.Store {
+	return usercache.New(&usercache.Config{
+		Store: testutil.NewUserStore(_ctx, t, _dbClient, _searchClient),
+		Cache: cache,
+	})
+}
+
+func TestUserCacheGetUserByToken(t *testing.T) {
+	u, _ := _mock.NewUser(_ctx, t)
+	s := newUserCache(t, nil)
+
+	for i := 0; i < 3; i++ {
+		got, found, err := s.GetUserByToken(_ctx, u.Token)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, u.ID, got.ID)
+	}
+
+	assert.Equal(t, usercache.Stats{Hits: 2, Misses: 1, Size: 2}, s.Stats())
+
+	// Unknown users are not cached.
+	_, found, err := s.GetUserByToken(_ctx, "unknown")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, int64(2), s.Stats().Misses)
+}
+
+func TestUserCacheReturnsCopies(t *testing.T) {
+	u, _ := _mock.NewUser(_ctx, t)
+	s := newUserCache(t, nil)
+
+	got, err := s.GetUserByID(_ctx, u.ID)
+	assert.NoError(t, err)
+
+	// Changes are not seen until they are committed.
+	got.FirstName = "Uncommitted"
+	got.Emails = append(got.Emails, "uncommitted@example.com")
+
+	got, err = s.GetUserByID(_ctx, u.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, u.FirstName, got.FirstName)
+	assert.False(t, got.HasEmail("uncommitted@example.com"))
+}
+
+func TestUserCacheInvalidatesOnCommit(t *testing.T) {
+	u, _ := _mock.NewUser(_ctx, t)
+	s := newUserCache(t, nil)
+
+	got, found, err := s.GetUserByEmail(_ctx, u.Email)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	oldToken := got.Token
+	got.FirstName = "Nicolas"
+	got.Token = "rotated" + oldToken
+	assert.NoError(t, s.Commit(_ctx, got))
+
+	got, found, err = s.GetUserByEmail(_ctx, u.Email)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "Nicolas", got.FirstName)
+
+	// The old token no longer resolves to the user even though it is
+	// still in the cache.
+	_, found, err = s.GetUserByToken(_ctx, oldToken)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestUserCacheInvalidatesOnMerge(t *testing.T) {
+	u, _ := _mock.NewUser(_ctx, t)
+	oldUser := _mock.NewIncompleteUser(_ctx, t)
+	s := newUserCache(t, nil)
+
+	_, found, err := s.GetUserByToken(_ctx, oldUser.Token)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	_, err = s.GetUserByID(_ctx, u.ID)
+	assert.NoError(t, err)
+
+	assert.NoError(t, u.MergeWith(
+		_ctx,
+		_dbClient,
+		s,
+		_mock.MessageStore,
+		_mock.ThreadStore,
+		_mock.EventStore,
+		_mock.NoteStore,
+		oldUser))
+
+	_, found, err = s.GetUserByToken(_ctx, oldUser.Token)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	_, err = s.GetUserByID(_ctx, oldUser.ID)
+	assert.Error(t, err)
+}
+
+func TestUserCacheExpires(t *testing.T) {
+	u, _ := _mock.NewUser(_ctx, t)
+	s := newUserCache(t, usercache.NewLRU(1, 50*time.Millisecond))
+
+	// Changes made by other instances are only seen once the cached user
+	// has expired.
+	other := testutil.NewUserStore(_ctx, t, _dbClient, _searchClient)
+
+	_, err := s.GetUserByID(_ctx, u.ID)
+	assert.NoError(t, err)
+
+	u.FirstName = "Antoine"
+	assert.NoError(t, other.Commit(_ctx, u))
+
+	got, err := s.GetUserByID(_ctx, u.ID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "Antoine", got.FirstName)
+
+	time.Sleep(100 * time.Millisecond)
+
+	got, err = s.GetUserByID(_ctx, u.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Antoine", got.FirstName)
+}
+
+func TestUserCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := usercache.NewLRU(2, time.Minute)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+
+	c.Set("c", 3)
+
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+
+	_, ok = c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestUserCacheAuthenticatedRequests(t *testing.T) {
+	u, _ := _mock.NewUser(_ctx, t)
+
+	apitest.New().
+		Handler(_handler).
+		Get("/users").
+		Headers(testutil.GetAuthHeader(u.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(_handler).
+		Patch("/users").
+		JSON(`{"firstName": "Pierre", "lastName": "Bayle"}`).
+		Headers(testutil.GetAuthHeader(u.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	// The user that authenticates the request is not stale.
+	apitest.New().
+		Handler(_handler).
+		Get("/users").
+		Headers(testutil.GetAuthHeader(u.Token)).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(jsonpath.Equal("$.firstName", "Pierre")).
+		Assert(jsonpath.Equal("$.lastName", "Bayle")).
+		End()
+
+	stats := _mock.UserStore.(usercache.Store).Stats()
+	assert.True(t, stats.Hits > 0)
+}
@@ -0,0 +1,227 @@
+// Package linkcache caches link previews so that popular links are not
+// fetched every time they are posted.
+package linkcache
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	og "github.com/hiconvo/api/clients/opengraph"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/log"
+	"github.com/hiconvo/api/model"
+)
+
+const (
+	DefaultTTL              = 24 * time.Hour
+	DefaultNegativeTTL      = time.Hour
+	DefaultRefreshBatchSize = 100
+	DefaultIdleTTL          = 30 * 24 * time.Hour
+)
+
+// Client is an opengraph.Client that serves link previews from a cache.
+type Client interface {
+	og.Client
+	// Refresh refetches expired previews in the background and returns the
+	// number of previews that were refreshed. Expired previews that have not
+	// been asked for in IdleTTL are evicted instead.
+	Refresh(ctx context.Context) (int, error)
+}
+
+type Config struct {
+	Store model.LinkPreviewStore
+	OG    og.Client
+	// TTL is how long a preview is served before it is fetched again.
+	TTL time.Duration
+	// NegativeTTL is how long a failed fetch is remembered.
+	NegativeTTL time.Duration
+	// RefreshBatchSize is the maximum number of previews refreshed by
+	// a single call to Refresh.
+	RefreshBatchSize int
+	// IdleTTL is how long a preview is kept after it was last asked for.
+	IdleTTL time.Duration
+}
+
+type clientImpl struct {
+	*Config
+}
+
+func New(c *Config) Client {
+	if c.TTL == 0 {
+		c.TTL = DefaultTTL
+	}
+
+	if c.NegativeTTL == 0 {
+		c.NegativeTTL = DefaultNegativeTTL
+	}
+
+	if c.RefreshBatchSize == 0 {
+		c.RefreshBatchSize = DefaultRefreshBatchSize
+	}
+
+	if c.IdleTTL == 0 {
+		c.IdleTTL = DefaultIdleTTL
+	}
+
+	return &clientImpl{Config: c}
+}
+
+func (c *clientImpl) Extract(ctx context.Context, text string) *og.LinkData {
+	found := og.FindURL(text)
+	if found == "" {
+		return nil
+	}
+
+	ld, err := c.Fetch(ctx, found)
+	if err != nil {
+		log.Print(err)
+
+		return nil
+	}
+
+	ld.Original = found
+
+	return ld
+}
+
+func (c *clientImpl) Fetch(ctx context.Context, rawURL string) (*og.LinkData, error) {
+	op := errors.Opf("linkcache.Fetch(%s)", rawURL)
+
+	url, err := og.NormalizeURL(rawURL)
+	if err != nil {
+		return nil, errors.E(op, err, http.StatusBadRequest, map[string]string{
+			"url": "invalid url",
+		})
+	}
+
+	p, found, err := c.Store.GetLinkPreviewByURL(ctx, url)
+	if err != nil {
+		// The cache is best effort. Fall through to a live fetch.
+		log.Alarm(errors.E(op, err))
+	}
+
+	switch {
+	case !found || p.IsExpired():
+		fetched, ok := c.fetch(ctx, url, p)
+		if !ok {
+			// The caller gave up, which says nothing about the link, so
+			// nothing is cached. A stale preview is better than none.
+			if !found || p.Failed || p.Link == nil {
+				return nil, errors.E(op, ctx.Err())
+			}
+
+			break
+		}
+
+		p = fetched
+		p.RequestedAt = time.Now()
+		c.commit(ctx, op, p)
+	case time.Since(p.RequestedAt) > c.TTL:
+		// Recording every request would mean a write for every read, so
+		// it is only recorded about once per TTL.
+		p.RequestedAt = time.Now()
+		c.commit(ctx, op, p)
+	}
+
+	if p.Failed || p.Link == nil {
+		return nil, errors.E(op, errors.Str("no preview"), http.StatusNotFound, map[string]string{
+			"message": "No preview is available for this link",
+		})
+	}
+
+	ld := *p.Link
+	ld.Original = rawURL
+
+	return &ld, nil
+}
+
+func (c *clientImpl) Refresh(ctx context.Context) (int, error) {
+	op := errors.Op("linkcache.Refresh")
+
+	previews, err := c.Store.GetExpiredLinkPreviews(ctx, time.Now(), c.RefreshBatchSize)
+	if err != nil {
+		return 0, errors.E(op, err)
+	}
+
+	var count int
+
+	for i := range previews {
+		if time.Since(previews[i].LastRequestedAt()) > c.IdleTTL {
+			if err := c.Store.Delete(ctx, previews[i]); err != nil {
+				log.Alarm(errors.E(op, err))
+			}
+
+			continue
+		}
+
+		p, ok := c.fetch(ctx, previews[i].URL, previews[i])
+		if !ok {
+			return count, errors.E(op, ctx.Err())
+		}
+
+		if err := c.Store.Commit(ctx, p); err != nil {
+			log.Alarm(errors.E(op, err))
+			continue
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// commit saves the preview unless ctx is done, in which case the write
+// could only fail.
+func (c *clientImpl) commit(ctx context.Context, op errors.Op, p *model.LinkPreview) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err := c.Store.Commit(ctx, p); err != nil {
+		log.Alarm(errors.E(op, err))
+	}
+}
+
+// fetch requests a fresh preview of url. If p is not nil, it is updated in
+// place so that its key is kept. It reports false, leaving p as it was, if
+// the fetch failed because ctx is done.
+func (c *clientImpl) fetch(
+	ctx context.Context,
+	url string,
+	p *model.LinkPreview,
+) (*model.LinkPreview, bool) {
+	ld, err := c.OG.Fetch(ctx, url)
+	if (err != nil || ld == nil) && ctx.Err() != nil {
+		return p, false
+	}
+
+	if p == nil {
+		p = &model.LinkPreview{URL: url}
+	}
+
+	now := time.Now()
+
+	p.FetchedAt = now
+
+	if err != nil || ld == nil {
+		log.Print(errors.E(errors.Opf("linkcache.fetch(%s)", url), err))
+
+		p.Failed = true
+		p.ExpiresAt = now.Add(c.NegativeTTL)
+
+		// Keep serving the last good preview if there is one.
+		if p.Link != nil {
+			p.Failed = false
+		}
+
+		return p, true
+	}
+
+	ld.Original = ""
+	p.Link = ld
+	p.Failed = false
+	p.ExpiresAt = now.Add(c.TTL)
+
+	return p, true
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/hiconvo/api/clients/magic"
 	"github.com/hiconvo/api/clients/mail"
@@ -27,6 +28,7 @@ type Client struct {
 	tplStrPasswordReset string
 	tplStrVerifyEmail   string
 	tplStrMergeAccounts string
+	tplStrPromotion     string
 }
 
 func New(sender mail.Client, tpl *template.Client) *Client {
@@ -37,6 +39,7 @@ func New(sender mail.Client, tpl *template.Client) *Client {
 		tplStrPasswordReset: readStringFromFile("password-reset.txt"),
 		tplStrVerifyEmail:   readStringFromFile("verify-email.txt"),
 		tplStrMergeAccounts: readStringFromFile("merge-accounts.txt"),
+		tplStrPromotion:     readStringFromFile("waitlist-promotion.txt"),
 	}
 }
 
@@ -125,7 +128,7 @@ func (c *Client) SendThread(
 	// Filter out registered users
 	var users []*model.User
 	for i := range thread.Users {
-		if thread.Users[i].SendThreads && !thread.Users[i].IsRegistered() && !model.IsRead(thread, thread.Users[i].Key) {
+		if thread.Users[i].SendThreads && !thread.Users[i].IsRegistered() && !model.IsRead(thread, thread.Users[i].ID) {
 			users = append(users, thread.Users[i])
 		}
 	}
@@ -138,7 +141,7 @@ func (c *Client) SendThread(
 
 	for i, curUser := range users {
 		// Don't send an email to the sender.
-		if curUser.Key.Equal(sender.Key) || !curUser.SendThreads {
+		if curUser.ID == sender.ID || !curUser.SendThreads {
 			continue
 		}
 
@@ -150,12 +153,13 @@ func (c *Client) SendThread(
 		if len(messages) < 5 {
 			firstMessage := &model.Message{
 				Body:      thread.Body,
-				PhotoKeys: thread.Photos,
+				PhotoKeys: thread.PhotoKeys,
+				Photos:    thread.Photos,
 				Link:      thread.Link,
+				Links:     thread.Links,
 				User:      thread.Owner,
-				UserKey:   thread.OwnerKey,
-				ParentKey: thread.Key,
-				ParentID:  thread.Key.Encode(),
+				UserID:    thread.OwnerID,
+				ParentID:  thread.ID,
 				CreatedAt: thread.CreatedAt,
 			}
 			cleanMessages = append(cleanMessages, lastFive...)
@@ -170,10 +174,11 @@ func (c *Client) SendThread(
 				Body:     m.Body,
 				Name:     m.User.FirstName,
 				HasPhoto: m.HasPhoto(),
+				Photos:   m.Photos,
 				HasLink:  m.HasLink(),
-				Link:     m.Link,
-				FromID:   m.User.ID,
-				ToID:     curUser.ID,
+				Links:    m.GetLinks(),
+				FromID:   m.User.ID.String(),
+				ToID:     curUser.ID.String(),
 				// Since these users are not registered, we do not show a magic login link
 				MagicLink: "https://app.convo.events",
 			}
@@ -255,7 +260,7 @@ func (c *Client) SendEventInvites(
 			Subject:       fmt.Sprintf(fmtStr, event.Name),
 			TextContent:   plainText,
 			HTMLContent:   html,
-			ICSAttachment: event.GetICS(),
+			ICSAttachment: event.GetInvitationICS(curUser),
 		}
 	}
 
@@ -299,7 +304,96 @@ func (c *Client) SendEventInvitation(m magic.Client, event *model.Event, user *m
 		Subject:       fmt.Sprintf("Invitation to %s", event.Name),
 		TextContent:   plainText,
 		HTMLContent:   html,
-		ICSAttachment: event.GetICS(),
+		ICSAttachment: event.GetInvitationICS(user),
+	}
+
+	return c.mail.Send(email)
+}
+
+// SendEventReminders reminds the guests of the event who have not declined
+// of its occurrence that starts at start, or of its next occurrence when
+// start is zero.
+func (c *Client) SendEventReminders(magicClient magic.Client, event *model.Event, start time.Time) error {
+	formatedTime := event.GetFormatedTime()
+	if !start.IsZero() {
+		formatedTime = event.GetFormatedOccurrence(start)
+	}
+
+	emailMessages := make([]mail.EmailMessage, len(event.Users))
+	for i, curUser := range event.Users {
+		if event.OwnerIs(curUser) || !curUser.SendEvents {
+			continue
+		}
+
+		if r := event.GetRSVP(curUser); r != nil && r.Status == model.RSVPDeclined {
+			continue
+		}
+
+		plainText, html, err := c.tpl.RenderReminder(&template.Event{
+			Name:                 event.Name,
+			Address:              event.Address,
+			Time:                 formatedTime,
+			Description:          event.Description,
+			FromName:             event.Owner.FullName,
+			MagicLink:            event.GetRSVPMagicLink(magicClient, curUser),
+			ButtonText:           "RSVP",
+			UnsubscribeMagicLink: curUser.GetUnsubscribeMagicLink(magicClient),
+		})
+		if err != nil {
+			return err
+		}
+
+		emailMessages[i] = mail.EmailMessage{
+			FromName:      event.Owner.FullName,
+			FromEmail:     event.GetEmail(),
+			ToName:        curUser.FullName,
+			ToEmail:       curUser.Email,
+			Subject:       fmt.Sprintf("Reminder: %s", event.Name),
+			TextContent:   plainText,
+			HTMLContent:   html,
+			ICSAttachment: event.GetInvitationICS(curUser),
+		}
+	}
+
+	for i := range emailMessages {
+		if emailMessages[i].FromEmail == "" {
+			continue
+		}
+
+		if err := c.mail.Send(emailMessages[i]); err != nil {
+			log.Alarm(errors.Errorf("mail.SendEventReminders: %v", err))
+		}
+	}
+
+	return nil
+}
+
+// SendWaitlistPromotion tells the user that a spot opened up at the event
+// and that she is no longer on its waitlist.
+func (c *Client) SendWaitlistPromotion(m magic.Client, event *model.Event, user *model.User) error {
+	if !user.SendEvents {
+		return nil
+	}
+
+	plainText, html, err := c.tpl.RenderAdminEmail(&template.AdminEmail{
+		Body:       c.tplStrPromotion,
+		ButtonText: "RSVP",
+		MagicLink:  event.GetRSVPMagicLink(m, user),
+		Fargs:      []interface{}{event.Name, event.GetFormatedTime(), event.Address},
+	})
+	if err != nil {
+		return err
+	}
+
+	email := mail.EmailMessage{
+		FromName:      event.Owner.FullName,
+		FromEmail:     event.GetEmail(),
+		ToName:        user.FullName,
+		ToEmail:       user.Email,
+		Subject:       fmt.Sprintf("You're going to %s", event.Name),
+		TextContent:   plainText,
+		HTMLContent:   html,
+		ICSAttachment: event.GetInvitationICS(user),
 	}
 
 	return c.mail.Send(email)
@@ -327,13 +421,14 @@ func (c *Client) SendCancellation(m magic.Client, event *model.Event, message st
 		}
 
 		emailMessages[i] = mail.EmailMessage{
-			FromName:    event.Owner.FullName,
-			FromEmail:   event.GetEmail(),
-			ToName:      curUser.FullName,
-			ToEmail:     curUser.Email,
-			Subject:     fmt.Sprintf("Cancelled: %s", event.Name),
-			TextContent: plainText,
-			HTMLContent: html,
+			FromName:      event.Owner.FullName,
+			FromEmail:     event.GetEmail(),
+			ToName:        curUser.FullName,
+			ToEmail:       curUser.Email,
+			Subject:       fmt.Sprintf("Cancelled: %s", event.Name),
+			TextContent:   plainText,
+			HTMLContent:   html,
+			ICSAttachment: event.GetInvitationICS(curUser),
 		}
 	}
 
@@ -370,10 +465,11 @@ func (c *Client) SendDigest(
 				Body:      digestList[i].Messages[j].Body,
 				Name:      digestList[i].Messages[j].User.FullName,
 				HasPhoto:  digestList[i].Messages[j].HasPhoto(),
+				Photos:    digestList[i].Messages[j].Photos,
 				HasLink:   digestList[i].Messages[j].HasLink(),
-				Link:      digestList[i].Messages[j].Link,
-				FromID:    digestList[i].Messages[j].User.ID,
-				ToID:      user.ID,
+				Links:     digestList[i].Messages[j].GetLinks(),
+				FromID:    digestList[i].Messages[j].User.ID.String(),
+				ToID:      user.ID.String(),
 				MagicLink: magicLink,
 			}
 		}
@@ -0,0 +1,314 @@
+// Package migrate runs migrations of the data in the db. Migrations run in
+// the order of their IDs and are recorded in the db as they progress, so
+// that each of them is applied once and one that is interrupted resumes
+// where it stopped.
+package migrate
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/log"
+)
+
+const (
+	DefaultBatchSize = 100
+	// Kind is the kind of the entities that record the progress of
+	// migrations. They are keyed by the IDs of the migrations.
+	Kind = "Migration"
+)
+
+// Migration is a change to the entities that a query returns. The entities
+// are migrated in batches in the order of their keys and the last key of
+// each batch is recorded after it.
+type Migration struct {
+	// ID identifies the migration. Migrations run in the order of their IDs,
+	// so IDs start with a sequence number, as in "0001-message-photos".
+	ID          string
+	Description string
+	// Query returns the entities to migrate. It must not have an order or
+	// inequality filters of its own, since batches are selected by key. A
+	// step may delete entities or remove them from the results; an
+	// interrupted migration resumes after the last key it recorded.
+	Query     *db.Query
+	BatchSize int
+	// Baseline migrations replaced one-off commands that ran before
+	// migrations were recorded. They are recorded as applied instead of
+	// running when there is no record of them yet, since their changes are
+	// either already made or no longer apply to newer data.
+	Baseline bool
+	// Step migrates one batch of entities and returns the number of
+	// entities that it migrated.
+	Step func(ctx context.Context, s *Step) (int, error)
+}
+
+// Step is a batch of a migration.
+type Step struct {
+	DB db.Client
+	// Query is the query of the migration limited to the keys of the batch.
+	Query *db.Query
+	// IsDryRun is true when nothing must be written to the db.
+	IsDryRun bool
+}
+
+// Status is the progress of a migration.
+type Status struct {
+	Migration *Migration
+	// Count is the number of entities that have been migrated.
+	Count     int
+	StartedAt time.Time
+	AppliedAt time.Time
+}
+
+// IsApplied reports whether the migration has been applied.
+func (s *Status) IsApplied() bool {
+	return !s.AppliedAt.IsZero()
+}
+
+type Migrator interface {
+	// Run runs the migrations that have not been applied yet, in order.
+	Run(ctx context.Context) error
+	// Status returns the progress of every migration, in order.
+	Status(ctx context.Context) ([]*Status, error)
+	// MarkApplied records the migrations with the given IDs as applied
+	// without running them. This is for migrations whose changes were made
+	// before they were recorded.
+	MarkApplied(ctx context.Context, ids ...string) error
+}
+
+type Config struct {
+	DB         db.Client
+	Migrations []*Migration
+	// IsDryRun runs the migrations without writing to the db. Progress is
+	// not recorded either, so every pending migration runs from the start.
+	IsDryRun bool
+}
+
+type migratorImpl struct {
+	*Config
+}
+
+func New(c *Config) Migrator {
+	if c.Migrations == nil {
+		c.Migrations = All
+	}
+
+	migrations := make([]*Migration, len(c.Migrations))
+	copy(migrations, c.Migrations)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].ID < migrations[j].ID
+	})
+
+	for i := range migrations {
+		if i > 0 && migrations[i].ID == migrations[i-1].ID {
+			panic("migrate: duplicate migration " + migrations[i].ID)
+		}
+	}
+
+	c.Migrations = migrations
+
+	return &migratorImpl{Config: c}
+}
+
+// record is what is stored in the db about a migration.
+type record struct {
+	Description string `datastore:",noindex"`
+	Count       int
+	// LastKey is the last key of the last batch that was migrated.
+	LastKey   *datastore.Key `datastore:",noindex"`
+	StartedAt time.Time
+	AppliedAt time.Time
+}
+
+func (m *migratorImpl) Run(ctx context.Context) error {
+	op := errors.Op("migrate.Run")
+
+	for _, mig := range m.Migrations {
+		rec, err := m.getRecord(ctx, mig.ID)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		if !rec.AppliedAt.IsZero() {
+			log.Printf("migrate: %s was applied at %v, skipping", mig.ID, rec.AppliedAt)
+
+			continue
+		}
+
+		if mig.Baseline && rec.StartedAt.IsZero() {
+			if err := m.markApplied(ctx, mig, rec); err != nil {
+				return errors.E(op, err)
+			}
+
+			continue
+		}
+
+		if err := m.run(ctx, mig, rec); err != nil {
+			return errors.E(op, errors.Errorf("migration %s: %v", mig.ID, err))
+		}
+	}
+
+	return nil
+}
+
+func (m *migratorImpl) run(ctx context.Context, mig *Migration, rec *record) error {
+	batchSize := mig.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	if rec.StartedAt.IsZero() {
+		rec.StartedAt = time.Now()
+		rec.Description = mig.Description
+	}
+
+	log.Printf("migrate: running %s (%s) from entity %d, dry-run=%v",
+		mig.ID, mig.Description, rec.Count, m.IsDryRun)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		query := mig.Query
+		if rec.LastKey != nil {
+			query = query.Filter("__key__ >", rec.LastKey)
+		}
+
+		keys, err := m.DB.GetAll(ctx, query.KeysOnly().Limit(batchSize), nil)
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			n, err := mig.Step(ctx, &Step{
+				DB:       m.DB,
+				Query:    query.Filter("__key__ <=", keys[len(keys)-1]),
+				IsDryRun: m.IsDryRun,
+			})
+			if err != nil {
+				return err
+			}
+
+			rec.Count += n
+			rec.LastKey = keys[len(keys)-1]
+		}
+
+		if len(keys) < batchSize {
+			rec.AppliedAt = time.Now()
+		}
+
+		if err := m.putRecord(ctx, mig.ID, rec); err != nil {
+			return err
+		}
+
+		log.Printf("migrate: %s migrated %d entities", mig.ID, rec.Count)
+
+		if len(keys) < batchSize {
+			log.Printf("migrate: %s done", mig.ID)
+
+			return nil
+		}
+	}
+}
+
+func (m *migratorImpl) Status(ctx context.Context) ([]*Status, error) {
+	op := errors.Op("migrate.Status")
+
+	statuses := make([]*Status, len(m.Migrations))
+	for i, mig := range m.Migrations {
+		rec, err := m.getRecord(ctx, mig.ID)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+
+		statuses[i] = &Status{
+			Migration: mig,
+			Count:     rec.Count,
+			StartedAt: rec.StartedAt,
+			AppliedAt: rec.AppliedAt,
+		}
+	}
+
+	return statuses, nil
+}
+
+func (m *migratorImpl) MarkApplied(ctx context.Context, ids ...string) error {
+	op := errors.Op("migrate.MarkApplied")
+
+	for _, id := range ids {
+		mig := m.find(id)
+		if mig == nil {
+			return errors.E(op, errors.Errorf("unknown migration %q", id))
+		}
+
+		rec, err := m.getRecord(ctx, id)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		if !rec.AppliedAt.IsZero() {
+			continue
+		}
+
+		if err := m.markApplied(ctx, mig, rec); err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *migratorImpl) markApplied(ctx context.Context, mig *Migration, rec *record) error {
+	now := time.Now()
+	if rec.StartedAt.IsZero() {
+		rec.StartedAt = now
+	}
+
+	rec.Description = mig.Description
+	rec.AppliedAt = now
+
+	if err := m.putRecord(ctx, mig.ID, rec); err != nil {
+		return err
+	}
+
+	log.Printf("migrate: marked %s as applied, dry-run=%v", mig.ID, m.IsDryRun)
+
+	return nil
+}
+
+func (m *migratorImpl) find(id string) *Migration {
+	for _, mig := range m.Migrations {
+		if mig.ID == id {
+			return mig
+		}
+	}
+
+	return nil
+}
+
+func (m *migratorImpl) getRecord(ctx context.Context, id string) (*record, error) {
+	rec := new(record)
+
+	err := m.DB.Get(ctx, datastore.NameKey(Kind, id, nil), rec)
+	if err != nil && !errors.Is(err, datastore.ErrNoSuchEntity) {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func (m *migratorImpl) putRecord(ctx context.Context, id string, rec *record) error {
+	if m.IsDryRun {
+		return nil
+	}
+
+	_, err := m.DB.Put(ctx, datastore.NameKey(Kind, id, nil), rec)
+
+	return err
+}
@@ -0,0 +1,272 @@
+package migrate
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	dbc "github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/db"
+	"github.com/hiconvo/api/log"
+	"github.com/hiconvo/api/model"
+)
+
+// All is every migration, in order. New migrations are appended with the
+// next sequence number; applied migrations must never be changed.
+var All = []*Migration{
+	{
+		ID:          "0001-message-photos",
+		Description: "Bring outdated messages up to date",
+		Query:       dbc.NewQuery("Message"),
+		BatchSize:   20,
+		Step:        migrateMessagePhotos,
+		Baseline:    true,
+	},
+	{
+		ID:          "0002-first-messages",
+		Description: "Delete the first message of threads when it is identical to the thread preview",
+		Query:       dbc.NewQuery("Thread"),
+		Step:        deleteFirstMessages,
+		Baseline:    true,
+	},
+	{
+		ID:          "0003-thread-previews",
+		Description: "Populate UpdatedAt of threads",
+		Query:       dbc.NewQuery("Thread"),
+		Step:        migrateThreadPreviews,
+		Baseline:    true,
+	},
+	{
+		ID:          "0004-thread-deleted-at",
+		Description: "Populate DeletedAt of threads so that queries can exclude deleted threads",
+		Query:       dbc.NewQuery("Thread"),
+		Step:        populateDeletedAt,
+	},
+	{
+		ID:          "0005-event-deleted-at",
+		Description: "Populate DeletedAt of events so that queries can exclude deleted events",
+		Query:       dbc.NewQuery("Event"),
+		Step:        populateDeletedAt,
+	},
+	{
+		ID:          "0006-message-deleted-at",
+		Description: "Populate DeletedAt of messages so that queries can exclude deleted messages",
+		Query:       dbc.NewQuery("Message"),
+		Step:        populateDeletedAt,
+	},
+	{
+		ID:          "0007-note-deleted-at",
+		Description: "Populate DeletedAt of notes so that queries can exclude deleted notes",
+		Query:       dbc.NewQuery("Note"),
+		Step:        populateDeletedAt,
+	},
+	{
+		ID:          "0008-event-time-zones",
+		Description: "Set the time zones of events that only have UTC offsets",
+		Query:       dbc.NewQuery("Event"),
+		Step:        migrateEventTimeZones,
+	},
+	{
+		ID:          "0009-event-rsvp-statuses",
+		Description: "Move the RSVPs of events to responses of users who are going",
+		Query:       dbc.NewQuery("Event"),
+		Step:        migrateEventRSVPStatuses,
+	},
+}
+
+// migrateMessagePhotos leaves photos as they are. The one-off command that
+// it replaced stored them by URL, but photos are now stored by key and the
+// storage client accepts either.
+func migrateMessagePhotos(ctx context.Context, s *Step) (int, error) {
+	var messages []*model.Message
+	if _, err := s.DB.GetAll(ctx, s.Query, &messages); err != nil {
+		return 0, err
+	}
+
+	if !s.IsDryRun {
+		store := &db.MessageStore{DB: s.DB}
+		if err := store.CommitMulti(ctx, messages); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(messages), nil
+}
+
+func deleteFirstMessages(ctx context.Context, s *Step) (int, error) {
+	var threads []*model.Thread
+	if _, err := s.DB.GetAll(ctx, s.Query, &threads); err != nil {
+		return 0, err
+	}
+
+	store := &db.MessageStore{DB: s.DB}
+
+	for _, thread := range threads {
+		messages, err := store.GetMessagesByThread(ctx, thread, &model.Pagination{})
+		if err != nil {
+			return 0, err
+		}
+
+		if len(messages) == 0 || thread.Body == "" || messages[0].Body != thread.Body {
+			continue
+		}
+
+		log.Printf("migrate: thread=%d: deleting first message=%s, which has the same body as the preview",
+			thread.Int64ID, messages[0].ID)
+
+		if !s.IsDryRun {
+			if err := store.Delete(ctx, messages[0]); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(threads), nil
+}
+
+// migrateThreadPreviews can run any number of times. The one-off command
+// that it replaced also stored photos by URL, which migrateMessagePhotos
+// explains, and decremented the response counts of threads created before
+// their first messages were removed, which must only happen once and was
+// done in production before migrations were recorded.
+func migrateThreadPreviews(ctx context.Context, s *Step) (int, error) {
+	var threads []*model.Thread
+	if _, err := s.DB.GetAll(ctx, s.Query, &threads); err != nil {
+		return 0, err
+	}
+
+	for _, thread := range threads {
+		if thread.UpdatedAt.IsZero() {
+			thread.UpdatedAt = thread.CreatedAt
+		}
+	}
+
+	if !s.IsDryRun {
+		store := &db.ThreadStore{DB: s.DB}
+		if err := store.CommitMulti(ctx, threads); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(threads), nil
+}
+
+// migrateEventTimeZones sets the time zones of events from their offsets.
+// The zones never observe daylight saving time, since offsets do not say
+// when it applies, so the events are shown as they were before.
+func migrateEventTimeZones(ctx context.Context, s *Step) (int, error) {
+	var events []*model.Event
+	if _, err := s.DB.GetAll(ctx, s.Query, &events); err != nil {
+		return 0, err
+	}
+
+	var changed []*model.Event
+
+	for _, event := range events {
+		if event.TimeZone != "" {
+			continue
+		}
+
+		if err := event.SetTimeZone(""); err != nil {
+			return 0, err
+		}
+
+		if event.TimeZone == "" {
+			log.Printf("migrate: event=%d: no time zone has offset %d", event.Int64ID, event.UTCOffset)
+			continue
+		}
+
+		log.Printf("migrate: event=%d: setting time zone to %s", event.Int64ID, event.TimeZone)
+
+		changed = append(changed, event)
+	}
+
+	if !s.IsDryRun && len(changed) > 0 {
+		store := &db.EventStore{DB: s.DB}
+		if err := store.CommitMulti(ctx, changed); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(events), nil
+}
+
+// populateDeletedAt sets DeletedAt to the zero time on entities that were
+// saved before it existed, since queries that filter on a property do not
+// match entities without it. Entities are saved as property lists so that
+// the step works for any kind and leaves their other properties untouched.
+func populateDeletedAt(ctx context.Context, s *Step) (int, error) {
+	var entities []datastore.PropertyList
+
+	keys, err := s.DB.GetAll(ctx, s.Query, &entities)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		changedKeys     []*datastore.Key
+		changedEntities []datastore.PropertyList
+	)
+
+	for i := range entities {
+		if hasProperty(entities[i], "DeletedAt") {
+			continue
+		}
+
+		log.Printf("migrate: %s=%d: populating DeletedAt", keys[i].Kind, keys[i].ID)
+
+		changedKeys = append(changedKeys, keys[i])
+		changedEntities = append(changedEntities,
+			append(entities[i], datastore.Property{Name: "DeletedAt", Value: time.Time{}}))
+	}
+
+	if !s.IsDryRun && len(changedKeys) > 0 {
+		if _, err := s.DB.PutMulti(ctx, changedKeys, changedEntities); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(entities), nil
+}
+
+func hasProperty(ps datastore.PropertyList, name string) bool {
+	for i := range ps {
+		if ps[i].Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// migrateEventRSVPStatuses saves the events whose RSVPs were saved before
+// they had statuses. Their RSVPs are moved to responses when they are
+// loaded, so saving them is all that is left to do.
+func migrateEventRSVPStatuses(ctx context.Context, s *Step) (int, error) {
+	var events []*model.Event
+	if _, err := s.DB.GetAll(ctx, s.Query, &events); err != nil {
+		return 0, err
+	}
+
+	var changed []*model.Event
+
+	for _, event := range events {
+		if !event.HasLegacyRSVPs() {
+			continue
+		}
+
+		log.Printf("migrate: event=%d: moving %d rsvps", event.Int64ID, len(event.LegacyRSVPIDs))
+
+		changed = append(changed, event)
+	}
+
+	if !s.IsDryRun && len(changed) > 0 {
+		store := &db.EventStore{DB: s.DB}
+		if err := store.CommitMulti(ctx, changed); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(events), nil
+}
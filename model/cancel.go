@@ -0,0 +1,89 @@
+package model
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hiconvo/api/errors"
+)
+
+// CancelDelay is how long after an event that has not happened yet is
+// deleted its guests are told that it was cancelled. Until then, its owner
+// can restore it without its guests ever knowing. Once they have been told,
+// it can no longer be restored.
+const CancelDelay = time.Hour
+
+// Cancel cancels the event, which keeps it around so that its guests can
+// still see it along with the message of its owner. Cancelled events cannot
+// be changed or responded to, and their guests are no longer reminded of
+// them.
+func (e *Event) Cancel(message string) error {
+	op := errors.Op("event.Cancel")
+
+	if e.IsCancelled() {
+		return errors.E(op,
+			errors.Str("already cancelled"),
+			map[string]string{"message": "This event was already cancelled"},
+			http.StatusBadRequest)
+	}
+
+	if !e.IsInFuture() {
+		return errors.E(op,
+			errors.Str("event in past"),
+			map[string]string{"message": "You cannot cancel past events"},
+			http.StatusBadRequest)
+	}
+
+	e.CancelledAt = time.Now()
+	e.CancelMessage = message
+	e.Revise()
+
+	return nil
+}
+
+func (e *Event) IsCancelled() bool {
+	return !e.CancelledAt.IsZero()
+}
+
+// IsCancelledSinceDeleted reports whether the guests of the deleted event
+// were told that it was cancelled after it was deleted.
+func (e *Event) IsCancelledSinceDeleted() bool {
+	return !e.DeletedAt.IsZero() && e.CancelledAt.After(e.DeletedAt)
+}
+
+// CancelDueAt returns when the guests of the deleted event are told that it
+// was cancelled. The CancelDelay is cut down to half of the time that was
+// left before the event when it was deleted, so that they are told before
+// it starts.
+func (e *Event) CancelDueAt() time.Time {
+	delay := CancelDelay
+
+	if start, ok := e.NextOccurrence(e.DeletedAt); ok {
+		if left := start.Sub(e.DeletedAt) / 2; left < delay {
+			delay = left
+		}
+	}
+
+	return e.DeletedAt.Add(delay)
+}
+
+// IsCancellationDue reports whether the guests of the event, which was
+// deleted before it happened, are due to be told at t that it was cancelled.
+func (e *Event) IsCancellationDue(t time.Time) bool {
+	return !e.DeletedAt.IsZero() &&
+		!e.IsCancelled() &&
+		e.IsInFuture() &&
+		!t.Before(e.CancelDueAt())
+}
+
+// checkNotCancelled returns an error if the event was cancelled.
+func (e *Event) checkNotCancelled(op errors.Op) error {
+	if e.IsCancelled() {
+		return errors.E(op,
+			errors.Str("event cancelled"),
+			map[string]string{"message": "This event was cancelled"},
+			http.StatusBadRequest)
+	}
+
+	return nil
+}
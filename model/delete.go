@@ -0,0 +1,34 @@
+package model
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hiconvo/api/errors"
+)
+
+// RestoreWindow is how long threads, events, messages and notes can be
+// restored after they were deleted. They are purged once it has passed.
+const RestoreWindow = 30 * 24 * time.Hour
+
+// Deleting a thread, event, message or note only sets its DeletedAt. The
+// stores hide deleted entities from all of their queries, except for the
+// ones that look up deleted entities in order to restore or purge them.
+
+// IsRestorable reports whether an entity that was deleted at deletedAt can
+// still be restored.
+func IsRestorable(deletedAt time.Time) bool {
+	return !deletedAt.IsZero() && time.Since(deletedAt) < RestoreWindow
+}
+
+// ErrNotRestorable returns the error of restoring an entity that was not
+// deleted or whose restore window has passed.
+func ErrNotRestorable(op errors.Op) error {
+	return errors.E(op, errors.Str("not restorable"), http.StatusNotFound)
+}
+
+// PurgeBefore returns the time before which deleted entities can no longer
+// be restored and are purged.
+func PurgeBefore() time.Time {
+	return time.Now().Add(-RestoreWindow)
+}
@@ -1,14 +1,12 @@
 package model
 
-import "cloud.google.com/go/datastore"
-
 type DigestItem struct {
-	ParentID *datastore.Key
+	ParentID ID
 	Name     string
 	Messages []*Message
 }
 
 type Digestable interface {
-	GetKey() *datastore.Key
+	GetID() ID
 	GetName() string
 }
@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	ics "github.com/arran4/golang-ical"
 	"github.com/gosimple/slug"
 
@@ -24,41 +24,69 @@ const (
 )
 
 type Event struct {
-	Key             *datastore.Key   `json:"-"        datastore:"__key__"`
-	Token           string           `json:"-"`
-	ID              string           `json:"id"       datastore:"-"`
-	OwnerKey        *datastore.Key   `json:"-"`
-	Owner           *UserPartial     `json:"owner"    datastore:"-"`
-	HostKeys        []*datastore.Key `json:"-"`
-	HostPartials    []*UserPartial   `json:"hosts"    datastore:"-"`
-	UserKeys        []*datastore.Key `json:"-"`
-	UserPartials    []*UserPartial   `json:"users"    datastore:"-"`
-	Users           []*User          `json:"-"        datastore:"-"`
-	RSVPKeys        []*datastore.Key `json:"-"`
-	RSVPs           []*UserPartial   `json:"rsvps"    datastore:"-"`
-	PlaceID         string           `json:"placeId"  datastore:",noindex"`
-	Address         string           `json:"address"  datastore:",noindex"`
-	Lat             float64          `json:"lat"      datastore:",noindex"`
-	Lng             float64          `json:"lng"      datastore:",noindex"`
-	Name            string           `json:"name"     datastore:",noindex"`
-	Description     string           `json:"description"  datastore:",noindex"`
-	Timestamp       time.Time        `json:"timestamp"    datastore:",noindex"`
-	UTCOffset       int              `json:"-"        datastore:",noindex"`
-	UserReads       []*UserPartial   `json:"reads"    datastore:"-"`
-	Reads           []*Read          `json:"-"        datastore:",noindex"`
-	CreatedAt       time.Time        `json:"createdAt"`
-	UpdatedAt       time.Time        `json:"updatedAt"`
-	GuestsCanInvite bool             `json:"guestsCanInvite"`
+	Token           string            `json:"-"`
+	ID              ID                `json:"id"       datastore:"-"`
+	Int64ID         int64             `json:"-"        datastore:"-"`
+	OwnerID         ID                `json:"-"        datastore:"OwnerKey"`
+	Owner           *UserPartial      `json:"owner"    datastore:"-"`
+	HostIDs         []ID              `json:"-"        datastore:"HostKeys"`
+	HostPartials    []*UserPartial    `json:"hosts"    datastore:"-"`
+	UserIDs         []ID              `json:"-"        datastore:"UserKeys"`
+	UserPartials    []*UserPartial    `json:"users"    datastore:"-"`
+	Users           []*User           `json:"-"        datastore:"-"`
+	LegacyRSVPIDs   []ID              `json:"-"        datastore:"RSVPKeys"`
+	Responses       []*RSVP           `json:"responses"  datastore:",noindex"`
+	RSVPs           []*UserPartial    `json:"rsvps"    datastore:"-"`
+	Maybes          []*UserPartial    `json:"maybes"     datastore:"-"`
+	Declines        []*UserPartial    `json:"declines"   datastore:"-"`
+	Waitlist        []*UserPartial    `json:"waitlist"   datastore:"-"`
+	Capacity        int               `json:"capacity"   datastore:",noindex"`
+	Reminders       []int             `json:"reminders"  datastore:",noindex"`
+	RemindedAt      time.Time         `json:"-"          datastore:",noindex"`
+	NextReminderAt  time.Time         `json:"-"`
+	RSVPCounts      RSVPCounts        `json:"rsvpCounts" datastore:"-"`
+	PlaceID         string            `json:"placeId"  datastore:",noindex"`
+	Address         string            `json:"address"  datastore:",noindex"`
+	Lat             float64           `json:"lat"      datastore:",noindex"`
+	Lng             float64           `json:"lng"      datastore:",noindex"`
+	Name            string            `json:"name"     datastore:",noindex"`
+	Description     string            `json:"description"  datastore:",noindex"`
+	Timestamp       time.Time         `json:"timestamp"    datastore:",noindex"`
+	EndTimestamp    time.Time         `json:"endTimestamp" datastore:",noindex"`
+	AllDay          bool              `json:"allDay"       datastore:",noindex"`
+	UTCOffset       int               `json:"-"        datastore:",noindex"`
+	TimeZone        string            `json:"timeZone" datastore:",noindex"`
+	UserReads       []*UserPartial    `json:"reads"    datastore:"-"`
+	Reads           []*Read           `json:"-"        datastore:",noindex"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	UpdatedAt       time.Time         `json:"updatedAt"`
+	GuestsCanInvite bool              `json:"guestsCanInvite"`
+	Version         int64             `json:"-"        datastore:",noindex"`
+	DeletedAt       time.Time         `json:"-"`
+	CancelMessage   string            `json:"cancelMessage" datastore:",noindex"`
+	CancelledAt     time.Time         `json:"cancelledAt"   datastore:",noindex"`
+	Sequence        int               `json:"-"             datastore:",noindex"`
+	Recurrence      *Recurrence       `json:"recurrence"   datastore:",noindex"`
+	OccurrenceRSVPs []*OccurrenceRSVP `json:"-"            datastore:",noindex"`
+	Occurrences     []*Occurrence     `json:"occurrences,omitempty"  datastore:"-"`
 }
 
 type EventStore interface {
-	GetEventByID(ctx context.Context, id string) (*Event, error)
+	GetEventByID(ctx context.Context, id ID) (*Event, error)
+	GetDeletedEventByID(ctx context.Context, id ID) (*Event, error)
+	GetEventsDeletedBefore(ctx context.Context, t time.Time) ([]*Event, error)
+	GetEventsDeletedAfter(ctx context.Context, t time.Time) ([]*Event, error)
+	GetEventsWithRemindersDue(ctx context.Context, t time.Time) ([]*Event, error)
 	GetUnhydratedEventsByUser(ctx context.Context, u *User, p *Pagination) ([]*Event, error)
 	GetEventsByUser(ctx context.Context, u *User, p *Pagination) ([]*Event, error)
+	AllocateID(ctx context.Context) (ID, error)
 	Commit(ctx context.Context, e *Event) error
 	CommitMulti(ctx context.Context, events []*Event) error
-	CommitWithTransaction(tx db.Transaction, e *Event) (*datastore.PendingKey, error)
+	CommitWithTransaction(tx db.Transaction, e *Event) error
+	CommitMultiWithTransaction(tx db.Transaction, events []*Event) error
 	Delete(ctx context.Context, e *Event) error
+	Restore(ctx context.Context, e *Event) error
+	Purge(ctx context.Context, e *Event) error
 }
 
 func NewEvent(
@@ -79,35 +107,35 @@ func NewEvent(
 			http.StatusBadRequest)
 	}
 
-	// Get all of the users' keys, remove duplicates, and check whether
+	// Get all of the users' IDs, remove duplicates, and check whether
 	// the owner was included in the users slice
-	userKeys := make([]*datastore.Key, 0)
-	seenUsers := make(map[string]*User)
+	userIDs := make([]ID, 0)
+	seenUsers := make(map[ID]*User)
 	hasOwner := false
 	for _, u := range users {
 		if _, alreadySeen := seenUsers[u.ID]; alreadySeen {
 			continue
 		}
 		seenUsers[u.ID] = u
-		if u.Key.Equal(owner.Key) {
+		if u.ID == owner.ID {
 			hasOwner = true
 		}
-		userKeys = append(userKeys, u.Key)
+		userIDs = append(userIDs, u.ID)
 	}
 
 	// Add the owner to the users if not already present
 	if !hasOwner {
-		userKeys = append(userKeys, owner.Key)
+		userIDs = append(userIDs, owner.ID)
 		users = append(users, owner)
 	}
 
-	// Get all of the hosts' keys, remove duplicates, and check whether
+	// Get all of the hosts' IDs, remove duplicates, and check whether
 	// hosts were included in the users slice.
-	hostKeys := make([]*datastore.Key, 0)
-	seenHosts := make(map[string]struct{})
+	hostIDs := make([]ID, 0)
+	seenHosts := make(map[ID]struct{})
 	cleanHosts := make([]*User, 0)
 	for _, u := range hosts {
-		if u.Key.Equal(owner.Key) {
+		if u.ID == owner.ID {
 			continue
 		}
 
@@ -116,7 +144,7 @@ func NewEvent(
 		}
 
 		seenHosts[u.ID] = struct{}{}
-		hostKeys = append(hostKeys, u.Key)
+		hostIDs = append(hostIDs, u.ID)
 		cleanHosts = append(cleanHosts, u)
 
 		if _, alreadySeenUser := seenUsers[u.ID]; alreadySeenUser {
@@ -124,7 +152,7 @@ func NewEvent(
 		}
 
 		seenUsers[u.ID] = u
-		userKeys = append(userKeys, u.Key)
+		userIDs = append(userIDs, u.ID)
 	}
 
 	allUsers := make([]*User, 0)
@@ -137,13 +165,12 @@ func NewEvent(
 	}
 
 	return &Event{
-		Key:             datastore.IncompleteKey("Event", nil),
 		Token:           random.Token(),
-		OwnerKey:        owner.Key,
+		OwnerID:         owner.ID,
 		Owner:           MapUserToUserPartial(owner),
-		HostKeys:        hostKeys,
+		HostIDs:         hostIDs,
 		HostPartials:    MapUsersToUserPartials(cleanHosts),
-		UserKeys:        userKeys,
+		UserIDs:         userIDs,
 		UserPartials:    MapUsersToUserPartials(users),
 		Users:           allUsers,
 		Name:            name,
@@ -158,31 +185,9 @@ func NewEvent(
 	}, nil
 }
 
-func (e *Event) LoadKey(k *datastore.Key) error {
-	e.Key = k
-
-	// Add URL safe key
-	e.ID = k.Encode()
-
-	return nil
-}
-
-func (e *Event) Save() ([]datastore.Property, error) {
-	return datastore.SaveStruct(e)
-}
-
-func (e *Event) Load(ps []datastore.Property) error {
-	if err := datastore.LoadStruct(e, ps); err != nil {
-		if mismatch, ok := err.(*datastore.ErrFieldMismatch); ok {
-			if mismatch.FieldName != "GuestsCanInvite" {
-				return err
-			}
-		} else {
-			return err
-		}
-	}
-
-	return nil
+// ETag returns the entity tag of the current version of the event.
+func (e *Event) ETag() string {
+	return etag(e.Version)
 }
 
 func (e *Event) GetReads() []*Read {
@@ -193,57 +198,51 @@ func (e *Event) SetReads(newReads []*Read) {
 	e.Reads = newReads
 }
 
-func (e *Event) GetKey() *datastore.Key {
-	return e.Key
+func (e *Event) GetID() ID {
+	return e.ID
 }
 
 func (e *Event) GetName() string {
 	return e.Name
 }
 
+// GetFormatedTime formats the next occurrence of the event, or its first
+// occurrence once they are all over, along with its end if it has one.
 func (e *Event) GetFormatedTime() string {
-	loc := time.FixedZone("Given", e.UTCOffset)
-	return e.Timestamp.In(loc).Format("Monday, January 2 @ 3:04 PM")
-}
-
-func (e *Event) HasUser(u *User) bool {
-	for _, k := range e.UserKeys {
-		if k.Equal(u.Key) {
-			return true
-		}
+	start, ok := e.NextOccurrence(time.Now())
+	if !ok {
+		start = e.Timestamp.In(e.location())
 	}
 
-	return false
+	return e.formatOccurrence(start)
 }
 
-func (e *Event) OwnerIs(u *User) bool {
-	return e.OwnerKey.Equal(u.Key)
+// GetFormatedOccurrence formats the occurrence of the event that starts at
+// start in the time zone of the event, along with its end if it has one.
+func (e *Event) GetFormatedOccurrence(start time.Time) string {
+	return e.formatOccurrence(start.In(e.location()))
 }
 
-func (e *Event) HostIs(u *User) bool {
-	for _, k := range e.HostKeys {
-		if k.Equal(u.Key) {
-			return true
-		}
-	}
-
-	return false
+func (e *Event) HasUser(u *User) bool {
+	return hasID(e.UserIDs, u.ID)
 }
 
-func (e *Event) HasRSVP(u *User) bool {
-	for _, k := range e.RSVPKeys {
-		if k.Equal(u.Key) {
-			return true
-		}
-	}
+func (e *Event) OwnerIs(u *User) bool {
+	return e.OwnerID == u.ID
+}
 
-	return false
+func (e *Event) HostIs(u *User) bool {
+	return hasID(e.HostIDs, u.ID)
 }
 
 // AddUser adds a user to the event.
 func (e *Event) AddUser(u *User) error {
 	op := errors.Op("event.AddUser")
 	// Cannot add owner or duplicate.
+	if err := e.checkNotCancelled(op); err != nil {
+		return err
+	}
+
 	if e.OwnerIs(u) || e.HasUser(u) {
 		return errors.E(op,
 			map[string]string{"message": "This user is already invited to this event"},
@@ -251,14 +250,14 @@ func (e *Event) AddUser(u *User) error {
 			http.StatusBadRequest)
 	}
 
-	if len(e.UserKeys) >= 300 {
+	if len(e.UserIDs) >= 300 {
 		return errors.E(op,
 			map[string]string{"message": "This event has the maximum number of guests"},
 			errors.Str("user count limit"),
 			http.StatusBadRequest)
 	}
 
-	e.UserKeys = append(e.UserKeys, u.Key)
+	e.UserIDs = append(e.UserIDs, u.ID)
 	e.UserPartials = append(e.UserPartials, MapUserToUserPartial(u))
 
 	return nil
@@ -278,14 +277,8 @@ func (e *Event) RemoveUser(u *User) error {
 			http.StatusBadRequest)
 	}
 
-	// Remove from keys.
-	for i, k := range e.UserKeys {
-		if k.Equal(u.Key) {
-			e.UserKeys[i] = e.UserKeys[len(e.UserKeys)-1]
-			e.UserKeys = e.UserKeys[:len(e.UserKeys)-1]
-			break
-		}
-	}
+	// Remove from IDs.
+	e.UserIDs = removeID(e.UserIDs, u.ID)
 	// Remove from partials.
 	for i, c := range e.UserPartials {
 		if c.ID == u.ID {
@@ -301,13 +294,13 @@ func (e *Event) RemoveUser(u *User) error {
 func (e *Event) SetHosts(hosts []*User) error {
 	op := errors.Op("event.SetHosts")
 	// TODO: Find a way to remove duplicated code here...
-	// Get all of the hosts' keys, remove duplicates, and check whether
+	// Get all of the hosts' IDs, remove duplicates, and check whether
 	// hosts were included in the users slice.
-	hostKeys := make([]*datastore.Key, 0)
-	seenHosts := make(map[string]struct{})
+	hostIDs := make([]ID, 0)
+	seenHosts := make(map[ID]struct{})
 	cleanHosts := make([]*User, 0)
 	for _, u := range hosts {
-		if u.Key.Equal(e.OwnerKey) {
+		if u.ID == e.OwnerID {
 			continue
 		}
 
@@ -316,7 +309,7 @@ func (e *Event) SetHosts(hosts []*User) error {
 		}
 
 		seenHosts[u.ID] = struct{}{}
-		hostKeys = append(hostKeys, u.Key)
+		hostIDs = append(hostIDs, u.ID)
 		cleanHosts = append(cleanHosts, u)
 
 		if e.HasUser(u) {
@@ -326,87 +319,59 @@ func (e *Event) SetHosts(hosts []*User) error {
 		e.AddUser(u)
 	}
 
-	if len(hostKeys) > MaxEventHosts {
+	if len(hostIDs) > MaxEventHosts {
 		return errors.E(op,
 			map[string]string{"message": "Max number of hosts is 20"},
 			errors.Str("max hosts"),
 			http.StatusBadRequest)
 	}
 
-	e.HostKeys = hostKeys
+	e.HostIDs = hostIDs
 	e.HostPartials = MapUsersToUserPartials(cleanHosts)
 
 	return nil
 }
 
-// AddRSVP RSVPs a user for the event.
-func (e *Event) AddRSVP(u *User) error {
-	op := errors.Op("event.AddRSVP")
-
-	if !e.HasUser(u) {
-		return errors.E(op, errors.Str("user not in event"), http.StatusUnauthorized)
-	}
-
-	// Cannot add owner or duplicate.
-	if e.OwnerIs(u) || e.HasRSVP(u) {
-		return errors.E(op,
-			errors.Str("already has rsvp"),
-			map[string]string{"message": "You have already RSVP'd"},
-			http.StatusBadRequest)
+func (e *Event) GetEmail() string {
+	slugified := slug.Make(e.Name)
+	if len(slugified) > 20 {
+		slugified = slugified[:20]
 	}
-
-	e.RSVPKeys = append(e.RSVPKeys, u.Key)
-	e.RSVPs = append(e.RSVPs, MapUserToUserPartial(u))
-	e.SetReads([]*Read{})
-
-	return nil
+	return fmt.Sprintf("%s-%d@mail.convo.events", slugified, e.Int64ID)
 }
 
-func (e *Event) RemoveRSVP(u *User) error {
-	op := errors.Op("event.RemoveRSVP")
-
-	if !e.HasUser(u) {
-		return errors.E(op, errors.Str("no permission"), http.StatusNotFound)
-	}
+// GetOrganizerEmail returns the address of the ORGANIZER of the event in
+// calendars. Unlike GetEmail, it does not change when the event is renamed,
+// since calendars only apply updates from the organizer of the entry.
+func (e *Event) GetOrganizerEmail() string {
+	return fmt.Sprintf("%s%d@mail.convo.events", organizerEmailPrefix, e.Int64ID)
+}
 
-	if e.OwnerIs(u) {
-		return errors.E(op,
-			map[string]string{"message": "You cannot remove yourself from your own event"},
-			errors.Str("user cannot remove herself"),
-			http.StatusBadRequest)
-	}
+// organizerEmailPrefix starts the local part of organizer addresses. The plus
+// keeps them apart from thread addresses, whose IDs follow a hyphen.
+const organizerEmailPrefix = "event+"
 
-	// Remove from keys.
-	for i, k := range e.RSVPKeys {
-		if k.Equal(u.Key) {
-			e.RSVPKeys[i] = e.RSVPKeys[len(e.RSVPKeys)-1]
-			e.RSVPKeys = e.RSVPKeys[:len(e.RSVPKeys)-1]
-			break
-		}
+// EventInt64IDFromOrganizerEmail returns the Int64ID of the event whose
+// organizer address is addr. It reports false when addr is not one.
+func EventInt64IDFromOrganizerEmail(addr string) (int64, bool) {
+	parts := strings.Split(strings.ToLower(addr), "@")
+	if len(parts) != 2 || parts[1] != "mail.convo.events" ||
+		!strings.HasPrefix(parts[0], organizerEmailPrefix) {
+		return 0, false
 	}
 
-	// Remove from partials.
-	for i, c := range e.RSVPs {
-		if c.ID == u.ID {
-			e.RSVPs[i] = e.RSVPs[len(e.RSVPs)-1]
-			e.RSVPs = e.RSVPs[:len(e.RSVPs)-1]
-			break
-		}
+	id, err := strconv.ParseInt(strings.TrimPrefix(parts[0], organizerEmailPrefix), 10, 64)
+	if err != nil {
+		return 0, false
 	}
 
-	return nil
-}
-
-func (e *Event) GetEmail() string {
-	slugified := slug.Make(e.Name)
-	if len(slugified) > 20 {
-		slugified = slugified[:20]
-	}
-	return fmt.Sprintf("%s-%d@mail.convo.events", slugified, e.Key.ID)
+	return id, true
 }
 
+// IsInFuture reports whether any occurrence of the event is yet to start.
 func (e *Event) IsInFuture() bool {
-	return e.Timestamp.After(time.Now())
+	_, ok := e.NextOccurrence(time.Now())
+	return ok
 }
 
 func (e *Event) IsUpcoming() bool {
@@ -422,23 +387,156 @@ func (e *Event) IsUpcoming() bool {
 	windowStart := time.Now().Add(start)
 	windowEnd := time.Now().Add(end)
 
-	return e.Timestamp.After(windowStart) && e.Timestamp.Before(windowEnd)
+	next, ok := e.NextOccurrence(windowStart)
+
+	return ok && next.Before(windowEnd)
 }
 
+// GetICS returns the event as an iCalendar file that can be imported into
+// calendars.
 func (e *Event) GetICS() string {
+	cal, _ := e.icalendar()
+	return cal.Serialize()
+}
+
+// GetInvitationICS returns the event as an iTIP message for the user, which
+// lets calendars add the event and update it in place when it changes or is
+// cancelled. It includes the response of the user.
+func (e *Event) GetInvitationICS(u *User) string {
+	cal, ev := e.icalendar()
+
+	if e.IsCancelled() {
+		cal.SetMethod(ics.MethodCancel)
+	} else {
+		cal.SetMethod(ics.MethodRequest)
+	}
+
+	ev.AddAttendee(u.Email,
+		ics.WithCN(u.FullName),
+		&ics.KeyValues{Key: string(ics.ParameterRole), Value: []string{"REQ-PARTICIPANT"}},
+		e.partStat(u),
+		&ics.KeyValues{Key: string(ics.ParameterRsvp), Value: []string{"TRUE"}})
+
+	return cal.Serialize()
+}
+
+// ParseInvitationReply returns the ID of the event that an iTIP REPLY to an
+// invitation from GetInvitationICS is about, along with the RSVP status that
+// the attendee with the given email gave in it. Replies about single
+// occurrences of recurring events are not supported.
+func ParseInvitationReply(raw, email string) (ID, string, error) {
+	op := errors.Op("model.ParseInvitationReply")
+
+	cal, err := ics.ParseCalendar(strings.NewReader(raw))
+	if err != nil {
+		return "", "", errors.E(op, err, http.StatusBadRequest)
+	}
+
+	var method string
+	for _, p := range cal.CalendarProperties {
+		if p.IANAToken == string(ics.PropertyMethod) {
+			method = p.Value
+		}
+	}
+
+	if !strings.EqualFold(method, string(ics.MethodReply)) {
+		return "", "", errors.E(op, errors.Errorf("method %q is not a reply", method), http.StatusBadRequest)
+	}
+
+	for _, ev := range cal.Events() {
+		if ev.GetProperty(ics.ComponentProperty(ics.PropertyRecurrenceId)) != nil {
+			continue
+		}
+
+		for _, a := range ev.Attendees() {
+			// Some calendars write the scheme in upper case.
+			if strings.TrimPrefix(strings.ToLower(a.Value), "mailto:") != strings.ToLower(email) {
+				continue
+			}
+
+			switch a.ParticipationStatus() {
+			case ics.ParticipationStatusAccepted:
+				return ID(ev.Id()), RSVPGoing, nil
+			case ics.ParticipationStatusTentative:
+				return ID(ev.Id()), RSVPMaybe, nil
+			case ics.ParticipationStatusDeclined:
+				return ID(ev.Id()), RSVPDeclined, nil
+			default:
+				return "", "", errors.E(op,
+					errors.Errorf("participation status %q", a.ParticipationStatus()),
+					http.StatusBadRequest)
+			}
+		}
+	}
+
+	return "", "", errors.E(op, errors.Str("no reply from attendee"), http.StatusBadRequest)
+}
+
+// icalendar returns the event as a calendar, along with the VEVENT of the
+// event in it. Its UID is the ID of the event, and its SEQUENCE goes up
+// whenever the event changes in a way that guests need to know about.
+func (e *Event) icalendar() (*ics.Calendar, *ics.VEvent) {
 	cal := ics.NewCalendar()
 
-	ev := cal.AddEvent(e.ID)
+	ev := cal.AddEvent(e.ID.String())
 
+	ev.SetDtStampTime(time.Now())
 	ev.SetCreatedTime(e.CreatedAt)
-	ev.SetStartAt(e.Timestamp)
-	ev.SetEndAt(e.Timestamp.Add(time.Hour))
+	ev.SetModifiedAt(e.UpdatedAt)
+	ev.SetProperty(ics.ComponentPropertyDtStart, e.icalTime(e.Timestamp), e.icalParams()...)
+	ev.SetProperty(ics.ComponentPropertyDtEnd, e.icalTime(e.endOf(e.Timestamp.In(e.location()))), e.icalParams()...)
 	ev.SetSummary(e.Name)
 	ev.SetLocation(e.Address)
 	ev.SetDescription(e.Description)
-	ev.SetOrganizer(e.GetEmail(), ics.WithCN(e.Owner.FullName))
+	ev.SetOrganizer("mailto:"+e.GetOrganizerEmail(), ics.WithCN(e.Owner.FullName))
+	ev.SetProperty(ics.ComponentProperty(ics.PropertySequence), strconv.Itoa(e.Sequence))
 
-	return cal.Serialize()
+	if e.IsCancelled() {
+		ev.SetStatus(ics.ObjectStatusCancelled)
+	} else {
+		ev.SetStatus(ics.ObjectStatusConfirmed)
+	}
+
+	if e.IsRecurring() {
+		ev.AddProperty(ics.ComponentProperty(ics.PropertyRrule), e.Recurrence.rrule(e.icalUTCTime))
+
+		if len(e.Recurrence.Exceptions) > 0 {
+			ev.AddProperty(ics.ComponentProperty(ics.PropertyExdate), e.Recurrence.exdate(e.icalTime), e.icalParams()...)
+		}
+	}
+
+	// Calendars need the time zone to place times that are given in it.
+	if e.TimeZone != "" && !e.AllDay {
+		cal.Components = append([]ics.Component{e.vtimezone()}, cal.Components...)
+	}
+
+	return cal, ev
+}
+
+// partStat returns the participation status of the user in the event. Users
+// who are waitlisted have not been let in yet, so they still need to act.
+func (e *Event) partStat(u *User) ics.ParticipationStatus {
+	r := e.GetRSVP(u)
+	if r == nil {
+		return ics.ParticipationStatusNeedsAction
+	}
+
+	switch r.Status {
+	case RSVPGoing:
+		return ics.ParticipationStatusAccepted
+	case RSVPMaybe:
+		return ics.ParticipationStatusTentative
+	case RSVPDeclined:
+		return ics.ParticipationStatusDeclined
+	default:
+		return ics.ParticipationStatusNeedsAction
+	}
+}
+
+// Revise records that the event changed in a way that its guests need to
+// know about, so that their calendars replace the copies they have.
+func (e *Event) Revise() {
+	e.Sequence++
 }
 
 func (e *Event) RollToken() {
@@ -446,18 +544,18 @@ func (e *Event) RollToken() {
 }
 
 func (e *Event) GetInviteMagicLink(m magic.Client) string {
-	return m.NewLink(e.Key, e.Token, "invite")
+	return m.NewLink(e.ID.String(), e.Token, "invite")
 }
 
 func (e *Event) VerifyInviteMagicLink(m magic.Client, ts, sig string) error {
-	return m.Verify(e.ID, ts, e.Token, sig)
+	return m.Verify(e.ID.String(), ts, e.Token, sig)
 }
 
 func (e *Event) GetRSVPMagicLink(m magic.Client, u *User) string {
 	return m.NewLink(
-		u.Key,
+		u.ID.String(),
 		e.Token+strconv.FormatBool(!e.IsInFuture()),
-		fmt.Sprintf("rsvp/%s", e.Key.Encode()))
+		fmt.Sprintf("rsvp/%s", e.ID))
 }
 
 func (e *Event) VerifyRSVPMagicLink(m magic.Client, userID, ts, sig string) error {
@@ -468,7 +566,7 @@ func (e *Event) SendInvitesAsync(ctx context.Context, q queue.Client) error {
 	return q.PutEmail(ctx, queue.EmailPayload{
 		Type:   queue.Event,
 		Action: queue.SendInvites,
-		IDs:    []string{e.ID},
+		IDs:    []string{e.ID.String()},
 	})
 }
 
@@ -476,13 +574,21 @@ func (e *Event) SendUpdatedInvitesAsync(ctx context.Context, q queue.Client) err
 	return q.PutEmail(ctx, queue.EmailPayload{
 		Type:   queue.Event,
 		Action: queue.SendUpdatedInvites,
-		IDs:    []string{e.ID},
+		IDs:    []string{e.ID.String()},
+	})
+}
+
+func (e *Event) SendCancellationAsync(ctx context.Context, q queue.Client) error {
+	return q.PutEmail(ctx, queue.EmailPayload{
+		Type:   queue.Event,
+		Action: queue.SendCancellation,
+		IDs:    []string{e.ID.String()},
 	})
 }
 
-func IsHostsDifferent(eventHosts []*datastore.Key, payloadHosts []*User) bool {
+func IsHostsDifferent(eventHosts []ID, payloadHosts []*User) bool {
 	for i := range eventHosts {
-		target := eventHosts[i].Encode()
+		target := eventHosts[i]
 		seen := false
 		for j := range payloadHosts {
 			if payloadHosts[j].ID == target {
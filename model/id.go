@@ -0,0 +1,51 @@
+package model
+
+// ID identifies an entity. It is opaque outside of the stores, which
+// convert it to and from whatever their backend uses as keys. Its string
+// form is what the API exposes.
+type ID string
+
+// String returns the string form of the ID.
+func (id ID) String() string {
+	return string(id)
+}
+
+// IsZero reports whether the ID is empty, which is the case for entities
+// that have not been saved yet.
+func (id ID) IsZero() bool {
+	return id == ""
+}
+
+// hasID reports whether ids contains id.
+func hasID(ids []ID, id ID) bool {
+	for i := range ids {
+		if ids[i] == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeID removes the first occurrence of id from ids without preserving
+// the order of the remaining IDs.
+func removeID(ids []ID, id ID) []ID {
+	for i := range ids {
+		if ids[i] == id {
+			ids[i] = ids[len(ids)-1]
+			return ids[:len(ids)-1]
+		}
+	}
+
+	return ids
+}
+
+// IDStrings returns the string forms of ids.
+func IDStrings(ids []ID) []string {
+	out := make([]string, len(ids))
+	for i := range ids {
+		out[i] = ids[i].String()
+	}
+
+	return out
+}
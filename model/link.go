@@ -0,0 +1,43 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	og "github.com/hiconvo/api/clients/opengraph"
+)
+
+// LinkPreview is a cached link preview of a normalized URL, by which it is
+// stored. Failed fetches are cached too so that broken links are not
+// requested over and over again.
+type LinkPreview struct {
+	URL       string       `json:"url" datastore:",noindex"`
+	Link      *og.LinkData `json:"link" datastore:",noindex"`
+	Failed    bool         `json:"-"`
+	FetchedAt time.Time    `json:"-"`
+	ExpiresAt time.Time    `json:"-"`
+	// RequestedAt is roughly when the preview was last asked for. Previews
+	// that nobody asks for are evicted instead of being refreshed.
+	RequestedAt time.Time `json:"-" datastore:",noindex"`
+}
+
+type LinkPreviewStore interface {
+	GetLinkPreviewByURL(ctx context.Context, url string) (*LinkPreview, bool, error)
+	GetExpiredLinkPreviews(ctx context.Context, before time.Time, limit int) ([]*LinkPreview, error)
+	Commit(ctx context.Context, p *LinkPreview) error
+	Delete(ctx context.Context, p *LinkPreview) error
+}
+
+func (p *LinkPreview) IsExpired() bool {
+	return time.Now().After(p.ExpiresAt)
+}
+
+// LastRequestedAt returns when the preview was last asked for. Previews that
+// were cached before this was recorded count from when they were fetched.
+func (p *LinkPreview) LastRequestedAt() time.Time {
+	if p.RequestedAt.IsZero() {
+		return p.FetchedAt
+	}
+
+	return p.RequestedAt
+}
@@ -3,42 +3,38 @@ package model
 import (
 	"context"
 
-	"cloud.google.com/go/datastore"
-
 	"github.com/hiconvo/api/clients/db"
 )
 
-func swapKeys(keyList []*datastore.Key, oldKey, newKey *datastore.Key) []*datastore.Key {
-	for i := range keyList {
-		if keyList[i].Equal(oldKey) {
-			keyList[i] = newKey
+func swapIDs(ids []ID, oldID, newID ID) []ID {
+	for i := range ids {
+		if ids[i] == oldID {
+			ids[i] = newID
 		}
 	}
 
 	// Remove duplicates
-	var clean []*datastore.Key
-	seen := map[string]struct{}{}
-	for i := range keyList {
-		keyString := keyList[i].String()
-		if _, hasVal := seen[keyString]; !hasVal {
-			seen[keyString] = struct{}{}
-			clean = append(clean, keyList[i])
+	var clean []ID
+	seen := map[ID]struct{}{}
+	for i := range ids {
+		if _, hasVal := seen[ids[i]]; !hasVal {
+			seen[ids[i]] = struct{}{}
+			clean = append(clean, ids[i])
 		}
 	}
 
 	return clean
 }
 
-func swapReadUserKeys(readList []*Read, oldKey, newKey *datastore.Key) []*Read {
+func swapReadUserIDs(readList []*Read, oldID, newID ID) []*Read {
 	var clean []*Read
-	seen := map[string]struct{}{}
+	seen := map[ID]struct{}{}
 	for i := range readList {
-		keyString := readList[i].UserKey.String()
-		if _, isSeen := seen[keyString]; !isSeen {
-			seen[keyString] = struct{}{}
+		if _, isSeen := seen[readList[i].UserID]; !isSeen {
+			seen[readList[i].UserID] = struct{}{}
 
-			if readList[i].UserKey.Equal(oldKey) {
-				readList[i].UserKey = newKey
+			if readList[i].UserID == oldID {
+				readList[i].UserID = newID
 			}
 
 			clean = append(clean, readList[i])
@@ -48,22 +44,59 @@ func swapReadUserKeys(readList []*Read, oldKey, newKey *datastore.Key) []*Read {
 	return clean
 }
 
-func mergeContacts(a, b []*datastore.Key) []*datastore.Key {
-	var all []*datastore.Key
+// swapRSVPUserIDs reassigns the response of the user with oldID, dropping it
+// if the user with newID responded too.
+func swapRSVPUserIDs(rsvps []*RSVP, oldID, newID ID) []*RSVP {
+	var clean []*RSVP
+	seen := map[ID]struct{}{}
+	for i := range rsvps {
+		if rsvps[i].UserID == oldID {
+			rsvps[i].UserID = newID
+		}
+
+		if _, isSeen := seen[rsvps[i].UserID]; !isSeen {
+			seen[rsvps[i].UserID] = struct{}{}
+			clean = append(clean, rsvps[i])
+		}
+	}
+
+	return clean
+}
+
+// swapOccurrenceRSVPUserIDs reassigns the occurrence RSVPs of the user with
+// oldID, dropping those to occurrences that the user with newID RSVP'd to.
+func swapOccurrenceRSVPUserIDs(rsvps []*OccurrenceRSVP, oldID, newID ID) []*OccurrenceRSVP {
+	var clean []*OccurrenceRSVP
+	seen := map[string]struct{}{}
+	for i := range rsvps {
+		if rsvps[i].UserID == oldID {
+			rsvps[i].UserID = newID
+		}
+
+		key := rsvps[i].UserID.String() + rsvps[i].Start.UTC().String()
+		if _, isSeen := seen[key]; !isSeen {
+			seen[key] = struct{}{}
+			clean = append(clean, rsvps[i])
+		}
+	}
+
+	return clean
+}
+
+func mergeIDs(a, b []ID) []ID {
+	var all []ID
 	all = append(all, a...)
 	all = append(all, b...)
 
-	var merged []*datastore.Key
-	seen := make(map[string]struct{})
+	var merged []ID
+	seen := make(map[ID]struct{})
 
 	for i := range all {
-		keyString := all[i].String()
-
-		if _, isSeen := seen[keyString]; isSeen {
+		if _, isSeen := seen[all[i]]; isSeen {
 			continue
 		}
 
-		seen[keyString] = struct{}{}
+		seen[all[i]] = struct{}{}
 		merged = append(merged, all[i])
 	}
 
@@ -82,15 +115,10 @@ func reassignContacts(
 	}
 
 	for i := range users {
-		users[i].ContactKeys = swapKeys(users[i].ContactKeys, oldUser.Key, newUser.Key)
+		users[i].ContactIDs = swapIDs(users[i].ContactIDs, oldUser.ID, newUser.ID)
 	}
 
-	_, err = tx.PutMulti(MapUsersToKeys(users), users)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return us.CommitMultiWithTransaction(tx, users)
 }
 
 func reassignMessageUsers(
@@ -104,21 +132,14 @@ func reassignMessageUsers(
 		return err
 	}
 
-	// Reassign ownership of messages and save keys to oldUserMessageKeys slice
-	userMessageKeys := make([]*datastore.Key, len(userMessages))
+	// Reassign ownership of messages
 	for i := range userMessages {
-		userMessages[i].UserKey = newUser.Key
-		userMessages[i].Reads = swapReadUserKeys(userMessages[i].Reads, old.Key, newUser.Key)
-		userMessageKeys[i] = userMessages[i].Key
+		userMessages[i].UserID = newUser.ID
+		userMessages[i].Reads = swapReadUserIDs(userMessages[i].Reads, old.ID, newUser.ID)
 	}
 
 	// Save the messages
-	_, err = tx.PutMulti(userMessageKeys, userMessages)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return ms.CommitMultiWithTransaction(tx, userMessages)
 }
 
 func reassignThreadUsers(
@@ -132,26 +153,18 @@ func reassignThreadUsers(
 		return err
 	}
 
-	// Reassign ownership of threads and save keys to oldUserThreadKeys slice
-	userThreadKeys := make([]*datastore.Key, len(userThreads))
+	// Reassign ownership of threads
 	for i := range userThreads {
-		userThreads[i].UserKeys = swapKeys(userThreads[i].UserKeys, old.Key, newUser.Key)
-		userThreads[i].Reads = swapReadUserKeys(userThreads[i].Reads, old.Key, newUser.Key)
+		userThreads[i].UserIDs = swapIDs(userThreads[i].UserIDs, old.ID, newUser.ID)
+		userThreads[i].Reads = swapReadUserIDs(userThreads[i].Reads, old.ID, newUser.ID)
 
-		if userThreads[i].OwnerKey.Equal(old.Key) {
-			userThreads[i].OwnerKey = newUser.Key
+		if userThreads[i].OwnerID == old.ID {
+			userThreads[i].OwnerID = newUser.ID
 		}
-
-		userThreadKeys[i] = userThreads[i].Key
 	}
 
 	// Save the threads
-	_, err = tx.PutMulti(userThreadKeys, userThreads)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return ts.CommitMultiWithTransaction(tx, userThreads)
 }
 
 func reassignEventUsers(
@@ -165,27 +178,20 @@ func reassignEventUsers(
 		return err
 	}
 
-	// Reassign ownership of events and save keys to userEvetKeys slice
-	userEventKeys := make([]*datastore.Key, len(userEvents))
+	// Reassign ownership of events
 	for i := range userEvents {
-		userEvents[i].UserKeys = swapKeys(userEvents[i].UserKeys, old.Key, newUser.Key)
-		userEvents[i].RSVPKeys = swapKeys(userEvents[i].RSVPKeys, old.Key, newUser.Key)
-		userEvents[i].Reads = swapReadUserKeys(userEvents[i].Reads, old.Key, newUser.Key)
+		userEvents[i].UserIDs = swapIDs(userEvents[i].UserIDs, old.ID, newUser.ID)
+		userEvents[i].Responses = swapRSVPUserIDs(userEvents[i].Responses, old.ID, newUser.ID)
+		userEvents[i].Reads = swapReadUserIDs(userEvents[i].Reads, old.ID, newUser.ID)
+		userEvents[i].OccurrenceRSVPs = swapOccurrenceRSVPUserIDs(userEvents[i].OccurrenceRSVPs, old.ID, newUser.ID)
 
-		if userEvents[i].OwnerKey.Equal(old.Key) {
-			userEvents[i].OwnerKey = newUser.Key
+		if userEvents[i].OwnerID == old.ID {
+			userEvents[i].OwnerID = newUser.ID
 		}
-
-		userEventKeys[i] = userEvents[i].Key
 	}
 
 	// Save the events
-	_, err = tx.PutMulti(userEventKeys, userEvents)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return es.CommitMultiWithTransaction(tx, userEvents)
 }
 
 func reassignNoteUsers(
@@ -199,16 +205,9 @@ func reassignNoteUsers(
 		return err
 	}
 
-	keys := make([]*datastore.Key, len(notes))
 	for i := range notes {
-		notes[i].OwnerKey = newUser.Key
-		keys[i] = notes[i].Key
-	}
-
-	_, err = tx.PutMulti(keys, notes)
-	if err != nil {
-		return err
+		notes[i].OwnerID = newUser.ID
 	}
 
-	return nil
+	return ns.CommitMultiWithTransaction(tx, notes)
 }
@@ -6,33 +6,35 @@ import (
 	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
-
+	"github.com/hiconvo/api/clients/db"
 	og "github.com/hiconvo/api/clients/opengraph"
 	"github.com/hiconvo/api/clients/storage"
 	"github.com/hiconvo/api/errors"
 )
 
 type Message struct {
-	Key       *datastore.Key `json:"-"        datastore:"__key__"`
-	ID        string         `json:"id"       datastore:"-"`
-	UserKey   *datastore.Key `json:"-"`
+	ID        ID             `json:"id"       datastore:"-"`
+	UserID    ID             `json:"-"        datastore:"UserKey"`
 	User      *UserPartial   `json:"user"     datastore:"-"`
-	ParentKey *datastore.Key `json:"-"`
-	ParentID  string         `json:"parentId" datastore:"-"`
+	ParentID  ID             `json:"parentId" datastore:"ParentKey"`
 	Body      string         `json:"body"     datastore:",noindex"`
 	CreatedAt time.Time      `json:"createdAt"`
 	Reads     []*Read        `json:"-"        datastore:",noindex"`
-	PhotoKeys []string       `json:"photos"`
+	PhotoKeys []string       `json:"-"`
+	Photos    []string       `json:"photos"   datastore:"-"`
 	Link      *og.LinkData   `json:"link"     datastore:",noindex"`
+	Links     []*og.LinkData `json:"links"    datastore:",noindex"`
+	DeletedAt time.Time      `json:"-"`
 }
 
 type GetMessagesOption func(m map[string]interface{})
 
 type MessageStore interface {
-	GetMessageByID(ctx context.Context, id string) (*Message, error)
-	GetMessagesByKey(ctx context.Context,
-		k *datastore.Key, p *Pagination, o ...GetMessagesOption) ([]*Message, error)
+	GetMessageByID(ctx context.Context, id ID) (*Message, error)
+	GetDeletedMessageByID(ctx context.Context, id ID) (*Message, error)
+	GetMessagesDeletedBefore(ctx context.Context, t time.Time) ([]*Message, error)
+	GetMessagesByParent(ctx context.Context,
+		parentID ID, p *Pagination, o ...GetMessagesOption) ([]*Message, error)
 	GetMessagesByThread(ctx context.Context,
 		t *Thread, p *Pagination, o ...GetMessagesOption) ([]*Message, error)
 	GetMessagesByEvent(ctx context.Context,
@@ -41,12 +43,15 @@ type MessageStore interface {
 		u *User, p *Pagination, o ...GetMessagesOption) ([]*Message, error)
 	Commit(ctx context.Context, t *Message) error
 	CommitMulti(ctx context.Context, messages []*Message) error
+	CommitMultiWithTransaction(tx db.Transaction, messages []*Message) error
 	Delete(ctx context.Context, t *Message) error
+	Restore(ctx context.Context, m *Message) error
+	Purge(ctx context.Context, m *Message) error
 }
 
 type NewMessageInput struct {
 	User   *User
-	Parent *datastore.Key
+	Parent ID
 	Body   string
 	Blob   string
 }
@@ -60,70 +65,38 @@ func NewMessage(
 	var (
 		op       = errors.Op("model.NewThreadMessage")
 		ts       = time.Now()
-		photoURL string
+		photoKey string
 		err      error
 	)
 
-	link, photoURL, err := handleLinkAndPhoto(
+	links, photoKey, err := handleLinkAndPhoto(
 		ctx, sclient, ogclient, input.Parent, input.Body, input.Blob)
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
 
 	message := Message{
-		Key:       datastore.IncompleteKey("Message", nil),
-		UserKey:   input.User.Key,
+		UserID:    input.User.ID,
 		User:      MapUserToUserPartial(input.User),
-		ParentKey: input.Parent,
-		ParentID:  input.Parent.Encode(),
-		Body:      removeLink(input.Body, link),
+		ParentID:  input.Parent,
+		Body:      removeLinks(input.Body, links),
 		CreatedAt: ts,
-		Link:      link,
-	}
-
-	if photoURL != "" {
-		message.PhotoKeys = []string{photoURL}
+		Link:      firstLink(links),
+		Links:     links,
 	}
 
-	MarkAsRead(&message, input.User.Key)
-
-	return &message, nil
-}
-
-func (m *Message) LoadKey(k *datastore.Key) error {
-	m.Key = k
-
-	// Add URL safe key
-	if k != nil {
-		m.ID = k.Encode()
-	}
-
-	return nil
-}
-
-func (m *Message) Save() ([]datastore.Property, error) {
-	return datastore.SaveStruct(m)
-}
-
-func (m *Message) Load(ps []datastore.Property) error {
-	op := errors.Op("message.Load")
-
-	if err := datastore.LoadStruct(m, ps); err != nil {
-		return errors.E(op, err)
-	}
+	if photoKey != "" {
+		message.PhotoKeys = []string{photoKey}
 
-	for _, p := range ps {
-		if p.Name == "ParentKey" {
-			k, ok := p.Value.(*datastore.Key)
-			if !ok {
-				return errors.E(op, errors.Errorf("could not load parent key into message='%v'", m.Key.ID))
-			}
-			m.ParentKey = k
-			m.ParentID = k.Encode()
+		message.Photos, err = sclient.GetPhotoURLs(ctx, message.PhotoKeys)
+		if err != nil {
+			return nil, errors.E(op, err)
 		}
 	}
 
-	return nil
+	MarkAsRead(&message, input.User.ID)
+
+	return &message, nil
 }
 
 func (m *Message) GetReads() []*Read {
@@ -139,11 +112,21 @@ func (m *Message) HasPhoto() bool {
 }
 
 func (m *Message) HasLink() bool {
-	return m.Link != nil
+	return m.Link != nil || len(m.Links) > 0
+}
+
+// GetLinks returns the link previews of the message. Messages created
+// before multiple previews were supported only have Link set.
+func (m *Message) GetLinks() []*og.LinkData {
+	if len(m.Links) == 0 && m.Link != nil {
+		return []*og.LinkData{m.Link}
+	}
+
+	return m.Links
 }
 
 func (m *Message) OwnerIs(u *User) bool {
-	return m.UserKey.Equal(u.Key)
+	return m.UserID == u.ID
 }
 
 func (m *Message) HasPhotoKey(key string) bool {
@@ -160,17 +143,17 @@ func MarkMessagesAsRead(
 	ctx context.Context,
 	s MessageStore,
 	u *User,
-	parentKey *datastore.Key,
+	parentID ID,
 ) error {
 	op := errors.Op("model.MarkMessagesAsRead")
 
-	messages, err := s.GetMessagesByKey(ctx, parentKey, &Pagination{Size: 50})
+	messages, err := s.GetMessagesByParent(ctx, parentID, &Pagination{Size: 50})
 	if err != nil {
 		return errors.E(op, err)
 	}
 
 	for i := range messages {
-		MarkAsRead(messages[i], u.Key)
+		MarkAsRead(messages[i], u.ID)
 	}
 
 	err = s.CommitMulti(ctx, messages)
@@ -181,6 +164,14 @@ func MarkMessagesAsRead(
 	return nil
 }
 
+func removeLinks(body string, links []*og.LinkData) string {
+	for i := range links {
+		body = removeLink(body, links[i])
+	}
+
+	return body
+}
+
 func removeLink(body string, linkPtr *og.LinkData) string {
 	if linkPtr == nil {
 		return body
@@ -195,27 +186,37 @@ func removeLink(body string, linkPtr *og.LinkData) string {
 	return strings.Replace(body, linkPtr.Original, "", 1)
 }
 
+// firstLink returns the first of the given links. It is used to keep the
+// Link field populated for older clients.
+func firstLink(links []*og.LinkData) *og.LinkData {
+	if len(links) == 0 {
+		return nil
+	}
+
+	return links[0]
+}
+
 func handleLinkAndPhoto(
 	ctx context.Context,
 	sclient *storage.Client,
 	ogclient og.Client,
-	key *datastore.Key,
+	id ID,
 	body, blob string,
-) (*og.LinkData, string, error) {
+) ([]*og.LinkData, string, error) {
 	var (
 		op       = errors.Op("model.handleLinkAndPhoto")
-		photoURL string
+		photoKey string
 		err      error
 	)
 
 	if blob != "" {
-		photoURL, err = sclient.PutPhotoFromBlob(ctx, key.Encode(), blob)
+		photoKey, err = sclient.PutPhotoFromBlob(ctx, id.String(), blob)
 		if err != nil {
 			return nil, "", errors.E(op, err)
 		}
 	}
 
-	link := ogclient.Extract(ctx, body)
+	links := og.ExtractAll(ctx, ogclient, body)
 
-	return link, photoURL, nil
+	return links, photoKey, nil
 }
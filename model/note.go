@@ -6,34 +6,40 @@ import (
 	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
-
+	"github.com/hiconvo/api/clients/db"
 	"github.com/hiconvo/api/errors"
 	"github.com/hiconvo/api/valid"
 )
 
 type Note struct {
-	Key       *datastore.Key `json:"-"        datastore:"__key__"`
-	ID        string         `json:"id"       datastore:"-"`
-	OwnerKey  *datastore.Key `json:"-"`
-	Body      string         `json:"body"     datastore:",noindex"`
-	Tags      []string       `json:"tags"`
-	URL       string         `json:"url"`
-	Favicon   string         `json:"favicon"  datastore:",noindex"`
-	Name      string         `json:"name"`
-	Pin       bool           `json:"pin"`
-	Variant   string         `json:"variant"`
-	CreatedAt time.Time      `json:"createdAt"`
-	UpdatedAt time.Time      `json:"updatedAt"`
+	ID        ID        `json:"id"       datastore:"-"`
+	OwnerID   ID        `json:"-"        datastore:"OwnerKey"`
+	Body      string    `json:"body"     datastore:",noindex"`
+	Tags      []string  `json:"tags"`
+	URL       string    `json:"url"`
+	Favicon   string    `json:"favicon"  datastore:",noindex"`
+	Name      string    `json:"name"`
+	Pin       bool      `json:"pin"`
+	Variant   string    `json:"variant"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Version   int64     `json:"-"        datastore:",noindex"`
+	DeletedAt time.Time `json:"-"`
 }
 
 type GetNotesOption func(m map[string]interface{})
 
 type NoteStore interface {
-	GetNoteByID(ctx context.Context, id string) (*Note, error)
+	GetNoteByID(ctx context.Context, id ID) (*Note, error)
+	GetDeletedNoteByID(ctx context.Context, id ID) (*Note, error)
+	GetNotesDeletedBefore(ctx context.Context, t time.Time) ([]*Note, error)
 	GetNotesByUser(ctx context.Context, u *User, p *Pagination, o ...GetNotesOption) ([]*Note, error)
 	Commit(ctx context.Context, n *Note) error
+	CommitMultiWithTransaction(tx db.Transaction, notes []*Note) error
 	Delete(ctx context.Context, n *Note) error
+	Restore(ctx context.Context, n *Note) error
+	Purge(ctx context.Context, n *Note) error
+	IterAll(ctx context.Context) db.Iterator
 }
 
 func NewNote(u *User, name, url, favicon, body string) (*Note, error) {
@@ -79,8 +85,7 @@ func NewNote(u *User, name, url, favicon, body string) (*Note, error) {
 	}
 
 	return &Note{
-		Key:       datastore.IncompleteKey("Note", nil),
-		OwnerKey:  u.Key,
+		OwnerID:   u.ID,
 		Name:      name,
 		URL:       url,
 		Favicon:   favicon,
@@ -90,21 +95,9 @@ func NewNote(u *User, name, url, favicon, body string) (*Note, error) {
 	}, nil
 }
 
-func (n *Note) LoadKey(k *datastore.Key) error {
-	n.Key = k
-
-	// Add URL safe key
-	n.ID = k.Encode()
-
-	return nil
-}
-
-func (n *Note) Save() ([]datastore.Property, error) {
-	return datastore.SaveStruct(n)
-}
-
-func (n *Note) Load(ps []datastore.Property) error {
-	return datastore.LoadStruct(n, ps)
+// ETag returns the entity tag of the current version of the note.
+func (n *Note) ETag() string {
+	return etag(n.Version)
 }
 
 func (n *Note) AddTag(tag string) {
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/random"
+)
+
+type OutboxMessageType string
+
+const (
+	// OutboxNotification delivers a notification.Notification.
+	OutboxNotification OutboxMessageType = "notification"
+	// OutboxEmail enqueues a queue.EmailPayload.
+	OutboxEmail OutboxMessageType = "email"
+	// OutboxSearch updates the search document of the entity whose ID is
+	// the payload.
+	OutboxSearch OutboxMessageType = "search"
+)
+
+// OutboxMessage is a side effect that is recorded along with the change that
+// causes it, in the same transaction, and delivered afterwards. Messages are
+// deleted once they have been delivered and retried with a backoff until
+// then, which makes delivery at least once.
+type OutboxMessage struct {
+	// ID is random so that messages can be stored, and deleted after a
+	// transaction, without waiting for IDs to be allocated.
+	ID            string `datastore:"-"`
+	Type          OutboxMessageType
+	Payload       string `datastore:",noindex"`
+	Attempts      int    `datastore:",noindex"`
+	LastError     string `datastore:",noindex"`
+	Failed        bool
+	CreatedAt     time.Time
+	NextAttemptAt time.Time
+}
+
+// NewOutboxMessage returns a message of type t with the JSON representation
+// of payload.
+func NewOutboxMessage(t OutboxMessageType, payload interface{}) (*OutboxMessage, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OutboxMessage{
+		ID:        random.Token(),
+		Type:      t,
+		Payload:   string(b),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// NewSearchOutboxMessage returns a message that updates the search document
+// of the entity with the given ID.
+func NewSearchOutboxMessage(id ID) (*OutboxMessage, error) {
+	return NewOutboxMessage(OutboxSearch, id)
+}
+
+type OutboxStore interface {
+	// GetDueOutboxMessages returns the messages that have not failed for good
+	// and are due to be delivered before the given time.
+	GetDueOutboxMessages(ctx context.Context, before time.Time, limit int) ([]*OutboxMessage, error)
+	Commit(ctx context.Context, m *OutboxMessage) error
+	CommitWithTransaction(tx db.Transaction, m *OutboxMessage) error
+	Delete(ctx context.Context, m *OutboxMessage) error
+}
+
+// Outbox records messages and delivers them once the changes that caused
+// them have been saved.
+type Outbox interface {
+	// Enqueue records m in the pending transaction of ctx and delivers it
+	// once the transaction has been committed. Without a pending
+	// transaction, m is saved and delivered right away.
+	Enqueue(ctx context.Context, m *OutboxMessage) error
+	// EnqueueWithTransaction records m in tx and delivers it once tx has
+	// been committed.
+	EnqueueWithTransaction(tx db.Transaction, m *OutboxMessage) error
+}
+
+// SearchIndexer brings the search document of an entity up to date with
+// the entity in the database.
+type SearchIndexer interface {
+	// UpdateSearchIndex indexes the entity with the given ID or removes
+	// its document if it no longer exists or should not be searchable.
+	UpdateSearchIndex(ctx context.Context, id ID) error
+}
@@ -1,13 +1,9 @@
 package model
 
-import (
-	"time"
-
-	"cloud.google.com/go/datastore"
-)
+import "time"
 
 type Read struct {
-	UserKey   *datastore.Key
+	UserID    ID `datastore:"UserKey"`
 	Timestamp time.Time
 }
 
@@ -16,22 +12,22 @@ type Readable interface {
 	SetReads([]*Read)
 }
 
-func NewRead(userKey *datastore.Key) *Read {
+func NewRead(userID ID) *Read {
 	return &Read{
-		UserKey:   userKey,
+		UserID:    userID,
 		Timestamp: time.Now(),
 	}
 }
 
-func MarkAsRead(r Readable, userKey *datastore.Key) {
+func MarkAsRead(r Readable, userID ID) {
 	reads := r.GetReads()
 
 	// If this has already been read, skip it
-	if IsRead(r, userKey) {
+	if IsRead(r, userID) {
 		return
 	}
 
-	reads = append(reads, NewRead(userKey))
+	reads = append(reads, NewRead(userID))
 
 	r.SetReads(reads)
 }
@@ -40,11 +36,11 @@ func ClearReads(r Readable) {
 	r.SetReads([]*Read{})
 }
 
-func IsRead(r Readable, userKey *datastore.Key) bool {
+func IsRead(r Readable, userID ID) bool {
 	reads := r.GetReads()
 
 	for i := range reads {
-		if reads[i].UserKey.Equal(userKey) {
+		if reads[i].UserID == userID {
 			return true
 		}
 	}
@@ -57,7 +53,7 @@ func MapReadsToUserPartials(r Readable, users []*User) []*UserPartial {
 	var userPartials []*UserPartial
 	for i := range reads {
 		for j := range users {
-			if users[j].Key.Equal(reads[i].UserKey) {
+			if users[j].ID == reads[i].UserID {
 				userPartials = append(userPartials, MapUserToUserPartial(users[j]))
 				break
 			}
@@ -0,0 +1,605 @@
+package model
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/random"
+)
+
+const (
+	FrequencyDaily   = "daily"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+
+	MaxRecurrenceInterval   = 99
+	MaxRecurrenceExceptions = 100
+	// MaxListedOccurrences is how many upcoming occurrences are listed
+	// along with a recurring event.
+	MaxListedOccurrences = 10
+	// MaxExpandedOccurrences is the most occurrences that are expanded at
+	// once.
+	MaxExpandedOccurrences = 100
+
+	// maxRecurrenceSteps bounds the expansion of recurrences that do not
+	// end.
+	maxRecurrenceSteps = 10000
+	icalTimeFormat     = "20060102T150405Z"
+)
+
+// Recurrence is the rule by which an event repeats. The Timestamp of the
+// event is the start of its first occurrence, and the others start every
+// Interval days, weeks or months after it at the same local time. Monthly
+// occurrences that would fall on a day that a month does not have, such as
+// the 31st, are skipped.
+//
+// A recurrence ends after Count occurrences or with the last occurrence that
+// starts at or before Until, if either is set. Exceptions are the starts of
+// occurrences that were cancelled. They still count towards Count.
+type Recurrence struct {
+	Frequency  string      `json:"frequency"`
+	Interval   int         `json:"interval"`
+	Count      int         `json:"count"`
+	Until      time.Time   `json:"until"`
+	Exceptions []time.Time `json:"exceptions"`
+}
+
+// Occurrence is a single occurrence of an event, identified by its start.
+// RSVPs holds the users who RSVP'd to the occurrence, including those who
+// RSVP'd to every occurrence of the event.
+type Occurrence struct {
+	Start time.Time      `json:"start"`
+	RSVPs []*UserPartial `json:"rsvps"`
+}
+
+// OccurrenceRSVP is the RSVP of a user to a single occurrence of a recurring
+// event.
+type OccurrenceRSVP struct {
+	UserID ID `datastore:"UserKey"`
+	Start  time.Time
+}
+
+func (r *Recurrence) validate(start time.Time) error {
+	op := errors.Op("model.Recurrence.validate")
+
+	switch r.Frequency {
+	case FrequencyDaily, FrequencyWeekly, FrequencyMonthly:
+	default:
+		return errors.E(op,
+			map[string]string{"recurrence": "Events can repeat daily, weekly or monthly"},
+			http.StatusBadRequest)
+	}
+
+	if r.Interval == 0 {
+		r.Interval = 1
+	}
+
+	if r.Interval < 0 || r.Interval > MaxRecurrenceInterval {
+		return errors.E(op,
+			map[string]string{"recurrence": fmt.Sprintf("The interval must be between 1 and %d", MaxRecurrenceInterval)},
+			http.StatusBadRequest)
+	}
+
+	if r.Count < 0 {
+		return errors.E(op,
+			map[string]string{"recurrence": "The count cannot be negative"},
+			http.StatusBadRequest)
+	}
+
+	if r.Count > 0 && !r.Until.IsZero() {
+		return errors.E(op,
+			map[string]string{"recurrence": "Events can repeat a number of times or until a time, but not both"},
+			http.StatusBadRequest)
+	}
+
+	if !r.Until.IsZero() && r.Until.Before(start) {
+		return errors.E(op,
+			map[string]string{"recurrence": "Events must start before they stop repeating"},
+			http.StatusBadRequest)
+	}
+
+	if len(r.Exceptions) > MaxRecurrenceExceptions {
+		return errors.E(op,
+			map[string]string{"recurrence": fmt.Sprintf("Events can skip at most %d occurrences", MaxRecurrenceExceptions)},
+			http.StatusBadRequest)
+	}
+
+	return nil
+}
+
+// occurrences returns the starts of the occurrences of a recurrence whose
+// first occurrence starts at start. Only the occurrences that start at or
+// after from and before to are returned, and at most limit of them. There is
+// no upper bound when to is zero.
+func (r *Recurrence) occurrences(start, from, to time.Time, limit int) []time.Time {
+	var (
+		out   []time.Time
+		count int
+	)
+
+	for n := 0; n < maxRecurrenceSteps && len(out) < limit; n++ {
+		t, ok := r.nth(start, n)
+		if !ok {
+			continue
+		}
+
+		count++
+
+		if r.Count > 0 && count > r.Count {
+			break
+		}
+
+		if !r.Until.IsZero() && t.After(r.Until) {
+			break
+		}
+
+		if !to.IsZero() && !t.Before(to) {
+			break
+		}
+
+		if t.Before(from) || r.isException(t) {
+			continue
+		}
+
+		out = append(out, t)
+	}
+
+	return out
+}
+
+// countBefore returns the number of occurrences, including exceptions, that
+// start before t.
+func (r *Recurrence) countBefore(start, t time.Time) int {
+	count := 0
+
+	for n := 0; n < maxRecurrenceSteps; n++ {
+		next, ok := r.nth(start, n)
+		if !ok {
+			continue
+		}
+
+		if !next.Before(t) {
+			break
+		}
+
+		count++
+	}
+
+	return count
+}
+
+// nth returns the start of the nth candidate occurrence and whether it is an
+// occurrence at all.
+func (r *Recurrence) nth(start time.Time, n int) (time.Time, bool) {
+	step := n * r.Interval
+
+	switch r.Frequency {
+	case FrequencyDaily:
+		return start.AddDate(0, 0, step), true
+	case FrequencyWeekly:
+		return start.AddDate(0, 0, 7*step), true
+	case FrequencyMonthly:
+		t := start.AddDate(0, step, 0)
+		return t, t.Day() == start.Day()
+	default:
+		return time.Time{}, false
+	}
+}
+
+// index returns n such that the nth candidate occurrence starts at t, or -1
+// if none does.
+func (r *Recurrence) index(start, t time.Time) int {
+	for n := 0; n < maxRecurrenceSteps; n++ {
+		next, _ := r.nth(start, n)
+
+		if next.Equal(t) {
+			return n
+		}
+
+		if next.After(t) {
+			break
+		}
+	}
+
+	return -1
+}
+
+func (r *Recurrence) isException(t time.Time) bool {
+	for i := range r.Exceptions {
+		if r.Exceptions[i].Equal(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rrule returns the recurrence as the value of an iCalendar RRULE. Times are
+// formatted by format.
+func (r *Recurrence) rrule(format func(time.Time) string) string {
+	rule := fmt.Sprintf("FREQ=%s;INTERVAL=%d", strings.ToUpper(r.Frequency), r.Interval)
+
+	if r.Count > 0 {
+		rule += fmt.Sprintf(";COUNT=%d", r.Count)
+	} else if !r.Until.IsZero() {
+		rule += ";UNTIL=" + format(r.Until)
+	}
+
+	return rule
+}
+
+// exdate returns the exceptions as the value of an iCalendar EXDATE. Times
+// are formatted by format.
+func (r *Recurrence) exdate(format func(time.Time) string) string {
+	dates := make([]string, len(r.Exceptions))
+	for i := range r.Exceptions {
+		dates[i] = format(r.Exceptions[i])
+	}
+
+	return strings.Join(dates, ",")
+}
+
+func (e *Event) IsRecurring() bool {
+	return e.Recurrence != nil
+}
+
+// SetRecurrence makes the event repeat by r. The event stops repeating when
+// r has no frequency, and keeps only the RSVPs to its first occurrence.
+func (e *Event) SetRecurrence(r *Recurrence) error {
+	if r.Frequency == "" {
+		if e.IsRecurring() {
+			e.keepOccurrenceRSVPs(e.Timestamp, e.Timestamp.Add(time.Nanosecond))
+			e.Recurrence = nil
+		}
+
+		return nil
+	}
+
+	if err := r.validate(e.Timestamp); err != nil {
+		return err
+	}
+
+	e.Recurrence = r
+
+	return nil
+}
+
+// Reschedule moves the event so that its first occurrence starts at start.
+// Its end, and the exceptions and RSVPs of its occurrences, move along with
+// it.
+func (e *Event) Reschedule(start time.Time) {
+	e.EndTimestamp = e.endTimestampAt(start)
+	e.keepOccurrences(func() { e.Timestamp = start })
+}
+
+// keepOccurrences runs change, which moves the occurrences of the event, and
+// moves its exceptions and the RSVPs to its occurrences along with them.
+// Occurrences are told apart by their position rather than by how far they
+// move, since that differs between them when they move across a change of
+// offset in the time zone of the event.
+func (e *Event) keepOccurrences(change func()) {
+	if !e.IsRecurring() {
+		change()
+		return
+	}
+
+	start := e.Timestamp.In(e.location())
+
+	exceptions := make([]int, len(e.Recurrence.Exceptions))
+	for i := range e.Recurrence.Exceptions {
+		exceptions[i] = e.Recurrence.index(start, e.Recurrence.Exceptions[i])
+	}
+
+	rsvps := make([]int, len(e.OccurrenceRSVPs))
+	for i := range e.OccurrenceRSVPs {
+		rsvps[i] = e.Recurrence.index(start, e.OccurrenceRSVPs[i].Start)
+	}
+
+	change()
+
+	start = e.Timestamp.In(e.location())
+
+	for i, n := range exceptions {
+		if n >= 0 {
+			e.Recurrence.Exceptions[i], _ = e.Recurrence.nth(start, n)
+		}
+	}
+
+	for i, n := range rsvps {
+		if n >= 0 {
+			e.OccurrenceRSVPs[i].Start, _ = e.Recurrence.nth(start, n)
+		}
+	}
+}
+
+// GetOccurrences returns the starts of the occurrences of the event that
+// start at or after from and before to, at most limit of them. There is no
+// upper bound when to is zero. Events that do not repeat have a single
+// occurrence at their Timestamp.
+func (e *Event) GetOccurrences(from, to time.Time, limit int) []time.Time {
+	start := e.Timestamp.In(e.location())
+
+	if e.IsRecurring() {
+		return e.Recurrence.occurrences(start, from, to, limit)
+	}
+
+	if limit < 1 || start.Before(from) || (!to.IsZero() && !start.Before(to)) {
+		return nil
+	}
+
+	return []time.Time{start}
+}
+
+// NextOccurrence returns the start of the first occurrence of the event that
+// starts at or after t, if there is one.
+func (e *Event) NextOccurrence(t time.Time) (time.Time, bool) {
+	occurrences := e.GetOccurrences(t, time.Time{}, 1)
+	if len(occurrences) == 0 {
+		return time.Time{}, false
+	}
+
+	return occurrences[0], true
+}
+
+// IsOccurrence reports whether an occurrence of the event starts at t.
+func (e *Event) IsOccurrence(t time.Time) bool {
+	next, ok := e.NextOccurrence(t)
+	return ok && next.Equal(t)
+}
+
+// ExpandOccurrences returns the occurrences of the event like GetOccurrences
+// does, along with their RSVPs. The event must be hydrated.
+func (e *Event) ExpandOccurrences(from, to time.Time, limit int) []*Occurrence {
+	starts := e.GetOccurrences(from, to, limit)
+	occurrences := make([]*Occurrence, len(starts))
+
+	for i := range starts {
+		rsvps := make([]*User, 0)
+
+		for j := range e.Users {
+			if e.HasOccurrenceRSVP(e.Users[j], starts[i]) {
+				rsvps = append(rsvps, e.Users[j])
+			}
+		}
+
+		occurrences[i] = &Occurrence{
+			Start: starts[i],
+			RSVPs: MapUsersToUserPartials(rsvps),
+		}
+	}
+
+	return occurrences
+}
+
+// SetUpcomingOccurrences lists the next occurrences of a recurring event
+// along with it. The event must be hydrated.
+func (e *Event) SetUpcomingOccurrences() {
+	if !e.IsRecurring() {
+		e.Occurrences = nil
+		return
+	}
+
+	e.Occurrences = e.ExpandOccurrences(time.Now(), time.Time{}, MaxListedOccurrences)
+}
+
+// HasOccurrenceRSVP reports whether the user RSVP'd to the occurrence that
+// starts at start, either on its own or by RSVPing to the event.
+func (e *Event) HasOccurrenceRSVP(u *User, start time.Time) bool {
+	if e.HasRSVP(u) {
+		return true
+	}
+
+	for i := range e.OccurrenceRSVPs {
+		if e.OccurrenceRSVPs[i].UserID == u.ID && e.OccurrenceRSVPs[i].Start.Equal(start) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddOccurrenceRSVP RSVPs a user for the occurrence of the event that starts
+// at start. Occurrences have no waitlist, so RSVPs to occurrences that are
+// full are rejected.
+func (e *Event) AddOccurrenceRSVP(u *User, start time.Time) error {
+	op := errors.Op("event.AddOccurrenceRSVP")
+
+	if !e.HasUser(u) {
+		return errors.E(op, errors.Str("user not in event"), http.StatusUnauthorized)
+	}
+
+	if err := e.checkNotCancelled(op); err != nil {
+		return err
+	}
+
+	if !e.IsOccurrence(start) || start.Before(time.Now()) {
+		return errors.E(op,
+			errors.Str("not an upcoming occurrence"),
+			map[string]string{"occurrence": "This is not an upcoming occurrence of the event"},
+			http.StatusBadRequest)
+	}
+
+	// Cannot add owner or duplicate.
+	if e.OwnerIs(u) || e.HasOccurrenceRSVP(u, start) {
+		return errors.E(op,
+			errors.Str("already has rsvp"),
+			map[string]string{"message": "You have already RSVP'd"},
+			http.StatusBadRequest)
+	}
+
+	if !e.hasRoomForOccurrence(u, start) {
+		return errors.E(op,
+			errors.Str("occurrence full"),
+			map[string]string{"message": "This occurrence is full"},
+			http.StatusBadRequest)
+	}
+
+	e.OccurrenceRSVPs = append(e.OccurrenceRSVPs, &OccurrenceRSVP{UserID: u.ID, Start: start})
+	e.SetReads([]*Read{})
+
+	return nil
+}
+
+// hasRoomForOccurrence reports whether the occurrence of the event that
+// starts at start has room for the user, on top of everyone who is going to
+// every occurrence and everyone else who RSVP'd to it.
+func (e *Event) hasRoomForOccurrence(u *User, start time.Time) bool {
+	if e.Capacity == 0 {
+		return true
+	}
+
+	headcount := 1
+	for _, r := range e.Responses {
+		if r.Status == RSVPGoing && r.UserID != u.ID {
+			headcount += 1 + r.Guests
+		}
+	}
+
+	for _, r := range e.OccurrenceRSVPs {
+		if r.Start.Equal(start) && r.UserID != u.ID {
+			headcount++
+		}
+	}
+
+	return headcount <= e.Capacity
+}
+
+// RemoveOccurrenceRSVP removes the RSVP of a user for the occurrence of the
+// event that starts at start. RSVPs to every occurrence are left alone.
+func (e *Event) RemoveOccurrenceRSVP(u *User, start time.Time) error {
+	op := errors.Op("event.RemoveOccurrenceRSVP")
+
+	if !e.HasUser(u) {
+		return errors.E(op, errors.Str("no permission"), http.StatusNotFound)
+	}
+
+	if e.OwnerIs(u) {
+		return errors.E(op,
+			map[string]string{"message": "You cannot remove yourself from your own event"},
+			errors.Str("user cannot remove herself"),
+			http.StatusBadRequest)
+	}
+
+	rsvps := make([]*OccurrenceRSVP, 0, len(e.OccurrenceRSVPs))
+	for i := range e.OccurrenceRSVPs {
+		if e.OccurrenceRSVPs[i].UserID != u.ID || !e.OccurrenceRSVPs[i].Start.Equal(start) {
+			rsvps = append(rsvps, e.OccurrenceRSVPs[i])
+		}
+	}
+
+	e.OccurrenceRSVPs = rsvps
+
+	return nil
+}
+
+// SplitAt ends the recurrence of the event before its occurrence that starts
+// at start and returns a new event that repeats the same way from start on.
+// This lets the occurrences from start on be changed without changing the
+// earlier ones. The new event has the same owner, hosts and guests and takes
+// over the exceptions and RSVPs of the occurrences that it repeats. If start
+// is the first occurrence, nothing is split and the event itself is returned.
+//
+// The new event does not have an ID yet, so both events have to be saved.
+func (e *Event) SplitAt(start time.Time) (*Event, error) {
+	op := errors.Op("event.SplitAt")
+
+	if !e.IsRecurring() || !e.IsOccurrence(start) {
+		return nil, errors.E(op,
+			errors.Str("not an occurrence"),
+			map[string]string{"occurrence": "This is not an occurrence of the event"},
+			http.StatusBadRequest)
+	}
+
+	if start.Equal(e.Timestamp) {
+		return e, nil
+	}
+
+	following := &Recurrence{
+		Frequency: e.Recurrence.Frequency,
+		Interval:  e.Recurrence.Interval,
+		Until:     e.Recurrence.Until,
+	}
+
+	if e.Recurrence.Count > 0 {
+		following.Count = e.Recurrence.Count - e.Recurrence.countBefore(e.Timestamp.In(e.location()), start)
+	}
+
+	preceding := &Recurrence{
+		Frequency: e.Recurrence.Frequency,
+		Interval:  e.Recurrence.Interval,
+		Until:     start.Add(-time.Second),
+	}
+
+	for _, t := range e.Recurrence.Exceptions {
+		if t.Before(start) {
+			preceding.Exceptions = append(preceding.Exceptions, t)
+		} else {
+			following.Exceptions = append(following.Exceptions, t)
+		}
+	}
+
+	split := &Event{
+		Token:           random.Token(),
+		OwnerID:         e.OwnerID,
+		Owner:           e.Owner,
+		HostIDs:         append([]ID(nil), e.HostIDs...),
+		HostPartials:    e.HostPartials,
+		UserIDs:         append([]ID(nil), e.UserIDs...),
+		UserPartials:    e.UserPartials,
+		Users:           e.Users,
+		RSVPs:           e.RSVPs,
+		Maybes:          e.Maybes,
+		Declines:        e.Declines,
+		Waitlist:        e.Waitlist,
+		Capacity:        e.Capacity,
+		RSVPCounts:      e.RSVPCounts,
+		PlaceID:         e.PlaceID,
+		Address:         e.Address,
+		Lat:             e.Lat,
+		Lng:             e.Lng,
+		Name:            e.Name,
+		Description:     e.Description,
+		Timestamp:       start,
+		EndTimestamp:    e.endTimestampAt(start),
+		AllDay:          e.AllDay,
+		UTCOffset:       e.UTCOffset,
+		TimeZone:        e.TimeZone,
+		GuestsCanInvite: e.GuestsCanInvite,
+		Recurrence:      following,
+		Reminders:       append([]int(nil), e.Reminders...),
+		RemindedAt:      e.RemindedAt,
+	}
+
+	for _, r := range e.Responses {
+		copied := *r
+		split.Responses = append(split.Responses, &copied)
+	}
+
+	for _, rsvp := range e.OccurrenceRSVPs {
+		if !rsvp.Start.Before(start) {
+			split.OccurrenceRSVPs = append(split.OccurrenceRSVPs, rsvp)
+		}
+	}
+
+	e.keepOccurrenceRSVPs(e.Timestamp, start)
+	e.Recurrence = preceding
+
+	return split, nil
+}
+
+// keepOccurrenceRSVPs removes the RSVPs to the occurrences that do not start
+// at or after from and before to.
+func (e *Event) keepOccurrenceRSVPs(from, to time.Time) {
+	var rsvps []*OccurrenceRSVP
+
+	for _, rsvp := range e.OccurrenceRSVPs {
+		if !rsvp.Start.Before(from) && rsvp.Start.Before(to) {
+			rsvps = append(rsvps, rsvp)
+		}
+	}
+
+	e.OccurrenceRSVPs = rsvps
+}
@@ -0,0 +1,122 @@
+package model
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/hiconvo/api/errors"
+)
+
+const (
+	MaxEventReminders = 5
+	// MaxReminderMinutes is how long before an occurrence its reminders can
+	// be sent at most, which is four weeks.
+	MaxReminderMinutes = 4 * 7 * 24 * 60
+	// ReminderGrace is how late a reminder can be sent. Reminders that are
+	// later than that, such as those of events that were moved to a time
+	// that is closer than the reminder, are skipped.
+	ReminderGrace = time.Hour
+)
+
+// SetReminders sets when the guests of the event are reminded of each of its
+// occurrences, in minutes before it starts. Reminders that are already due
+// are not sent.
+func (e *Event) SetReminders(minutes []int) error {
+	op := errors.Op("event.SetReminders")
+
+	if len(minutes) > MaxEventReminders {
+		return errors.E(op,
+			errors.Str("too many reminders"),
+			map[string]string{"reminders": "Events can have up to 5 reminders"},
+			http.StatusBadRequest)
+	}
+
+	seen := make(map[int]struct{}, len(minutes))
+	reminders := make([]int, 0, len(minutes))
+
+	for _, m := range minutes {
+		if m < 1 || m > MaxReminderMinutes {
+			return errors.E(op,
+				errors.Errorf("invalid reminder %d", m),
+				map[string]string{"reminders": "Reminders must be between a minute and four weeks before the event"},
+				http.StatusBadRequest)
+		}
+
+		if _, ok := seen[m]; ok {
+			continue
+		}
+
+		seen[m] = struct{}{}
+		reminders = append(reminders, m)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(reminders)))
+
+	e.Reminders = reminders
+	e.RemindedAt = time.Now()
+
+	return nil
+}
+
+// DueReminder returns the start of the occurrence whose reminder is due at
+// t, if there is one that has not been sent yet. Of several due reminders,
+// only the last one is returned, since there is no point in sending the
+// others as well.
+func (e *Event) DueReminder(t time.Time) (time.Time, bool) {
+	var (
+		occurrence time.Time
+		due        time.Time
+	)
+
+	for _, m := range e.Reminders {
+		before := time.Duration(m) * time.Minute
+
+		starts := e.GetOccurrences(
+			e.RemindedAt.Add(before+time.Nanosecond),
+			t.Add(before+time.Nanosecond),
+			MaxExpandedOccurrences)
+		if len(starts) == 0 {
+			continue
+		}
+
+		start := starts[len(starts)-1]
+		if start.Add(-before).After(due) {
+			occurrence, due = start, start.Add(-before)
+		}
+	}
+
+	if due.IsZero() || t.Sub(due) > ReminderGrace {
+		return time.Time{}, false
+	}
+
+	return occurrence, true
+}
+
+// MarkReminded records that the reminders of the event that are due at t
+// were sent, or skipped.
+func (e *Event) MarkReminded(t time.Time) {
+	e.RemindedAt = t
+}
+
+// NextReminder returns when the next reminder of the event that has not been
+// sent yet is due, or zero if there is none. Deleted and cancelled events
+// are not reminded of.
+func (e *Event) NextReminder() time.Time {
+	var next time.Time
+
+	if !e.DeletedAt.IsZero() || e.IsCancelled() {
+		return next
+	}
+
+	for _, m := range e.Reminders {
+		before := time.Duration(m) * time.Minute
+
+		start, ok := e.NextOccurrence(e.RemindedAt.Add(before + time.Nanosecond))
+		if ok && (next.IsZero() || start.Add(-before).Before(next)) {
+			next = start.Add(-before)
+		}
+	}
+
+	return next
+}
@@ -0,0 +1,377 @@
+package model
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hiconvo/api/errors"
+)
+
+const (
+	RSVPGoing    = "going"
+	RSVPMaybe    = "maybe"
+	RSVPDeclined = "declined"
+	// RSVPWaitlisted is the status of users who want to go to an event that
+	// is full. Users cannot choose it themselves.
+	RSVPWaitlisted = "waitlisted"
+
+	// MaxRSVPGuests is the most guests that a user can bring along.
+	MaxRSVPGuests = 10
+)
+
+// RSVP is the response of a user to an event. Guests is how many people the
+// user is bringing along, such as a partner. Users who decline bring no one.
+//
+// Users who want to go to an event that does not have room for them and
+// their guests are put on its waitlist instead. Waitlisted responses are
+// kept in the order that users joined the waitlist.
+type RSVP struct {
+	UserID    ID        `json:"userId"    datastore:"UserKey"`
+	Status    string    `json:"status"`
+	Guests    int       `json:"guests"`
+	Note      string    `json:"note"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// RSVPCounts counts the responses to an event by status. Headcount is the
+// number of people going, including their guests.
+type RSVPCounts struct {
+	Going      int `json:"going"`
+	Maybe      int `json:"maybe"`
+	Declined   int `json:"declined"`
+	Waitlisted int `json:"waitlisted"`
+	Headcount  int `json:"headcount"`
+}
+
+// GetRSVP returns the response of the user to the event, or nil if she has
+// not responded.
+func (e *Event) GetRSVP(u *User) *RSVP {
+	for i := range e.Responses {
+		if e.Responses[i].UserID == u.ID {
+			return e.Responses[i]
+		}
+	}
+
+	return nil
+}
+
+// HasRSVP reports whether the user is going to the event.
+func (e *Event) HasRSVP(u *User) bool {
+	r := e.GetRSVP(u)
+	return r != nil && r.Status == RSVPGoing
+}
+
+// AddRSVP RSVPs a user as going to the event. The guests and note of her
+// earlier response, if any, are kept.
+func (e *Event) AddRSVP(u *User) error {
+	return e.SetRSVPStatus(u, RSVPGoing)
+}
+
+// SetRSVPStatus changes the status of the response of the user to the
+// event, keeping her guests and note.
+func (e *Event) SetRSVPStatus(u *User, status string) error {
+	var (
+		guests int
+		note   string
+	)
+
+	if r := e.GetRSVP(u); r != nil {
+		guests, note = r.Guests, r.Note
+	}
+
+	return e.SetRSVP(u, status, guests, note)
+}
+
+// SetRSVP sets the response of the user to the event, replacing her earlier
+// response if she has one. Users who want to go are waitlisted if the event
+// does not have room for them, and users who are waitlisted keep their place
+// unless they stop wanting to go.
+func (e *Event) SetRSVP(u *User, status string, guests int, note string) error {
+	op := errors.Op("event.SetRSVP")
+
+	if !e.HasUser(u) {
+		return errors.E(op, errors.Str("user not in event"), http.StatusUnauthorized)
+	}
+
+	if err := e.checkNotCancelled(op); err != nil {
+		return err
+	}
+
+	if e.OwnerIs(u) {
+		return errors.E(op,
+			errors.Str("owner cannot rsvp"),
+			map[string]string{"message": "You have already RSVP'd"},
+			http.StatusBadRequest)
+	}
+
+	switch status {
+	case RSVPGoing, RSVPMaybe:
+	case RSVPDeclined:
+		guests = 0
+	default:
+		return errors.E(op,
+			errors.Errorf("invalid status %q", status),
+			map[string]string{"status": "Must be going, maybe or declined"},
+			http.StatusBadRequest)
+	}
+
+	if guests < 0 || guests > MaxRSVPGuests {
+		return errors.E(op,
+			errors.Str("invalid guests"),
+			map[string]string{"guests": "You can bring up to 10 guests"},
+			http.StatusBadRequest)
+	}
+
+	r := e.GetRSVP(u)
+	if r != nil && r.Status == RSVPWaitlisted && status == RSVPGoing {
+		status = RSVPWaitlisted
+	}
+
+	if r != nil && r.Status == status && r.Guests == guests && r.Note == note {
+		return errors.E(op,
+			errors.Str("already has rsvp"),
+			map[string]string{"message": "You have already RSVP'd"},
+			http.StatusBadRequest)
+	}
+
+	if status == RSVPGoing {
+		isGoing := r != nil && r.Status == RSVPGoing
+
+		switch {
+		case isGoing && !e.hasRoomFor(u, guests):
+			return errors.E(op,
+				errors.Str("over capacity"),
+				map[string]string{"guests": "There is not enough room for more guests"},
+				http.StatusBadRequest)
+		case !isGoing && (e.hasWaitlist() || !e.hasRoomFor(u, guests)):
+			// Users cannot skip ahead of those who are already waitlisted.
+			status = RSVPWaitlisted
+		}
+	}
+
+	if r == nil {
+		r = &RSVP{UserID: u.ID}
+		e.Responses = append(e.Responses, r)
+	}
+
+	if status == RSVPWaitlisted && r.Status != RSVPWaitlisted {
+		// Users join the end of the waitlist.
+		e.Responses = append(removeRSVP(e.Responses, u.ID), r)
+	}
+
+	r.Status = status
+	r.Guests = guests
+	r.Note = note
+	r.UpdatedAt = time.Now()
+
+	e.removeRSVPPartial(u.ID)
+	e.addRSVPPartial(r, MapUserToUserPartial(u))
+	e.RSVPCounts = e.countRSVPs()
+	e.SetReads([]*Read{})
+
+	return nil
+}
+
+// RemoveRSVP removes the response of the user to the event, whatever it was.
+func (e *Event) RemoveRSVP(u *User) error {
+	op := errors.Op("event.RemoveRSVP")
+
+	if !e.HasUser(u) {
+		return errors.E(op, errors.Str("no permission"), http.StatusNotFound)
+	}
+
+	if e.OwnerIs(u) {
+		return errors.E(op,
+			map[string]string{"message": "You cannot remove yourself from your own event"},
+			errors.Str("user cannot remove herself"),
+			http.StatusBadRequest)
+	}
+
+	e.Responses = removeRSVP(e.Responses, u.ID)
+	e.removeRSVPPartial(u.ID)
+	e.RSVPCounts = e.countRSVPs()
+
+	return nil
+}
+
+// SetCapacity sets the most people, including guests, that can go to the
+// event. Zero means that there is no limit. Users who are already going
+// keep their places when the capacity is lowered.
+func (e *Event) SetCapacity(capacity int) error {
+	if capacity < 0 {
+		return errors.E(errors.Op("event.SetCapacity"),
+			errors.Str("negative capacity"),
+			map[string]string{"capacity": "Capacity cannot be negative"},
+			http.StatusBadRequest)
+	}
+
+	e.Capacity = capacity
+
+	return nil
+}
+
+// PromoteWaitlist lets the users at the front of the waitlist go to the
+// event for as long as it has room for them and their guests, and returns
+// the IDs of the users who were let in. Users are never let in ahead of
+// someone who joined the waitlist before them.
+func (e *Event) PromoteWaitlist() []ID {
+	var promoted []ID
+
+	for _, r := range e.Responses {
+		if r.Status != RSVPWaitlisted {
+			continue
+		}
+
+		if !e.hasRoomFor(&User{ID: r.UserID}, r.Guests) {
+			break
+		}
+
+		r.Status = RSVPGoing
+		r.UpdatedAt = time.Now()
+		promoted = append(promoted, r.UserID)
+
+		for i := range e.Waitlist {
+			if e.Waitlist[i].ID == r.UserID {
+				e.RSVPs = append(e.RSVPs, e.Waitlist[i])
+				e.Waitlist = removeUserPartial(e.Waitlist, r.UserID)
+
+				break
+			}
+		}
+	}
+
+	if len(promoted) > 0 {
+		e.RSVPCounts = e.countRSVPs()
+		e.SetReads([]*Read{})
+	}
+
+	return promoted
+}
+
+// hasRoomFor reports whether the event has room for the user and her guests,
+// on top of everyone else who is going.
+func (e *Event) hasRoomFor(u *User, guests int) bool {
+	if e.Capacity == 0 {
+		return true
+	}
+
+	headcount := 1 + guests
+	for _, r := range e.Responses {
+		if r.Status == RSVPGoing && r.UserID != u.ID {
+			headcount += 1 + r.Guests
+		}
+	}
+
+	return headcount <= e.Capacity
+}
+
+func (e *Event) hasWaitlist() bool {
+	for _, r := range e.Responses {
+		if r.Status == RSVPWaitlisted {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetRSVPUsers sets the partials of the users who responded to the event,
+// by status and in the order of their responses, along with the counts of
+// the responses. users are the users of the event.
+func (e *Event) SetRSVPUsers(users []*User) {
+	byID := make(map[ID]*User, len(users))
+	for i := range users {
+		byID[users[i].ID] = users[i]
+	}
+
+	e.RSVPs = make([]*UserPartial, 0)
+	e.Maybes = make([]*UserPartial, 0)
+	e.Declines = make([]*UserPartial, 0)
+	e.Waitlist = make([]*UserPartial, 0)
+
+	for i := range e.Responses {
+		if u, ok := byID[e.Responses[i].UserID]; ok {
+			e.addRSVPPartial(e.Responses[i], MapUserToUserPartial(u))
+		}
+	}
+
+	e.RSVPCounts = e.countRSVPs()
+}
+
+func (e *Event) addRSVPPartial(r *RSVP, p *UserPartial) {
+	switch r.Status {
+	case RSVPGoing:
+		e.RSVPs = append(e.RSVPs, p)
+	case RSVPMaybe:
+		e.Maybes = append(e.Maybes, p)
+	case RSVPDeclined:
+		e.Declines = append(e.Declines, p)
+	case RSVPWaitlisted:
+		e.Waitlist = append(e.Waitlist, p)
+	}
+}
+
+func (e *Event) removeRSVPPartial(id ID) {
+	e.RSVPs = removeUserPartial(e.RSVPs, id)
+	e.Maybes = removeUserPartial(e.Maybes, id)
+	e.Declines = removeUserPartial(e.Declines, id)
+	e.Waitlist = removeUserPartial(e.Waitlist, id)
+}
+
+func (e *Event) countRSVPs() RSVPCounts {
+	var counts RSVPCounts
+
+	for _, r := range e.Responses {
+		switch r.Status {
+		case RSVPGoing:
+			counts.Going++
+			counts.Headcount += 1 + r.Guests
+		case RSVPMaybe:
+			counts.Maybe++
+		case RSVPDeclined:
+			counts.Declined++
+		case RSVPWaitlisted:
+			counts.Waitlisted++
+		}
+	}
+
+	return counts
+}
+
+// MoveLegacyRSVPs turns the RSVPs that were saved before they had statuses
+// into responses of users who are going. It is called when the event is
+// loaded.
+func (e *Event) MoveLegacyRSVPs() {
+	for _, id := range e.LegacyRSVPIDs {
+		if e.GetRSVP(&User{ID: id}) == nil {
+			e.Responses = append(e.Responses, &RSVP{UserID: id, Status: RSVPGoing})
+		}
+	}
+}
+
+// HasLegacyRSVPs reports whether the event was saved before RSVPs had
+// statuses. Its RSVPs are moved when it is loaded, and it is saved without
+// them.
+func (e *Event) HasLegacyRSVPs() bool {
+	return len(e.LegacyRSVPIDs) > 0
+}
+
+func removeRSVP(rsvps []*RSVP, id ID) []*RSVP {
+	for i := range rsvps {
+		if rsvps[i].UserID == id {
+			return append(rsvps[:i], rsvps[i+1:]...)
+		}
+	}
+
+	return rsvps
+}
+
+func removeUserPartial(partials []*UserPartial, id ID) []*UserPartial {
+	for i := range partials {
+		if partials[i].ID == id {
+			return append(partials[:i], partials[i+1:]...)
+		}
+	}
+
+	return partials
+}
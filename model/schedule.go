@@ -0,0 +1,160 @@
+package model
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hiconvo/api/errors"
+)
+
+const (
+	// DefaultEventDuration is how long events that were given no end last.
+	DefaultEventDuration = time.Hour
+
+	icalDateFormat = "20060102"
+)
+
+// SetEnd sets when the event ends and whether it lasts all day. Events whose
+// end is zero last DefaultEventDuration.
+//
+// All-day events start at the beginning of the day of their Timestamp and
+// their EndTimestamp is the beginning of their last day, in the time zone of
+// the event. Their end defaults to the day that they start.
+func (e *Event) SetEnd(end time.Time, allDay bool) error {
+	op := errors.Op("event.SetEnd")
+
+	start := e.Timestamp
+	if allDay {
+		start = startOfDay(e.Timestamp, e.location())
+
+		if end.IsZero() {
+			end = start
+		} else {
+			end = startOfDay(end, e.location())
+		}
+	}
+
+	if !end.IsZero() && (end.Before(start) || (!allDay && end.Equal(start))) {
+		return errors.E(op,
+			errors.Str("end before start"),
+			map[string]string{"endTimestamp": "Your event must end after it starts"},
+			http.StatusBadRequest)
+	}
+
+	e.Reschedule(start)
+	e.EndTimestamp = end
+	e.AllDay = allDay
+
+	return nil
+}
+
+// Duration returns how long each occurrence of the event lasts. All-day
+// events last whole days.
+func (e *Event) Duration() time.Duration {
+	if e.AllDay {
+		return time.Duration(e.days()) * 24 * time.Hour
+	}
+
+	if e.EndTimestamp.IsZero() {
+		return DefaultEventDuration
+	}
+
+	return e.EndTimestamp.Sub(e.Timestamp)
+}
+
+// days returns the number of days that an all-day event lasts.
+func (e *Event) days() int {
+	if e.EndTimestamp.IsZero() {
+		return 1
+	}
+
+	// Days are rounded since they are not all 24 hours long.
+	return int((e.EndTimestamp.Sub(e.Timestamp)+12*time.Hour)/(24*time.Hour)) + 1
+}
+
+// endOf returns the end of the occurrence of the event that starts at start.
+// All-day events end at the beginning of the day after their last day.
+func (e *Event) endOf(start time.Time) time.Time {
+	if e.AllDay {
+		return start.AddDate(0, 0, e.days())
+	}
+
+	return start.Add(e.Duration())
+}
+
+// endTimestampAt returns the EndTimestamp of the event if it started at
+// start instead.
+func (e *Event) endTimestampAt(start time.Time) time.Time {
+	switch {
+	case e.EndTimestamp.IsZero():
+		return time.Time{}
+	case e.AllDay:
+		// Days are added in the time zone of the event, so that the end
+		// stays at the beginning of a day across daylight saving time.
+		return start.In(e.location()).AddDate(0, 0, e.days()-1).In(start.Location())
+	default:
+		return start.Add(e.Duration())
+	}
+}
+
+// formatOccurrence formats the occurrence of the event that starts at start.
+func (e *Event) formatOccurrence(start time.Time) string {
+	const (
+		dayFormat  = "Monday, January 2"
+		timeFormat = "3:04 PM"
+	)
+
+	end := e.endOf(start).In(start.Location())
+
+	if e.AllDay {
+		last := end.AddDate(0, 0, -1)
+		if sameDay(start, last) {
+			return start.Format(dayFormat)
+		}
+
+		return start.Format(dayFormat) + " - " + last.Format(dayFormat)
+	}
+
+	formatted := start.Format(dayFormat + " @ " + timeFormat)
+
+	switch {
+	case e.EndTimestamp.IsZero():
+		return formatted
+	case sameDay(start, end):
+		return formatted + " - " + end.Format(timeFormat)
+	default:
+		return formatted + " - " + end.Format(dayFormat+" @ "+timeFormat)
+	}
+}
+
+// icalTime formats t as an iCalendar time in the time zone of the event, or
+// as a date for all-day events. The time zone is given by icalParams.
+func (e *Event) icalTime(t time.Time) string {
+	switch {
+	case e.AllDay:
+		return t.In(e.location()).Format(icalDateFormat)
+	case e.TimeZone != "":
+		return t.In(e.location()).Format(icalLocalTimeFormat)
+	default:
+		return t.UTC().Format(icalTimeFormat)
+	}
+}
+
+// icalUTCTime formats t as an iCalendar time in UTC, or as a date for all-day
+// events.
+func (e *Event) icalUTCTime(t time.Time) string {
+	if e.AllDay {
+		return e.icalTime(t)
+	}
+
+	return t.UTC().Format(icalTimeFormat)
+}
+
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+func sameDay(a, b time.Time) bool {
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
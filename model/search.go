@@ -0,0 +1,84 @@
+package model
+
+import (
+	"context"
+	"time"
+)
+
+// SearchResultType is the kind of object that a search result refers to.
+type SearchResultType string
+
+const (
+	SearchResultNote    SearchResultType = "note"
+	SearchResultThread  SearchResultType = "thread"
+	SearchResultMessage SearchResultType = "message"
+	SearchResultEvent   SearchResultType = "event"
+	SearchResultPerson  SearchResultType = "person"
+)
+
+// SearchResultTypes are all of the types that can be searched.
+var SearchResultTypes = []SearchResultType{
+	SearchResultNote,
+	SearchResultThread,
+	SearchResultMessage,
+	SearchResultEvent,
+	SearchResultPerson,
+}
+
+// IsValid returns whether t is one of SearchResultTypes.
+func (t SearchResultType) IsValid() bool {
+	for i := range SearchResultTypes {
+		if SearchResultTypes[i] == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SearchResult is a single object that matched a unified search query.
+// ParentID is set for messages and is the ID of their thread. User is set
+// for people. Highlights maps the names of the matched fields to snippets
+// in which the matching terms are wrapped in <em> tags.
+type SearchResult struct {
+	Type       SearchResultType    `json:"type"`
+	ID         string              `json:"id"`
+	ParentID   string              `json:"parentId,omitempty"`
+	Title      string              `json:"title"`
+	User       *UserPartial        `json:"user,omitempty"`
+	Highlights map[string][]string `json:"highlights"`
+	Score      float64             `json:"score"`
+	CreatedAt  *time.Time          `json:"createdAt,omitempty"`
+}
+
+// DateFacet is the number of matches created in the month given by Date,
+// which is formatted as YYYY-MM.
+type DateFacet struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// SearchFacets summarize all of the matches of a query, regardless of the
+// requested types and page.
+type SearchFacets struct {
+	Types map[SearchResultType]int64 `json:"types"`
+	Dates []*DateFacet               `json:"dates"`
+}
+
+type SearchResults struct {
+	Results []*SearchResult `json:"results"`
+	Facets  *SearchFacets   `json:"facets"`
+	Total   int64           `json:"total"`
+}
+
+// SearchInput is a unified search query. When Types is empty, all types
+// are searched.
+type SearchInput struct {
+	Query      string
+	Types      []SearchResultType
+	Pagination *Pagination
+}
+
+type SearchStore interface {
+	Search(ctx context.Context, u *User, input *SearchInput) (*SearchResults, error)
+}
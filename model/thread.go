@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"github.com/gosimple/slug"
 
 	"github.com/hiconvo/api/clients/db"
@@ -16,34 +15,55 @@ import (
 )
 
 type Thread struct {
-	Key           *datastore.Key   `json:"-"        datastore:"__key__"`
-	ID            string           `json:"id"       datastore:"-"`
-	OwnerKey      *datastore.Key   `json:"-"`
-	Owner         *UserPartial     `json:"owner"    datastore:"-"`
-	UserKeys      []*datastore.Key `json:"-"`
-	Users         []*User          `json:"-"        datastore:"-"`
-	UserPartials  []*UserPartial   `json:"users"    datastore:"-"`
-	Subject       string           `json:"subject"  datastore:",noindex"`
-	Body          string           `json:"body"     datastore:",noindex"`
-	Photos        []string         `json:"photos"   datastore:",noindex"`
-	Link          *og.LinkData     `json:"link"`
-	UserReads     []*UserPartial   `json:"reads"    datastore:"-"`
-	Reads         []*Read          `json:"-"        datastore:",noindex"`
-	CreatedAt     time.Time        `json:"createdAt"`
-	UpdatedAt     time.Time        `json:"updatedAt"`
-	ResponseCount int              `json:"responseCount"`
+	ID            ID             `json:"id"       datastore:"-"`
+	Int64ID       int64          `json:"-"        datastore:"-"`
+	OwnerID       ID             `json:"-"        datastore:"OwnerKey"`
+	Owner         *UserPartial   `json:"owner"    datastore:"-"`
+	UserIDs       []ID           `json:"-"        datastore:"UserKeys"`
+	Users         []*User        `json:"-"        datastore:"-"`
+	UserPartials  []*UserPartial `json:"users"    datastore:"-"`
+	Subject       string         `json:"subject"  datastore:",noindex"`
+	Body          string         `json:"body"     datastore:",noindex"`
+	PhotoKeys     []string       `json:"-"        datastore:"Photos,noindex"`
+	Photos        []string       `json:"photos"   datastore:"-"`
+	Link          *og.LinkData   `json:"link"`
+	Links         []*og.LinkData `json:"links"    datastore:",noindex"`
+	UserReads     []*UserPartial `json:"reads"    datastore:"-"`
+	Reads         []*Read        `json:"-"        datastore:",noindex"`
+	CreatedAt     time.Time      `json:"createdAt"`
+	UpdatedAt     time.Time      `json:"updatedAt"`
+	ResponseCount int            `json:"responseCount"`
+	Version       int64          `json:"-"        datastore:",noindex"`
+	DeletedAt     time.Time      `json:"-"`
+}
+
+// ThreadSearchResult is a thread or a message of a thread that matched
+// a search query. Highlights maps the names of the matched fields to
+// snippets in which the matching terms are wrapped in <em> tags.
+type ThreadSearchResult struct {
+	ThreadID   string              `json:"threadId"`
+	MessageID  string              `json:"messageId,omitempty"`
+	Subject    string              `json:"subject"`
+	Highlights map[string][]string `json:"highlights"`
+	CreatedAt  time.Time           `json:"createdAt"`
 }
 
 type ThreadStore interface {
-	GetThreadByID(ctx context.Context, id string) (*Thread, error)
+	GetThreadByID(ctx context.Context, id ID) (*Thread, error)
 	GetThreadByInt64ID(ctx context.Context, id int64) (*Thread, error)
+	GetDeletedThreadByID(ctx context.Context, id ID) (*Thread, error)
+	GetThreadsDeletedBefore(ctx context.Context, t time.Time) ([]*Thread, error)
 	GetUnhydratedThreadsByUser(ctx context.Context, u *User, p *Pagination) ([]*Thread, error)
 	GetThreadsByUser(ctx context.Context, u *User, p *Pagination) ([]*Thread, error)
+	Search(ctx context.Context, u *User, query string, p *Pagination) ([]*ThreadSearchResult, error)
 	Commit(ctx context.Context, t *Thread) error
 	CommitMulti(ctx context.Context, threads []*Thread) error
-	CommitWithTransaction(tx db.Transaction, t *Thread) (*datastore.PendingKey, error)
+	CommitWithTransaction(tx db.Transaction, t *Thread) error
+	CommitMultiWithTransaction(tx db.Transaction, threads []*Thread) error
 	Delete(ctx context.Context, t *Thread) error
-	AllocateKey(ctx context.Context) (*datastore.Key, error)
+	Restore(ctx context.Context, t *Thread) error
+	Purge(ctx context.Context, t *Thread) error
+	AllocateID(ctx context.Context) (ID, error)
 }
 
 type NewThreadInput struct {
@@ -69,44 +89,50 @@ func NewThread(
 		})
 	}
 
-	// Get all of the users' keys, remove duplicates, and check whether
+	// Get all of the users' IDs, remove duplicates, and check whether
 	// the owner was included in the users slice
-	userKeys := make([]*datastore.Key, 0)
-	seen := make(map[string]struct{})
+	userIDs := make([]ID, 0)
+	seen := make(map[ID]struct{})
 	hasOwner := false
 	for _, u := range input.Users {
 		if _, alreadySeen := seen[u.ID]; alreadySeen {
 			continue
 		}
 		seen[u.ID] = struct{}{}
-		if u.Key.Equal(input.Owner.Key) {
+		if u.ID == input.Owner.ID {
 			hasOwner = true
 		}
-		userKeys = append(userKeys, u.Key)
+		userIDs = append(userIDs, u.ID)
 	}
 
 	// Add the owner to the users if not already present
 	if !hasOwner {
-		userKeys = append(userKeys, input.Owner.Key)
+		userIDs = append(userIDs, input.Owner.ID)
 		input.Users = append(input.Users, input.Owner)
 	}
 
-	key, err := tstore.AllocateKey(ctx)
+	id, err := tstore.AllocateID(ctx)
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
 
-	link, photoURL, err := handleLinkAndPhoto(
-		ctx, sclient, ogclient, key, input.Body, input.Blob)
+	links, photoKey, err := handleLinkAndPhoto(
+		ctx, sclient, ogclient, id, input.Body, input.Blob)
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
 
-	var photos []string
-	if photoURL != "" {
-		photos = []string{photoURL}
+	var photoKeys, photos []string
+	if photoKey != "" {
+		photoKeys = []string{photoKey}
+
+		photos, err = sclient.GetPhotoURLs(ctx, photoKeys)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
 	}
 
+	link := firstLink(links)
 	if input.Subject == "" && link != nil && link.Title != "" {
 		input.Subject = link.Title
 	}
@@ -130,38 +156,38 @@ func NewThread(
 	}
 
 	t := &Thread{
-		Key:          key,
-		OwnerKey:     input.Owner.Key,
+		ID:           id,
+		OwnerID:      input.Owner.ID,
 		Owner:        MapUserToUserPartial(input.Owner),
-		UserKeys:     userKeys,
+		UserIDs:      userIDs,
 		Users:        input.Users,
 		UserPartials: MapUsersToUserPartials(input.Users),
 		Subject:      input.Subject,
-		Body:         removeLink(input.Body, link),
+		Body:         removeLinks(input.Body, links),
+		PhotoKeys:    photoKeys,
 		Photos:       photos,
 		Link:         link,
+		Links:        links,
 	}
 
-	MarkAsRead(t, input.Owner.Key)
+	MarkAsRead(t, input.Owner.ID)
 
 	return t, nil
 }
 
-func (t *Thread) LoadKey(k *datastore.Key) error {
-	t.Key = k
-
-	// Add URL safe key
-	t.ID = k.Encode()
-
-	return nil
+// ETag returns the entity tag of the current version of the thread.
+func (t *Thread) ETag() string {
+	return etag(t.Version)
 }
 
-func (t *Thread) Save() ([]datastore.Property, error) {
-	return datastore.SaveStruct(t)
-}
+// GetLinks returns the link previews of the thread. Threads created before
+// multiple previews were supported only have Link set.
+func (t *Thread) GetLinks() []*og.LinkData {
+	if len(t.Links) == 0 && t.Link != nil {
+		return []*og.LinkData{t.Link}
+	}
 
-func (t *Thread) Load(ps []datastore.Property) error {
-	return datastore.LoadStruct(t, ps)
+	return t.Links
 }
 
 func (t *Thread) GetReads() []*Read {
@@ -172,8 +198,8 @@ func (t *Thread) SetReads(newReads []*Read) {
 	t.Reads = newReads
 }
 
-func (t *Thread) GetKey() *datastore.Key {
-	return t.Key
+func (t *Thread) GetID() ID {
+	return t.ID
 }
 
 func (t *Thread) GetName() string {
@@ -185,22 +211,16 @@ func (t *Thread) GetEmail() string {
 	if len(slugified) > 20 {
 		slugified = slugified[:20]
 	}
-	return fmt.Sprintf("%s-%d@mail.convo.events", slugified, t.Key.ID)
+	return fmt.Sprintf("%s-%d@mail.convo.events", slugified, t.Int64ID)
 }
 
 func (t *Thread) HasUser(u *User) bool {
-	for _, k := range t.UserKeys {
-		if k.Equal(u.Key) {
-			return true
-		}
-	}
-
-	return false
+	return hasID(t.UserIDs, u.ID)
 }
 
 func (t *Thread) IsSendable() bool {
 	for i := range t.Users {
-		if !t.Users[i].IsRegistered() && !IsRead(t, t.Users[i].Key) {
+		if !t.Users[i].IsRegistered() && !IsRead(t, t.Users[i].ID) {
 			return true
 		}
 	}
@@ -209,15 +229,15 @@ func (t *Thread) IsSendable() bool {
 }
 
 func (t *Thread) OwnerIs(u *User) bool {
-	return t.OwnerKey.Equal(u.Key)
+	return t.OwnerID == u.ID
 }
 
 // AddUser adds a user to the thread.
 func (t *Thread) AddUser(u *User) error {
 	op := errors.Op("thread.AddUser")
 
-	if u.Key.Incomplete() {
-		return errors.E(op, errors.Str("incomplete key"))
+	if u.ID.IsZero() {
+		return errors.E(op, errors.Str("user has no ID"))
 	}
 
 	// Cannot add owner or duplicate.
@@ -228,14 +248,14 @@ func (t *Thread) AddUser(u *User) error {
 			errors.Str("already has user"))
 	}
 
-	if len(t.UserKeys) >= 11 {
+	if len(t.UserIDs) >= 11 {
 		return errors.E(op,
 			map[string]string{"message": "This Convo has the maximum number of users"},
 			http.StatusBadRequest,
 			errors.Str("user count limit"))
 	}
 
-	t.UserKeys = append(t.UserKeys, u.Key)
+	t.UserIDs = append(t.UserIDs, u.ID)
 	t.Users = append(t.Users, u)
 	t.UserPartials = append(t.UserPartials, MapUserToUserPartial(u))
 
@@ -243,14 +263,8 @@ func (t *Thread) AddUser(u *User) error {
 }
 
 func (t *Thread) RemoveUser(u *User) {
-	// Remove from keys.
-	for i, k := range t.UserKeys {
-		if k.Equal(u.Key) {
-			t.UserKeys[i] = t.UserKeys[len(t.UserKeys)-1]
-			t.UserKeys = t.UserKeys[:len(t.UserKeys)-1]
-			break
-		}
-	}
+	// Remove from IDs.
+	t.UserIDs = removeID(t.UserIDs, u.ID)
 	// Remove from users.
 	for i, c := range t.Users {
 		if c.ID == u.ID {
@@ -0,0 +1,227 @@
+package model
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+
+	"github.com/hiconvo/api/errors"
+)
+
+const (
+	// maxTimeZoneYears bounds the years that the time zone of an event is
+	// described for in its ICS.
+	maxTimeZoneYears = 5
+
+	icalLocalTimeFormat = "20060102T150405"
+)
+
+// locations caches the time zones that have been loaded by name, since
+// time.LoadLocation reads them from disk every time.
+var locations sync.Map
+
+// fractionalOffsetZones are time zones that are always a fraction of an hour
+// away from UTC, by their offsets in seconds east of UTC.
+var fractionalOffsetZones = map[int]string{
+	-9*3600 - 1800: "Pacific/Marquesas",
+	4*3600 + 1800:  "Asia/Kabul",
+	5*3600 + 1800:  "Asia/Kolkata",
+	5*3600 + 2700:  "Asia/Kathmandu",
+	6*3600 + 1800:  "Asia/Yangon",
+	8*3600 + 2700:  "Australia/Eucla",
+	9*3600 + 1800:  "Australia/Darwin",
+}
+
+// TimeZoneFromOffset returns the name of a time zone that is always offset
+// seconds east of UTC, or an empty string if there is none. It is meant for
+// events that only have an offset, which does not say when daylight saving
+// time applies, so the zones that it returns never observe it.
+func TimeZoneFromOffset(offset int) string {
+	if offset%3600 != 0 {
+		return fractionalOffsetZones[offset]
+	}
+
+	hours := offset / 3600
+
+	switch {
+	case hours == 0:
+		return "Etc/UTC"
+	case hours >= -12 && hours <= 14:
+		// The signs of the Etc zones are inverted.
+		return fmt.Sprintf("Etc/GMT%+d", -hours)
+	default:
+		return ""
+	}
+}
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	locations.Store(name, loc)
+
+	return loc, nil
+}
+
+// SetTimeZone sets the time zone of the event by its IANA name, such as
+// "Europe/Paris". An empty name sets the time zone from the UTCOffset of the
+// event. The occurrences of a recurring event keep their exceptions and
+// RSVPs.
+func (e *Event) SetTimeZone(name string) error {
+	if name == "" {
+		name = TimeZoneFromOffset(e.UTCOffset)
+	}
+
+	if name != "" {
+		if _, err := loadLocation(name); err != nil {
+			return errors.E(errors.Op("event.SetTimeZone"),
+				err,
+				map[string]string{"timeZone": "Unknown time zone"},
+				http.StatusBadRequest)
+		}
+	}
+
+	e.keepOccurrences(func() { e.TimeZone = name })
+
+	return nil
+}
+
+// location returns the time zone in which the times of the event are given.
+// Events that were saved before they had time zones only have the offset of
+// their time zone when they were created.
+func (e *Event) location() *time.Location {
+	if e.TimeZone != "" {
+		if loc, err := loadLocation(e.TimeZone); err == nil {
+			return loc
+		}
+	}
+
+	return time.FixedZone("Given", e.UTCOffset)
+}
+
+// icalParams returns the parameters of the times of the event in its ICS.
+func (e *Event) icalParams() []ics.PropertyParameter {
+	switch {
+	case e.AllDay:
+		return []ics.PropertyParameter{ics.WithValue("DATE")}
+	case e.TimeZone != "":
+		return []ics.PropertyParameter{&ics.KeyValues{Key: "TZID", Value: []string{e.TimeZone}}}
+	default:
+		return nil
+	}
+}
+
+// vtimezone describes the time zone of the event for as long as it lasts, up
+// to maxTimeZoneYears, as an iCalendar VTIMEZONE. It has an observance for
+// when the event starts and for each time that the offset changes after.
+func (e *Event) vtimezone() *ics.VTimezone {
+	loc := e.location()
+
+	from := e.Timestamp.Add(-24 * time.Hour)
+	limit := from.AddDate(maxTimeZoneYears, 0, 0)
+	to := e.endOf(e.Timestamp.In(loc))
+
+	if e.IsRecurring() {
+		to = limit
+		if !e.Recurrence.Until.IsZero() {
+			to = e.endOf(e.Recurrence.Until.In(loc))
+		}
+	}
+
+	if to.After(limit) {
+		to = limit
+	}
+
+	name, offset := from.In(loc).Zone()
+
+	tz := &ics.VTimezone{}
+	tz.Properties = []ics.IANAProperty{icalProperty("TZID", e.TimeZone)}
+	tz.Components = []ics.Component{timeZoneObservance(from, name, offset, offset, false)}
+
+	for _, t := range zoneTransitions(loc, from, to) {
+		name, next := t.In(loc).Zone()
+		tz.Components = append(tz.Components, timeZoneObservance(t, name, offset, next, next > offset))
+		offset = next
+	}
+
+	return tz
+}
+
+// zoneTransitions returns the times after from and before to at which the
+// offset of loc changes, to the minute.
+func zoneTransitions(loc *time.Location, from, to time.Time) []time.Time {
+	// Offsets never change twice within a week.
+	const step = 7 * 24 * time.Hour
+
+	var out []time.Time
+
+	_, offset := from.In(loc).Zone()
+
+	for t := from; t.Before(to); t = t.Add(step) {
+		if _, next := t.Add(step).In(loc).Zone(); next == offset {
+			continue
+		}
+
+		lo, hi := t, t.Add(step)
+		for hi.Sub(lo) > time.Minute {
+			mid := lo.Add(hi.Sub(lo) / 2)
+			if _, o := mid.In(loc).Zone(); o == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+
+		hi = hi.Truncate(time.Minute)
+		if !hi.Before(to) {
+			break
+		}
+
+		out = append(out, hi)
+		_, offset = hi.In(loc).Zone()
+	}
+
+	return out
+}
+
+// timeZoneObservance returns the observance of a VTIMEZONE that starts at t,
+// when the offset changes from one to the other.
+func timeZoneObservance(t time.Time, name string, from, to int, isDaylight bool) ics.Component {
+	base := ics.ComponentBase{
+		Properties: []ics.IANAProperty{
+			icalProperty("DTSTART", t.In(time.FixedZone("", from)).Format(icalLocalTimeFormat)),
+			icalProperty("TZOFFSETFROM", formatOffset(from)),
+			icalProperty("TZOFFSETTO", formatOffset(to)),
+			icalProperty("TZNAME", name),
+		},
+	}
+
+	if isDaylight {
+		return &ics.Daylight{ComponentBase: base}
+	}
+
+	return &ics.Standard{ComponentBase: base}
+}
+
+func icalProperty(name, value string) ics.IANAProperty {
+	return ics.IANAProperty{BaseProperty: ics.BaseProperty{IANAToken: name, Value: value}}
+}
+
+// formatOffset formats an offset in seconds east of UTC as in "+0130".
+func formatOffset(offset int) string {
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+
+	return fmt.Sprintf("%c%02d%02d", sign, offset/3600, offset%3600/60)
+}
@@ -8,7 +8,6 @@ import (
 	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/hiconvo/api/clients/db"
@@ -22,41 +21,40 @@ import (
 )
 
 type User struct {
-	Key              *datastore.Key   `json:"-"        datastore:"__key__"`
-	ID               string           `json:"id"       datastore:"-"`
-	Email            string           `json:"email"`
-	Emails           []string         `json:"emails"`
-	FirstName        string           `json:"firstName"`
-	LastName         string           `json:"lastName"`
-	FullName         string           `json:"fullName" datastore:"-"`
-	Token            string           `json:"token"`
-	RealtimeToken    string           `json:"realtimeToken"`
-	PasswordDigest   string           `json:"-"        datastore:",noindex"`
-	OAuthGoogleID    string           `json:"-"`
-	OAuthFacebookID  string           `json:"-"`
-	IsPasswordSet    bool             `json:"isPasswordSet"    datastore:"-"`
-	IsGoogleLinked   bool             `json:"isGoogleLinked"   datastore:"-"`
-	IsFacebookLinked bool             `json:"isFacebookLinked" datastore:"-"`
-	IsLocked         bool             `json:"-"`
-	Verified         bool             `json:"verified"`
-	Avatar           string           `json:"avatar"`
-	ContactKeys      []*datastore.Key `json:"-"`
-	Contacts         []*UserPartial   `json:"-"        datastore:"-"`
-	CreatedAt        time.Time        `json:"-"`
-	UpdatedAt        time.Time        `json:"-"`
-	SendDigest       bool             `json:"sendDigest"`
-	SendThreads      bool             `json:"sendThreads"`
-	SendEvents       bool             `json:"sendEvents"`
-	Tags             TagList          `json:"tags"`
+	ID               ID             `json:"id"       datastore:"-"`
+	Email            string         `json:"email"`
+	Emails           []string       `json:"emails"`
+	FirstName        string         `json:"firstName"`
+	LastName         string         `json:"lastName"`
+	FullName         string         `json:"fullName" datastore:"-"`
+	Token            string         `json:"token"`
+	RealtimeToken    string         `json:"realtimeToken"`
+	PasswordDigest   string         `json:"-"        datastore:",noindex"`
+	OAuthGoogleID    string         `json:"-"`
+	OAuthFacebookID  string         `json:"-"`
+	IsPasswordSet    bool           `json:"isPasswordSet"    datastore:"-"`
+	IsGoogleLinked   bool           `json:"isGoogleLinked"   datastore:"-"`
+	IsFacebookLinked bool           `json:"isFacebookLinked" datastore:"-"`
+	IsLocked         bool           `json:"-"`
+	Verified         bool           `json:"verified"`
+	Avatar           string         `json:"avatar"`
+	ContactIDs       []ID           `json:"-"        datastore:"ContactKeys"`
+	Contacts         []*UserPartial `json:"-"        datastore:"-"`
+	CreatedAt        time.Time      `json:"-"`
+	UpdatedAt        time.Time      `json:"-"`
+	SendDigest       bool           `json:"sendDigest"`
+	SendThreads      bool           `json:"sendThreads"`
+	SendEvents       bool           `json:"sendEvents"`
+	Tags             TagList        `json:"tags"`
 }
 
 type UserInput struct {
-	ID    string `json:"id"`
+	ID    ID     `json:"id"`
 	Email string `json:"email"`
 }
 
 type UserPartial struct {
-	ID        string `json:"id"`
+	ID        ID     `json:"id"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	FullName  string `json:"fullName"`
@@ -64,7 +62,7 @@ type UserPartial struct {
 }
 
 type UserStore interface {
-	GetUserByID(ctx context.Context, id string) (*User, error)
+	GetUserByID(ctx context.Context, id ID) (*User, error)
 	GetUserByEmail(ctx context.Context, email string) (*User, bool, error)
 	GetUserByToken(ctx context.Context, token string) (*User, bool, error)
 	GetUserByOAuthID(ctx context.Context, oauthtoken, provider string) (*User, bool, error)
@@ -75,10 +73,10 @@ type UserStore interface {
 	GetContactsByUser(ctx context.Context, u *User) ([]*User, error)
 	Search(ctx context.Context, query string) ([]*UserPartial, error)
 	Commit(ctx context.Context, u *User) error
-	CommitWithTransaction(tx db.Transaction, u *User) (*datastore.PendingKey, error)
+	CommitWithTransaction(tx db.Transaction, u *User) error
+	CommitMultiWithTransaction(tx db.Transaction, users []*User) error
 	DeleteWithTransaction(ctx context.Context, tx db.Transaction, u *User) error
-	CreateOrUpdateSearchIndex(ctx context.Context, u *User)
-	IterAll(ctx context.Context) *datastore.Iterator
+	IterAll(ctx context.Context) db.Iterator
 }
 
 type Welcomer interface {
@@ -96,7 +94,6 @@ func NewIncompleteUser(emailAddress string) (*User, error) {
 	}
 
 	user := User{
-		Key:         datastore.IncompleteKey("User", nil),
 		Email:       email,
 		FirstName:   strings.Split(email, "@")[0],
 		Token:       random.Token(),
@@ -122,7 +119,6 @@ func NewUserWithPassword(emailAddress, firstName, lastName, password string) (*U
 	}
 
 	user := User{
-		Key:             datastore.IncompleteKey("User", nil),
 		Email:           email,
 		FirstName:       firstName,
 		LastName:        lastName,
@@ -163,7 +159,6 @@ func NewUserWithOAuth(emailAddress, firstName, lastName, avatar, oAuthProvider,
 	}
 
 	user := User{
-		Key:             datastore.IncompleteKey("User", nil),
 		Email:           email,
 		Emails:          []string{email},
 		FirstName:       firstName,
@@ -184,51 +179,8 @@ func NewUserWithOAuth(emailAddress, firstName, lastName, avatar, oAuthProvider,
 	return &user, nil
 }
 
-func (u *User) LoadKey(k *datastore.Key) error {
-	u.Key = k
-
-	u.ID = k.Encode()
-
-	return nil
-}
-
-func (u *User) Save() ([]datastore.Property, error) {
-	return datastore.SaveStruct(u)
-}
-
-func (u *User) Load(ps []datastore.Property) error {
-	if err := datastore.LoadStruct(u, ps); err != nil {
-		return err
-	}
-
-	u.SendDigest = true
-	u.SendThreads = true
-	u.SendEvents = true
-
-	for _, p := range ps {
-		if p.Name == "SendDigest" {
-			val := p.Value.(bool)
-			u.SendDigest = val
-		}
-
-		if p.Name == "SendThreads" {
-			val := p.Value.(bool)
-			u.SendThreads = val
-		}
-
-		if p.Name == "SendEvents" {
-			val := p.Value.(bool)
-			u.SendEvents = val
-		}
-	}
-
-	u.DeriveProperties()
-
-	return nil
-}
-
 func (u *User) GetPasswordResetMagicLink(m magic.Client) string {
-	return m.NewLink(u.Key, u.PasswordDigest, "reset")
+	return m.NewLink(u.ID.String(), u.PasswordDigest, "reset")
 }
 
 func (u *User) VerifyPasswordResetMagicLink(m magic.Client, id, ts, sig string) error {
@@ -237,7 +189,7 @@ func (u *User) VerifyPasswordResetMagicLink(m magic.Client, id, ts, sig string)
 
 func (u *User) GetVerifyEmailMagicLink(m magic.Client, email string) string {
 	salt := email + strconv.FormatBool(u.HasEmail(email))
-	return m.NewLink(u.Key, salt, "verify/"+email)
+	return m.NewLink(u.ID.String(), salt, "verify/"+email)
 }
 
 func (u *User) VerifyEmailMagicLink(m magic.Client, email, id, ts, sig string) error {
@@ -246,7 +198,7 @@ func (u *User) VerifyEmailMagicLink(m magic.Client, email, id, ts, sig string) e
 }
 
 func (u *User) GetMagicLoginMagicLink(m magic.Client) string {
-	return m.NewLink(u.Key, u.Token, "magic")
+	return m.NewLink(u.ID.String(), u.Token, "magic")
 }
 
 func (u *User) VerifyMagicLogin(m magic.Client, id, ts, sig string) error {
@@ -254,7 +206,7 @@ func (u *User) VerifyMagicLogin(m magic.Client, id, ts, sig string) error {
 }
 
 func (u *User) GetUnsubscribeMagicLink(m magic.Client) string {
-	return m.NewLink(u.Key, u.Token, "unsubscribe")
+	return m.NewLink(u.ID.String(), u.Token, "unsubscribe")
 }
 
 func (u *User) VerifyUnsubscribeMagicLink(m magic.Client, id, ts, sig string) error {
@@ -380,12 +332,12 @@ func (u *User) MergeWith(
 	ns NoteStore,
 	oldUser *User,
 ) error {
-	if u.Key.Incomplete() {
-		return errors.Str("models.MergeWith: user's key is incomplete")
+	if u.ID.IsZero() {
+		return errors.Str("models.MergeWith: user has no ID")
 	}
 
-	if oldUser.Key.Incomplete() {
-		return errors.Str("models.MergeWith: oldUser's key is incomplete")
+	if oldUser.ID.IsZero() {
+		return errors.Str("models.MergeWith: oldUser has no ID")
 	}
 
 	_, err := transacter.RunInTransaction(ctx, func(tx db.Transaction) error {
@@ -432,11 +384,11 @@ func (u *User) MergeWith(
 		for _, email := range oldUser.Emails {
 			u.AddEmail(email)
 		}
-		u.ContactKeys = mergeContacts(u.ContactKeys, oldUser.ContactKeys)
+		u.ContactIDs = mergeIDs(u.ContactIDs, oldUser.ContactIDs)
 		u.RemoveContact(oldUser)
 
 		// Save user
-		_, err = us.CommitWithTransaction(tx, u)
+		err = us.CommitWithTransaction(tx, u)
 		if err != nil {
 			return err
 		}
@@ -449,8 +401,6 @@ func (u *User) MergeWith(
 		return nil
 	})
 
-	us.CreateOrUpdateSearchIndex(ctx, u)
-
 	return err
 }
 
@@ -462,17 +412,17 @@ func (u *User) AddContact(c *User) error {
 			"message": "You already have this contact"})
 	}
 
-	if u.Key.Equal(c.Key) {
+	if u.ID == c.ID {
 		return errors.E(op, http.StatusBadRequest, map[string]string{
 			"message": "You cannot add yourself as a contact"})
 	}
 
-	if len(u.ContactKeys) >= 50 {
+	if len(u.ContactIDs) >= 50 {
 		return errors.E(op, http.StatusBadRequest, map[string]string{
 			"message": "You can have a maximum of 50 contacts"})
 	}
 
-	u.ContactKeys = append(u.ContactKeys, c.Key)
+	u.ContactIDs = append(u.ContactIDs, c.ID)
 
 	return nil
 }
@@ -485,26 +435,13 @@ func (u *User) RemoveContact(c *User) error {
 			map[string]string{"message": "You don't have this contact"})
 	}
 
-	for i, k := range u.ContactKeys {
-		if k.Equal(c.Key) {
-			u.ContactKeys[i] = u.ContactKeys[len(u.ContactKeys)-1]
-			u.ContactKeys = u.ContactKeys[:len(u.ContactKeys)-1]
-
-			return nil
-		}
-	}
+	u.ContactIDs = removeID(u.ContactIDs, c.ID)
 
 	return nil
 }
 
 func (u *User) HasContact(c *User) bool {
-	for _, k := range u.ContactKeys {
-		if k.Equal(c.Key) {
-			return true
-		}
-	}
-
-	return false
+	return hasID(u.ContactIDs, c.ID)
 }
 
 func MapUserToUserPartial(u *User) *UserPartial {
@@ -545,19 +482,19 @@ func MapUserPartialToUser(c *UserPartial, users []*User) (*User, error) {
 	return nil, errors.Str("Matching user not in slice")
 }
 
-func MapUsersToKeys(users []*User) []*datastore.Key {
-	ups := make([]*datastore.Key, len(users))
+func MapUsersToIDs(users []*User) []ID {
+	ids := make([]ID, len(users))
 	for i, u := range users {
-		ups[i] = u.Key
+		ids[i] = u.ID
 	}
 
-	return ups
+	return ids
 }
 
 func UserWelcomeMulti(ctx context.Context, q queue.Client, users []*User) {
 	ids := make([]string, len(users))
 	for i := range users {
-		ids[i] = users[i].ID
+		ids[i] = users[i].ID.String()
 	}
 
 	err := q.PutEmail(ctx, queue.EmailPayload{
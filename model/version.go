@@ -0,0 +1,55 @@
+package model
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/hiconvo/api/errors"
+)
+
+// maxConflictAttempts is how many times RetryOnConflict calls its function.
+const maxConflictAttempts = 3
+
+// Threads, events and notes have a version that is incremented every time
+// they are committed. Their stores refuse to commit them when the stored
+// version is not the one that was loaded, since that means that they were
+// changed in the meantime and committing them would overwrite the changes.
+
+// etag returns the entity tag of the given version, which identifies the
+// version in ETag and If-Match headers.
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// ErrConflict returns the error of a commit that would overwrite a
+// concurrent change. It is reported to clients as a 409 Conflict.
+func ErrConflict(op errors.Op) error {
+	return errors.E(op, errors.Str("version conflict"), http.StatusConflict)
+}
+
+// IsConflict reports whether err is due to a concurrent change, either
+// because a version did not match or because a transaction conflicted with
+// another one.
+func IsConflict(err error) bool {
+	r, ok := err.(errors.ClientReporter)
+	return ok && r.StatusCode() == http.StatusConflict
+}
+
+// RetryOnConflict calls f until it does not fail because of a concurrent
+// change, at most a few times, and returns the last error. attempt is zero
+// the first time. Whatever f loaded before is stale when it is retried, so
+// f must load what it changes again when attempt is not zero. This is only
+// suitable for changes that can be applied on top of any other change, such
+// as marking something as read.
+func RetryOnConflict(f func(attempt int) error) error {
+	var err error
+
+	for attempt := 0; attempt < maxConflictAttempts; attempt++ {
+		err = f(attempt)
+		if !IsConflict(err) {
+			return err
+		}
+	}
+
+	return err
+}
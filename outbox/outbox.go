@@ -0,0 +1,228 @@
+// Package outbox delivers side effects such as notifications, emails and
+// search index updates after the changes that cause them have been saved.
+// Side effects are recorded in the same transaction as the change, so a
+// rollback discards them and a crash cannot lose them.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hiconvo/api/clients/db"
+	notif "github.com/hiconvo/api/clients/notification"
+	"github.com/hiconvo/api/clients/queue"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/log"
+	"github.com/hiconvo/api/model"
+)
+
+const (
+	DefaultMaxAttempts = 10
+	DefaultBatchSize   = 100
+	// DefaultLease is how long a message is left to be delivered by the
+	// request that recorded it before Dispatch picks it up.
+	DefaultLease = time.Minute
+	// maxBackoff caps the time between attempts.
+	maxBackoff = 6 * time.Hour
+)
+
+// Client records side effects in the outbox. It implements notification.Client
+// and queue.Client so that it can stand in for them: notifications and emails
+// are recorded in the pending transaction of the given context, if any, and
+// delivered once it has been committed.
+type Client interface {
+	model.Outbox
+	notif.Client
+	queue.Client
+	// Dispatch delivers the messages that are due and returns the number of
+	// messages that were delivered.
+	Dispatch(ctx context.Context) (int, error)
+}
+
+type Config struct {
+	Store   model.OutboxStore
+	Notif   notif.Client
+	Queue   queue.Client
+	Indexer model.SearchIndexer
+	// MaxAttempts is the number of failed attempts after which a message
+	// is given up on. It is kept for inspection.
+	MaxAttempts int
+	// BatchSize is the maximum number of messages delivered by a single
+	// call to Dispatch.
+	BatchSize int
+	Lease     time.Duration
+}
+
+type clientImpl struct {
+	*Config
+}
+
+func New(c *Config) Client {
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = DefaultMaxAttempts
+	}
+
+	if c.BatchSize == 0 {
+		c.BatchSize = DefaultBatchSize
+	}
+
+	if c.Lease == 0 {
+		c.Lease = DefaultLease
+	}
+
+	return &clientImpl{Config: c}
+}
+
+func (c *clientImpl) Enqueue(ctx context.Context, m *model.OutboxMessage) error {
+	if tx, ok := db.TransactionFromContext(ctx); ok && tx.Pending() {
+		return c.EnqueueWithTransaction(tx, m)
+	}
+
+	m.NextAttemptAt = time.Now().Add(c.Lease)
+
+	if err := c.Store.Commit(ctx, m); err != nil {
+		return errors.E(errors.Opf("outbox.Enqueue(type=%s)", m.Type), err)
+	}
+
+	c.deliver(ctx, m)
+
+	return nil
+}
+
+func (c *clientImpl) EnqueueWithTransaction(tx db.Transaction, m *model.OutboxMessage) error {
+	m.NextAttemptAt = time.Now().Add(c.Lease)
+
+	if err := c.Store.CommitWithTransaction(tx, m); err != nil {
+		return errors.E(errors.Opf("outbox.EnqueueWithTransaction(type=%s)", m.Type), err)
+	}
+
+	// The request may be over by the time the transaction is committed.
+	tx.OnCommit(func() {
+		c.deliver(context.Background(), m)
+	})
+
+	return nil
+}
+
+// Put records the notification in the outbox.
+func (c *clientImpl) Put(ctx context.Context, n *notif.Notification) error {
+	return c.putPayload(ctx, model.OutboxNotification, n)
+}
+
+// PutEmail records the email payload in the outbox.
+func (c *clientImpl) PutEmail(ctx context.Context, payload queue.EmailPayload) error {
+	return c.putPayload(ctx, model.OutboxEmail, payload)
+}
+
+// GenerateToken does not have side effects, so it is not recorded.
+func (c *clientImpl) GenerateToken(userID string) string {
+	return c.Notif.GenerateToken(userID)
+}
+
+func (c *clientImpl) Dispatch(ctx context.Context) (int, error) {
+	op := errors.Op("outbox.Dispatch")
+
+	messages, err := c.Store.GetDueOutboxMessages(ctx, time.Now(), c.BatchSize)
+	if err != nil {
+		return 0, errors.E(op, err)
+	}
+
+	var count int
+
+	for i := range messages {
+		if c.deliver(ctx, messages[i]) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (c *clientImpl) putPayload(ctx context.Context, t model.OutboxMessageType, payload interface{}) error {
+	m, err := model.NewOutboxMessage(t, payload)
+	if err != nil {
+		return errors.E(errors.Opf("outbox.putPayload(type=%s)", t), err)
+	}
+
+	return c.Enqueue(ctx, m)
+}
+
+// deliver delivers m and deletes it. When delivery fails, the next attempt
+// is scheduled with an exponential backoff. It reports whether m was
+// delivered.
+func (c *clientImpl) deliver(ctx context.Context, m *model.OutboxMessage) bool {
+	op := errors.Opf("outbox.deliver(type=%s)", m.Type)
+
+	err := c.handle(ctx, m)
+	if err == nil {
+		if err := c.Store.Delete(ctx, m); err != nil {
+			// The message will be delivered again, which is fine.
+			log.Alarm(errors.E(op, err))
+		}
+
+		return true
+	}
+
+	m.Attempts++
+	m.LastError = err.Error()
+	m.NextAttemptAt = time.Now().Add(backoff(m.Attempts))
+
+	if m.Attempts >= c.MaxAttempts {
+		m.Failed = true
+		log.Alarm(errors.E(op, errors.Errorf("giving up after %d attempts", m.Attempts), err))
+	} else {
+		log.Printf("%s: attempt %d failed: %v", string(op), m.Attempts, err)
+	}
+
+	if err := c.Store.Commit(db.WithoutTransaction(ctx), m); err != nil {
+		log.Alarm(errors.E(op, err))
+	}
+
+	return false
+}
+
+func (c *clientImpl) handle(ctx context.Context, m *model.OutboxMessage) error {
+	switch m.Type {
+	case model.OutboxNotification:
+		n := new(notif.Notification)
+		if err := json.Unmarshal([]byte(m.Payload), n); err != nil {
+			return err
+		}
+
+		return c.Notif.Put(ctx, n)
+	case model.OutboxEmail:
+		var payload queue.EmailPayload
+		if err := json.Unmarshal([]byte(m.Payload), &payload); err != nil {
+			return err
+		}
+
+		return c.Queue.PutEmail(ctx, payload)
+	case model.OutboxSearch:
+		if c.Indexer == nil {
+			return nil
+		}
+
+		var id model.ID
+		if err := json.Unmarshal([]byte(m.Payload), &id); err != nil {
+			return err
+		}
+
+		return c.Indexer.UpdateSearchIndex(ctx, id)
+	default:
+		return errors.Errorf("unknown message type %q", m.Type)
+	}
+}
+
+func backoff(attempts int) time.Duration {
+	d := time.Minute
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+
+	return d
+}
@@ -0,0 +1,245 @@
+// Package purge permanently deletes the threads, events, messages and notes
+// that can no longer be restored, and tells the guests of deleted events
+// that they were cancelled.
+package purge
+
+import (
+	"context"
+	"time"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/clients/magic"
+	notif "github.com/hiconvo/api/clients/notification"
+	"github.com/hiconvo/api/clients/queue"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/log"
+	"github.com/hiconvo/api/mail"
+	"github.com/hiconvo/api/model"
+)
+
+type Purger interface {
+	// Purge permanently deletes everything that was deleted longer than
+	// model.RestoreWindow ago and returns the number of threads, events,
+	// messages and notes that were purged.
+	Purge(ctx context.Context) (int, error)
+	// CancelDeleted cancels the deleted events that have not happened yet
+	// once their guests are due to be told, and returns the number of
+	// events that were cancelled.
+	CancelDeleted(ctx context.Context) (int, error)
+}
+
+type Config struct {
+	DB           db.Client
+	Queue        queue.Client
+	ThreadStore  model.ThreadStore
+	EventStore   model.EventStore
+	MessageStore model.MessageStore
+	NoteStore    model.NoteStore
+	Mail         *mail.Client
+	Magic        magic.Client
+	Notif        notif.Client
+}
+
+type purgerImpl struct {
+	*Config
+}
+
+func New(c *Config) Purger {
+	return &purgerImpl{Config: c}
+}
+
+// Purge purges threads and events before messages, since their messages are
+// purged along with them. Entities that cannot be purged are logged and left
+// for the next run.
+func (p *purgerImpl) Purge(ctx context.Context) (int, error) {
+	op := errors.Op("purge.Purge")
+	before := model.PurgeBefore()
+	count := 0
+
+	threads, err := p.ThreadStore.GetThreadsDeletedBefore(ctx, before)
+	if err != nil {
+		return count, errors.E(op, err)
+	}
+
+	for i := range threads {
+		if err := p.ThreadStore.Purge(ctx, threads[i]); err != nil {
+			log.Alarm(errors.E(op, err))
+			continue
+		}
+
+		count++
+	}
+
+	events, err := p.EventStore.GetEventsDeletedBefore(ctx, before)
+	if err != nil {
+		return count, errors.E(op, err)
+	}
+
+	for i := range events {
+		if err := p.cancelEvent(ctx, events[i]); err != nil {
+			log.Alarm(errors.E(op, err))
+			continue
+		}
+
+		if err := p.EventStore.Purge(ctx, events[i]); err != nil {
+			log.Alarm(errors.E(op, err))
+			continue
+		}
+
+		count++
+	}
+
+	messages, err := p.MessageStore.GetMessagesDeletedBefore(ctx, before)
+	if err != nil {
+		return count, errors.E(op, err)
+	}
+
+	for i := range messages {
+		if err := p.MessageStore.Purge(ctx, messages[i]); err != nil {
+			log.Alarm(errors.E(op, err))
+			continue
+		}
+
+		count++
+	}
+
+	notes, err := p.NoteStore.GetNotesDeletedBefore(ctx, before)
+	if err != nil {
+		return count, errors.E(op, err)
+	}
+
+	for i := range notes {
+		if err := p.NoteStore.Purge(ctx, notes[i]); err != nil {
+			log.Alarm(errors.E(op, err))
+			continue
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// CancelDeleted cancels each event in the same transaction that queues its
+// cancellation, so that guests are told once even when runs overlap. Events
+// that cannot be cancelled are logged and left for the next run.
+func (p *purgerImpl) CancelDeleted(ctx context.Context) (int, error) {
+	op := errors.Op("purge.CancelDeleted")
+	now := time.Now()
+	count := 0
+
+	events, err := p.EventStore.GetEventsDeletedAfter(ctx, model.PurgeBefore())
+	if err != nil {
+		return count, errors.E(op, err)
+	}
+
+	for i := range events {
+		if !events[i].IsCancellationDue(now) {
+			continue
+		}
+
+		if err := p.cancelDeletedEvent(ctx, events[i]); err != nil {
+			log.Alarm(errors.E(op, err))
+			continue
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// cancelDeletedEvent cancels the deleted event, which stays deleted, and
+// queues the emails that tell its guests.
+func (p *purgerImpl) cancelDeletedEvent(ctx context.Context, e *model.Event) error {
+	op := errors.Opf("purge.cancelDeletedEvent(id=%s)", e.ID)
+
+	ctx, tx, err := db.AddTransactionToContext(ctx, p.DB)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	defer func() {
+		if tx.Pending() {
+			tx.Rollback()
+		}
+	}()
+
+	event, err := p.EventStore.GetDeletedEventByID(ctx, e.ID)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := event.Cancel(event.CancelMessage); err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := p.EventStore.CommitWithTransaction(tx, event); err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := event.SendCancellationAsync(ctx, p.Queue); err != nil {
+		return errors.E(op, err)
+	}
+
+	n := &notif.Notification{
+		UserIDs:    notif.FilterID(model.IDStrings(event.UserIDs), event.OwnerID.String()),
+		Actor:      event.Owner.FullName,
+		Verb:       notif.DeleteEvent,
+		Target:     notif.Event,
+		TargetID:   event.ID.String(),
+		TargetName: event.Name,
+	}
+
+	// Only the run that commits the cancellation notifies.
+	tx.OnCommit(func() {
+		if err := p.Notif.Put(context.Background(), n); err != nil {
+			log.Alarm(errors.E(op, err))
+		}
+	})
+
+	if _, err := tx.Commit(); err != nil {
+		return errors.E(op, err)
+	}
+
+	return nil
+}
+
+// cancelEvent tells the guests of an event that has not happened yet that
+// it was cancelled, unless they were already told when it was cancelled or
+// once its CancelDelay passed, in case CancelDeleted failed to cancel it.
+func (p *purgerImpl) cancelEvent(ctx context.Context, e *model.Event) error {
+	op := errors.Opf("purge.cancelEvent(id=%s)", e.ID)
+
+	if !e.IsInFuture() || e.IsCancelled() {
+		return nil
+	}
+
+	event, err := p.EventStore.GetDeletedEventByID(ctx, e.ID)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	// The event is not saved again, but it is cancelled so that the
+	// calendars of its guests remove it.
+	if err := event.Cancel(event.CancelMessage); err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := p.Mail.SendCancellation(p.Magic, event, event.CancelMessage); err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := p.Notif.Put(ctx, &notif.Notification{
+		UserIDs:    notif.FilterID(model.IDStrings(event.UserIDs), event.OwnerID.String()),
+		Actor:      event.Owner.FullName,
+		Verb:       notif.DeleteEvent,
+		Target:     notif.Event,
+		TargetID:   event.ID.String(),
+		TargetName: event.Name,
+	}); err != nil {
+		// Log the error but don't keep the event from being purged
+		log.Alarm(errors.E(op, err))
+	}
+
+	return nil
+}
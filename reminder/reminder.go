@@ -0,0 +1,101 @@
+// Package reminder schedules the reminder emails of upcoming events.
+package reminder
+
+import (
+	"context"
+	"time"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/clients/queue"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/log"
+	"github.com/hiconvo/api/model"
+)
+
+type Scheduler interface {
+	// Schedule queues the reminders of events that are due now and returns
+	// the number of events whose guests are reminded.
+	Schedule(ctx context.Context) (int, error)
+}
+
+type Config struct {
+	DB         db.Client
+	EventStore model.EventStore
+	Queue      queue.Client
+}
+
+type schedulerImpl struct {
+	*Config
+}
+
+func New(c *Config) Scheduler {
+	return &schedulerImpl{Config: c}
+}
+
+// Schedule marks the reminders of each event as sent in the same transaction
+// that queues them, so that guests are reminded once even when runs overlap.
+// Events that cannot be reminded are logged and left for the next run.
+func (s *schedulerImpl) Schedule(ctx context.Context) (int, error) {
+	op := errors.Op("reminder.Schedule")
+	now := time.Now()
+	count := 0
+
+	events, err := s.EventStore.GetEventsWithRemindersDue(ctx, now)
+	if err != nil {
+		return count, errors.E(op, err)
+	}
+
+	for i := range events {
+		sent, err := s.remind(ctx, events[i], now)
+		if err != nil {
+			log.Alarm(errors.E(op, err))
+			continue
+		}
+
+		if sent {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// remind queues the reminder of the event that is due at t, if it is not
+// too late for it, and reports whether it did.
+func (s *schedulerImpl) remind(ctx context.Context, e *model.Event, t time.Time) (bool, error) {
+	op := errors.Opf("reminder.remind(id=%s)", e.ID)
+
+	ctx, tx, err := db.AddTransactionToContext(ctx, s.DB)
+	if err != nil {
+		return false, errors.E(op, err)
+	}
+	defer func() {
+		if tx.Pending() {
+			tx.Rollback()
+		}
+	}()
+
+	start, due := e.DueReminder(t)
+	if due {
+		if err := s.Queue.PutEmail(ctx, queue.EmailPayload{
+			Type:       queue.Event,
+			Action:     queue.SendReminders,
+			IDs:        []string{e.ID.String()},
+			Occurrence: start,
+		}); err != nil {
+			return false, errors.E(op, err)
+		}
+	}
+
+	e.MarkReminded(t)
+
+	if err := s.EventStore.CommitWithTransaction(tx, e); err != nil {
+		return false, errors.E(op, err)
+	}
+
+	if _, err := tx.Commit(); err != nil {
+		return false, errors.E(op, err)
+	}
+
+	return due, nil
+}
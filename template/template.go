@@ -14,6 +14,7 @@ const (
 	_tplStrMessage      = "%s said:\n\n%s\n\n"
 	_tplStrEvent        = "%s invited you to:\n\n%s\n\n%s\n\n%s\n\n%s\n"
 	_tplStrCancellation = "%s has cancelled:\n\n%s\n\n%s\n\n%s\n\n%s"
+	_tplStrReminder     = "Reminder from %s:\n\n%s\n\n%s\n\n%s\n\n%s\n"
 )
 
 // Message is a renderable message. It is always a constituent of a
@@ -25,8 +26,9 @@ type Message struct {
 	FromID    string
 	ToID      string
 	HasPhoto  bool
+	Photos    []string
 	HasLink   bool
-	Link      *opengraph.LinkData
+	Links     []*opengraph.LinkData
 	MagicLink string
 }
 
@@ -118,6 +120,7 @@ func NewClient() *Client {
 		"thread.html",
 		"event.html",
 		"cancellation.html",
+		"reminder.html",
 		"digest.html",
 		"admin.html",
 	} {
@@ -194,6 +197,27 @@ func (c *Client) RenderCancellation(e *Event) (string, string, error) {
 	return plainText, html, err
 }
 
+// RenderReminder returns a rendered event reminder email.
+func (c *Client) RenderReminder(e *Event) (string, string, error) {
+	e.RenderMarkdown(e.Description)
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, _tplStrReminder,
+		e.FromName,
+		e.Name,
+		e.Address,
+		e.Time,
+		e.Description)
+	plainText := builder.String()
+	preview := getPreview(plainText)
+
+	e.Preview = preview
+
+	html, err := e.RenderHTML(c.templates["reminder.html"], e)
+
+	return plainText, html, err
+}
+
 // RenderDigest returns a rendered digest email.
 func (c *Client) RenderDigest(d *Digest) (string, string, error) {
 	for i := range d.Items {
@@ -0,0 +1,496 @@
+package testutil
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/icrowley/fake"
+
+	dbc "github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/db"
+	"github.com/hiconvo/api/errors"
+	"github.com/hiconvo/api/model"
+)
+
+// RunStoreContract tests the stores against dbClient. Every backend that
+// the stores can run on must pass it. The database should be empty.
+func RunStoreContract(ctx context.Context, t *testing.T, dbClient dbc.Client) {
+	_, m := Handler(dbClient, NewSearchClient())
+
+	t.Run("UserStore", func(t *testing.T) {
+		u, _ := m.NewUser(ctx, t)
+
+		got, err := m.UserStore.GetUserByID(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Email != u.Email || got.ID != u.ID {
+			t.Errorf("GetUserByID returned %q, want %q", got.Email, u.Email)
+		}
+
+		got, found, err := m.UserStore.GetUserByEmail(ctx, u.Email)
+		if err != nil || !found || got.ID != u.ID {
+			t.Errorf("GetUserByEmail(%q) = %v, %v, %v", u.Email, got, found, err)
+		}
+
+		got, found, err = m.UserStore.GetUserByToken(ctx, u.Token)
+		if err != nil || !found || got.ID != u.ID {
+			t.Errorf("GetUserByToken = %v, %v, %v", got, found, err)
+		}
+
+		if _, found, err := m.UserStore.GetUserByEmail(ctx, fake.EmailAddress()); err != nil || found {
+			t.Errorf("GetUserByEmail found a user that does not exist: %v", err)
+		}
+
+		if _, created, err := m.UserStore.GetOrCreateUserByEmail(ctx, u.Email); err != nil || created {
+			t.Errorf("GetOrCreateUserByEmail created an existing user: %v", err)
+		}
+
+		created, isNew, err := m.UserStore.GetOrCreateUserByEmail(ctx, fake.EmailAddress())
+		if err != nil || !isNew || created.ID.IsZero() {
+			t.Errorf("GetOrCreateUserByEmail did not create a user: %v", err)
+		}
+	})
+
+	t.Run("NoteStore", func(t *testing.T) {
+		u, _ := m.NewUser(ctx, t)
+		other, _ := m.NewUser(ctx, t)
+
+		var notes []*model.Note
+		for i := 0; i < 3; i++ {
+			notes = append(notes, m.NewNote(ctx, t, u))
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		m.NewNote(ctx, t, other)
+
+		got, err := m.NoteStore.GetNotesByUser(ctx, u, &model.Pagination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertIDs(t, "GetNotesByUser", noteIDs(got), noteIDs([]*model.Note{notes[2], notes[1], notes[0]}))
+
+		got, err = m.NoteStore.GetNotesByUser(ctx, u, &model.Pagination{Page: 1, Size: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertIDs(t, "GetNotesByUser(page=1)", noteIDs(got), noteIDs(notes[:1]))
+
+		if err := m.NoteStore.Delete(ctx, notes[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m.NoteStore.GetNoteByID(ctx, notes[0].ID); !isNotFound(err) {
+			t.Errorf("GetNoteByID returned %v for a deleted note", err)
+		}
+	})
+
+	t.Run("ThreadStore", func(t *testing.T) {
+		owner, _ := m.NewUser(ctx, t)
+		member, _ := m.NewUser(ctx, t)
+		th := m.NewThread(ctx, t, owner, []*model.User{member})
+
+		got, err := m.ThreadStore.GetThreadByID(ctx, th.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Subject != th.Subject || !got.HasUser(member) {
+			t.Errorf("GetThreadByID returned %q, want %q with its users", got.Subject, th.Subject)
+		}
+
+		threads, err := m.ThreadStore.GetThreadsByUser(ctx, member, &model.Pagination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertIDs(t, "GetThreadsByUser", threadIDs(threads), []model.ID{th.ID})
+
+		if err := m.ThreadStore.Delete(ctx, th); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m.ThreadStore.GetThreadByID(ctx, th.ID); !isNotFound(err) {
+			t.Errorf("GetThreadByID returned %v for a deleted thread", err)
+		}
+	})
+
+	t.Run("EventStore", func(t *testing.T) {
+		owner, _ := m.NewUser(ctx, t)
+		guest, _ := m.NewUser(ctx, t)
+		ev := m.NewEvent(ctx, t, owner, nil, []*model.User{guest})
+
+		got, err := m.EventStore.GetEventByID(ctx, ev.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Name != ev.Name || !got.HasUser(guest) || !got.Timestamp.Equal(ev.Timestamp.Truncate(time.Millisecond)) {
+			t.Errorf("GetEventByID returned %q at %v, want %q at %v", got.Name, got.Timestamp, ev.Name, ev.Timestamp)
+		}
+
+		events, err := m.EventStore.GetEventsByUser(ctx, guest, &model.Pagination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertIDs(t, "GetEventsByUser", eventIDs(events), []model.ID{ev.ID})
+
+		start := time.Date(2030, 6, 5, 18, 0, 0, 0, time.UTC)
+		ev.Reschedule(start)
+
+		if err := ev.SetRecurrence(&model.Recurrence{
+			Frequency:  model.FrequencyWeekly,
+			Count:      3,
+			Exceptions: []time.Time{start.AddDate(0, 0, 7)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ev.AddOccurrenceRSVP(guest, start.AddDate(0, 0, 14)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ev.SetRSVP(guest, model.RSVPMaybe, 2, "note"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.EventStore.Commit(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err = m.EventStore.GetEventByID(ctx, ev.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if occurrences := got.GetOccurrences(time.Time{}, time.Time{}, 10); len(occurrences) != 2 ||
+			!got.HasOccurrenceRSVP(guest, start.AddDate(0, 0, 14)) {
+			t.Errorf("GetEventByID returned occurrences %v with RSVPs %v", occurrences, got.OccurrenceRSVPs)
+		}
+
+		if r := got.GetRSVP(guest); r == nil || r.Status != model.RSVPMaybe || r.Guests != 2 || len(got.Maybes) != 1 {
+			t.Errorf("GetEventByID returned responses %v", got.Responses)
+		}
+
+		if err := m.EventStore.Delete(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m.EventStore.GetEventByID(ctx, ev.ID); !isNotFound(err) {
+			t.Errorf("GetEventByID returned %v for a deleted event", err)
+		}
+	})
+
+	t.Run("MessageStore", func(t *testing.T) {
+		owner, _ := m.NewUser(ctx, t)
+		th := m.NewThread(ctx, t, owner, nil)
+
+		var messages []*model.Message
+		for i := 0; i < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			messages = append(messages, m.NewThreadMessage(ctx, t, owner, th))
+		}
+
+		got, err := m.MessageStore.GetMessagesByThread(ctx, th, &model.Pagination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertIDs(t, "GetMessagesByThread", messageIDs(got)[len(got)-2:], messageIDs(messages))
+
+		if err := m.MessageStore.Delete(ctx, messages[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m.MessageStore.GetMessageByID(ctx, messages[1].ID); !isNotFound(err) {
+			t.Errorf("GetMessageByID returned %v for a deleted message", err)
+		}
+	})
+
+	t.Run("Transactions", func(t *testing.T) {
+		owner, _ := m.NewUser(ctx, t)
+		th := m.NewThread(ctx, t, owner, nil)
+		subject := th.Subject
+
+		tx, err := dbClient.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		th.Subject = "rolled back"
+		if err := m.ThreadStore.CommitWithTransaction(tx, th); err != nil {
+			t.Fatal(err)
+		}
+
+		var called bool
+		tx.OnCommit(func() { called = true })
+
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := m.ThreadStore.GetThreadByID(ctx, th.ID); err != nil || got.Subject != subject {
+			t.Errorf("rolled back transaction changed the thread: %v", err)
+		}
+
+		if called {
+			t.Error("OnCommit hook was called after rollback")
+		}
+
+		_, err = dbClient.RunInTransaction(ctx, func(tx dbc.Transaction) error {
+			got, err := m.ThreadStore.GetThreadByID(ctx, th.ID)
+			if err != nil {
+				return err
+			}
+
+			got.Subject = "committed"
+			tx.OnCommit(func() { called = true })
+
+			err = m.ThreadStore.CommitWithTransaction(tx, got)
+
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := m.ThreadStore.GetThreadByID(ctx, th.ID); err != nil || got.Subject != "committed" {
+			t.Errorf("committed transaction did not change the thread: %v", err)
+		}
+
+		if !called {
+			t.Error("OnCommit hook was not called after commit")
+		}
+	})
+
+	t.Run("Versions", func(t *testing.T) {
+		owner, _ := m.NewUser(ctx, t)
+		th := m.NewThread(ctx, t, owner, nil)
+		ev := m.NewEvent(ctx, t, owner, nil, nil)
+		n := m.NewNote(ctx, t, owner)
+
+		staleThread, err := m.ThreadStore.GetThreadByID(ctx, th.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		th.Subject = "first"
+		if err := m.ThreadStore.Commit(ctx, th); err != nil {
+			t.Fatal(err)
+		}
+
+		staleThread.Subject = "second"
+		if err := m.ThreadStore.Commit(ctx, staleThread); !model.IsConflict(err) {
+			t.Errorf("ThreadStore.Commit returned %v for a stale thread", err)
+		}
+
+		if got, err := m.ThreadStore.GetThreadByID(ctx, th.ID); err != nil || got.Subject != "first" {
+			t.Errorf("stale thread overwrote the thread: %v", err)
+		}
+
+		staleEvent, err := m.EventStore.GetEventByID(ctx, ev.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.EventStore.Commit(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = dbClient.RunInTransaction(ctx, func(tx dbc.Transaction) error {
+			err := m.EventStore.CommitWithTransaction(tx, staleEvent)
+			return err
+		})
+		if !model.IsConflict(err) {
+			t.Errorf("EventStore.CommitWithTransaction returned %v for a stale event", err)
+		}
+
+		staleNote, err := m.NoteStore.GetNoteByID(ctx, n.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.NoteStore.Commit(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.NoteStore.Commit(ctx, staleNote); !model.IsConflict(err) {
+			t.Errorf("NoteStore.Commit returned %v for a stale note", err)
+		}
+
+		if n.ETag() == staleNote.ETag() {
+			t.Errorf("committed and stale notes have the same ETag %s", n.ETag())
+		}
+	})
+
+	t.Run("SoftDelete", func(t *testing.T) {
+		owner, _ := m.NewUser(ctx, t)
+		th := m.NewThread(ctx, t, owner, nil)
+		message := m.NewThreadMessage(ctx, t, owner, th)
+		n := m.NewNote(ctx, t, owner)
+
+		if err := m.ThreadStore.Delete(ctx, th); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.NoteStore.Delete(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+
+		threads, err := m.ThreadStore.GetThreadsByUser(ctx, owner, &model.Pagination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertIDs(t, "GetThreadsByUser", threadIDs(threads), nil)
+
+		notes, err := m.NoteStore.GetNotesByUser(ctx, owner, &model.Pagination{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertIDs(t, "GetNotesByUser", noteIDs(notes), nil)
+
+		if _, err := m.ThreadStore.GetDeletedThreadByID(ctx, th.ID); err != nil {
+			t.Errorf("GetDeletedThreadByID returned %v for a deleted thread", err)
+		}
+
+		deleted, err := m.NoteStore.GetNotesDeletedBefore(ctx, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for i := range deleted {
+			found = found || deleted[i].ID == n.ID
+		}
+
+		if !found {
+			t.Errorf("GetNotesDeletedBefore did not return the deleted note")
+		}
+
+		if err := m.NoteStore.Restore(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m.NoteStore.GetNoteByID(ctx, n.ID); err != nil {
+			t.Errorf("GetNoteByID returned %v for a restored note", err)
+		}
+
+		if err := m.ThreadStore.Purge(ctx, th); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m.ThreadStore.GetDeletedThreadByID(ctx, th.ID); !isNotFound(err) {
+			t.Errorf("GetDeletedThreadByID returned %v for a purged thread", err)
+		}
+
+		if _, err := m.MessageStore.GetDeletedMessageByID(ctx, message.ID); !isNotFound(err) {
+			t.Errorf("GetDeletedMessageByID returned %v for a message of a purged thread", err)
+		}
+	})
+
+	t.Run("OutboxStore", func(t *testing.T) {
+		s := &db.OutboxStore{DB: dbClient}
+		now := time.Now()
+
+		var all, due []*model.OutboxMessage
+		for i, offset := range []time.Duration{-time.Minute, -time.Hour, time.Hour} {
+			msg, err := model.NewOutboxMessage(model.OutboxEmail, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg.NextAttemptAt = now.Add(offset)
+
+			if err := s.Commit(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+
+			all = append(all, msg)
+
+			if offset < 0 {
+				due = append(due, msg)
+			}
+		}
+
+		got, err := s.GetDueOutboxMessages(ctx, now, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != 2 || got[0].Payload != due[1].Payload || got[1].Payload != due[0].Payload {
+			t.Errorf("GetDueOutboxMessages returned %d messages, want the 2 due ones by time", len(got))
+		}
+
+		for _, msg := range all {
+			if err := s.Delete(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+// isNotFound reports whether err is reported to clients as a 404.
+func isNotFound(err error) bool {
+	cr, ok := err.(errors.ClientReporter)
+	return ok && cr.StatusCode() == http.StatusNotFound
+}
+
+func assertIDs(t *testing.T, name string, got, want []model.ID) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("%s returned %v, want %v", name, got, want)
+		return
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s returned %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func noteIDs(notes []*model.Note) []model.ID {
+	ids := make([]model.ID, len(notes))
+	for i := range notes {
+		ids[i] = notes[i].ID
+	}
+
+	return ids
+}
+
+func threadIDs(threads []*model.Thread) []model.ID {
+	ids := make([]model.ID, len(threads))
+	for i := range threads {
+		ids[i] = threads[i].ID
+	}
+
+	return ids
+}
+
+func eventIDs(events []*model.Event) []model.ID {
+	ids := make([]model.ID, len(events))
+	for i := range events {
+		ids[i] = events[i].ID
+	}
+
+	return ids
+}
+
+func messageIDs(messages []*model.Message) []model.ID {
+	ids := make([]model.ID, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID
+	}
+
+	return ids
+}
@@ -9,7 +9,6 @@ import (
 	"testing"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"github.com/icrowley/fake"
 	"go.mongodb.org/mongo-driver/mongo"
 
@@ -26,9 +25,12 @@ import (
 	"github.com/hiconvo/api/clients/storage"
 	"github.com/hiconvo/api/db"
 	"github.com/hiconvo/api/handler"
+	"github.com/hiconvo/api/linkcache"
 	"github.com/hiconvo/api/mail"
 	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/outbox"
 	"github.com/hiconvo/api/template"
+	"github.com/hiconvo/api/usercache"
 	"github.com/hiconvo/api/welcome"
 )
 
@@ -38,6 +40,7 @@ type Mock struct {
 	EventStore   model.EventStore
 	MessageStore model.MessageStore
 	NoteStore    model.NoteStore
+	LinkStore    model.LinkPreviewStore
 	Welcome      model.Welcomer
 	Mail         *mail.Client
 	Magic        magic.Client
@@ -52,11 +55,22 @@ func Handler(dbClient dbc.Client, searchClient search.Client) (http.Handler, *Mo
 	mailClient := mail.New(sender.NewLogger(), template.NewClient())
 	magicClient := magic.NewClient("")
 	storageClient := storage.NewClient("", "")
-	userStore := &db.UserStore{DB: dbClient, Notif: notification.NewLogger(), S: searchClient, Queue: queue.NewLogger()}
-	threadStore := &db.ThreadStore{DB: dbClient}
-	eventStore := &db.EventStore{DB: dbClient}
-	messageStore := &db.MessageStore{DB: dbClient}
-	noteStore := &db.NoteStore{DB: dbClient, S: searchClient}
+	outboxClient := outbox.New(&outbox.Config{
+		Store:   &db.OutboxStore{DB: dbClient},
+		Notif:   notification.NewLogger(),
+		Queue:   queue.NewLogger(),
+		Indexer: &db.SearchIndexer{DB: dbClient, S: searchClient},
+	})
+	userStore := usercache.New(&usercache.Config{
+		Store: &db.UserStore{DB: dbClient, Notif: notification.NewLogger(), S: searchClient, Queue: outboxClient, Outbox: outboxClient},
+	})
+	threadStore := &db.ThreadStore{DB: dbClient, S: searchClient, Outbox: outboxClient, Storage: storageClient}
+	eventStore := &db.EventStore{DB: dbClient, Outbox: outboxClient}
+	messageStore := &db.MessageStore{DB: dbClient, Outbox: outboxClient, Storage: storageClient}
+	noteStore := &db.NoteStore{DB: dbClient, S: searchClient, Outbox: outboxClient}
+	linkStore := &db.LinkPreviewStore{DB: dbClient}
+	searchStore := &db.SearchStore{S: searchClient}
+	linkClient := linkcache.New(&linkcache.Config{Store: linkStore, OG: opengraph.NewClient()})
 	welcomer := welcome.New(context.Background(), userStore, "support")
 
 	h := handler.New(&handler.Config{
@@ -67,16 +81,19 @@ func Handler(dbClient dbc.Client, searchClient search.Client) (http.Handler, *Mo
 		EventStore:    eventStore,
 		MessageStore:  messageStore,
 		NoteStore:     noteStore,
+		SearchStore:   searchStore,
 		Welcome:       welcomer,
 		TxnMiddleware: dbc.WithTransaction(dbClient),
 		Mail:          mailClient,
 		Magic:         magicClient,
 		Storage:       storageClient,
 		OAuth:         oauth.NewClient(""),
-		Notif:         notification.NewLogger(),
-		OG:            opengraph.NewClient(),
+		Notif:         outboxClient,
+		OG:            linkClient,
+		Links:         linkClient,
 		Places:        places.NewLogger(),
-		Queue:         queue.NewLogger(),
+		Queue:         outboxClient,
+		Outbox:        outboxClient,
 	})
 
 	m := &Mock{
@@ -85,20 +102,21 @@ func Handler(dbClient dbc.Client, searchClient search.Client) (http.Handler, *Mo
 		EventStore:   eventStore,
 		MessageStore: messageStore,
 		NoteStore:    noteStore,
+		LinkStore:    linkStore,
 		Welcome:      welcomer,
 		Mail:         mailClient,
 		Magic:        magicClient,
 		Storage:      storageClient,
 		OAuth:        oauth.NewClient(""),
-		OG:           opengraph.NewClient(),
+		OG:           linkClient,
 		Places:       places.NewLogger(),
-		Queue:        queue.NewLogger(),
+		Queue:        outboxClient,
 	}
 
 	return h, m
 }
 
-func (m *Mock) NewUser(ctx context.Context, t *testing.T) (*model.User, string) {
+func (m *Mock) NewUser(ctx context.Context, t testing.TB) (*model.User, string) {
 	t.Helper()
 
 	email := fake.EmailAddress()
@@ -123,7 +141,7 @@ func (m *Mock) NewUser(ctx context.Context, t *testing.T) (*model.User, string)
 	return u, pw
 }
 
-func (m *Mock) NewIncompleteUser(ctx context.Context, t *testing.T) *model.User {
+func (m *Mock) NewIncompleteUser(ctx context.Context, t testing.TB) *model.User {
 	t.Helper()
 
 	u, err := model.NewIncompleteUser(fake.EmailAddress())
@@ -141,7 +159,7 @@ func (m *Mock) NewIncompleteUser(ctx context.Context, t *testing.T) *model.User
 
 func (m *Mock) NewThread(
 	ctx context.Context,
-	t *testing.T,
+	t testing.TB,
 	owner *model.User,
 	users []*model.User,
 ) *model.Thread {
@@ -167,7 +185,7 @@ func (m *Mock) NewThread(
 
 func (m *Mock) NewEvent(
 	ctx context.Context,
-	t *testing.T,
+	t testing.TB,
 	owner *model.User,
 	hosts []*model.User,
 	users []*model.User,
@@ -200,7 +218,7 @@ func (m *Mock) NewEvent(
 
 func (m *Mock) NewThreadMessage(
 	ctx context.Context,
-	t *testing.T,
+	t testing.TB,
 	owner *model.User,
 	thread *model.Thread,
 ) *model.Message {
@@ -212,7 +230,7 @@ func (m *Mock) NewThreadMessage(
 		m.OG,
 		&model.NewMessageInput{
 			User:   owner,
-			Parent: thread.Key,
+			Parent: thread.ID,
 			Body:   fake.Paragraph(),
 			Blob:   "",
 		})
@@ -230,7 +248,7 @@ func (m *Mock) NewThreadMessage(
 
 func (m *Mock) NewEventMessage(
 	ctx context.Context,
-	t *testing.T,
+	t testing.TB,
 	owner *model.User,
 	event *model.Event,
 ) *model.Message {
@@ -242,7 +260,7 @@ func (m *Mock) NewEventMessage(
 		m.OG,
 		&model.NewMessageInput{
 			User:   owner,
-			Parent: event.Key,
+			Parent: event.ID,
 			Body:   fake.Paragraph(),
 			Blob:   "",
 		})
@@ -258,7 +276,7 @@ func (m *Mock) NewEventMessage(
 	return mess
 }
 
-func (m *Mock) NewNote(ctx context.Context, t *testing.T, u *model.User) *model.Note {
+func (m *Mock) NewNote(ctx context.Context, t testing.TB, u *model.User) *model.Note {
 	t.Helper()
 
 	n, err := model.NewNote(u, fake.Title(), "", "", fake.Paragraph())
@@ -274,46 +292,47 @@ func (m *Mock) NewNote(ctx context.Context, t *testing.T, u *model.User) *model.
 	return n
 }
 
-func NewNotifClient(t *testing.T) notification.Client {
+func NewNotifClient(t testing.TB) notification.Client {
 	t.Helper()
 	return notification.NewLogger()
 }
 
-func NewUserStore(ctx context.Context, t *testing.T, dbClient dbc.Client, searchClient search.Client) model.UserStore {
+func NewUserStore(ctx context.Context, t testing.TB, dbClient dbc.Client, searchClient search.Client) model.UserStore {
 	t.Helper()
 	return &db.UserStore{DB: dbClient, Notif: notification.NewLogger(), S: searchClient}
 }
 
-func NewThreadStore(ctx context.Context, t *testing.T, dbClient dbc.Client) model.ThreadStore {
+func NewThreadStore(ctx context.Context, t testing.TB, dbClient dbc.Client) model.ThreadStore {
 	t.Helper()
 	return &db.ThreadStore{DB: dbClient}
 }
 
-func NewMessageStore(ctx context.Context, t *testing.T, dbClient dbc.Client) model.MessageStore {
+func NewMessageStore(ctx context.Context, t testing.TB, dbClient dbc.Client) model.MessageStore {
 	t.Helper()
 	return &db.MessageStore{DB: dbClient}
 }
 
-func NewEventStore(ctx context.Context, t *testing.T, dbClient dbc.Client) model.EventStore {
+func NewEventStore(ctx context.Context, t testing.TB, dbClient dbc.Client) model.EventStore {
 	t.Helper()
 	return &db.EventStore{DB: dbClient}
 }
 
-func NewNoteStore(ctx context.Context, t *testing.T, dbClient dbc.Client, searchClient search.Client) model.NoteStore {
+func NewNoteStore(ctx context.Context, t testing.TB, dbClient dbc.Client, searchClient search.Client) model.NoteStore {
 	t.Helper()
 	return &db.NoteStore{DB: dbClient, S: searchClient}
 }
 
 func NewSearchClient() search.Client {
-	esh := os.Getenv("ELASTICSEARCH_HOST")
-	if esh == "" {
-		esh = "elasticsearch"
-	}
-
-	return search.NewClient(esh)
+	return search.NewEmbeddedClient()
 }
 
+// NewDBClient returns a client of the Datastore emulator when
+// DATASTORE_EMULATOR_HOST is set and an in-memory client otherwise.
 func NewDBClient(ctx context.Context) dbc.Client {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		return dbc.NewMemoryClient()
+	}
+
 	return dbc.NewClient(ctx, "local-convo-api")
 }
 
@@ -327,8 +346,8 @@ func NewMongoClient(ctx context.Context) (*mongo.Client, func()) {
 }
 
 func ClearDB(ctx context.Context, client dbc.Client) {
-	for _, tp := range []string{"User", "Thread", "Event", "Message", "Note"} {
-		q := datastore.NewQuery(tp).KeysOnly()
+	for _, tp := range []string{"User", "Thread", "Event", "Message", "Note", "LinkPreview", "Outbox", "Migration"} {
+		q := dbc.NewQuery(tp).KeysOnly()
 
 		keys, err := client.GetAll(ctx, q, nil)
 		if err != nil {
@@ -0,0 +1,248 @@
+// Package usercache caches users so that authenticating a request and
+// hydrating the users of a list do not hit the db every time.
+package usercache
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/hiconvo/api/clients/db"
+	"github.com/hiconvo/api/model"
+	"github.com/hiconvo/api/valid"
+)
+
+const (
+	DefaultSize = 10000
+	// DefaultTTL is kept short since users that are changed by other
+	// instances are only seen once their cached copy has expired.
+	DefaultTTL = time.Minute
+)
+
+// Store is a model.UserStore that serves users by ID, token and email from
+// a cache. Cached users are invalidated whenever they are committed or
+// deleted through the store, which includes merging them, since
+// model.User.MergeWith writes through the store it is given.
+type Store interface {
+	model.UserStore
+	// Stats returns the hits and misses of the cache so far.
+	Stats() Stats
+}
+
+type Stats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// Size is the number of entries in the cache.
+	Size int `json:"size"`
+}
+
+type Config struct {
+	Store model.UserStore
+	// Cache holds the users. It defaults to an LRU cache of DefaultSize
+	// users that expire after DefaultTTL.
+	Cache Cache
+}
+
+type storeImpl struct {
+	// hits and misses come first so that they are 64-bit aligned, which
+	// sync/atomic requires on 32-bit platforms.
+	hits   int64
+	misses int64
+
+	model.UserStore
+	cache Cache
+}
+
+func New(c *Config) Store {
+	if c.Cache == nil {
+		c.Cache = NewLRU(DefaultSize, DefaultTTL)
+	}
+
+	return &storeImpl{UserStore: c.Store, cache: c.Cache}
+}
+
+func (s *storeImpl) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadInt64(&s.hits),
+		Misses: atomic.LoadInt64(&s.misses),
+		Size:   s.cache.Len(),
+	}
+}
+
+// GetUserByID serves the user from the cache unless ctx holds a transaction,
+// in which case the user is read in the transaction.
+func (s *storeImpl) GetUserByID(ctx context.Context, id model.ID) (*model.User, error) {
+	if _, ok := db.TransactionFromContext(ctx); ok {
+		return s.UserStore.GetUserByID(ctx, id)
+	}
+
+	if u, ok := s.get(id); ok {
+		s.hit()
+		return u, nil
+	}
+
+	s.miss()
+
+	u, err := s.UserStore.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.set(u)
+
+	return u, nil
+}
+
+func (s *storeImpl) GetUserByEmail(ctx context.Context, email string) (*model.User, bool, error) {
+	email, err := valid.Email(email)
+	if err != nil {
+		// Let the store report the invalid email
+		return s.UserStore.GetUserByEmail(ctx, email)
+	}
+
+	return s.getByIndex("email:"+email, func(u *model.User) bool {
+		return u.Email == email || u.HasEmail(email)
+	}, func() (*model.User, bool, error) {
+		return s.UserStore.GetUserByEmail(ctx, email)
+	})
+}
+
+func (s *storeImpl) GetUserByToken(ctx context.Context, token string) (*model.User, bool, error) {
+	return s.getByIndex("token:"+token, func(u *model.User) bool {
+		return u.Token == token
+	}, func() (*model.User, bool, error) {
+		return s.UserStore.GetUserByToken(ctx, token)
+	})
+}
+
+func (s *storeImpl) Commit(ctx context.Context, u *model.User) error {
+	err := s.UserStore.Commit(ctx, u)
+
+	// The user is invalidated even if the commit failed, since it might
+	// have been saved anyway.
+	s.invalidate(u.ID)
+
+	return err
+}
+
+func (s *storeImpl) CommitWithTransaction(tx db.Transaction, u *model.User) error {
+	s.invalidateOnCommit(tx, u)
+
+	return s.UserStore.CommitWithTransaction(tx, u)
+}
+
+func (s *storeImpl) CommitMultiWithTransaction(tx db.Transaction, users []*model.User) error {
+	s.invalidateOnCommit(tx, users...)
+
+	return s.UserStore.CommitMultiWithTransaction(tx, users)
+}
+
+func (s *storeImpl) DeleteWithTransaction(ctx context.Context, tx db.Transaction, u *model.User) error {
+	s.invalidateOnCommit(tx, u)
+
+	return s.UserStore.DeleteWithTransaction(ctx, tx, u)
+}
+
+// getByIndex looks up the ID of a user by a secondary key, such as its token,
+// and serves the user with that ID from the cache if matches still holds for
+// it. Otherwise, the user is loaded with load and cached under key.
+func (s *storeImpl) getByIndex(
+	key string,
+	matches func(u *model.User) bool,
+	load func() (*model.User, bool, error),
+) (*model.User, bool, error) {
+	if v, ok := s.cache.Get(key); ok {
+		if u, ok := s.get(v.(model.ID)); ok && matches(u) {
+			s.hit()
+			return u, true, nil
+		}
+	}
+
+	s.miss()
+
+	u, found, err := load()
+	if err != nil || !found {
+		return u, found, err
+	}
+
+	s.set(u)
+	s.cache.Set(key, u.ID)
+
+	return u, true, nil
+}
+
+// get returns a copy of the cached user with the given ID so that changes
+// to it are only seen by others once it is committed.
+func (s *storeImpl) get(id model.ID) (*model.User, bool) {
+	v, ok := s.cache.Get("id:" + id.String())
+	if !ok {
+		return nil, false
+	}
+
+	return cloneUser(v.(*model.User)), true
+}
+
+func (s *storeImpl) hit() {
+	atomic.AddInt64(&s.hits, 1)
+}
+
+func (s *storeImpl) miss() {
+	atomic.AddInt64(&s.misses, 1)
+}
+
+func (s *storeImpl) set(u *model.User) {
+	s.cache.Set("id:"+u.ID.String(), cloneUser(u))
+}
+
+// invalidate removes the user with the given ID from the cache. Its
+// secondary keys are left in place, since they only resolve to the ID.
+func (s *storeImpl) invalidate(id model.ID) {
+	if !id.IsZero() {
+		s.cache.Delete("id:" + id.String())
+	}
+}
+
+// invalidateOnCommit invalidates users now and again once tx has been
+// committed, since they could be cached again by reads that happen before
+// the commit.
+func (s *storeImpl) invalidateOnCommit(tx db.Transaction, users ...*model.User) {
+	ids := model.MapUsersToIDs(users)
+
+	for i := range ids {
+		s.invalidate(ids[i])
+	}
+
+	tx.OnCommit(func() {
+		for i := range ids {
+			s.invalidate(ids[i])
+		}
+	})
+}
+
+// cloneUser copies u along with its slices. Nil slices stay nil so that the
+// copy is encoded the same way as u.
+func cloneUser(u *model.User) *model.User {
+	c := *u
+
+	if u.Emails != nil {
+		c.Emails = make([]string, len(u.Emails))
+		copy(c.Emails, u.Emails)
+	}
+
+	if u.ContactIDs != nil {
+		c.ContactIDs = make([]model.ID, len(u.ContactIDs))
+		copy(c.ContactIDs, u.ContactIDs)
+	}
+
+	if u.Contacts != nil {
+		c.Contacts = make([]*model.UserPartial, len(u.Contacts))
+		copy(c.Contacts, u.Contacts)
+	}
+
+	if u.Tags != nil {
+		c.Tags = make(model.TagList, len(u.Tags))
+		copy(c.Tags, u.Tags)
+	}
+
+	return &c
+}
@@ -76,7 +76,7 @@ func (w *Welcomer) Welcome(
 	}
 
 	// Don't spam users with this welcome message in their digests
-	model.MarkAsRead(thread, u.Key)
+	model.MarkAsRead(thread, u.ID)
 
 	if err := ts.Commit(ctx, thread); err != nil {
 		return errors.E(op, err)